@@ -0,0 +1,859 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"kodik_parser/kodik"
+	"kodik_parser/queue"
+	"kodik_parser/server"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+	"kodik_parser/watch"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Коды завершения программы, по одному на каждый этап работы
+const (
+	exitOK       = 0
+	exitFailure  = 1 // непредвиденная ошибка
+	exitUsage    = 2 // неверные аргументы командной строки
+	exitConfig   = 3 // ошибка чтения конфига
+	exitInput    = 4 // неверный URL или выбор серий
+	exitResolve  = 5 // ошибка парсинга страниц или получения ссылок
+	exitDownload = 6 // ошибка загрузки видео
+	exitPlayer   = 7 // ошибка запуска плеера
+
+	exitInterrupted = 130 // работа прервана сигналом SIGINT/SIGTERM
+)
+
+const usageText = `Использование:
+  kodik_parser [флаги]               режим по умолчанию, действия берутся из config.json
+  kodik_parser <команда> [флаги] [URL]
+
+Команды:
+  resolve   получить ссылки на видео и вывести их
+  download  получить ссылки и загрузить видео
+  play      получить ссылки и открыть их в mpv.net
+  info      вывести название и список серий без получения ссылок
+  decode    расшифровать строку Kodik и вывести все варианты с оценками
+  serve     запустить HTTP API для получения ссылок и загрузки видео
+  enqueue   добавить выбранные серии в очередь загрузок на диске
+  worker    загружать серии из очереди; очередь переживает перезапуск
+  jobs      вывести задания очереди; jobs cancel <id> отменяет задание
+  watch     следить за сериалами из конфига и загружать новые серии
+
+Запустите "kodik_parser <команда> -h" для списка флагов.
+`
+
+// serverTokenEnv — переменная окружения с токеном HTTP API; перекрывает server.token из конфига
+const serverTokenEnv = "KODIK_PARSER_TOKEN"
+
+// exitError связывает ошибку с кодом завершения этапа, на котором она произошла
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func fail(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// cliOptions содержит значения общих для всех команд флагов
+type cliOptions struct {
+	url          string
+	episodes     string
+	translation  string
+	quality      int
+	maxQuality   int
+	fallback     string
+	closest      int
+	outputDir    string
+	fileName     string
+	remux        bool
+	limit        string
+	episodeLimit string
+	downloader   int
+	listen       string
+	priority     int
+	drain        bool
+	once         bool
+	format       string
+	exportPath   string
+	configPath   string
+
+	args []string // позиционные аргументы команд с command.args
+}
+
+type command struct {
+	name string
+	run  func(ctx context.Context, opts *cliOptions, config *utils.Config) error
+
+	// args — команда сама разбирает позиционные аргументы из cliOptions.args вместо URL
+	args bool
+}
+
+var commands = map[string]command{
+	"resolve":  {name: "resolve", run: runResolve},
+	"download": {name: "download", run: runDownload},
+	"play":     {name: "play", run: runPlay},
+	"info":     {name: "info", run: runInfo},
+	"decode":   {name: "decode", run: runDecode},
+	"serve":    {name: "serve", run: runServe},
+	"enqueue":  {name: "enqueue", run: runEnqueue},
+	"worker":   {name: "worker", run: runWorker},
+	"jobs":     {name: "jobs", run: runJobs, args: true},
+	"watch":    {name: "watch", run: runWatch},
+}
+
+func newFlagSet(name string, opts *cliOptions, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	fs.StringVar(&opts.url, "url", "", "URL страницы Kodik (можно передать последним аргументом)")
+	fs.StringVar(&opts.episodes, "episodes", "", "серии: 1-3,5,9-, last:3, 1-12,!7, S1E1-S2E5, title:текст или all")
+	fs.StringVar(&opts.translation, "translation", "", "озвучка: id или название (перекрывает translation из конфига)")
+	fs.IntVar(&opts.quality, "quality", 0, "предпочтительное качество, например 720")
+	fs.IntVar(&opts.maxQuality, "max-quality", 0, "максимальное допустимое качество")
+	fs.StringVar(&opts.fallback, "quality-fallback", "", "качества по порядку, если нет предпочтительного, например 720,480")
+	fs.IntVar(&opts.closest, "closest-quality", 0, "выбрать качество, ближайшее к указанному")
+	fs.StringVar(&opts.outputDir, "out", "", "папка для загрузки видео (перекрывает outputDirectory из конфига)")
+	fs.StringVar(&opts.fileName, "name", "", "шаблон пути файла серии, например {title}/S{season:02}E{episode:02}.{ext} (перекрывает fileTemplate из конфига)")
+	fs.BoolVar(&opts.remux, "remux", false, "перепаковать загруженные HLS .ts в MP4 (включает remux из конфига)")
+	fs.StringVar(&opts.limit, "limit", "", "общая скорость загрузки, например 5M (перекрывает maxBandwidth из конфига)")
+	fs.StringVar(&opts.episodeLimit, "episode-limit", "", "скорость загрузки одной серии, например 1M (перекрывает episodeBandwidth из конфига)")
+	fs.IntVar(&opts.downloader, "downloader", 0, "версия загрузчика: 1 - mp4 частями, 2 - HLS")
+	fs.StringVar(&opts.listen, "listen", "", "адрес HTTP API команды serve, например 127.0.0.1:8080 (перекрывает server.listen из конфига)")
+	fs.IntVar(&opts.priority, "priority", 0, "приоритет заданий enqueue: большие выполняются раньше")
+	fs.BoolVar(&opts.drain, "drain", false, "worker завершается, когда в очереди не остается заданий")
+	fs.BoolVar(&opts.once, "once", false, "watch проверяет сериалы один раз и завершается")
+	fs.StringVar(&opts.format, "format", "", "формат вывода ссылок resolve и download: text, m3u, xspf, json или csv (по умолчанию по расширению -export, иначе text)")
+	fs.StringVar(&opts.exportPath, "export", "", "записать ссылки в файл вместо stdout, например playlist.m3u")
+	fs.StringVar(&opts.configPath, "config", "config.json", "путь к файлу конфигурации")
+
+	return fs
+}
+
+// run разбирает аргументы, выполняет команду и возвращает код завершения
+func run(ctx context.Context, args []string) int {
+	err := execute(ctx, args)
+	if err == nil {
+		return exitOK
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+
+	fmt.Fprintln(os.Stderr, "Ошибка:", err)
+	log.Printf("Exiting with error: %v", err)
+
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+
+	return exitFailure
+}
+
+func execute(ctx context.Context, args []string) error {
+	cmd := command{name: "kodik_parser", run: runDefault}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if args[0] == "help" {
+			fmt.Print(usageText)
+			return nil
+		}
+
+		var ok bool
+		cmd, ok = commands[args[0]]
+		if !ok {
+			fmt.Fprint(os.Stderr, usageText)
+			return fail(exitUsage, fmt.Errorf("неизвестная команда: %s", args[0]))
+		}
+		args = args[1:]
+	}
+
+	opts := &cliOptions{}
+	fs := newFlagSet(cmd.name, opts, os.Stderr)
+	if cmd.name == "kodik_parser" {
+		fs.Usage = func() {
+			fmt.Fprint(fs.Output(), usageText, "\nФлаги:\n")
+			fs.PrintDefaults()
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return fail(exitUsage, err)
+	}
+
+	switch {
+	case cmd.args:
+		opts.args = fs.Args()
+	case fs.NArg() == 0:
+	case fs.NArg() == 1:
+		if opts.url != "" {
+			return fail(exitUsage, errors.New("URL указан и флагом, и аргументом"))
+		}
+		opts.url = fs.Arg(0)
+	default:
+		return fail(exitUsage, fmt.Errorf("лишние аргументы: %s", strings.Join(fs.Args()[1:], " ")))
+	}
+
+	if _, err := exportFormat(opts); err != nil {
+		return fail(exitUsage, err)
+	}
+
+	if err := utils.InitLogger(); err != nil {
+		fmt.Println(err)
+	}
+
+	config, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+	applyConfig(&config)
+
+	stopReload := reloadBandwidthOnSignal(ctx, opts)
+	defer stopReload()
+
+	return cmd.run(ctx, opts, &config)
+}
+
+// loadConfig читает конфиг и применяет к нему значения флагов. Настройки процесса
+// при этом не меняются, это делает applyConfig
+func loadConfig(opts *cliOptions) (utils.Config, error) {
+	config, err := utils.GetConfigFile(opts.configPath)
+	if err != nil {
+		return config, fail(exitConfig, fmt.Errorf("error getting config file: %w", err))
+	}
+
+	if opts.outputDir != "" {
+		config.OutputDirectory = opts.outputDir
+	}
+
+	if opts.fileName != "" {
+		config.FileTemplate = opts.fileName
+	}
+
+	if opts.remux {
+		config.Remux = true
+	}
+
+	if opts.limit != "" {
+		limit, err := utils.ParseByteRate(opts.limit)
+		if err != nil {
+			return config, fail(exitUsage, err)
+		}
+		config.MaxBandwidth = limit
+	}
+
+	if opts.episodeLimit != "" {
+		limit, err := utils.ParseByteRate(opts.episodeLimit)
+		if err != nil {
+			return config, fail(exitUsage, err)
+		}
+		config.EpisodeBandwidth = limit
+	}
+
+	if err := video_utils.ValidateFileTemplate(config.FileTemplate); err != nil {
+		return config, fail(exitConfig, err)
+	}
+
+	if opts.translation != "" {
+		config.Translation = opts.translation
+	}
+
+	if opts.quality != 0 {
+		config.Quality.Preferred = opts.quality
+	}
+
+	if opts.maxQuality != 0 {
+		config.Quality.Max = opts.maxQuality
+	}
+
+	if opts.fallback != "" {
+		fallback, err := utils.ParseQualityList(opts.fallback)
+		if err != nil {
+			return config, fail(exitUsage, err)
+		}
+		config.Quality.Fallback = fallback
+	}
+
+	if opts.closest != 0 {
+		config.Quality.Closest = opts.closest
+	}
+
+	if opts.listen != "" {
+		config.Server.Listen = opts.listen
+	}
+
+	if token := os.Getenv(serverTokenEnv); token != "" {
+		config.Server.Token = token
+	}
+
+	if opts.downloader != 0 {
+		if opts.downloader != 1 && opts.downloader != 2 {
+			return config, fail(exitUsage, fmt.Errorf("неизвестная версия загрузчика: %d", opts.downloader))
+		}
+		config.DownloaderVersion = opts.downloader
+	}
+
+	return config, nil
+}
+
+// applyConfig применяет настройки, общие для всего процесса: доверенные домены CDN
+// декодеров ссылок и лимиты скорости загрузки
+func applyConfig(config *utils.Config) {
+	utils.SetTrustedHosts(config.TrustedHosts)
+	video_utils.SetBandwidthLimit(config.MaxBandwidth, config.EpisodeBandwidth)
+}
+
+// readURL возвращает URL из флагов, а при его отсутствии спрашивает пользователя
+func readURL(opts *cliOptions) (string, error) {
+	url := opts.url
+
+	if url == "" {
+		if !utils.IsInteractive() {
+			return "", fail(exitUsage, errors.New("не указан URL (флаг -url или аргумент)"))
+		}
+
+		for {
+			fmt.Print("Введите URL: ")
+			fmt.Scanln(&url)
+
+			if utils.ValidateURL(url) {
+				break
+			}
+
+			fmt.Println("Некорретный URL!")
+			log.Println("Invalid url input")
+		}
+	}
+
+	if !utils.ValidateURL(url) {
+		log.Println("Invalid url input")
+		return "", fail(exitInput, fmt.Errorf("некорректный URL: %s", url))
+	}
+
+	return utils.NormalizeURL(url), nil
+}
+
+// resolve получает страницу сериала, выбирает серии и получает на них ссылки
+func resolve(ctx context.Context, opts *cliOptions, config *utils.Config) (utils.HandleResult, error) {
+	url, err := readURL(opts)
+	if err != nil {
+		return utils.HandleResult{}, err
+	}
+
+	log.Println("=================LETS FUCK KODIK=================")
+
+	httpClient := kodik.NewHTTPClient()
+	defer httpClient.CloseIdleConnections()
+
+	progress := &cliProgress{}
+	defer progress.finish()
+
+	client := kodik.NewClient(httpClient).WithLog(log.Printf)
+	result, err := client.Resolve(ctx, url, kodik.Options{
+		SelectTranslation: selectTranslation(ctx, client, config.Translation),
+		SelectEpisodes:    progress.selectEpisodes(opts.episodes),
+		OnStage:           progress.onStage,
+		OnResult:          progress.onResult,
+		Quality:           config.Quality,
+		Retries:           config.ResolveRetries,
+		Retry:             config.Retry.Resolve,
+	})
+	if err != nil {
+		var stageErr *kodik.StageError
+		if errors.As(err, &stageErr) {
+			switch stageErr.Stage {
+			case kodik.StageSelect, kodik.StageTranslation:
+				return result, fail(exitInput, err)
+			case kodik.StageLinks:
+				progress.finish()
+				printReport(result, nil, ctx.Err() != nil)
+			}
+		}
+		return result, fail(exitResolve, err)
+	}
+
+	// Загрузка может начаться намного позже получения ссылок; если ссылка к тому времени
+	// истечет, загрузчик получит её заново
+	config.ReResolve = func(ctx context.Context, res utils.Result) (utils.Result, error) {
+		httpClient := kodik.NewHTTPClient()
+		defer httpClient.CloseIdleConnections()
+
+		return kodik.NewClient(httpClient).WithLog(log.Printf).ResolveEpisode(ctx, url, res.Seria, kodik.Options{
+			Quality: config.Quality,
+			Retries: config.ResolveRetries,
+			Retry:   config.Retry.Resolve,
+		})
+	}
+
+	return result, nil
+}
+
+// exportFormat возвращает формат вывода из флага -format, а без него — по расширению файла -export
+func exportFormat(opts *cliOptions) (utils.ExportFormat, error) {
+	if opts.format == "" {
+		return utils.ExportFormatFromPath(opts.exportPath), nil
+	}
+	return utils.ParseExportFormat(opts.format)
+}
+
+// exportResults выводит результаты в stdout или записывает в файл -export в выбранном формате
+func exportResults(opts *cliOptions, result utils.HandleResult) error {
+	format, err := exportFormat(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.exportPath == "" || opts.exportPath == "-" {
+		return utils.Export(os.Stdout, result, format)
+	}
+
+	file, err := os.Create(opts.exportPath)
+	if err != nil {
+		return fmt.Errorf("ошибка создания файла экспорта: %w", err)
+	}
+
+	if err := utils.Export(file, result, format); err != nil {
+		file.Close()
+		return fmt.Errorf("ошибка записи файла экспорта: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("ошибка записи файла экспорта: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Результаты (%s) записаны в %s\n", format, opts.exportPath)
+	log.Printf("Exported %d results as %s to %s", len(result.Results), format, opts.exportPath)
+
+	return nil
+}
+
+// runDefault повторяет поведение программы без команды: действия определяются конфигом
+func runDefault(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	switch {
+	case config.OpenInMpvNet:
+		return runPlay(ctx, opts, config)
+	case config.DownloadResults:
+		return runDownload(ctx, opts, config)
+	default:
+		return runResolve(ctx, opts, config)
+	}
+}
+
+func runResolve(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	result, err := resolve(ctx, opts, config)
+	if err != nil {
+		return err
+	}
+
+	log.Println(" Printing results")
+	if err := exportResults(opts, result); err != nil {
+		return fail(exitFailure, err)
+	}
+	printReport(result, config.Progress, ctx.Err() != nil)
+
+	if err := resultError(result); err != nil {
+		return err
+	}
+
+	log.Println("============KODIK SUCCESSFULLY FUCKED============")
+
+	return nil
+}
+
+func runDownload(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	result, err := resolve(ctx, opts, config)
+	if err != nil {
+		return err
+	}
+
+	result, err = downloadResults(ctx, result, config)
+	if err != nil {
+		return fail(exitDownload, err)
+	}
+
+	log.Println(" Printing results")
+	if err := exportResults(opts, result); err != nil {
+		return fail(exitFailure, err)
+	}
+	printReport(result, config.Progress, ctx.Err() != nil)
+
+	if err := resultError(result); err != nil {
+		return err
+	}
+
+	log.Println("============KODIK SUCCESSFULLY FUCKED============")
+
+	return nil
+}
+
+func runPlay(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	result, err := resolve(ctx, opts, config)
+	if err != nil {
+		return err
+	}
+
+	if config.DownloadResults {
+		result, err = downloadResults(ctx, result, config)
+		if err != nil {
+			return fail(exitDownload, err)
+		}
+	}
+
+	printReport(result, config.Progress, ctx.Err() != nil)
+
+	if len(result.Succeeded()) > 0 {
+		log.Println(" Opening in MPV")
+		if err := utils.OpenInMpvNet(result, config); err != nil {
+			return fail(exitPlayer, err)
+		}
+	}
+
+	if err := resultError(result); err != nil {
+		return err
+	}
+
+	log.Println("============KODIK SUCCESSFULLY FUCKED============")
+
+	return nil
+}
+
+func runInfo(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	url, err := readURL(opts)
+	if err != nil {
+		return err
+	}
+
+	httpClient := kodik.NewHTTPClient()
+	defer httpClient.CloseIdleConnections()
+
+	client := kodik.NewClient(httpClient).WithLog(log.Printf)
+
+	title, err := client.Fetch(ctx, url)
+	if err != nil {
+		return fail(exitResolve, err)
+	}
+
+	if config.Translation != "" && len(title.Translations) > 0 {
+		translation, err := kodik.FindTranslation(title.Translations, config.Translation)
+		if err != nil {
+			return fail(exitInput, err)
+		}
+
+		if err := client.SelectTranslation(ctx, title, translation); err != nil {
+			return fail(exitResolve, err)
+		}
+	}
+
+	fmt.Printf("Название: %s\n", title.Name)
+	if title.Type == utils.KodikLinkTypes.Serial {
+		fmt.Printf("Тип: сериал, серий: %d\n", len(title.Series))
+		if len(title.Seasons) > 1 {
+			fmt.Printf("Сезонов: %d, текущий сезон: %d\n", len(title.Seasons), title.Season)
+		}
+		for _, seria := range title.Series {
+			fmt.Printf("  Серия %s: %s\n", seria.Label(), seria.Title)
+		}
+	} else {
+		fmt.Println("Тип: фильм")
+	}
+
+	if len(title.Translations) > 0 {
+		translations, err := client.Translations(ctx, title)
+		if err != nil {
+			return fail(exitResolve, err)
+		}
+
+		fmt.Println("Озвучки:")
+		printTranslations(os.Stdout, translations)
+	}
+
+	return nil
+}
+
+// runDecode расшифровывает строку всеми декодерами и выводит варианты от лучшего к худшему.
+// Строка передается последним аргументом вместо URL
+func runDecode(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	input := opts.url
+
+	if input == "" {
+		if !utils.IsInteractive() {
+			return fail(exitUsage, errors.New("не указана строка для расшифровки"))
+		}
+
+		fmt.Print("Введите строку: ")
+		fmt.Scanln(&input)
+	}
+
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return fail(exitInput, errors.New("пустая строка"))
+	}
+
+	candidates := utils.DefaultDecoders.Candidates(input)
+	if len(candidates) == 0 {
+		return fail(exitInput, errors.New("ни один декодер не смог расшифровать строку"))
+	}
+
+	printCandidates(os.Stdout, candidates)
+
+	return nil
+}
+
+// runServe запускает HTTP API и работает до SIGINT/SIGTERM. При остановке выполняемые
+// задания прерываются, и незавершенные загрузки сохраняют прогресс
+func runServe(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	if opts.url != "" {
+		return fail(exitUsage, errors.New("serve не принимает URL: адреса передаются в запросах к API"))
+	}
+
+	if config.Server.Token == "" {
+		return fail(exitConfig, fmt.Errorf("не задан токен API: укажите server.token в конфиге или переменную окружения %s", serverTokenEnv))
+	}
+
+	srv := server.New(*config, nil)
+	srv.Log = log.Printf
+
+	fmt.Printf("HTTP API слушает %s\n", config.Server.Listen)
+	if err := srv.ListenAndServe(ctx, config.Server.Listen); err != nil {
+		return fail(exitFailure, err)
+	}
+
+	return nil
+}
+
+// runEnqueue получает список серий тайтла и ставит выбранные серии в очередь.
+// Ссылки получает исполнитель перед загрузкой, поэтому они не успевают истечь
+func runEnqueue(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	url, err := readURL(opts)
+	if err != nil {
+		return err
+	}
+
+	httpClient := kodik.NewHTTPClient()
+	defer httpClient.CloseIdleConnections()
+
+	client := kodik.NewClient(httpClient).WithLog(log.Printf)
+
+	title, err := client.Fetch(ctx, url)
+	if err != nil {
+		return fail(exitResolve, err)
+	}
+
+	if len(title.Translations) > 1 {
+		translation, err := selectTranslation(ctx, client, config.Translation)(title)
+		if err != nil {
+			return fail(exitInput, err)
+		}
+
+		if err := client.SelectTranslation(ctx, title, translation); err != nil {
+			return fail(exitResolve, err)
+		}
+	}
+
+	series, err := selectEpisodes(title, opts.episodes)
+	if err != nil {
+		return fail(exitInput, err)
+	}
+
+	store, err := queue.OpenStore(config.Queue.Directory)
+	if err != nil {
+		return fail(exitConfig, err)
+	}
+
+	added := 0
+	for _, seria := range series {
+		ok, err := store.Add(queue.Job{
+			URL:         url,
+			Title:       title.Name,
+			Translation: title.Translation,
+			Episode:     seria,
+			Quality:     config.Quality,
+			Priority:    opts.priority,
+		})
+		if err != nil {
+			return fail(exitFailure, err)
+		}
+		if ok {
+			added++
+		}
+	}
+
+	fmt.Printf("%s: в очередь добавлено серий: %d из %d\n", title.Name, added, len(series))
+	log.Printf("Enqueued %d of %d episodes of %s", added, len(series), title.Name)
+
+	return nil
+}
+
+// runWorker выполняет задания очереди до SIGINT/SIGTERM, а с флагом -drain — пока они не кончатся.
+// Прерванные задания остаются в очереди и продолжаются при следующем запуске
+func runWorker(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	q, err := queue.New(*config, nil)
+	if err != nil {
+		return fail(exitConfig, err)
+	}
+	q.Log = log.Printf
+
+	fmt.Printf("Очередь %s, исполнителей: %d\n", config.Queue.Directory, max(1, config.Queue.Workers))
+
+	// OnFinish вызывается из разных исполнителей
+	var failed atomic.Int32
+	err = q.Run(ctx, queue.Options{
+		Drain: opts.drain,
+		OnFinish: func(job queue.Job) {
+			switch job.State {
+			case queue.StateDone:
+				fmt.Printf("%s: загружена в %s\n", job.Label(), job.Path)
+			case queue.StateFailed:
+				failed.Add(1)
+				fmt.Printf("%s: не загружена после %d попыток: %s\n", job.Label(), job.Attempts, job.LastError)
+			case queue.StateQueued:
+				if job.LastError != "" {
+					fmt.Printf("%s: ошибка, повтор в %s: %s\n", job.Label(), job.NotBefore.Format(time.TimeOnly), job.LastError)
+				}
+			}
+		},
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return fail(exitFailure, err)
+	}
+
+	if n := failed.Load(); n > 0 {
+		return fail(exitDownload, fmt.Errorf("не удалось загрузить серий: %d", n))
+	}
+	return nil
+}
+
+// runJobs выводит задания очереди в порядке выполнения, а jobs cancel <id> отменяет задания
+func runJobs(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	store, err := queue.OpenStore(config.Queue.Directory)
+	if err != nil {
+		return fail(exitConfig, err)
+	}
+
+	switch {
+	case len(opts.args) == 0:
+	case opts.args[0] == "cancel":
+		return cancelJobs(store, opts.args[1:])
+	default:
+		return fail(exitUsage, fmt.Errorf("неизвестная подкоманда jobs: %s (доступна cancel <id>)", opts.args[0]))
+	}
+
+	jobs, err := store.Jobs()
+	if err != nil {
+		return fail(exitFailure, err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tСостояние\tПриоритет\tПопыток\tСерия\tФайл или ошибка")
+
+	for _, job := range jobs {
+		detail := job.Path
+		if job.LastError != "" {
+			detail = job.LastError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", job.ID, job.State, job.Priority, job.Attempts, job.Label(), detail)
+	}
+
+	return tw.Flush()
+}
+
+// runWatch проверяет сериалы из watch.serials до SIGINT/SIGTERM, а с флагом -once — один раз.
+// Виденные серии хранятся в watch.stateFile, поэтому после перезапуска загружаются только новые
+func runWatch(ctx context.Context, opts *cliOptions, config *utils.Config) error {
+	if opts.url != "" {
+		return fail(exitUsage, errors.New("watch не принимает URL: сериалы перечисляются в watch.serials конфига"))
+	}
+
+	if len(config.Watch.Serials) == 0 {
+		return fail(exitConfig, errors.New("не задано ни одного сериала: заполните watch.serials в конфиге"))
+	}
+
+	fmt.Printf("Сериалов под наблюдением: %d\n", len(config.Watch.Serials))
+
+	failed := 0
+	watcher := watch.New(*config, nil)
+	watcher.Log = log.Printf
+	err := watcher.Run(ctx, watch.Options{
+		Once: opts.once,
+		OnReport: func(report watch.Report) {
+			name := report.Title
+			if name == "" {
+				name = report.Serial.URL
+			}
+
+			switch {
+			case len(report.New) == 0 && report.Err != nil:
+				// Серии не проверены, ниже выводится только ошибка
+			case report.First && len(report.New) == 0:
+				fmt.Printf("%s: вышедшие серии запомнены, будут загружаться новые\n", name)
+			case len(report.New) == 0:
+				fmt.Printf("%s: новых серий нет\n", name)
+			default:
+				fmt.Printf("%s: новых серий: %d\n", name, len(report.New))
+				printReport(report.Result, nil, false)
+			}
+
+			if report.Err != nil || len(report.Result.Failed()) > 0 {
+				failed++
+			}
+			if report.Err != nil {
+				fmt.Printf("%s: ошибка: %v\n", name, report.Err)
+			}
+		},
+		OnSleep: func(next time.Time) {
+			fmt.Printf("Следующая проверка в %s\n", next.Format(time.DateTime))
+		},
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return fail(exitFailure, err)
+	}
+
+	if opts.once && failed > 0 {
+		return fail(exitDownload, fmt.Errorf("не удалось проверить или загрузить сериалов: %d", failed))
+	}
+	return nil
+}
+
+// cancelJobs отменяет ждущие задания очереди. Выполняемое задание заблокировано исполнителем,
+// его нужно остановить вместе с worker
+func cancelJobs(store *queue.Store, ids []string) error {
+	if len(ids) == 0 {
+		return fail(exitUsage, errors.New("не указан ID задания: jobs cancel <id>"))
+	}
+
+	for _, id := range ids {
+		if err := store.Cancel(id); err != nil {
+			return fail(exitFailure, fmt.Errorf("не удалось отменить задание %s: %w", id, err))
+		}
+		fmt.Printf("Задание %s отменено\n", id)
+	}
+
+	return nil
+}
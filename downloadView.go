@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"kodik_parser/utils"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// downloadViewInterval — как часто перерисовывается ход загрузки
+const downloadViewInterval = 250 * time.Millisecond
+
+// downloadView показывает в терминале строку на каждую загружаемую серию и общую строку.
+// Завершенные серии печатаются над ними отдельной строкой и больше не перерисовываются.
+// Если stdout не терминал, ничего не выводится: итог покажет printReport
+type downloadView struct {
+	progress *utils.DownloadProgress
+	out      io.Writer
+	episodes int // сколько серий будет загружаться
+
+	lines    int // строк в текущей отрисовке, которые стираются перед следующей
+	speeds   map[string]*speedMeter
+	finished map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startDownloadView(progress *utils.DownloadProgress, episodes int) *downloadView {
+	v := &downloadView{
+		progress: progress,
+		episodes: episodes,
+		speeds:   make(map[string]*speedMeter),
+		finished: make(map[string]bool),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 && enableTerminalSequences() {
+		v.out = os.Stdout
+	}
+
+	go v.run()
+	return v
+}
+
+func (v *downloadView) run() {
+	defer close(v.done)
+
+	if v.out == nil {
+		<-v.stop
+		return
+	}
+
+	ticker := time.NewTicker(downloadViewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			v.render(time.Now(), false)
+		case <-v.stop:
+			v.render(time.Now(), true)
+			return
+		}
+	}
+}
+
+// Stop дорисовывает завершенные серии, стирает строки хода загрузки и останавливает отрисовку
+func (v *downloadView) Stop() {
+	close(v.stop)
+	<-v.done
+}
+
+func (v *downloadView) render(now time.Time, final bool) {
+	stats := v.progress.Snapshot()
+	width := terminalWidth()
+
+	var b strings.Builder
+	if v.lines > 0 {
+		// В начало первой строки прошлой отрисовки и стереть все ниже
+		fmt.Fprintf(&b, "\x1b[%dF\x1b[J", v.lines)
+	}
+
+	var active []string
+	var total downloadTotals
+	for _, s := range stats {
+		label := s.Seria.Label()
+		meter := v.speeds[label]
+		if meter == nil {
+			meter = &speedMeter{}
+			v.speeds[label] = meter
+		}
+		speed := meter.update(now, s.Bytes)
+		total.add(s, speed)
+
+		if s.Done() {
+			if !v.finished[label] {
+				v.finished[label] = true
+				b.WriteString(fitLine(finishedLine(s, now), width) + "\n")
+			}
+			continue
+		}
+		active = append(active, fitLine(episodeLine(s, speed), width))
+	}
+
+	v.lines = 0
+	if final {
+		fmt.Fprint(v.out, b.String())
+		return
+	}
+
+	for _, line := range active {
+		b.WriteString(line + "\n")
+	}
+	b.WriteString(fitLine(total.line(v.episodes), width) + "\n")
+	v.lines = len(active) + 1
+
+	fmt.Fprint(v.out, b.String())
+}
+
+// speedMeter сглаживает скорость по приросту байт между отрисовками
+type speedMeter struct {
+	last  time.Time
+	bytes int64
+	speed float64
+}
+
+func (m *speedMeter) update(now time.Time, bytes int64) float64 {
+	if m.last.IsZero() {
+		// Байты, уже лежавшие на диске, не должны дать всплеск скорости
+		m.last, m.bytes = now, bytes
+		return 0
+	}
+
+	dt := now.Sub(m.last).Seconds()
+	if dt <= 0 {
+		return m.speed
+	}
+
+	current := max(0, float64(bytes-m.bytes)/dt)
+	m.speed = 0.7*m.speed + 0.3*current
+	m.last, m.bytes = now, bytes
+
+	return m.speed
+}
+
+// downloadTotals складывает строки серий в общую строку
+type downloadTotals struct {
+	done, failed     int
+	bytes, estimated int64
+	estimates        int // серий, размер которых уже можно оценить
+	speed            float64
+}
+
+// add учитывает серию. Серии с ошибкой не входят в общий размер, иначе оставшееся время не сошлось бы
+func (t *downloadTotals) add(s utils.EpisodeStats, speed float64) {
+	if s.Done() && s.Err != nil {
+		t.failed++
+		return
+	}
+
+	t.bytes += s.Bytes
+	if estimate := s.EstimatedTotal(); estimate > 0 {
+		t.estimated += estimate
+		t.estimates++
+	}
+
+	if s.Done() {
+		t.done++
+	} else {
+		t.speed += speed
+	}
+}
+
+func (t *downloadTotals) line(episodes int) string {
+	// Серии без оценки размера считаются средними
+	estimated := t.estimated
+	if t.estimates > 0 {
+		estimated += t.estimated / int64(t.estimates) * int64(max(0, episodes-t.failed-t.estimates))
+	}
+
+	line := fmt.Sprintf("Всего: %d из %d серий  %s", t.done, episodes, sizeOfTotal(t.bytes, estimated))
+	if t.failed > 0 {
+		line += fmt.Sprintf(", ошибок: %d", t.failed)
+	}
+	return line + "  " + speedAndETA(t.speed, t.bytes, estimated)
+}
+
+// printDownloadSummary выводит таблицу итогов загрузки: строку на каждую серию и общую строку
+func printDownloadSummary(w io.Writer, result utils.HandleResult, stats []utils.EpisodeStats, now time.Time) {
+	started := make(map[string]utils.EpisodeStats, len(stats))
+	for _, s := range stats {
+		started[s.Seria.Label()] = s
+	}
+
+	var (
+		downloaded  int
+		bytes       int64
+		first, last time.Time
+	)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Серия\tСтатус\tРазмер\tВремя\tСкорость\tФайл или ошибка")
+
+	for _, res := range result.Results {
+		size, elapsed, speed := "-", "-", "-"
+		if s, ok := started[res.Seria.Label()]; ok {
+			size = formatSize(s.Bytes)
+			elapsed = formatDuration(s.Elapsed(now))
+			speed = formatSpeed(float64(s.AverageSpeed(now)))
+
+			if first.IsZero() || s.Started.Before(first) {
+				first = s.Started
+			}
+			if end := s.Started.Add(s.Elapsed(now)); end.After(last) {
+				last = end
+			}
+		}
+
+		var status, detail string
+		switch {
+		case res.Err == nil:
+			status, detail = "загружена", res.Path
+			downloaded++
+			if s, ok := started[res.Seria.Label()]; ok {
+				bytes += s.Bytes
+			}
+		case res.Status == utils.StatusResolveFailed:
+			status, detail = "ссылка не получена", fmt.Sprintf("попыток: %d: %v", res.Attempts, res.Err)
+		default:
+			status, detail = "не загружена", res.Err.Error()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", res.Seria.Label(), status, size, elapsed, speed, strings.ReplaceAll(detail, "\n", " "))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "Итого: загружено %d из %d серий, %s за %s\n", downloaded, len(result.Results), formatSize(bytes), formatDuration(last.Sub(first)))
+}
+
+func episodeLine(s utils.EpisodeStats, speed float64) string {
+	total := s.EstimatedTotal()
+
+	line := fmt.Sprintf("Серия %-6s %s %s", s.Seria.Label(), progressBar(s.Bytes, total, 20), sizeOfTotal(s.Bytes, total))
+	if s.TotalFragments > 0 {
+		line += fmt.Sprintf("  фрагменты %d/%d", s.Fragments, s.TotalFragments)
+	}
+	return line + "  " + speedAndETA(speed, s.Bytes, total)
+}
+
+func finishedLine(s utils.EpisodeStats, now time.Time) string {
+	if s.Err != nil {
+		return fmt.Sprintf("Серия %s: ошибка: %v", s.Seria.Label(), s.Err)
+	}
+	return fmt.Sprintf("Серия %s: загружена, %s за %s (%s)",
+		s.Seria.Label(), formatSize(s.Bytes), formatDuration(s.Elapsed(now)), formatSpeed(float64(s.AverageSpeed(now))))
+}
+
+func progressBar(done, total int64, width int) string {
+	filled := 0
+	if total > 0 {
+		filled = int(min(done, total) * int64(width) / total)
+	}
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+func sizeOfTotal(done, total int64) string {
+	if total <= 0 {
+		return formatSize(done) + " / ?"
+	}
+	return fmt.Sprintf("%3d%%  %s / %s", min(done, total)*100/total, formatSize(done), formatSize(total))
+}
+
+func speedAndETA(speed float64, done, total int64) string {
+	eta := "--:--"
+	if speed > 0 && total > done {
+		eta = formatDuration(time.Duration(float64(total-done) / speed * float64(time.Second)))
+	}
+	return fmt.Sprintf("%s  ETA %s", formatSpeed(speed), eta)
+}
+
+// formatSize выводит размер в тех же единицах, что utils.ByteRate
+func formatSize(bytes int64) string {
+	if bytes <= 0 {
+		return "0 B"
+	}
+	return strings.TrimSuffix(utils.ByteRate(bytes).String(), "/s")
+}
+
+func formatSpeed(speed float64) string {
+	return formatSize(int64(speed)) + "/s"
+}
+
+func formatDuration(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// fitLine обрезает строку до ширины терминала: перенос сбил бы подсчет строк при перерисовке
+func fitLine(line string, width int) string {
+	if utf8.RuneCountInString(line) < width {
+		return line
+	}
+
+	runes := []rune(line)
+	return string(runes[:max(0, width-1)])
+}
+
+func terminalWidth() int {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		return 80
+	}
+	return width
+}
@@ -4,12 +4,15 @@ go 1.23.4
 
 require github.com/PuerkitoBio/goquery v1.10.1 // direct
 
+require (
+	github.com/schollz/progressbar/v3 v3.18.0
+	golang.org/x/sys v0.29.0
+	golang.org/x/term v0.28.0
+)
+
 require (
 	github.com/andybalholm/cascadia v1.3.3 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/schollz/progressbar/v3 v3.18.0 // indirect
 	golang.org/x/net v0.34.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/term v0.28.0 // indirect
 )
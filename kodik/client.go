@@ -0,0 +1,472 @@
+// Package kodik получает прямые ссылки на видео со страниц Kodik.
+//
+// Пакет ничего не печатает и не завершает процесс: каждая ошибка возвращается
+// вызывающему коду в виде *StageError с указанием этапа, на котором она произошла.
+package kodik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kodik_parser/utils"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client получает ссылки на видео, выполняя запросы через переданный HTTPDoer
+type Client struct {
+	http utils.HTTPDoer
+	log  utils.Logf
+}
+
+// Options настраивает одно получение ссылок
+type Options struct {
+	// SelectEpisodes выбирает серии тайтла (title.Series), для которых нужно получить ссылки.
+	// Если не задан, выбираются все серии
+	SelectEpisodes func(title *Title) ([]utils.KodikSeriaInfo, error)
+
+	// OnStage вызывается в начале каждого этапа
+	OnStage func(stage Stage)
+
+	// SelectTranslation выбирает озвучку из списка доступных. Если выбранная озвучка
+	// отличается от текущей, список серий загружается заново.
+	// Если не задан, используется озвучка, выбранная на странице плеера
+	SelectTranslation func(title *Title) (utils.KodikTranslation, error)
+
+	// OnResult вызывается, когда для серии получена ссылка или исчерпаны попытки
+	OnResult func(result utils.Result)
+
+	// Quality выбирает качество видео. Нулевое значение выбирает наибольшее
+	Quality utils.QualityPolicy
+
+	// Retries — сколько раз повторно запрашивать ссылки для серий, которые не удалось получить
+	Retries int
+
+	// Retry повторяет отдельные запросы при временных ошибках: обрывах соединения, таймаутах,
+	// статусах 429 и 5xx. Бюджет повторов общий для всех запросов тайтла. Нулевое значение не повторяет
+	Retry utils.RetryPolicy
+}
+
+// Title содержит всё, что удалось извлечь со страниц тайтла до получения ссылок
+type Title struct {
+	URL           string
+	Name          string
+	Type          int
+	PlayerPageURL string
+	Series        []utils.KodikSeriaInfo // серии всех сезонов
+	Seasons       []utils.KodikSeason
+	Season        int // сезон, выбранный на странице плеера; 0, если у сериала один сезон
+	Translations  []utils.KodikTranslation
+	Translation   utils.KodikTranslation // озвучка, для которой получен список серий
+
+	params     utils.KodikParams
+	playerPage string
+	retry      *utils.Retrier // повторы запросов к страницам тайтла
+}
+
+// referer возвращает адрес плеера, который браузер передает CDN при загрузке видео.
+// Пустая строка, если страница плеера еще не загружена
+func (t *Title) referer() string {
+	if t.params.PlayerDomain.Domain == "" {
+		return ""
+	}
+	return "https://" + t.params.PlayerDomain.Domain + "/"
+}
+
+// NewHTTPClient возвращает HTTP клиент с настройками, подходящими для Kodik
+func NewHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: 0,
+		Transport: &http.Transport{
+			TLSHandshakeTimeout: 60 * time.Second,
+		},
+	}
+}
+
+// NewClient создает клиент. Если doer равен nil, используется NewHTTPClient()
+func NewClient(doer utils.HTTPDoer) *Client {
+	if doer == nil {
+		doer = NewHTTPClient()
+	}
+
+	return &Client{http: doer}
+}
+
+// WithLog возвращает копию клиента, которая пишет ход получения ссылок в журнал log.
+// Клиент, созданный NewClient, журнал не ведет
+func (c *Client) WithLog(log utils.Logf) *Client {
+	client := *c
+	client.log = log
+	return &client
+}
+
+// Resolve загружает страницы тайтла, выбирает серии и получает на них ссылки.
+// Ошибки отдельных серий записываются в их Result; ошибка возвращается, только если
+// не удалось получить ни одной ссылки
+func (c *Client) Resolve(ctx context.Context, url string, opts Options) (utils.HandleResult, error) {
+	title, err := c.fetchTitle(ctx, url, opts)
+	if err != nil {
+		return utils.HandleResult{}, err
+	}
+
+	if opts.SelectTranslation != nil && len(title.Translations) > 1 {
+		opts.notify(StageTranslation)
+
+		translation, err := opts.SelectTranslation(title)
+		if err != nil {
+			return utils.HandleResult{TitleName: title.Name}, &StageError{Stage: StageTranslation, Err: err}
+		}
+
+		if err := c.switchTranslation(ctx, title, translation, opts); err != nil {
+			return utils.HandleResult{TitleName: title.Name}, err
+		}
+	}
+
+	series := title.Series
+	if opts.SelectEpisodes != nil {
+		opts.notify(StageSelect)
+
+		series, err = opts.SelectEpisodes(title)
+		if err != nil {
+			return utils.HandleResult{TitleName: title.Name, Translation: title.Translation}, &StageError{Stage: StageSelect, Err: err}
+		}
+	}
+
+	return c.resolveSeries(ctx, title, series, opts)
+}
+
+// Fetch загружает главную страницу и страницу плеера и извлекает название и список серий
+func (c *Client) Fetch(ctx context.Context, url string) (*Title, error) {
+	return c.fetchTitle(ctx, url, Options{})
+}
+
+// ResolveSeries получает ссылки на переданные серии ранее загруженного тайтла
+func (c *Client) ResolveSeries(ctx context.Context, title *Title, series []utils.KodikSeriaInfo, opts Options) (utils.HandleResult, error) {
+	return c.resolveSeries(ctx, title, series, opts)
+}
+
+// ResolveEpisode заново получает ссылку на одну серию, например когда ранее полученная ссылка истекла.
+// Id и Hash серии уже известны, поэтому серии тайтла и озвучки не выбираются
+func (c *Client) ResolveEpisode(ctx context.Context, url string, seria utils.KodikSeriaInfo, opts Options) (utils.Result, error) {
+	title, err := c.fetchTitle(ctx, url, opts)
+	if err != nil {
+		return utils.Result{Seria: seria}, err
+	}
+
+	result, err := c.resolveSeries(ctx, title, []utils.KodikSeriaInfo{seria}, opts)
+	if err != nil {
+		return utils.Result{Seria: seria}, err
+	}
+
+	return result.Results[0], nil
+}
+
+func (o Options) notify(stage Stage) {
+	if o.OnStage != nil {
+		o.OnStage(stage)
+	}
+}
+
+func (c *Client) fetchTitle(ctx context.Context, url string, opts Options) (*Title, error) {
+	var (
+		requestParams utils.KodikRequestParams
+		responseBody  string
+		err           error
+		title         = &Title{URL: url, Type: utils.GetLinkType(url), retry: opts.Retry.NewRetrier("resolve", c.log)}
+	)
+
+	c.log.Printf(" Parsing main page")
+	opts.notify(StageMainPage)
+
+	// Получаем домен
+	domain, err := utils.ParseDomainFromURL(url)
+	if err != nil {
+		return nil, stageError(StageMainPage, "error parsing domain from URL: %w", err)
+	}
+	title.params.MainDomain.Domain = domain
+
+	// Получаем страницу
+	requestParams = utils.GetKodikRequestParams(
+		url, "", "", "", "", utils.KodikPage.MAIN_PAGE, utils.KodikSeriaInfo{})
+
+	responseBody, err = utils.GetPage(ctx, c.http, title.retry, &title.params, requestParams)
+	if err != nil {
+		return nil, stageError(StageMainPage, "error getting page: %w", err)
+	}
+
+	// Извлекаем URL iframe
+	title.PlayerPageURL, err = utils.ParseIframeURL(responseBody)
+	if err != nil {
+		return nil, stageError(StageMainPage, "error parsing iframe URL: %w", err)
+	}
+
+	title.Name, err = utils.ParseTitle(responseBody)
+	if err != nil {
+		return nil, stageError(StageMainPage, "error parsing title: %w", err)
+	}
+
+	if err := c.loadPlayerPage(ctx, title, title.PlayerPageURL, opts); err != nil {
+		return nil, err
+	}
+
+	return title, nil
+}
+
+// loadPlayerPage загружает страницу плеера и извлекает из неё параметры, серии и озвучки
+func (c *Client) loadPlayerPage(ctx context.Context, title *Title, playerPageURL string, opts Options) error {
+	c.log.Printf(" Parsing player page")
+	opts.notify(StagePlayerPage)
+
+	// Получаем страницу плеера
+	requestParams := utils.GetKodikRequestParams(
+		playerPageURL, title.params.MainDomain.Domain, "", "", "", utils.KodikPage.PLAYER_PAGE, utils.KodikSeriaInfo{})
+
+	playerPage, err := utils.GetPage(ctx, c.http, title.retry, &title.params, requestParams)
+	if err != nil {
+		return stageError(StagePlayerPage, "error getting player page: %w", err)
+	}
+
+	c.log.Printf(" Using stealing method 1")
+
+	// Парсим параметры из страницы плеера
+	err = utils.ParseURLParameters(playerPage, &title.params)
+	if err != nil {
+		return stageError(StagePlayerPage, "error parsing URL parameters: %w", err)
+	}
+
+	opts.notify(StageEpisodes)
+
+	var (
+		series  []utils.KodikSeriaInfo
+		seasons []utils.KodikSeason
+		season  int
+	)
+	if title.Type == utils.KodikLinkTypes.Serial {
+		// Извлекаем серии сезона
+		series, err = utils.ParseSeasonSeries(playerPage)
+		if err != nil {
+			return stageError(StageEpisodes, "error parsing series: %w", err)
+		}
+
+		seasons, err = utils.ParseSeasons(playerPage)
+		if err != nil {
+			return stageError(StageEpisodes, "error parsing seasons: %w", err)
+		}
+
+		if len(seasons) > 1 {
+			series, season, err = c.loadSeasons(ctx, title, playerPageURL, playerPage, series, seasons)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		series, err = utils.ParseVideoInfo(playerPage)
+		if err != nil {
+			return stageError(StageEpisodes, "error parsing video: %w", err)
+		}
+	}
+
+	if len(series) == 0 {
+		return &StageError{Stage: StageEpisodes, Err: errors.New("no episodes found on player page")}
+	}
+
+	title.PlayerPageURL = playerPageURL
+	title.playerPage = playerPage
+	title.Series = series
+	title.Seasons = seasons
+	title.Season = season
+	title.Translations, title.Translation = parseTranslations(playerPage, len(series), c.log)
+
+	return nil
+}
+
+// resolveSeries обходит защиту и получает ссылки на видео для выбранных серий
+func (c *Client) resolveSeries(ctx context.Context, title *Title, series []utils.KodikSeriaInfo, opts Options) (utils.HandleResult, error) {
+	var (
+		requestParams utils.KodikRequestParams
+		responseBody  string
+		err           error
+		handleResult  = utils.HandleResult{TitleName: title.Name, Translation: title.Translation, Referer: title.referer()}
+	)
+
+	if len(series) == 0 {
+		return handleResult, &StageError{Stage: StageSelect, Err: errors.New("no episodes selected")}
+	}
+
+	c.log.Printf(" Serial script manipulations...")
+	opts.notify(StageSerialScript)
+
+	// Получаем URL для скрипта сериала
+	appSerialScriptURL, err := utils.GetSerialScriptURL(title.playerPage, title.params.PlayerDomain.Domain)
+	if err != nil {
+		return handleResult, stageError(StageSerialScript, "error getting serial script URL: %w", err)
+	}
+
+	// Получаем скрипт сериала
+	requestParams = utils.GetKodikRequestParams(
+		appSerialScriptURL, title.PlayerPageURL, "", "", "", utils.KodikPage.APP_SERIAL_SCRIPT, utils.KodikSeriaInfo{})
+
+	responseBody, err = utils.GetPage(ctx, c.http, title.retry, &title.params, requestParams)
+	if err != nil {
+		return handleResult, stageError(StageSerialScript, "error getting app serial script: %w", err)
+	}
+
+	opts.notify(StageSecretMethod)
+
+	// Извлекаем зашифрованный секретный метод
+	secretMethod, err := utils.GetSecretMethod(responseBody)
+	if err != nil {
+		return handleResult, stageError(StageSecretMethod, "error extracting secret method: %w", err)
+	}
+
+	secretMethod, err = decodeSecretMethod(secretMethod, c.log)
+	if err != nil {
+		return handleResult, stageError(StageSecretMethod, "error decoding secret method: %w", err)
+	}
+
+	c.log.Printf(" Decoded secret method: %s", secretMethod)
+
+	// Параметры расшифровки ссылок берутся из того же скрипта; без них используется эвристика
+	decoding, err := utils.ParseScriptDecoding(responseBody)
+	if err != nil {
+		c.log.Printf(" Can't extract decoding parameters from script: %v, using heuristic decoding", err)
+	} else {
+		c.log.Printf(" Using ROT offset %d from serial script", decoding.RotOffset)
+	}
+
+	c.log.Printf(" Obtaining secret data")
+	opts.notify(StageLinks)
+
+	// Ошибка одной серии не прерывает остальные: она записывается в её Result,
+	// а сама серия запрашивается повторно до opts.Retries раз
+	handleResult.Results = make([]utils.Result, len(series))
+	pending := make([]int, len(series))
+	for i, seria := range series {
+		handleResult.Results[i] = utils.Result{Seria: seria}
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			c.log.Printf(" Retrying %d failed episodes, attempt %d of %d", len(pending), attempt, opts.Retries)
+
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+			}
+		}
+
+		lastAttempt := attempt >= opts.Retries
+		c.resolvePending(ctx, title, secretMethod, decoding, handleResult.Results, pending, lastAttempt, opts)
+
+		var failed []int
+		for _, i := range pending {
+			if handleResult.Results[i].Err != nil {
+				failed = append(failed, i)
+			}
+		}
+
+		if lastAttempt || ctx.Err() != nil {
+			break
+		}
+		pending = failed
+	}
+
+	// Сортируем результаты
+	handleResult.Results = utils.SortResults(handleResult.Results)
+
+	if len(handleResult.Succeeded()) == 0 {
+		return handleResult, &StageError{Stage: StageLinks, Err: handleResult.Results[0].Err}
+	}
+
+	return handleResult, nil
+}
+
+// resolvePending параллельно получает ссылки для серий с индексами pending.
+// OnResult вызывается для успешных серий и для ошибок последней попытки
+func (c *Client) resolvePending(ctx context.Context, title *Title, secretMethod string, decoding *utils.ScriptDecoding, results []utils.Result, pending []int, lastAttempt bool, opts Options) {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	// Отправляем POST запросы на секретный метод горутин
+	for _, i := range pending {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := &results[i]
+			result.Attempts++
+
+			qualities, err := c.getVideoLinks(ctx, title, result.Seria, secretMethod, decoding)
+			if err == nil {
+				result.Qualities = qualities
+
+				var quality utils.Quality
+				quality, err = opts.Quality.Select(qualities)
+				if err == nil {
+					result.Quality = quality.Height
+					result.Video = quality.Sources[0].Src
+				}
+			}
+
+			if err != nil {
+				c.log.Printf(" Failed to resolve seria %s: %v", result.Seria.Label(), err)
+				result.Status = utils.StatusResolveFailed
+				result.Err = err
+			} else {
+				result.Status = utils.StatusResolved
+				result.Err = nil
+			}
+
+			if opts.OnResult != nil && (result.Err == nil || lastAttempt || ctx.Err() != nil) {
+				mu.Lock()
+				opts.OnResult(*result)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// getVideoLinks запрашивает секретный метод для одной серии и расшифровывает ссылки всех качеств
+func (c *Client) getVideoLinks(ctx context.Context, title *Title, seria utils.KodikSeriaInfo, secretMethod string, decoding *utils.ScriptDecoding) ([]utils.Quality, error) {
+	requestParams := utils.GetKodikRequestParams(
+		title.params.PlayerDomain.Domain+secretMethod,
+		title.PlayerPageURL,
+		title.params.PlayerDomain.Domain,
+		"application/x-www-form-urlencoded; charset=UTF-8",
+		"",
+		utils.KodikPage.SECRET_METHOD,
+		seria,
+	)
+
+	responseBody, err := utils.PostPage(ctx, c.http, title.retry, &title.params, requestParams, title.Type)
+	if err != nil {
+		return nil, fmt.Errorf("error getting secret method: %w", err)
+	}
+
+	qualities, err := utils.ParseLinks(responseBody, decoding, c.log)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing video links: %w", err)
+	}
+
+	return qualities, nil
+}
+
+// decodeSecretMethod расшифровывает секретный метод. Скрипт передает его в atob(),
+// поэтому сначала пробуется обычный Base64 и только затем эвристика
+func decodeSecretMethod(encoded string, log utils.Logf) (string, error) {
+	decoded, err := utils.Base64(encoded)
+	if err == nil && strings.HasPrefix(decoded, "/") {
+		log.Printf(" Secret method decoded as atob() argument")
+		return decoded, nil
+	}
+
+	log.Printf(" Secret method is not plain base64, using heuristic decoding")
+	return utils.AutoDecode(encoded)
+}
@@ -0,0 +1,259 @@
+package kodik_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"kodik_parser/kodik"
+	"kodik_parser/kodiktest"
+	"kodik_parser/utils"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveSerial(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Title: "Тестовый сериал", Episodes: 4})
+	defer server.Close()
+
+	client := kodik.NewClient(server.Client())
+
+	result, err := client.Resolve(context.Background(), server.TitleURL(), kodik.Options{
+		Quality: utils.QualityPolicy{Preferred: 480},
+	})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	if result.TitleName != "Тестовый сериал" {
+		t.Errorf("TitleName = %q", result.TitleName)
+	}
+	if want := "https://" + server.Host() + "/"; result.Referer != want {
+		t.Errorf("Referer = %q, want %q", result.Referer, want)
+	}
+	if len(result.Results) != 4 || len(result.Succeeded()) != 4 {
+		t.Fatalf("got %d results, %d succeeded", len(result.Results), len(result.Succeeded()))
+	}
+
+	for i, res := range result.Results {
+		num := i + 1
+		if want := server.VideoURL(0, 1, num, 480); res.Video != want {
+			t.Errorf("episode %d: Video = %q, want %q", num, res.Video, want)
+		}
+		if res.Quality != 480 || len(res.Qualities) != 3 {
+			t.Errorf("episode %d: Quality = %d, %d qualities", num, res.Quality, len(res.Qualities))
+		}
+		if res.Status != utils.StatusResolved || res.Attempts != 1 {
+			t.Errorf("episode %d: Status = %q, Attempts = %d", num, res.Status, res.Attempts)
+		}
+	}
+}
+
+func TestResolveMovie(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Movie: true})
+	defer server.Close()
+
+	result, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	if len(result.Results) != 1 {
+		t.Fatalf("got %d results", len(result.Results))
+	}
+	if want := server.VideoURL(0, 1, 1, 720); result.Results[0].Video != want {
+		t.Errorf("Video = %q, want %q", result.Results[0].Video, want)
+	}
+}
+
+func TestResolveLog(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer server.Close()
+
+	// Клиент без журнала ничего не пишет в глобальный log
+	var global bytes.Buffer
+	log.SetOutput(&global)
+	defer log.SetOutput(os.Stderr)
+
+	client := kodik.NewClient(server.Client())
+	if _, err := client.Resolve(context.Background(), server.TitleURL(), kodik.Options{}); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if global.Len() != 0 {
+		t.Errorf("client without log wrote to the global log:\n%s", global.String())
+	}
+
+	var messages []string
+	logged := client.WithLog(func(format string, args ...any) {
+		messages = append(messages, fmt.Sprintf(format, args...))
+	})
+	if _, err := logged.Resolve(context.Background(), server.TitleURL(), kodik.Options{}); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if !slices.ContainsFunc(messages, func(m string) bool { return strings.Contains(m, "Parsing main page") }) {
+		t.Errorf("log = %q, want the main page stage", messages)
+	}
+	if global.Len() != 0 {
+		t.Errorf("client with log wrote to the global log:\n%s", global.String())
+	}
+}
+
+func TestResolveSeasons(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Seasons: 3, Episodes: 2})
+	defer server.Close()
+
+	client := kodik.NewClient(server.Client())
+
+	title, err := client.Fetch(context.Background(), server.TitleURL())
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(title.Seasons) != 3 || len(title.Series) != 6 || title.Season != 1 {
+		t.Fatalf("got %d seasons, %d series, current season %d", len(title.Seasons), len(title.Series), title.Season)
+	}
+
+	series, err := utils.SelectSeries(title.Series, "S2E2-S3E1", title.Season)
+	if err != nil {
+		t.Fatalf("SelectSeries: %v", err)
+	}
+
+	result, err := client.ResolveSeries(context.Background(), title, series, kodik.Options{})
+	if err != nil {
+		t.Fatalf("ResolveSeries: %v", err)
+	}
+
+	want := []string{server.VideoURL(0, 2, 2, 720), server.VideoURL(0, 3, 1, 720)}
+	if len(result.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(result.Results), len(want))
+	}
+	for i, res := range result.Results {
+		if res.Video != want[i] {
+			t.Errorf("%s: Video = %q, want %q", res.Seria.Label(), res.Video, want[i])
+		}
+	}
+}
+
+func TestResolveTranslation(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{
+		Episodes: 6,
+		Translations: []kodiktest.Translation{
+			{ID: "610", Title: "AniLibria.TV", Type: "voice"},
+			{ID: "1291", Title: "Crunchyroll", Type: "subtitles", Episodes: 2},
+		},
+	})
+	defer server.Close()
+
+	client := kodik.NewClient(server.Client())
+
+	title, err := client.Fetch(context.Background(), server.TitleURL())
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+
+	translations, err := client.Translations(context.Background(), title)
+	if err != nil {
+		t.Fatalf("Translations: %v", err)
+	}
+	if len(translations) != 2 || translations[0].EpisodeCount != 6 || translations[1].EpisodeCount != 2 {
+		t.Fatalf("translations = %+v", translations)
+	}
+
+	result, err := client.Resolve(context.Background(), server.TitleURL(), kodik.Options{
+		SelectTranslation: func(title *kodik.Title) (utils.KodikTranslation, error) {
+			return kodik.FindTranslation(title.Translations, "crunchy")
+		},
+	})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	if result.Translation.ID != "1291" || len(result.Results) != 2 {
+		t.Fatalf("translation %s, %d results", result.Translation.ID, len(result.Results))
+	}
+	if want := server.VideoURL(1, 1, 2, 720); result.Results[1].Video != want {
+		t.Errorf("Video = %q, want %q", result.Results[1].Video, want)
+	}
+}
+
+func TestResolveRetryPolicy(t *testing.T) {
+	// Ошибки 500 повторяются внутри одной попытки получения ссылки
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2, FailLinks: map[int]int{1: 2}})
+	defer server.Close()
+
+	result, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{
+		Retry: utils.RetryPolicy{Attempts: 3, BaseDelay: 0.001},
+	})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	for _, res := range result.Results {
+		if res.Err != nil || res.Attempts != 1 {
+			t.Errorf("%s: Attempts = %d, Err = %v", res.Seria.Label(), res.Attempts, res.Err)
+		}
+	}
+	if n := server.SecretRequests(); n != 4 {
+		t.Errorf("secret method requested %d times, want 4", n)
+	}
+}
+
+func TestResolveRetries(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{
+		Episodes:  3,
+		FailLinks: map[int]int{2: 1, 3: 10},
+	})
+	defer server.Close()
+
+	var reported []utils.Result
+	result, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{
+		Retries:  1,
+		OnResult: func(result utils.Result) { reported = append(reported, result) },
+	})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	if len(reported) != 3 {
+		t.Errorf("OnResult called %d times, want 3", len(reported))
+	}
+
+	attempts := []int{1, 2, 2}
+	for i, res := range result.Results {
+		if res.Attempts != attempts[i] {
+			t.Errorf("%s: Attempts = %d, want %d", res.Seria.Label(), res.Attempts, attempts[i])
+		}
+	}
+
+	if failed := result.Failed(); len(failed) != 1 || failed[0].Seria.Num != "3" || failed[0].Status != utils.StatusResolveFailed {
+		t.Errorf("failed = %+v", failed)
+	}
+}
+
+func TestResolveAllFailed(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, FailLinks: map[int]int{1: 10}})
+	defer server.Close()
+
+	_, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{})
+
+	var stageErr *kodik.StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != kodik.StageLinks {
+		t.Fatalf("err = %v, want links stage error", err)
+	}
+}
+
+func TestResolveScriptRotOffset(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, RotShift: 7})
+	defer server.Close()
+
+	result, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	if want := server.VideoURL(0, 1, 1, 720); result.Results[0].Video != want {
+		t.Errorf("Video = %q, want %q", result.Results[0].Video, want)
+	}
+}
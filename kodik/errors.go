@@ -0,0 +1,35 @@
+package kodik
+
+import "fmt"
+
+// Stage обозначает этап получения ссылок
+type Stage string
+
+const (
+	StageMainPage     Stage = "main page"     // загрузка и разбор главной страницы
+	StagePlayerPage   Stage = "player page"   // загрузка страницы плеера и её параметров
+	StageEpisodes     Stage = "episodes"      // разбор списка серий
+	StageTranslation  Stage = "translation"   // выбор озвучки и загрузка её списка серий
+	StageSelect       Stage = "select"        // выбор серий пользователем
+	StageSerialScript Stage = "serial script" // загрузка скрипта сериала
+	StageSecretMethod Stage = "secret method" // извлечение и расшифровка секретного метода
+	StageLinks        Stage = "links"         // получение ссылок на видео
+)
+
+// StageError сообщает, на каком этапе и по какой причине не удалось получить ссылки
+type StageError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("kodik: %s: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+func stageError(stage Stage, format string, args ...any) error {
+	return &StageError{Stage: stage, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,97 @@
+package kodik
+
+import (
+	"context"
+	"kodik_parser/utils"
+	"net/url"
+	"strconv"
+)
+
+// loadSeasons собирает серии всех сезонов. Если страница плеера содержит списки серий
+// всех сезонов, они берутся с неё, иначе страница плеера загружается для каждого сезона отдельно.
+// Возвращает серии с номерами сезонов и номер сезона, выбранного на странице
+func (c *Client) loadSeasons(
+	ctx context.Context,
+	title *Title,
+	playerPageURL string,
+	playerPage string,
+	currentSeries []utils.KodikSeriaInfo,
+	seasons []utils.KodikSeason) ([]utils.KodikSeriaInfo, int, error) {
+
+	current := seasons[0].Number
+	for _, season := range seasons {
+		if season.Selected {
+			current = season.Number
+		}
+	}
+
+	if all, err := utils.ParseAllSeasonsSeries(playerPage); err == nil && coversSeasons(all, seasons) {
+		c.log.Printf(" Found episodes of %d seasons on player page", len(seasons))
+		return all, current, nil
+	}
+
+	var series []utils.KodikSeriaInfo
+	for _, season := range seasons {
+		seasonSeries := currentSeries
+
+		if season.Number != current {
+			c.log.Printf(" Loading episodes of season %d", season.Number)
+
+			seasonURL, err := seasonPlayerURL(playerPageURL, season.Number)
+			if err != nil {
+				return nil, 0, stageError(StageEpisodes, "error building season %d URL: %w", season.Number, err)
+			}
+
+			requestParams := utils.GetKodikRequestParams(
+				seasonURL, title.params.MainDomain.Domain, "", "", "", utils.KodikPage.PLAYER_PAGE, utils.KodikSeriaInfo{})
+
+			body, err := utils.GetPage(ctx, c.http, title.retry, &title.params, requestParams)
+			if err != nil {
+				return nil, 0, stageError(StageEpisodes, "error getting season %d: %w", season.Number, err)
+			}
+
+			seasonSeries, err = utils.ParseSeasonSeries(body)
+			if err != nil {
+				return nil, 0, stageError(StageEpisodes, "error parsing season %d: %w", season.Number, err)
+			}
+		}
+
+		for _, seria := range seasonSeries {
+			seria.Season = season.Number
+			series = append(series, seria)
+		}
+	}
+
+	return series, current, nil
+}
+
+// coversSeasons проверяет, что в списке есть серии каждого сезона
+func coversSeasons(series []utils.KodikSeriaInfo, seasons []utils.KodikSeason) bool {
+	found := make(map[int]bool)
+	for _, seria := range series {
+		found[seria.Season] = true
+	}
+
+	for _, season := range seasons {
+		if !found[season.Number] {
+			return false
+		}
+	}
+
+	return len(series) > 0
+}
+
+// seasonPlayerURL добавляет к URL страницы плеера параметр season
+func seasonPlayerURL(playerPageURL string, season int) (string, error) {
+	parsed, err := url.Parse(playerPageURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := parsed.Query()
+	query.Set("season", strconv.Itoa(season))
+	query.Del("episode")
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
@@ -0,0 +1,160 @@
+package kodik
+
+import (
+	"context"
+	"fmt"
+	"kodik_parser/utils"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// playerPathRegex находит id и hash тайтла в пути страницы плеера: /serial/<id>/<hash>/
+var playerPathRegex = regexp.MustCompile(`/(serial|season|video)/[^/]+/[^/]+/`)
+
+// parseTranslations извлекает список озвучек и определяет текущую.
+// Если на странице не отмечена выбранная озвучка, она берется из переменных скрипта плеера
+func parseTranslations(playerPage string, episodeCount int, log utils.Logf) ([]utils.KodikTranslation, utils.KodikTranslation) {
+	translations, err := utils.ParseTranslations(playerPage)
+	if err != nil {
+		log.Printf(" Failed to parse translations: %v", err)
+	}
+
+	currentID := ""
+	if details, err := utils.ParseSerialDetails(playerPage); err == nil {
+		currentID = details.TranslationID
+	}
+
+	current := -1
+	for i := range translations {
+		if translations[i].Selected || (currentID != "" && translations[i].ID == currentID) {
+			current = i
+			break
+		}
+	}
+
+	if current == -1 {
+		if len(translations) == 0 {
+			return translations, utils.KodikTranslation{}
+		}
+		current = 0
+	}
+
+	translations[current].Selected = true
+	if translations[current].EpisodeCount == 0 {
+		translations[current].EpisodeCount = episodeCount
+	}
+
+	return translations, translations[current]
+}
+
+// translationPlayerURL заменяет id и hash в URL страницы плеера на id и hash выбранной озвучки
+func translationPlayerURL(playerPageURL string, translation utils.KodikTranslation) (string, error) {
+	if translation.MediaID == "" || translation.MediaHash == "" {
+		return "", fmt.Errorf("translation %s has no media id or hash", translation.ID)
+	}
+
+	loc := playerPathRegex.FindStringSubmatchIndex(playerPageURL)
+	if loc == nil {
+		return "", fmt.Errorf("unexpected player page URL: %s", playerPageURL)
+	}
+
+	kind := playerPageURL[loc[2]:loc[3]]
+	path := fmt.Sprintf("/%s/%s/%s/", kind, translation.MediaID, translation.MediaHash)
+
+	return playerPageURL[:loc[0]] + path + playerPageURL[loc[1]:], nil
+}
+
+// switchTranslation загружает страницу плеера выбранной озвучки, если она не является текущей
+func (c *Client) switchTranslation(ctx context.Context, title *Title, translation utils.KodikTranslation, opts Options) error {
+	if translation.ID == title.Translation.ID {
+		return nil
+	}
+
+	c.log.Printf(" Switching translation to %s (%s)", translation.Title, translation.ID)
+
+	playerPageURL, err := translationPlayerURL(title.PlayerPageURL, translation)
+	if err != nil {
+		return &StageError{Stage: StageTranslation, Err: err}
+	}
+
+	return c.loadPlayerPage(ctx, title, playerPageURL, opts)
+}
+
+// SelectTranslation загружает список серий для выбранной озвучки
+func (c *Client) SelectTranslation(ctx context.Context, title *Title, translation utils.KodikTranslation) error {
+	return c.switchTranslation(ctx, title, translation, Options{})
+}
+
+// Translations возвращает список озвучек тайтла с количеством серий в каждой.
+// Для озвучек, у которых количество серий не указано на странице, загружается их страница плеера
+func (c *Client) Translations(ctx context.Context, title *Title) ([]utils.KodikTranslation, error) {
+	translations := make([]utils.KodikTranslation, len(title.Translations))
+	copy(translations, title.Translations)
+
+	for i := range translations {
+		if translations[i].EpisodeCount != 0 {
+			continue
+		}
+
+		playerPageURL, err := translationPlayerURL(title.PlayerPageURL, translations[i])
+		if err != nil {
+			c.log.Printf(" Can't count episodes of translation %s: %v", translations[i].ID, err)
+			continue
+		}
+
+		other := &Title{URL: title.URL, Type: title.Type, params: title.params, retry: title.retry}
+		if err := c.loadPlayerPage(ctx, other, playerPageURL, Options{}); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			c.log.Printf(" Can't count episodes of translation %s: %v", translations[i].ID, err)
+			continue
+		}
+
+		translations[i].EpisodeCount = len(other.Series)
+	}
+
+	return translations, nil
+}
+
+// FindTranslation ищет озвучку по id или по названию. Название сравнивается без учета регистра,
+// сначала целиком, затем по вхождению подстроки; неоднозначное совпадение считается ошибкой
+func FindTranslation(translations []utils.KodikTranslation, query string) (utils.KodikTranslation, error) {
+	query = strings.TrimSpace(query)
+
+	if _, err := strconv.Atoi(query); err == nil {
+		for _, translation := range translations {
+			if translation.ID == query {
+				return translation, nil
+			}
+		}
+	}
+
+	lower := strings.ToLower(query)
+	for _, translation := range translations {
+		if strings.ToLower(translation.Title) == lower {
+			return translation, nil
+		}
+	}
+
+	var matches []utils.KodikTranslation
+	for _, translation := range translations {
+		if strings.Contains(strings.ToLower(translation.Title), lower) {
+			matches = append(matches, translation)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return utils.KodikTranslation{}, fmt.Errorf("translation %q not found", query)
+	case 1:
+		return matches[0], nil
+	default:
+		var titles []string
+		for _, translation := range matches {
+			titles = append(titles, translation.Title)
+		}
+		return utils.KodikTranslation{}, fmt.Errorf("translation %q is ambiguous: %s", query, strings.Join(titles, ", "))
+	}
+}
@@ -0,0 +1,209 @@
+package kodiktest
+
+import "encoding/binary"
+
+// Параметры потока MPEG-TS, который сервер отдает при Config.MPEGTS
+const (
+	tsSegmentDuration    = 6 * 90000 // совпадает с EXTINF в mediaPlaylist
+	tsFrameDuration      = 90000 / 25
+	tsAudioFrameDuration = 1024 * 90000 / 48000
+	tsGOP                = 25 // ключевой кадр раз в секунду
+
+	tsVideoPID = 0x100
+	tsAudioPID = 0x101
+	tsPMTPID   = 0x1000
+
+	// tsBasePTS — метка первого кадра: 33-битный счетчик переполняется на третьей секунде
+	tsBasePTS = 1<<33 - 3*90000
+	// tsPTSDelay — сдвиг PTS относительно DTS, как у потока с B-кадрами
+	tsPTSDelay = 2 * tsFrameDuration
+)
+
+// SPS Baseline профиля для кадра 1280x720 и произвольный PPS
+var (
+	h264SPS = []byte{0x67, 0x42, 0x00, 0x1E, 0xDA, 0x01, 0x40, 0x16, 0xE4}
+	h264PPS = []byte{0x68, 0xCE, 0x38, 0x80}
+)
+
+// tsSegment возвращает n-й фрагмент (с 1) непрерывного потока H.264 1280x720 25 к/с
+// и AAC-LC 48 кГц стерео. Кадры не декодируются, но их структуры хватает для перепаковки
+func tsSegment(n int) []byte {
+	w := tsWriter{cc: make(map[int]byte)}
+	w.psi(0, patSection())
+	w.psi(tsPMTPID, pmtSection())
+
+	frames := tsSegmentDuration / tsFrameDuration
+	for f := (n - 1) * frames; f < n*frames; f++ {
+		dts := int64(f * tsFrameDuration)
+		w.pes(tsVideoPID, 0xE0, dts+tsPTSDelay, dts, videoFrame(f), false)
+
+		// Аудиокадры, которые начинаются во время этого видеокадра, идут одним PES
+		var audio []byte
+		first := -1
+		for k := ceilDiv(dts, tsAudioFrameDuration); k*tsAudioFrameDuration < dts+tsFrameDuration; k++ {
+			if first < 0 {
+				first = int(k)
+			}
+			audio = append(audio, audioFrame(int(k))...)
+		}
+		if first >= 0 {
+			pts := int64(first * tsAudioFrameDuration)
+			w.pes(tsAudioPID, 0xC0, pts, pts, audio, true)
+		}
+	}
+
+	return w.buf
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func videoFrame(f int) []byte {
+	startCode := []byte{0, 0, 0, 1}
+
+	frame := append([]byte(nil), startCode...)
+	frame = append(frame, 0x09, 0xF0) // разделитель кадров
+
+	header := byte(0x41)
+	if f%tsGOP == 0 {
+		header = 0x65
+		frame = append(append(frame, startCode...), h264SPS...)
+		frame = append(append(frame, startCode...), h264PPS...)
+	}
+
+	frame = append(append(frame, startCode...), header)
+	for i := 0; i < 40; i++ {
+		frame = append(frame, byte(1+(f+i)%250))
+	}
+
+	return frame
+}
+
+func audioFrame(k int) []byte {
+	const payload = 16
+	length := 7 + payload
+
+	frame := []byte{
+		0xFF, 0xF1, // MPEG-4, без CRC
+		0x40 | 3<<2, // AAC-LC, 48 кГц
+		2<<6 | byte(length>>11&3),
+		byte(length >> 3),
+		byte(length&7)<<5 | 0x1F,
+		0xFC,
+	}
+	for i := 0; i < payload; i++ {
+		frame = append(frame, byte(k+i))
+	}
+
+	return frame
+}
+
+// tsWriter разбивает PSI секции и PES пакеты на пакеты MPEG-TS по 188 байт
+type tsWriter struct {
+	buf []byte
+	cc  map[int]byte // continuity_counter по PID
+}
+
+func (w *tsWriter) psi(pid int, section []byte) {
+	w.packets(pid, append([]byte{0}, section...), 0xFF)
+}
+
+func (w *tsWriter) pes(pid int, streamID byte, pts, dts int64, payload []byte, withLength bool) {
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5}
+	timestamps := putTimestamp(nil, 2, pts)
+	if pts != dts {
+		header[7], header[8] = 0xC0, 10
+		timestamps = putTimestamp(putTimestamp(nil, 3, pts), 1, dts)
+	}
+
+	pes := append(header, timestamps...)
+	pes = append(pes, payload...)
+	if withLength {
+		binary.BigEndian.PutUint16(pes[4:], uint16(len(pes)-6))
+	}
+
+	w.packets(pid, pes, 0)
+}
+
+// packets пишет данные с начала нового пакета. Последний пакет PES дополняется полем адаптации,
+// а PSI — байтами 0xFF после секции
+func (w *tsWriter) packets(pid int, data []byte, fill byte) {
+	for first := true; len(data) > 0; first = false {
+		header := []byte{0x47, byte(pid >> 8 & 0x1F), byte(pid), 0x10 | w.cc[pid]&0x0F}
+		if first {
+			header[1] |= 0x40
+		}
+		w.cc[pid]++
+
+		n := min(len(data), 184)
+		if n < 184 && fill == 0 {
+			stuffing := 183 - n
+			header[3] |= 0x20
+			header = append(header, byte(stuffing))
+			if stuffing > 0 {
+				header = append(header, 0)
+				for i := 1; i < stuffing; i++ {
+					header = append(header, 0xFF)
+				}
+			}
+		}
+
+		packet := append(header, data[:n]...)
+		for len(packet) < 188 {
+			packet = append(packet, fill)
+		}
+
+		w.buf = append(w.buf, packet...)
+		data = data[n:]
+	}
+}
+
+func putTimestamp(b []byte, prefix byte, ts int64) []byte {
+	ts = (tsBasePTS + ts) % (1 << 33)
+	return append(b,
+		prefix<<4|byte(ts>>29&0x0E)|1,
+		byte(ts>>22),
+		byte(ts>>14&0xFE)|1,
+		byte(ts>>7),
+		byte(ts<<1&0xFE)|1,
+	)
+}
+
+func patSection() []byte {
+	body := []byte{0, 1, 0xC1, 0, 0, 0, 1, 0xE0 | tsPMTPID>>8, tsPMTPID & 0xFF}
+	return psiSection(0x00, body)
+}
+
+func pmtSection() []byte {
+	body := []byte{
+		0, 1, 0xC1, 0, 0,
+		0xE0 | tsVideoPID>>8, tsVideoPID & 0xFF, // PCR_PID
+		0xF0, 0,
+		0x1B, 0xE0 | tsVideoPID>>8, tsVideoPID & 0xFF, 0xF0, 0,
+		0x0F, 0xE0 | tsAudioPID>>8, tsAudioPID & 0xFF, 0xF0, 0,
+	}
+	return psiSection(0x02, body)
+}
+
+// psiSection добавляет к телу секции заголовок и CRC32/MPEG-2
+func psiSection(tableID byte, body []byte) []byte {
+	length := len(body) + 4
+	section := append([]byte{tableID, 0xB0 | byte(length>>8), byte(length)}, body...)
+	return binary.BigEndian.AppendUint32(section, crc32MPEG(section))
+}
+
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
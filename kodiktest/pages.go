@@ -0,0 +1,42 @@
+package kodiktest
+
+import "time"
+
+// startTime — время изменения файлов хранилища для http.ServeContent
+var startTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// mainPageTemplate: название тайтла, host, тип плеера, id и hash
+const mainPageTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Kodik</title></head>
+<body>
+<div class="player-info">
+  <div class="top-info"><div class="title">%s</div></div>
+</div>
+<iframe src="//%s/%s/%s/%s/720p?translations=true" width="610" height="370" frameborder="0" allowfullscreen></iframe>
+</body>
+</html>
+`
+
+// playerPageHeader: urlParams, serialId, serialHash, translationId, translationTitle.
+// urlParams должен идти до любых других фигурных скобок на странице
+const playerPageHeader = `<!DOCTYPE html>
+<html>
+<head>
+<script>
+  var urlParams = '%s';
+  var serialId = Number(%s);
+  var serialHash = "%s";
+  var playerDomain = "kodik.info";
+  var translationId = %s;
+  var translationTitle = "%s";
+</script>
+</head>
+<body>
+`
+
+// scriptTemplate: секретный метод в base64 и сдвиг ROT
+const scriptTemplate = `!function(){var t=this;` +
+	`function d(e){return e.replace(/[a-zA-Z]/g,function(e){return String.fromCharCode((e<="Z"?90:122)>=(e=e.charCodeAt(0)+%[2]d)?e:e-26)})}` +
+	`$.ajax({type:"POST",url:atob("%[1]s"),cache:!1,data:t.params,dataType:"json"})}();
+`
@@ -0,0 +1,722 @@
+// Package kodiktest поднимает поддельный Kodik на httptest.Server для офлайн тестов.
+//
+// Сервер отдает главную страницу с iframe, страницу плеера с urlParams, списками
+// сезонов, серий и озвучек, скрипт сериала с секретным методом в atob(...),
+// сам секретный метод с закодированными ссылками и хранилище с m3u8 плейлистами,
+// фрагментами и mp4 файлами. Сервер работает по TLS, так как парсер всегда
+// обращается к Kodik по https, поэтому запросы нужно выполнять через Server.Client().
+package kodiktest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Значения подписей, которые сервер отдает в urlParams и проверяет в запросах секретного метода
+const (
+	DomainSign       = "test-d-sign"
+	PlayerDomainSign = "test-pd-sign"
+	RefererSign      = "test-ref-sign"
+
+	// SecretPath — путь секретного метода, закодированный в скрипте сериала
+	SecretPath = "/ftor"
+)
+
+// Translation описывает озвучку поддельного тайтла
+type Translation struct {
+	ID       string
+	Title    string
+	Type     string // voice или subtitles
+	Episodes int    // серий в каждом сезоне; 0 — Config.Episodes
+}
+
+// Config описывает поддельный тайтл. Нулевые поля заменяются значениями по умолчанию
+type Config struct {
+	Title        string        // название тайтла, по умолчанию "Test Title"
+	Movie        bool          // фильм вместо сериала
+	Seasons      int           // количество сезонов, по умолчанию 1
+	Episodes     int           // серий в каждом сезоне, по умолчанию 3
+	Translations []Translation // по умолчанию одна озвучка
+	Qualities    []int         // доступные качества, по умолчанию 360, 480, 720
+	Segments     int           // фрагментов в HLS плейлисте, по умолчанию 4
+	SegmentSize  int           // размер фрагмента в байтах, по умолчанию 1024
+	VideoSize    int           // размер mp4 файла в байтах, по умолчанию 64 КБ
+	RotShift     int           // сдвиг ROT для ссылок, по умолчанию 13
+
+	// Variants — высоты кадра вариантов мастер плейлиста. Если заданы, по ссылке на видео
+	// отдается мастер плейлист, а фрагменты варианта содержат данные качества, равного его высоте
+	Variants []int
+
+	// KeyRotation шифрует фрагменты AES-128: каждые KeyRotation фрагментов — новый ключ.
+	// У ключей с четным номером IV указан в плейлисте, у нечетных выводится из номера сегмента.
+	// 0 — без шифрования
+	KeyRotation int
+	// KeyMethod — METHOD в EXT-X-KEY, по умолчанию AES-128. SAMPLE-AES позволяет проверить отказ от загрузки
+	KeyMethod string
+
+	// MPEGTS отдает вместо заполнителей настоящие фрагменты MPEG-TS с H.264 и AAC по 6 секунд,
+	// одинаковые у всех серий и качеств. Не сочетается с ByteRanges
+	MPEGTS bool
+
+	// ByteRanges отдает плейлист, в котором все фрагменты — части одного файла (EXT-X-BYTERANGE)
+	ByteRanges bool
+
+	// FMP4 отдает плейлист фрагментированного MP4: перед фрагментами стоит секция
+	// инициализации EXT-X-MAP, и HLSData начинается с InitData. Не сочетается с ByteRanges
+	FMP4 bool
+
+	// HideVideoSize отвечает на HEAD запрос mp4 файла без Content-Length
+	HideVideoSize bool
+
+	// FailLinks задает, сколько первых запросов секретного метода для серии с данным номером
+	// завершатся ошибкой FailStatus
+	FailLinks map[int]int
+	// FailSegments задает, сколько первых запросов фрагмента с данным номером (с 1)
+	// завершатся ошибкой FailStatus. Счетчик общий для всех серий
+	FailSegments map[int]int
+	// FailRanges задает, сколько первых запросов mp4 файла с Range, начинающимся с данного байта,
+	// завершатся ошибкой FailStatus
+	FailRanges map[int64]int
+	// FailStatus — статус ответов FailLinks, FailSegments и FailRanges, по умолчанию 500
+	FailStatus int
+	// RetryAfter — значение заголовка Retry-After в этих ответах; пустая строка — без заголовка
+	RetryAfter string
+}
+
+// Server — поддельный Kodik
+type Server struct {
+	*httptest.Server
+
+	config Config
+
+	mu             sync.Mutex
+	failLinks      map[int]int
+	failSegments   map[int]int
+	failRanges     map[int64]int
+	generation     int // поколение ссылок; ссылки прошлых поколений истекли
+	released       int // серий, вышедших после запуска, см. ReleaseEpisodes
+	secretRequests int
+	requests       map[string]int
+}
+
+// episode — серия в конкретной озвучке, сезоне и качестве
+type episode struct {
+	translation int
+	season      int
+	num         int
+}
+
+// NewServer запускает поддельный Kodik. Сервер нужно закрыть через Close
+func NewServer(config Config) *Server {
+	if config.Title == "" {
+		config.Title = "Test Title"
+	}
+	if config.Seasons == 0 {
+		config.Seasons = 1
+	}
+	if config.Episodes == 0 {
+		config.Episodes = 3
+	}
+	if config.Movie {
+		config.Seasons = 1
+		config.Episodes = 1
+	}
+	if len(config.Translations) == 0 {
+		config.Translations = []Translation{{ID: "610", Title: "AniLibria.TV", Type: "voice"}}
+	}
+	if len(config.Qualities) == 0 {
+		config.Qualities = []int{360, 480, 720}
+	}
+	if config.Segments == 0 {
+		config.Segments = 4
+	}
+	if config.SegmentSize == 0 {
+		config.SegmentSize = 1024
+	}
+	if config.FailStatus == 0 {
+		config.FailStatus = http.StatusInternalServerError
+	}
+	if config.VideoSize == 0 {
+		config.VideoSize = 64 * 1024
+	}
+	if config.RotShift == 0 {
+		config.RotShift = 13
+	}
+	if config.KeyMethod == "" {
+		config.KeyMethod = "AES-128"
+	}
+
+	s := &Server{
+		config:       config,
+		failLinks:    make(map[int]int),
+		failSegments: make(map[int]int),
+		failRanges:   make(map[int64]int),
+		requests:     make(map[string]int),
+	}
+	for num, count := range config.FailLinks {
+		s.failLinks[num] = count
+	}
+	for n, count := range config.FailSegments {
+		s.failSegments[n] = count
+	}
+	for start, count := range config.FailRanges {
+		s.failRanges[start] = count
+	}
+
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Host возвращает host:port сервера, который используется во всех доменах Kodik
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "https://")
+}
+
+// TitleURL возвращает URL главной страницы тайтла
+func (s *Server) TitleURL() string {
+	if s.config.Movie {
+		return s.URL + "/movie/1000/" + titleHash
+	}
+	return s.URL + "/serial/1000/" + titleHash
+}
+
+// EpisodeID возвращает data-id серии. translation — индекс озвучки в Config.Translations
+func (s *Server) EpisodeID(translation, season, num int) string {
+	return episode{translation: translation, season: season, num: num}.id()
+}
+
+// VideoURL возвращает ссылку на HLS плейлист серии в том виде, в котором её отдает секретный метод
+func (s *Server) VideoURL(translation, season, num, quality int) string {
+	return "https:" + s.link(s.EpisodeID(translation, season, num), quality)
+}
+
+// ExpireLinks делает недействительными все выданные ссылки на плейлисты: запросы по ним
+// завершаются ошибкой 410, пока ссылка не будет получена заново
+func (s *Server) ExpireLinks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+}
+
+// ReleaseEpisodes добавляет n новых серий в каждый сезон каждой озвучки, как будто они вышли
+// после запуска сервера. Новые серии появляются на странице плеера при следующем запросе
+func (s *Server) ReleaseEpisodes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.released += n
+}
+
+// link возвращает ссылку на плейлист без схемы, подписанную текущим поколением
+func (s *Server) link(episodeID string, quality int) string {
+	s.mu.Lock()
+	generation := s.generation
+	s.mu.Unlock()
+
+	return fmt.Sprintf("//%s/storage/%s/%d.mp4:hls:manifest.m3u8?t=%d", s.Host(), episodeID, quality, generation)
+}
+
+// SegmentData возвращает содержимое n-го фрагмента HLS плейлиста серии (n с 1)
+func (s *Server) SegmentData(episodeID string, quality, n int) []byte {
+	if s.config.MPEGTS {
+		return tsSegment(n)
+	}
+	return fill(fmt.Sprintf("segment %s/%d/%d;", episodeID, quality, n), s.config.SegmentSize)
+}
+
+// HLSData возвращает ожидаемое содержимое .ts файла: все фрагменты по порядку
+func (s *Server) HLSData(episodeID string, quality int) []byte {
+	var data []byte
+	if s.config.FMP4 {
+		data = s.InitData(episodeID, quality)
+	}
+	for n := 1; n <= s.config.Segments; n++ {
+		data = append(data, s.SegmentData(episodeID, quality, n)...)
+	}
+	return data
+}
+
+// InitData возвращает секцию инициализации плейлиста FMP4
+func (s *Server) InitData(episodeID string, quality int) []byte {
+	return fill(fmt.Sprintf("init %s/%d;", episodeID, quality), 256)
+}
+
+// MP4Data возвращает содержимое mp4 файла серии
+func (s *Server) MP4Data(episodeID string, quality int) []byte {
+	return fill(fmt.Sprintf("mp4 %s/%d;", episodeID, quality), s.config.VideoSize)
+}
+
+// SecretRequests возвращает количество запросов к секретному методу
+func (s *Server) SecretRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.secretRequests
+}
+
+// Requests возвращает количество запросов с указанным путем
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[path]
+}
+
+// EncodeLink кодирует ссылку так же, как Kodik: base64, затем ROT со сдвигом Config.RotShift
+func (s *Server) EncodeLink(link string) string {
+	return rot(base64.StdEncoding.EncodeToString([]byte(link)), s.config.RotShift)
+}
+
+const titleHash = "0123456789abcdef"
+
+func (e episode) id() string {
+	return fmt.Sprintf("%d%d%03d", e.translation+1, e.season, e.num)
+}
+
+func (e episode) hash() string {
+	return "h" + e.id()
+}
+
+// parseEpisodeID обратен episode.id
+func parseEpisodeID(id string) (episode, bool) {
+	var e episode
+	if len(id) != 5 {
+		return e, false
+	}
+	if _, err := fmt.Sscanf(id, "%1d%1d%03d", &e.translation, &e.season, &e.num); err != nil {
+		return e, false
+	}
+	e.translation--
+	return e, true
+}
+
+// mediaID и mediaHash определяют страницу плеера озвучки
+func mediaID(translation int) string {
+	return fmt.Sprintf("%d", 1000+translation)
+}
+
+func mediaHash(translation int) string {
+	return fmt.Sprintf("%s%d", titleHash, translation)
+}
+
+func (s *Server) episodeCount(translation int) int {
+	s.mu.Lock()
+	released := s.released
+	s.mu.Unlock()
+
+	if n := s.config.Translations[translation].Episodes; n > 0 {
+		return n + released
+	}
+	return s.config.Episodes + released
+}
+
+func (s *Server) count(r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[r.URL.Path]++
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.count(r)
+
+	path := r.URL.Path
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && path == SecretPath:
+		s.serveSecretMethod(w, r)
+	case strings.HasPrefix(path, "/assets/js/"):
+		s.serveScript(w, r)
+	case parts[0] == "storage" && len(parts) == 3:
+		s.serveStorage(w, r, parts[1], parts[2])
+	case (parts[0] == "serial" || parts[0] == "movie") && len(parts) == 3:
+		s.serveMainPage(w, r)
+	case (parts[0] == "serial" || parts[0] == "video") && len(parts) == 4:
+		s.servePlayerPage(w, r, parts[1], parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveMainPage(w http.ResponseWriter, r *http.Request) {
+	kind := "serial"
+	if s.config.Movie {
+		kind = "video"
+	}
+
+	fmt.Fprintf(w, mainPageTemplate, s.config.Title, s.Host(), kind, mediaID(0), mediaHash(0))
+}
+
+func (s *Server) servePlayerPage(w http.ResponseWriter, r *http.Request, id, hash string) {
+	translation := -1
+	for i := range s.config.Translations {
+		if mediaID(i) == id && mediaHash(i) == hash {
+			translation = i
+		}
+	}
+	if translation == -1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	season := 1
+	if value := r.URL.Query().Get("season"); value != "" {
+		if _, err := fmt.Sscanf(value, "%d", &season); err != nil || season < 1 || season > s.config.Seasons {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	fmt.Fprint(w, s.playerPage(translation, season))
+}
+
+func (s *Server) serveScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	// Скрипт расшифровывает ссылки обратным сдвигом
+	fmt.Fprintf(w, scriptTemplate, base64.StdEncoding.EncodeToString([]byte(SecretPath)), (26-s.config.RotShift%26)%26)
+}
+
+func (s *Server) serveSecretMethod(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.secretRequests++
+	s.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.PostForm.Get("d_sign") != DomainSign || r.PostForm.Get("pd_sign") != PlayerDomainSign ||
+		r.PostForm.Get("ref_sign") != RefererSign {
+		http.Error(w, "bad sign", http.StatusForbidden)
+		return
+	}
+
+	wantType := "seria"
+	if s.config.Movie {
+		wantType = "video"
+	}
+	if r.PostForm.Get("type") != wantType {
+		http.Error(w, "bad type", http.StatusBadRequest)
+		return
+	}
+
+	e, ok := parseEpisodeID(r.PostForm.Get("id"))
+	if !ok || r.PostForm.Get("hash") != e.hash() {
+		http.Error(w, "unknown episode", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	fail := s.failLinks[e.num] > 0
+	if fail {
+		s.failLinks[e.num]--
+	}
+	s.mu.Unlock()
+
+	if fail {
+		s.fail(w)
+		return
+	}
+
+	var links []string
+	for _, quality := range s.config.Qualities {
+		link := s.link(e.id(), quality)
+		links = append(links, fmt.Sprintf(`"%d":[{"src":"%s","type":"application/x-mpegURL"}]`, quality, s.EncodeLink(link)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"advert_script":"","domain":"%s","default":%d,"ip":"127.0.0.1","links":{%s}}`,
+		s.Host(), s.config.Qualities[0], strings.Join(links, ","))
+}
+
+// serveStorage отдает плейлисты, фрагменты и mp4 файлы: /storage/<id>/<quality>.mp4[:hls:...]
+func (s *Server) serveStorage(w http.ResponseWriter, r *http.Request, id, name string) {
+	if _, ok := parseEpisodeID(id); !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var key int
+	if _, err := fmt.Sscanf(name, "key-%d.bin", &key); err == nil {
+		w.Write(s.Key(key))
+		return
+	}
+
+	var quality int
+	if _, err := fmt.Sscanf(name, "%d.mp4", &quality); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	suffix := strings.TrimPrefix(name, fmt.Sprintf("%d.mp4", quality))
+	if suffix == ":hls:manifest.m3u8" && s.expired(r) {
+		http.Error(w, "link has expired", http.StatusGone)
+		return
+	}
+
+	switch {
+	case suffix == "" && r.Method == http.MethodHead && s.config.HideVideoSize:
+		w.Header().Set("Content-Type", "video/mp4")
+		w.WriteHeader(http.StatusOK)
+
+	case suffix == "":
+		var start int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil && s.failRange(start) {
+			s.fail(w)
+			return
+		}
+		http.ServeContent(w, r, name, startTime, strings.NewReader(string(s.MP4Data(id, quality))))
+
+	case suffix == ":hls:manifest.m3u8" && len(s.config.Variants) > 0:
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		fmt.Fprint(w, s.masterPlaylist())
+
+	case suffix == ":hls:manifest.m3u8" || suffix == ":hls:index.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		fmt.Fprint(w, s.mediaPlaylist(quality))
+
+	case suffix == ":hls:segments.ts":
+		http.ServeContent(w, r, name, startTime, strings.NewReader(string(s.HLSData(id, quality))))
+
+	case suffix == ":hls:init.mp4" && s.config.FMP4:
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(s.InitData(id, quality))
+
+	case strings.HasPrefix(suffix, ":hls:seg-"):
+		var n int
+		if _, err := fmt.Sscanf(suffix, ":hls:seg-%d-v1-a1.ts", &n); err != nil || n < 1 || n > s.config.Segments {
+			http.NotFound(w, r)
+			return
+		}
+		if s.failSegment(n) {
+			s.fail(w)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write(s.encryptSegment(s.SegmentData(id, quality, n), n))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// expired сообщает, что ссылка на плейлист подписана прошлым поколением
+func (s *Server) expired(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return r.URL.Query().Get("t") != fmt.Sprint(s.generation)
+}
+
+func (s *Server) failSegment(n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failSegments[n] > 0 {
+		s.failSegments[n]--
+		return true
+	}
+	return false
+}
+
+// fail отвечает на запрос, который по конфигурации должен завершиться ошибкой
+func (s *Server) fail(w http.ResponseWriter) {
+	if s.config.RetryAfter != "" {
+		w.Header().Set("Retry-After", s.config.RetryAfter)
+	}
+	http.Error(w, "internal error", s.config.FailStatus)
+}
+
+func (s *Server) failRange(start int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failRanges[start] > 0 {
+		s.failRanges[start]--
+		return true
+	}
+	return false
+}
+
+// masterPlaylist перечисляет варианты Config.Variants с общей группой аудиодорожек
+func (s *Server) masterPlaylist() string {
+	var b strings.Builder
+
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	b.WriteString("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"Русский\",LANGUAGE=\"ru\",DEFAULT=YES,AUTOSELECT=YES\n")
+	for _, height := range s.config.Variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"aac\"\n",
+			height*3000, height*16/9, height)
+		fmt.Fprintf(&b, "./%d.mp4:hls:index.m3u8\n", height)
+	}
+
+	return b.String()
+}
+
+func (s *Server) mediaPlaylist(quality int) string {
+	var b strings.Builder
+
+	b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-ALLOW-CACHE:YES\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:1\n")
+	if s.config.FMP4 {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"./%d.mp4:hls:init.mp4\"\n", quality)
+	}
+	for n := 1; n <= s.config.Segments; n++ {
+		if s.config.ByteRanges {
+			// Смещение указано только у первого фрагмента, остальные идут следом
+			if n == 1 {
+				fmt.Fprintf(&b, "#EXTINF:6,\n#EXT-X-BYTERANGE:%d@0\n./%d.mp4:hls:segments.ts\n", s.config.SegmentSize, quality)
+			} else {
+				fmt.Fprintf(&b, "#EXTINF:6,\n#EXT-X-BYTERANGE:%d\n./%d.mp4:hls:segments.ts\n", s.config.SegmentSize, quality)
+			}
+			continue
+		}
+		if s.config.KeyRotation > 0 && (n-1)%s.config.KeyRotation == 0 {
+			b.WriteString(s.keyTag((n - 1) / s.config.KeyRotation))
+		}
+		fmt.Fprintf(&b, "#EXTINF:6.000,\n./%d.mp4:hls:seg-%d-v1-a1.ts\n", quality, n)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	return b.String()
+}
+
+func (s *Server) playerPage(translation, season int) string {
+	var b strings.Builder
+
+	t := s.config.Translations[translation]
+	params := fmt.Sprintf(`{"d":"%s","d_sign":"%s","pd":"%s","pd_sign":"%s","ref":"","ref_sign":"%s"}`,
+		s.Host(), DomainSign, s.Host(), PlayerDomainSign, RefererSign)
+
+	fmt.Fprintf(&b, playerPageHeader, params, mediaID(translation), mediaHash(translation), t.ID, t.Title)
+
+	if s.config.Movie {
+		e := episode{translation: translation, season: 1, num: 1}
+		fmt.Fprintf(&b, "<script>\n  videoInfo.id = '%s';\n  videoInfo.hash = '%s';\n</script>\n", e.id(), e.hash())
+	}
+
+	b.WriteString(`<script type="text/javascript" src="/assets/js/app.serial.0a1b2c.js"></script>` + "\n")
+
+	if s.config.Seasons > 1 {
+		b.WriteString("<div class=\"serial-seasons-box\"><select>\n")
+		for n := 1; n <= s.config.Seasons; n++ {
+			fmt.Fprintf(&b, "<option value=\"%d\"%s>%d сезон</option>\n", n, selected(n == season), n)
+		}
+		b.WriteString("</select></div>\n")
+	}
+
+	if !s.config.Movie {
+		b.WriteString("<div class=\"serial-series-box\"><select>\n")
+		for n := 1; n <= s.episodeCount(translation); n++ {
+			e := episode{translation: translation, season: season, num: n}
+			fmt.Fprintf(&b, "<option value=\"%d\" data-id=\"%s\" data-hash=\"%s\" data-title=\"%d серия\"%s>%d серия</option>\n",
+				n, e.id(), e.hash(), n, selected(n == 1), n)
+		}
+		b.WriteString("</select></div>\n")
+	}
+
+	box := "serial-translations-box"
+	if s.config.Movie {
+		box = "movie-translations-box"
+	}
+	fmt.Fprintf(&b, "<div class=\"%s\"><select>\n", box)
+	for i, other := range s.config.Translations {
+		fmt.Fprintf(&b, "<option value=\"%s\" data-media-id=\"%s\" data-media-hash=\"%s\" data-title=\"%s\" data-translation-type=\"%s\"%s>%s</option>\n",
+			other.ID, mediaID(i), mediaHash(i), other.Title, other.Type, selected(i == translation), other.Title)
+	}
+	b.WriteString("</select></div>\n</body></html>\n")
+
+	return b.String()
+}
+
+// Key возвращает ключ AES-128 с номером n
+func (s *Server) Key(n int) []byte {
+	return fill(fmt.Sprintf("key-%d;", n), aes.BlockSize)
+}
+
+func keyIV(n int) []byte {
+	return fill(fmt.Sprintf("iv-%d;", n), aes.BlockSize)
+}
+
+func (s *Server) keyTag(n int) string {
+	if n%2 == 0 {
+		return fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"key-%d.bin\",IV=0x%s\n", s.config.KeyMethod, n, hex.EncodeToString(keyIV(n)))
+	}
+	return fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"key-%d.bin\"\n", s.config.KeyMethod, n)
+}
+
+// encryptSegment шифрует n-й фрагмент (n с 1, он же номер сегмента) AES-128-CBC с дополнением PKCS#7
+func (s *Server) encryptSegment(data []byte, n int) []byte {
+	if s.config.KeyRotation == 0 {
+		return data
+	}
+
+	key := (n - 1) / s.config.KeyRotation
+
+	iv := keyIV(key)
+	if key%2 == 1 {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(n))
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	plain := append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, _ := aes.NewCipher(s.Key(key))
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+
+	return encrypted
+}
+
+func selected(ok bool) string {
+	if ok {
+		return " selected"
+	}
+	return ""
+}
+
+// fill повторяет prefix до размера size
+func fill(prefix string, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = prefix[i%len(prefix)]
+	}
+	return data
+}
+
+// rot сдвигает латинские буквы вперед на shift позиций
+func rot(s string, shift int) string {
+	shift %= 26
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return 'A' + (r-'A'+rune(shift))%26
+		case r >= 'a' && r <= 'z':
+			return 'a' + (r-'a'+rune(shift))%26
+		}
+		return r
+	}, s)
+}
+
+// LinkPath возвращает путь из ссылки, например для сравнения с запросами к хранилищу
+func LinkPath(link string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return parsed.Path
+}
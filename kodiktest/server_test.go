@@ -0,0 +1,143 @@
+package kodiktest_test
+
+import (
+	"io"
+	"kodik_parser/kodiktest"
+	"kodik_parser/utils"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, server *kodiktest.Server, url string) string {
+	t.Helper()
+
+	resp, err := server.Client().Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return string(body)
+}
+
+func TestEncodeLinkDecodes(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{})
+	defer server.Close()
+
+	link := "//" + server.Host() + "/storage/11001/720.mp4:hls:manifest.m3u8"
+
+	decoded, err := utils.AutoDecode(server.EncodeLink(link))
+	if err != nil {
+		t.Fatalf("AutoDecode: %v", err)
+	}
+	if decoded != link {
+		t.Errorf("decoded %q, want %q", decoded, link)
+	}
+}
+
+func TestPagesParse(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{
+		Seasons:  2,
+		Episodes: 5,
+		Translations: []kodiktest.Translation{
+			{ID: "610", Title: "AniLibria.TV", Type: "voice"},
+			{ID: "1291", Title: "Crunchyroll", Type: "subtitles", Episodes: 2},
+		},
+	})
+	defer server.Close()
+
+	mainPage := get(t, server, server.TitleURL())
+
+	iframe, err := utils.ParseIframeURL(mainPage)
+	if err != nil {
+		t.Fatalf("ParseIframeURL: %v", err)
+	}
+
+	playerPage := get(t, server, iframe)
+
+	var params utils.KodikParams
+	if err := utils.ParseURLParameters(playerPage, &params); err != nil {
+		t.Fatalf("ParseURLParameters: %v", err)
+	}
+	if params.PlayerDomain.Domain != server.Host() || params.PlayerDomain.DomainSign != kodiktest.PlayerDomainSign {
+		t.Errorf("player domain = %+v", params.PlayerDomain)
+	}
+
+	series, err := utils.ParseSeasonSeries(playerPage)
+	if err != nil || len(series) != 5 {
+		t.Fatalf("ParseSeasonSeries = %d series, %v", len(series), err)
+	}
+	if series[0].Id != server.EpisodeID(0, 1, 1) {
+		t.Errorf("first episode id = %s, want %s", series[0].Id, server.EpisodeID(0, 1, 1))
+	}
+
+	seasons, err := utils.ParseSeasons(playerPage)
+	if err != nil || len(seasons) != 2 {
+		t.Fatalf("ParseSeasons = %d seasons, %v", len(seasons), err)
+	}
+
+	translations, err := utils.ParseTranslations(playerPage)
+	if err != nil || len(translations) != 2 {
+		t.Fatalf("ParseTranslations = %d translations, %v", len(translations), err)
+	}
+	if !translations[0].Selected || translations[1].Type != "subtitles" {
+		t.Errorf("translations = %+v", translations)
+	}
+
+	scriptURL, err := utils.GetSerialScriptURL(playerPage, server.Host())
+	if err != nil {
+		t.Fatalf("GetSerialScriptURL: %v", err)
+	}
+
+	script := get(t, server, scriptURL)
+
+	secret, err := utils.GetSecretMethod(script)
+	if err != nil {
+		t.Fatalf("GetSecretMethod: %v", err)
+	}
+	if secret, err = utils.AutoDecode(secret); err != nil || secret != kodiktest.SecretPath {
+		t.Errorf("secret method = %q, %v", secret, err)
+	}
+
+	if offset, err := utils.GetRot13Offset(script); err != nil || offset != 13 {
+		t.Errorf("GetRot13Offset = %d, %v", offset, err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Segments: 3, SegmentSize: 100})
+	defer server.Close()
+
+	id := server.EpisodeID(0, 1, 2)
+	playlist := get(t, server, server.VideoURL(0, 1, 2, 720))
+	if want := "./720.mp4:hls:seg-3-v1-a1.ts"; !strings.Contains(playlist, want) {
+		t.Errorf("playlist has no %q:\n%s", want, playlist)
+	}
+
+	segment := get(t, server, "https://"+server.Host()+"/storage/"+id+"/720.mp4:hls:seg-2-v1-a1.ts")
+	if segment != string(server.SegmentData(id, 720, 2)) {
+		t.Errorf("segment 2 content mismatch")
+	}
+
+	req, _ := http.NewRequest("GET", "https://"+server.Host()+"/storage/"+id+"/720.mp4", nil)
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("range request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != string(server.MP4Data(id, 720)[10:20]) {
+		t.Errorf("range request: status %d, body %q", resp.StatusCode, body)
+	}
+}
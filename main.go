@@ -1,361 +1,311 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"kodik_parser/kodik"
 	"kodik_parser/utils"
 	"kodik_parser/video_utils"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/schollz/progressbar/v3"
 )
 
-var (
-	debug bool = false
-)
-
-func handleSerial(url string, urlType int) utils.HandleResult {
-	var (
-		requestParams utils.KodikRequestParams
-		responseBody  string
-		err           error
-		bar           *progressbar.ProgressBar
-		handleResult  utils.HandleResult
-	)
-
-	fmt.Println("Парсинг сериала...")
-
-	log.Println(" Parsing main page")
-
-	bar = progressbar.Default(5)
-
-	client := &http.Client{
-		Timeout: 0,
-		Transport: &http.Transport{
-			TLSHandshakeTimeout: 60 * time.Second,
-		},
-	}
-	defer client.CloseIdleConnections()
-
-	// Инициализация параметров
-	params := utils.KodikParams{}
+// cliProgress показывает ход получения ссылок в терминале
+type cliProgress struct {
+	bar *progressbar.ProgressBar
+}
 
-	// Получаем домен
-	domain, err := utils.ParseDomainFromURL(url)
-	if err != nil {
-		log.Fatalf("Error parsing domain from URL: %v", err)
+func (p *cliProgress) onStage(stage kodik.Stage) {
+	switch stage {
+	case kodik.StageMainPage:
+		fmt.Println("Парсинг сериала...")
+	case kodik.StageSerialScript:
+		fmt.Println("Обход защиты...")
 	}
-	params.MainDomain.Domain = domain
-
-	// Получаем страницу
-	requestParams = utils.GetKodikRequestParams(
-		url, "", "", "", "", utils.KodikPage.MAIN_PAGE, utils.KodikSeriaInfo{})
+}
 
-	responseBody, err = utils.GetPage(client, &params, requestParams)
-	if err != nil {
-		log.Fatalf("Error getting page: %v", err)
+// selectEpisodes оборачивает выбор серий, чтобы после него показать прогресс получения ссылок
+func (p *cliProgress) selectEpisodes(spec string) func(*kodik.Title) ([]utils.KodikSeriaInfo, error) {
+	return func(title *kodik.Title) ([]utils.KodikSeriaInfo, error) {
+		selected, err := selectEpisodes(title, spec)
+		if err == nil {
+			p.bar = progressbar.Default(int64(len(selected)), "Получение ссылок...")
+		}
+		return selected, err
 	}
+}
 
-	bar.Add(1)
-
-	// Извлекаем URL iframe
-	playerPageURL, err := utils.ParseIframeURL(responseBody)
-	if err != nil {
-		log.Fatalf("Error parsing iframe URL: %v", err)
+func (p *cliProgress) onResult(utils.Result) {
+	if p.bar != nil {
+		p.bar.Add(1)
 	}
+}
 
-	titleName, err := utils.ParseTitle(responseBody)
-	if err != nil {
-		log.Fatalf("Error parsing title: %v", err)
+func (p *cliProgress) finish() {
+	if p.bar != nil {
+		p.bar.Finish()
 	}
-	handleResult.TitleName = titleName
-
-	bar.Add(1)
-
-	log.Println(" Parsing player page")
+}
 
-	// Получаем страницу плеера
-	requestParams = utils.GetKodikRequestParams(
-		playerPageURL, params.MainDomain.Domain, "", "", "", utils.KodikPage.PLAYER_PAGE, utils.KodikSeriaInfo{})
+// downloadResults загружает полученные видео выбранным загрузчиком и показывает ход загрузки.
+// Статус и ошибка каждой серии записываются в её Result, размер и время — в config.Progress
+func downloadResults(ctx context.Context, result utils.HandleResult, config *utils.Config) (utils.HandleResult, error) {
+	fmt.Println("Загрузка видео...")
+	log.Println(" Video download is starting")
 
-	responseBody, err = utils.GetPage(client, &params, requestParams)
+	config.Progress = utils.NewDownloadProgress()
+	view := startDownloadView(config.Progress, len(result.Succeeded()))
+	result, err := video_utils.Download(ctx, result, config, video_utils.Options{Log: log.Printf})
+	view.Stop()
 	if err != nil {
-		log.Fatalf("Error getting player page: %v", err)
+		return result, err
 	}
 
-	bar.Add(1)
+	log.Println(" Video download is complete")
 
-	log.Println(" Using stealing method 1")
+	return result, nil
+}
 
-	// Парсим параметры из страницы плеера
-	err = utils.ParseURLParameters(responseBody, &params)
-	if err != nil {
-		log.Fatalf("Error parsing URL parameters: %v", err)
+// printReport выводит в stderr итог обработки: какие серии обработаны успешно, какие нет и почему.
+// Если серии загружались, итог выводится таблицей с размером, временем и скоростью загрузки
+func printReport(result utils.HandleResult, progress *utils.DownloadProgress, interrupted bool) {
+	if interrupted {
+		fmt.Fprintln(os.Stderr, "\nРабота прервана.")
 	}
 
-	bar.Add(1)
-
-	var series []utils.KodikSeriaInfo
-	if urlType == utils.KodikLinkTypes.Serial {
-		// Извлекаем серии сезона
-		series, err = utils.ParseSeasonSeries(responseBody)
-		if err != nil {
-			log.Fatalf("Error parsing series: %v", err)
-		}
-	} else {
-		series, err = utils.ParseVideoInfo(responseBody)
-		if err != nil {
-			log.Fatalf("Error parsing video: %v", err)
-		}
+	if progress != nil {
+		printDownloadSummary(os.Stderr, result, progress.Snapshot(), time.Now())
+		return
 	}
 
-	bar.Add(1)
-	bar.Finish()
-
-	// Получаем диапазон серий
-	var epRange [2]int
-	for {
-		epRange, err = getEpisodeRange(len(series))
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			break
-		}
+	var succeeded []string
+	for _, res := range result.Succeeded() {
+		succeeded = append(succeeded, res.Seria.Label())
 	}
 
-	fmt.Println("Обход защиты...")
-
-	log.Println(" Serial script manipulations...")
-
-	bar = progressbar.Default(3)
-
-	// Получаем URL для скрипта сериала
-	appSerialScriptURL, err := utils.GetSerialScriptURL(responseBody, params.PlayerDomain.Domain)
-	if err != nil {
-		log.Fatalf("Error getting serial script URL: %v", err)
+	if len(succeeded) > 0 {
+		fmt.Fprintf(os.Stderr, "Успешно: %s\n", strings.Join(succeeded, ", "))
 	}
 
-	bar.Add(1)
-
-	// Получаем скрипт сериала
-	requestParams = utils.GetKodikRequestParams(
-		appSerialScriptURL, playerPageURL, "", "", "", utils.KodikPage.APP_SERIAL_SCRIPT, utils.KodikSeriaInfo{})
-
-	responseBody, err = utils.GetPage(client, &params, requestParams)
-	if err != nil {
-		log.Fatalf("Error getting app serial script: %v", err)
+	failed := result.Failed()
+	if len(failed) == 0 {
+		return
 	}
 
-	bar.Add(1)
+	fmt.Fprintln(os.Stderr, "С ошибками:")
+	for _, res := range failed {
+		switch res.Status {
+		case utils.StatusResolveFailed:
+			fmt.Fprintf(os.Stderr, "  Серия %s: ссылка не получена (попыток: %d): %v\n", res.Seria.Label(), res.Attempts, res.Err)
+		case utils.StatusDownloadFailed:
+			fmt.Fprintf(os.Stderr, "  Серия %s: не загружена: %v\n", res.Seria.Label(), res.Err)
+		default:
+			fmt.Fprintf(os.Stderr, "  Серия %s: %v\n", res.Seria.Label(), res.Err)
+		}
+	}
+}
 
-	// Извлекаем зашифрованный секретный метод
-	secretMethod, err := utils.GetSecretMethod(responseBody)
-	if err != nil {
-		log.Fatalf("Error extracting secret method: %v", err)
+// resultError возвращает ошибку с кодом завершения этапа, на котором не удалось обработать серии
+func resultError(result utils.HandleResult) error {
+	var resultErr *utils.ResultError
+	if err := result.Err(); !errors.As(err, &resultErr) {
+		return nil
 	}
 
-	secretMethod, err = utils.AutoDecode(secretMethod)
-	if err != nil {
-		log.Fatalf("Error decoding secret method: %v", err)
+	if len(resultErr.DownloadFailed) > 0 {
+		return fail(exitDownload, resultErr)
 	}
+	return fail(exitResolve, resultErr)
+}
 
-	log.Printf(" Decoded secret method: %s", secretMethod)
+// selectTranslation выбирает озвучку по флагу или конфигу, а при их отсутствии
+// показывает меню с количеством серий в каждой озвучке, если stdin является терминалом
+func selectTranslation(ctx context.Context, client *kodik.Client, query string) func(*kodik.Title) (utils.KodikTranslation, error) {
+	return func(title *kodik.Title) (utils.KodikTranslation, error) {
+		if query != "" {
+			return kodik.FindTranslation(title.Translations, query)
+		}
 
-	bar.Add(1)
+		if !utils.IsInteractive() {
+			return title.Translation, nil
+		}
 
-	fmt.Println("Получение ссылок...")
-	log.Println(" Obtaining secret data")
+		translations, err := client.Translations(ctx, title)
+		if err != nil {
+			return utils.KodikTranslation{}, err
+		}
 
-	bar.Finish()
+		printTranslations(os.Stdout, translations)
 
-	bar = progressbar.Default(-1 * int64(epRange[0]-epRange[1]-1))
+		for {
+			var input string
 
-	// Отправляем POST запросы на секретный метод горутин
-	var wg sync.WaitGroup
-	results := make(chan utils.Result, 10)
-	for i := epRange[0] - 1; i < epRange[1]; i++ {
-		wg.Add(1)
-		go getVideoUrlWorker(
-			&params,
-			series[i],
-			client, playerPageURL,
-			secretMethod, results,
-			&wg,
-			bar,
-			urlType,
-		)
-	}
+			fmt.Printf("Выберите озвучку (1-%d, Enter - текущая): ", len(translations))
+			fmt.Scanln(&input)
 
-	bar.Finish()
+			if input == "" {
+				return title.Translation, nil
+			}
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+			num, err := strconv.Atoi(input)
+			if err != nil || num < 1 || num > len(translations) {
+				fmt.Println("Неверный номер озвучки")
+				continue
+			}
 
-	for Result := range results {
-		handleResult.Results = append(handleResult.Results, Result)
+			return translations[num-1], nil
+		}
 	}
+}
 
-	// Сортируем результаты
-	handleResult.Results = utils.SortResults(handleResult.Results)
+// printTranslations выводит таблицу озвучек. Текущая озвучка отмечена звездочкой
+func printTranslations(w io.Writer, translations []utils.KodikTranslation) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  №\tID\tОзвучка\tТип\tСерий")
 
-	return handleResult
-}
+	for i, translation := range translations {
+		mark := " "
+		if translation.Selected {
+			mark = "*"
+		}
 
-func getVideoUrlWorker(
-	params *utils.KodikParams,
-	seria utils.KodikSeriaInfo,
-	client *http.Client,
-	playerPageURL string,
-	secretMethod string,
-	results chan<- utils.Result,
-	wg *sync.WaitGroup,
-	bar *progressbar.ProgressBar,
-	urlType int) {
-
-	defer wg.Done()
-	defer bar.Add(1)
-
-	var (
-		requestParams utils.KodikRequestParams
-		responseBody  string
-		err           error
-		video         string
-	)
-
-	requestParams = utils.GetKodikRequestParams(
-		params.PlayerDomain.Domain+secretMethod,
-		playerPageURL,
-		params.PlayerDomain.Domain,
-		"application/x-www-form-urlencoded; charset=UTF-8",
-		"",
-		utils.KodikPage.SECRET_METHOD,
-		seria,
-	)
-
-	responseBody, err = utils.PostPage(client, params, requestParams, urlType)
-	if err != nil {
-		log.Fatalf("Error getting secret method: %v", err)
-	}
+		episodes := "?"
+		if translation.EpisodeCount > 0 {
+			episodes = strconv.Itoa(translation.EpisodeCount)
+		}
 
-	video, err = utils.GetBestQualityURL(responseBody)
-	if err != nil {
-		log.Fatalf("Error getting best quality URL: %v", err)
+		fmt.Fprintf(tw, "%s %d\t%s\t%s\t%s\t%s\n", mark, i+1, translation.ID, translation.Title, translation.Type, episodes)
 	}
 
-	results <- utils.Result{Seria: seria, Video: video}
+	tw.Flush()
 }
 
-func handle(url string, config *utils.Config) {
-	log.Println("=================LETS FUCK KODIK=================")
+// printCandidates выводит варианты расшифровки; вариант, который выберет AutoDecode, отмечен *
+func printCandidates(w io.Writer, candidates []utils.Candidate) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  Оценка\tДекодер\tРезультат")
 
-	var (
-		result utils.HandleResult
-	)
-
-	urlType := utils.GetLinkType(url)
-
-	switch urlType {
-	case utils.KodikLinkTypes.Serial, utils.KodikLinkTypes.Movie:
-		result = handleSerial(url, urlType)
-	}
-
-	if config.DownloadResults {
-		fmt.Println("Загрузка видео...")
-		log.Println(" Video download is starting")
-
-		if config.DownloaderVersion == 1 {
-			result = video_utils.DownloadVideos(result, config)
-		} else if config.DownloaderVersion == 2 {
-			result = video_utils.DownloadVideosHLS(result, config)
+	for i, candidate := range candidates {
+		mark := " "
+		if i == 0 && candidate.Score > 1 {
+			mark = "*"
 		}
 
-		log.Println(" Video download is complete")
-	}
+		// Непечатаемые символы выводятся экранированными, чтобы не портить терминал
+		decoded := candidate.Decoded
+		if !utf8.ValidString(decoded) || strings.IndexFunc(decoded, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+			decoded = strconv.Quote(decoded)
+		}
 
-	if config.OpenInMpvNet {
-		log.Println(" Opening in MPV")
-		utils.OpenInMpvNet(result, config)
-	} else {
-		log.Println(" Printing results")
-		utils.PrintResults(result)
+		fmt.Fprintf(tw, "%s %d\t%s\t%s\n", mark, candidate.Score, candidate.Decoder, decoded)
 	}
 
-	log.Println("============KODIK SUCCESSFULLY FUCKED============")
+	tw.Flush()
 }
 
-func getEpisodeRange(epCount int) ([2]int, error) {
-	if epCount == 1 || debug {
-		return [2]int{1, 1}, nil
+// selectEpisodes выбирает серии по флагу, а при его отсутствии спрашивает пользователя,
+// если stdin является терминалом
+func selectEpisodes(title *kodik.Title, spec string) ([]utils.KodikSeriaInfo, error) {
+	if len(title.Series) == 1 {
+		return title.Series, nil
 	}
 
-	var input string
-	var result [2]int
-
-	fmt.Printf("Введите диапазон серий (от 1 до %d) через дефис: ", epCount)
-	fmt.Scanln(&input)
-
-	parts := strings.Split(input, "-")
-	if len(parts) == 2 {
-		start, _ := strconv.Atoi(parts[0])
-		end, _ := strconv.Atoi(parts[1])
-		result = [2]int{start, end}
-	} else {
-		fmt.Println("Invalid input")
-	}
-
-	if result[0] > result[1] {
-		result[0], result[1] = result[1], result[0]
+	if spec != "" {
+		return utils.SelectSeries(title.Series, spec, title.Season)
 	}
 
-	if result[0] < 1 || result[1] < 1 || result[1] > epCount {
-		return [2]int{}, errors.New("неверный диапазон")
+	if !utils.IsInteractive() {
+		return nil, errors.New("не указан диапазон серий (флаг -episodes)")
 	}
 
-	return result, nil
-}
+	for {
+		var input string
 
-func main() {
-	var (
-		url string
-	)
+		first, last := title.Series[0].Num, title.Series[len(title.Series)-1].Num
+		if len(title.Seasons) > 1 {
+			fmt.Printf("Введите серии сезона %d (например 1-3,5,!4, last:3, S1E1-S2E5 или all seasons): ", title.Season)
+		} else {
+			fmt.Printf("Введите серии от %s до %s (например 1-3,5,9-, last:3, 1-12,!7 или all): ", first, last)
+		}
+		fmt.Scanln(&input)
 
-	if debug {
-		url = "INSERT YOUR PRIVATE KODIK URL HERE"
+		series, err := utils.SelectSeries(title.Series, input, title.Season)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return series, nil
 	}
+}
 
-	err := utils.InitLogger()
-	if err != nil {
-		fmt.Println(err)
-	}
+// reloadBandwidthOnSignal по SIGHUP перечитывает конфиг и применяет новые лимиты скорости
+// к идущим загрузкам. Флаги -limit и -episode-limit по-прежнему перекрывают конфиг.
+// В Windows SIGHUP не приходит: там лимиты работающего serve меняются через PUT /api/limits
+func reloadBandwidthOnSignal(ctx context.Context, opts *cliOptions) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
 
-	config, err := utils.GetConfigFile("config.json")
-	if err != nil {
-		log.Fatalf("Error getting config file: %v", err)
+	go func() {
+		for {
+			select {
+			case <-signals:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			config, err := loadConfig(opts)
+			if err != nil {
+				log.Printf("Failed to reload bandwidth limits: %v", err)
+				continue
+			}
+			video_utils.SetBandwidthLimit(config.MaxBandwidth, config.EpisodeBandwidth)
+			log.Printf("Bandwidth limits reloaded: total %s, per episode %s", config.MaxBandwidth, config.EpisodeBandwidth)
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
 	}
+}
 
-	for {
-		if !debug {
-			fmt.Print("Введите URL: ")
-			fmt.Scanln(&url)
-		}
+func main() {
+	// Первый SIGINT/SIGTERM отменяет контекст: новые запросы и загрузки не начинаются,
+	// а незавершенные загрузки сохраняют прогресс, чтобы следующий запуск их продолжил.
+	// Повторный сигнал завершает процесс сразу
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	finished := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		stop()
 
-		if !utils.ValidateURL(url) {
-			fmt.Println("Некорретный URL!")
-			log.Println("Invalid url input")
-			continue
-		} else {
-			break
+		select {
+		case <-finished:
+			return
+		default:
 		}
-	}
 
-	url = utils.NormalizeURL(url)
+		fmt.Fprintln(os.Stderr, "\nПрерывание... Нажмите Ctrl+C ещё раз для немедленного выхода")
+		log.Println("Interrupt signal received")
+	}()
 
-	handle(url, &config)
+	code := run(ctx, os.Args[1:])
+	close(finished)
+	stop()
+	os.Exit(code)
 }
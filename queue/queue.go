@@ -0,0 +1,298 @@
+// Package queue хранит загрузки серий на диске и выполняет их пулом исполнителей.
+//
+// Каждое задание — одна серия: тайтл, озвучка, серия, политика качества, состояние,
+// число попыток и последняя ошибка. Задания переживают перезапуск: исполнитель при старте
+// подбирает ждущие задания и задания, выполнение которых прервалось вместе с процессом.
+// Задание блокируется на время выполнения, поэтому несколько процессов могут работать
+// с одним каталогом очереди, не записывая одну и ту же серию.
+package queue
+
+import (
+	"context"
+	"errors"
+	"kodik_parser/kodik"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+	"sync"
+	"time"
+)
+
+// pollInterval — как часто исполнитель без заданий перечитывает каталог очереди,
+// чтобы увидеть задания, добавленные другими процессами, и наступившие повторы
+const pollInterval = 5 * time.Second
+
+// maxRetryDelay ограничивает паузу перед повтором задания
+const maxRetryDelay = 6 * time.Hour
+
+// Options настраивает выполнение очереди
+type Options struct {
+	// Drain завершает Run, когда в очереди не остается ждущих заданий, в том числе отложенных повторов
+	Drain bool
+
+	// OnFinish вызывается после каждой попытки выполнить задание с его новым состоянием
+	OnFinish func(job Job)
+}
+
+// Queue выполняет задания из Store
+type Queue struct {
+	store  *Store
+	config utils.Config
+	client *kodik.Client
+	poll   time.Duration
+
+	// Log получает журнал заданий, получения ссылок и загрузок; nil — журнал не ведется
+	Log utils.Logf
+
+	// downloadOpts в тестах направляет загрузку на поддельный сервер
+	downloadOpts video_utils.Options
+
+	mu      sync.Mutex
+	running map[string]int       // выполняемых заданий по тайтлам
+	served  map[string]time.Time // когда тайтл последний раз получил исполнителя
+}
+
+// New создает очередь в каталоге config.Queue.Directory.
+// Если doer равен nil, запросы к Kodik выполняются через kodik.NewHTTPClient()
+func New(config utils.Config, doer utils.HTTPDoer) (*Queue, error) {
+	store, err := OpenStore(config.Queue.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Queue{
+		store:   store,
+		config:  config,
+		client:  kodik.NewClient(doer),
+		poll:    pollInterval,
+		running: make(map[string]int),
+		served:  make(map[string]time.Time),
+	}, nil
+}
+
+// Store возвращает хранилище заданий очереди
+func (q *Queue) Store() *Store {
+	return q.store
+}
+
+// Run выполняет задания config.Queue.Workers исполнителями до отмены ctx.
+// Прерванные отменой задания возвращаются в очередь без траты попытки, а незавершенные
+// загрузки сохраняют прогресс, чтобы следующий запуск их продолжил
+func (q *Queue) Run(ctx context.Context, opts Options) error {
+	var wg sync.WaitGroup
+	for range max(1, q.config.Queue.Workers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, opts)
+		}()
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func (q *Queue) work(ctx context.Context, opts Options) {
+	for ctx.Err() == nil {
+		job, unlock, pending, err := q.claim()
+		if err != nil {
+			q.Log.Printf("Queue: %v", err)
+		}
+
+		if job == nil {
+			if opts.Drain && !pending && err == nil {
+				return
+			}
+
+			select {
+			case <-time.After(q.poll):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		q.run(ctx, job)
+		unlock()
+
+		if opts.OnFinish != nil {
+			opts.OnFinish(*job)
+		}
+	}
+}
+
+// claim выбирает и блокирует следующее задание. Задания упорядочены по приоритету,
+// а среди равных выбирается тайтл, у которого сейчас меньше всего выполняемых заданий
+// и который дольше не получал исполнителя, так что один длинный сериал не занимает
+// все исполнители. pending сообщает, остались ли ждущие задания, которые пока нельзя начать
+func (q *Queue) claim() (job *Job, unlock func(), pending bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs, err := q.store.Jobs()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	now := time.Now()
+	var candidates []Job
+	for _, job := range jobs {
+		switch job.State {
+		case StateQueued:
+			pending = true
+			if job.NotBefore.After(now) {
+				continue
+			}
+		case StateRunning:
+			// Задание прервалось вместе с процессом, если его блокировку удастся захватить.
+			// Такая попытка засчитывается, иначе задание, роняющее процесс, повторялось бы бесконечно
+		default:
+			continue
+		}
+		candidates = append(candidates, job)
+	}
+
+	for len(candidates) > 0 {
+		i := q.fairest(candidates)
+		candidate := candidates[i]
+		candidates = append(candidates[:i], candidates[i+1:]...)
+
+		unlock, err := q.store.lock(candidate.ID)
+		if errors.Is(err, errLocked) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, pending, err
+		}
+
+		// Пока каталог читался, задание мог выполнить или отменить другой процесс
+		current, err := q.store.Job(candidate.ID)
+		if err != nil || (current.State != StateQueued && current.State != StateRunning) {
+			unlock()
+			continue
+		}
+
+		q.running[current.URL]++
+		q.served[current.URL] = now
+
+		return &current, func() {
+			q.mu.Lock()
+			q.running[current.URL]--
+			q.mu.Unlock()
+			unlock()
+		}, pending, nil
+	}
+
+	return nil, nil, pending, nil
+}
+
+// fairest возвращает индекс следующего задания среди кандидатов, упорядоченных compareJobs
+func (q *Queue) fairest(candidates []Job) int {
+	best := 0
+	for i, job := range candidates[1:] {
+		i++
+		top := candidates[best]
+		if job.Priority != top.Priority {
+			// Кандидаты упорядочены по приоритету, дальше только менее важные
+			break
+		}
+
+		switch {
+		case q.running[job.URL] != q.running[top.URL]:
+			if q.running[job.URL] < q.running[top.URL] {
+				best = i
+			}
+		case q.served[job.URL].Before(q.served[top.URL]):
+			best = i
+		}
+	}
+	return best
+}
+
+// run выполняет задание под его блокировкой: заново получает ссылку на серию и загружает её
+func (q *Queue) run(ctx context.Context, job *Job) {
+	queued := *job
+	job.State = StateRunning
+	job.Attempts++
+	if err := q.store.save(job); err != nil {
+		// Попытка не началась: задание остается таким же, как на диске
+		*job = queued
+		q.Log.Printf("Queue: %v", err)
+		return
+	}
+
+	q.Log.Printf("Queue: %s started (attempt %d)", job.Label(), job.Attempts)
+
+	path, err := q.download(ctx, job)
+
+	switch {
+	case err == nil:
+		job.State = StateDone
+		job.Path = path
+		job.LastError = ""
+	case ctx.Err() != nil:
+		// Прерывание не считается неудачной попыткой
+		job.State = StateQueued
+		job.Attempts--
+	case errors.Is(err, video_utils.ErrEpisodeLocked):
+		// Файл серии записывает другое задание, например другая озвучка с тем же путем.
+		// Это тоже не неудачная попытка: задание повторяется, когда файл освободится
+		job.State = StateQueued
+		job.Attempts--
+		job.NotBefore = time.Now().Add(q.poll)
+	case job.Attempts >= max(1, q.config.Queue.Attempts):
+		job.State = StateFailed
+		job.LastError = err.Error()
+	default:
+		job.State = StateQueued
+		job.LastError = err.Error()
+		job.NotBefore = time.Now().Add(q.retryDelay(job.Attempts))
+	}
+
+	q.Log.Printf("Queue: %s is %s: %v", job.Label(), job.State, err)
+
+	if err := q.store.save(job); err != nil {
+		q.Log.Printf("Queue: %v", err)
+	}
+}
+
+// retryDelay возвращает паузу перед повтором после attempts неудачных попыток
+func (q *Queue) retryDelay(attempts int) time.Duration {
+	delay := time.Duration(q.config.Queue.RetryDelay * float64(time.Second))
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+func (q *Queue) download(ctx context.Context, job *Job) (string, error) {
+	opts := kodik.Options{
+		Quality: job.Quality,
+		Retries: q.config.ResolveRetries,
+		Retry:   q.config.Retry.Resolve,
+	}
+
+	client := q.client.WithLog(q.Log)
+	res, err := client.ResolveEpisode(ctx, job.URL, job.Episode, opts)
+	if err != nil {
+		return "", err
+	}
+
+	config := q.config
+	config.ReResolve = func(ctx context.Context, res utils.Result) (utils.Result, error) {
+		return client.ResolveEpisode(ctx, job.URL, res.Seria, opts)
+	}
+
+	result := utils.HandleResult{
+		Results:     []utils.Result{res},
+		TitleName:   job.Title,
+		Translation: job.Translation,
+	}
+	downloadOpts := q.downloadOpts
+	downloadOpts.Log = q.Log
+	result, err = video_utils.Download(ctx, result, &config, downloadOpts)
+	if err != nil {
+		return "", err
+	}
+
+	res = result.Results[0]
+	return res.Path, res.Err
+}
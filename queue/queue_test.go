@@ -0,0 +1,424 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"kodik_parser/kodik"
+	"kodik_parser/kodiktest"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+)
+
+func testConfig(t *testing.T) utils.Config {
+	config := utils.NewDefaultConfig()
+	config.OutputDirectory = t.TempDir()
+	config.Queue.Directory = t.TempDir()
+	config.Queue.RetryDelay = 0.01
+	config.Retry.Download.Attempts = 1
+	return config
+}
+
+func newTestQueue(t *testing.T, server *kodiktest.Server, config utils.Config) *Queue {
+	t.Helper()
+
+	q, err := New(config, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.poll = 10 * time.Millisecond
+	q.downloadOpts = video_utils.Options{Transport: server.Client().Transport}
+	return q
+}
+
+// enqueue ставит в очередь все серии поддельного тайтла
+func enqueue(t *testing.T, q *Queue, server *kodiktest.Server, priority int) []Job {
+	t.Helper()
+
+	title, err := kodik.NewClient(server.Client()).Fetch(context.Background(), server.TitleURL())
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+
+	for _, seria := range title.Series {
+		job := Job{URL: server.TitleURL(), Title: title.Name, Translation: title.Translation, Episode: seria, Priority: priority}
+		if ok, err := q.Store().Add(job); !ok || err != nil {
+			t.Fatalf("Add(%s) = %v, %v", seria.Label(), ok, err)
+		}
+	}
+
+	jobs, err := q.Store().Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func drain(t *testing.T, q *Queue) []Job {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := q.Run(ctx, Options{Drain: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	jobs, err := q.Store().Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestStoreAdd(t *testing.T) {
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := func(num string, priority int) Job {
+		return Job{URL: "https://kodik.online/serial/1/abc", Title: "Title", Episode: utils.KodikSeriaInfo{Num: num, Id: "id" + num}, Priority: priority}
+	}
+
+	for _, j := range []Job{job("10", 0), job("2", 0), job("1", 5)} {
+		if ok, err := store.Add(j); !ok || err != nil {
+			t.Fatalf("Add(%s) = %v, %v", j.Episode.Num, ok, err)
+		}
+	}
+
+	// Серия, которая уже ждет, не добавляется повторно
+	if ok, err := store.Add(job("2", 3)); ok || err != nil {
+		t.Errorf("Add(duplicate) = %v, %v; want false", ok, err)
+	}
+
+	jobs, err := store.Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, j := range jobs {
+		order = append(order, j.Episode.Num)
+		if j.State != StateQueued || j.Created.IsZero() {
+			t.Errorf("episode %s: State = %q, Created = %v", j.Episode.Num, j.State, j.Created)
+		}
+	}
+	if want := []string{"1", "2", "10"}; !slices.Equal(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+
+	// Неудачное задание ставится заново с обнуленными попытками
+	failed := jobs[1]
+	failed.State, failed.Attempts, failed.LastError = StateFailed, 5, "unexpected status code: 500"
+	if err := store.save(&failed); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := store.Add(job("2", 0)); !ok || err != nil {
+		t.Fatalf("Add(failed) = %v, %v; want true", ok, err)
+	}
+	if j, _ := store.Job(failed.ID); j.State != StateQueued || j.Attempts != 0 || j.LastError != "" || !j.Created.Equal(failed.Created) {
+		t.Errorf("requeued job = %+v", j)
+	}
+
+	if err := store.Cancel(failed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cancel(failed.ID); err == nil {
+		t.Error("cancelled job cancelled again")
+	}
+	if err := store.Cancel("unknown"); err == nil {
+		t.Error("unknown job cancelled")
+	}
+	if _, err := os.Stat(filepath.Join(store.dir, "unknown.lock")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("cancelling unknown job left a lock file: %v", err)
+	}
+}
+
+func TestQueueRun(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 3})
+	defer server.Close()
+
+	q := newTestQueue(t, server, testConfig(t))
+	enqueue(t, q, server, 0)
+
+	for _, job := range drain(t, q) {
+		if job.State != StateDone || job.Attempts != 1 || job.LastError != "" {
+			t.Errorf("%s: State = %q, Attempts = %d, LastError = %q", job.Label(), job.State, job.Attempts, job.LastError)
+			continue
+		}
+
+		data, err := os.ReadFile(job.Path)
+		if err != nil || !bytes.Equal(data, server.HLSData(job.Episode.Id, 720)) {
+			t.Errorf("%s: %d bytes in %q, %v", job.Label(), len(data), job.Path, err)
+		}
+	}
+
+	// Загруженные серии при повторном запуске не выполняются
+	requests := server.SecretRequests()
+	drain(t, q)
+	if n := server.SecretRequests() - requests; n != 0 {
+		t.Errorf("second run resolved %d links, want 0", n)
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	// Второй фрагмент первый раз отвечает ошибкой: первая попытка задания неудачна
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, FailSegments: map[int]int{2: 1}})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Queue.Workers = 1
+
+	q := newTestQueue(t, server, config)
+	enqueue(t, q, server, 0)
+
+	var finished []Job
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.Run(ctx, Options{Drain: true, OnFinish: func(job Job) { finished = append(finished, job) }})
+
+	if len(finished) != 2 {
+		t.Fatalf("OnFinish called %d times, want 2", len(finished))
+	}
+	if first := finished[0]; first.State != StateQueued || first.LastError == "" || first.NotBefore.IsZero() {
+		t.Errorf("first attempt: State = %q, LastError = %q, NotBefore = %v", first.State, first.LastError, first.NotBefore)
+	}
+	if second := finished[1]; second.State != StateDone || second.Attempts != 2 || second.LastError != "" {
+		t.Errorf("second attempt: State = %q, Attempts = %d, LastError = %q", second.State, second.Attempts, second.LastError)
+	}
+}
+
+func TestQueueFailed(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, FailLinks: map[int]int{1: 100}})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Queue.Attempts = 2
+	config.ResolveRetries = 0
+	config.Retry.Resolve.Attempts = 1
+
+	q := newTestQueue(t, server, config)
+	enqueue(t, q, server, 0)
+
+	jobs := drain(t, q)
+	if job := jobs[0]; job.State != StateFailed || job.Attempts != 2 || job.LastError == "" {
+		t.Errorf("State = %q, Attempts = %d, LastError = %q", job.State, job.Attempts, job.LastError)
+	}
+}
+
+func TestQueueInterrupted(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer server.Close()
+
+	q := newTestQueue(t, server, testConfig(t))
+	jobs := enqueue(t, q, server, 0)
+
+	// Процесс упал во время загрузки первой серии: задание осталось в состоянии running
+	crashed := jobs[0]
+	crashed.State, crashed.Attempts = StateRunning, 1
+	if err := q.store.save(&crashed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Отмена до начала загрузки возвращает задание в очередь без траты попытки
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	job := jobs[1]
+	q.run(ctx, &job)
+	if job.State != StateQueued || job.Attempts != 0 {
+		t.Errorf("cancelled job: State = %q, Attempts = %d", job.State, job.Attempts)
+	}
+
+	for _, job := range drain(t, q) {
+		if job.State != StateDone {
+			t.Errorf("%s: State = %q, LastError = %q", job.Label(), job.State, job.LastError)
+		}
+	}
+	if job, _ := q.store.Job(crashed.ID); job.Attempts != 2 {
+		t.Errorf("crashed job: Attempts = %d, want 2", job.Attempts)
+	}
+}
+
+func TestQueueSaveFailed(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1})
+	defer server.Close()
+
+	q := newTestQueue(t, server, testConfig(t))
+	job := enqueue(t, q, server, 0)[0]
+
+	// Каталог на месте временного файла не дает записать задание
+	if err := os.Mkdir(q.store.path(job.ID, ".json.tmp"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	secretRequests := server.SecretRequests()
+	q.run(context.Background(), &job)
+	if job.State != StateQueued || job.Attempts != 0 {
+		t.Errorf("State = %q, Attempts = %d; want the job unchanged", job.State, job.Attempts)
+	}
+	if n := server.SecretRequests() - secretRequests; n != 0 {
+		t.Errorf("links requested %d times without a saved attempt", n)
+	}
+	if saved, _ := q.store.Job(job.ID); saved.State != StateQueued || saved.Attempts != 0 {
+		t.Errorf("saved job: State = %q, Attempts = %d", saved.State, saved.Attempts)
+	}
+}
+
+func TestQueueLocked(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer server.Close()
+
+	config := testConfig(t)
+	q := newTestQueue(t, server, config)
+	jobs := enqueue(t, q, server, 0)
+
+	// Другой процесс выполняет первую серию: его блокировку держит отдельное хранилище
+	other, err := OpenStore(config.Queue.Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := other.lock(jobs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	if _, err := q.store.lock(jobs[0].ID); !errors.Is(err, errLocked) {
+		t.Fatalf("lock held by another store: err = %v, want errLocked", err)
+	}
+
+	running := jobs[0]
+	running.State = StateRunning
+	if err := other.save(&running); err != nil {
+		t.Fatal(err)
+	}
+
+	result := drain(t, q)
+	if result[0].State != StateRunning || result[0].Attempts != 0 {
+		t.Errorf("locked job: State = %q, Attempts = %d; want it untouched", result[0].State, result[0].Attempts)
+	}
+	if result[1].State != StateDone {
+		t.Errorf("free job: State = %q", result[1].State)
+	}
+
+	// Блокировка не мешает файлу задания оставаться в каталоге вместе с .lock
+	if _, err := os.Stat(filepath.Join(config.Queue.Directory, jobs[0].ID+".lock")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueueSamePath(t *testing.T) {
+	// Без {translation} в шаблоне две озвучки одной серии загружаются в один файл
+	server := kodiktest.NewServer(kodiktest.Config{
+		Episodes: 1,
+		Segments: 16,
+		Translations: []kodiktest.Translation{
+			{ID: "610", Title: "AniLibria.TV", Type: "voice"},
+			{ID: "1291", Title: "Crunchyroll", Type: "subtitles"},
+		},
+	})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Queue.Workers = 2
+	q := newTestQueue(t, server, config)
+
+	ctx := context.Background()
+	client := kodik.NewClient(server.Client())
+	title, err := client.Fetch(ctx, server.TitleURL())
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	for _, translation := range title.Translations {
+		if err := client.SelectTranslation(ctx, title, translation); err != nil {
+			t.Fatalf("SelectTranslation(%s): %v", translation.Title, err)
+		}
+		job := Job{URL: server.TitleURL(), Title: title.Name, Translation: translation, Episode: title.Series[0]}
+		if ok, err := q.Store().Add(job); !ok || err != nil {
+			t.Fatalf("Add(%s) = %v, %v", translation.Title, ok, err)
+		}
+	}
+
+	// Задания выполняются по очереди: ожидание блокировки файла не тратит попытку
+	jobs := drain(t, q)
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+	for _, job := range jobs {
+		if job.State != StateDone || job.Attempts != 1 {
+			t.Errorf("%s: State = %q, Attempts = %d, LastError = %q", job.Translation.Title, job.State, job.Attempts, job.LastError)
+		}
+	}
+	if jobs[0].Path != jobs[1].Path {
+		t.Fatalf("paths %q and %q, want the same file", jobs[0].Path, jobs[1].Path)
+	}
+
+	// Файл целиком принадлежит одной из озвучек, а не смешивает фрагменты обеих
+	data, err := os.ReadFile(jobs[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, server.HLSData(jobs[0].Episode.Id, 720)) && !bytes.Equal(data, server.HLSData(jobs[1].Episode.Id, 720)) {
+		t.Errorf("%d bytes in %q match neither translation", len(data), jobs[0].Path)
+	}
+
+	if _, err := os.Stat(strings.TrimSuffix(jobs[0].Path, ".ts") + ".lock"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("episode lock is left: %v", err)
+	}
+}
+
+func TestQueueFairness(t *testing.T) {
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &Queue{store: store, running: make(map[string]int), served: make(map[string]time.Time)}
+
+	add := func(url, num string, priority int) {
+		job := Job{URL: url, Title: url, Episode: utils.KodikSeriaInfo{Num: num, Id: url + num}, Priority: priority}
+		if _, err := store.Add(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, num := range []string{"1", "2", "3", "4"} {
+		add("a", num, 0)
+	}
+	add("b", "1", 0)
+	add("b", "2", 0)
+	add("c", "1", 1)
+
+	// Сначала важное задание, затем тайтлы по очереди, пока у одного не кончатся серии
+	want := []string{"c 1", "a 1", "b 1", "a 2", "b 2", "a 3", "a 4"}
+	var got []string
+	var unlocks []func()
+	for range want {
+		job, unlock, _, err := q.claim()
+		if err != nil || job == nil {
+			t.Fatalf("claim: %v, %v", job, err)
+		}
+		got = append(got, job.URL+" "+job.Episode.Num)
+
+		// Выполненное задание освобождает исполнителя, а его тайтл уходит в конец
+		job.State = StateDone
+		store.save(job)
+		unlocks = append(unlocks, unlock)
+		if len(unlocks) == 2 {
+			unlocks[0]()
+			unlocks = unlocks[1:]
+		}
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
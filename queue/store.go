@@ -0,0 +1,269 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"kodik_parser/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errLocked — задание выполняет другой исполнитель или процесс
+var errLocked = errors.New("job is locked by another worker")
+
+// State описывает, на каком этапе находится задание
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateDone      State = "done"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+// Job — загрузка одной серии. Хранится в каталоге очереди файлом <ID>.json
+type Job struct {
+	ID          string                 `json:"id"`
+	URL         string                 `json:"url"`   // страница тайтла
+	Title       string                 `json:"title"` // название тайтла для шаблона имени файла
+	Translation utils.KodikTranslation `json:"translation"`
+	Episode     utils.KodikSeriaInfo   `json:"episode"`
+	Quality     utils.QualityPolicy    `json:"quality"`
+	Priority    int                    `json:"priority"` // задания с большим приоритетом выполняются раньше
+
+	State     State     `json:"state"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	Path      string    `json:"path,omitempty"`      // загруженный файл
+	NotBefore time.Time `json:"notBefore,omitempty"` // повтор после неудачной попытки не раньше этого времени
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+}
+
+// JobID возвращает идентификатор задания. Он зависит только от тайтла, озвучки и серии,
+// поэтому одна и та же серия не попадет в очередь дважды, а её блокировка не даст
+// двум процессам писать один файл
+func JobID(url string, translation utils.KodikTranslation, episode utils.KodikSeriaInfo) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{url, translation.ID, episode.Id}, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Label возвращает задание для вывода: "Test Title, серия S2E5"
+func (j Job) Label() string {
+	return fmt.Sprintf("%s, серия %s", j.Title, j.Episode.Label())
+}
+
+// Store хранит задания в каталоге: <ID>.json с заданием и <ID>.lock для блокировки.
+// Файл задания меняет только владелец его блокировки
+type Store struct {
+	dir string
+
+	mu   sync.Mutex
+	held map[string]bool // блокировки этого процесса
+}
+
+// OpenStore открывает каталог очереди, создавая его при необходимости
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	return &Store{dir: dir, held: make(map[string]bool)}, nil
+}
+
+func (s *Store) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// Jobs читает все задания в порядке выполнения: по приоритету, затем по тайтлу и номеру серии
+func (s *Store) Jobs() ([]Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	var jobs []Job
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		job, err := s.Job(id)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	slices.SortStableFunc(jobs, compareJobs)
+	return jobs, nil
+}
+
+// Job читает задание
+func (s *Store) Job(id string) (Job, error) {
+	data, err := os.ReadFile(s.path(id, ".json"))
+	if err != nil {
+		return Job{}, err
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Job{}, fmt.Errorf("failed to parse job %s: %w", id, err)
+	}
+	return job, nil
+}
+
+// save записывает задание через временный файл, чтобы падение процесса не оставило его недописанным.
+// Вызывающий должен владеть блокировкой задания
+func (s *Store) save(job *Job) error {
+	job.Updated = time.Now()
+
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path(job.ID, ".json.tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write job %s: %w", job.ID, err)
+	}
+	if err := os.Rename(tmp, s.path(job.ID, ".json")); err != nil {
+		return fmt.Errorf("failed to write job %s: %w", job.ID, err)
+	}
+
+	return nil
+}
+
+// lock захватывает блокировку задания без ожидания. errLocked — задание выполняет
+// другой исполнитель этого или другого процесса. Файл блокировки остается на диске,
+// а сама блокировка снимается вызовом unlock или системой при падении процесса
+func (s *Store) lock(id string) (unlock func(), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.held[id] {
+		return nil, errLocked
+	}
+
+	f, err := os.OpenFile(s.path(id, ".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job lock: %w", err)
+	}
+	if err := utils.LockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, utils.ErrLocked) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+
+	s.held[id] = true
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.held, id)
+		f.Close()
+	}, nil
+}
+
+// Add ставит задание в очередь. Серия, которая уже ждет или выполняется, не добавляется повторно,
+// а завершенная с ошибкой или отмененная ставится заново с обнуленными попытками.
+// Возвращает false, если очередь не изменилась
+func (s *Store) Add(job Job) (bool, error) {
+	job.ID = JobID(job.URL, job.Translation, job.Episode)
+
+	unlock, err := s.lock(job.ID)
+	if errors.Is(err, errLocked) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	existing, err := s.Job(job.ID)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		job.Created = time.Now()
+	case err != nil:
+		return false, err
+	case existing.State == StateFailed || existing.State == StateCancelled:
+		job.Created = existing.Created
+	default:
+		return false, nil
+	}
+
+	job.State = StateQueued
+	job.Attempts = 0
+	job.LastError = ""
+	job.Path = ""
+	job.NotBefore = time.Time{}
+
+	return true, s.save(&job)
+}
+
+// Cancel отменяет ждущее задание. Выполняемое задание отменить нельзя: оно заблокировано
+func (s *Store) Cancel(id string) error {
+	// Без проверки для неизвестного ID остался бы лишний файл блокировки
+	if _, err := s.Job(id); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("job %s not found", id)
+		}
+		return err
+	}
+
+	unlock, err := s.lock(id)
+	if errors.Is(err, errLocked) {
+		return fmt.Errorf("job %s is running", id)
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	job, err := s.Job(id)
+	if err != nil {
+		return err
+	}
+	if job.State != StateQueued && job.State != StateRunning {
+		return fmt.Errorf("job %s is already %s", id, job.State)
+	}
+
+	job.State = StateCancelled
+	return s.save(&job)
+}
+
+// compareJobs упорядочивает задания: по убыванию приоритета, затем по тайтлу, сезону и номеру серии
+func compareJobs(a, b Job) int {
+	if a.Priority != b.Priority {
+		return b.Priority - a.Priority
+	}
+	if c := strings.Compare(a.URL, b.URL); c != 0 {
+		return c
+	}
+	if a.Episode.Season != b.Episode.Season {
+		return a.Episode.Season - b.Episode.Season
+	}
+	return compareNums(a.Episode.Num, b.Episode.Num)
+}
+
+// compareNums сравнивает номера серий как числа, а нечисловые — как строки
+func compareNums(a, b string) int {
+	if len(a) != len(b) && strings.Trim(a+b, "0123456789") == "" {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
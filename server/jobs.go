@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+	"slices"
+	"time"
+)
+
+// JobStatus описывает, на каком этапе находится задание
+type JobStatus string
+
+const (
+	JobQueued      JobStatus = "queued"
+	JobResolving   JobStatus = "resolving"
+	JobDownloading JobStatus = "downloading"
+	JobDone        JobStatus = "done"
+	JobFailed      JobStatus = "failed"
+	JobCancelled   JobStatus = "cancelled"
+)
+
+// Finished сообщает, завершено ли задание
+func (s JobStatus) Finished() bool {
+	return s == JobDone || s == JobFailed || s == JobCancelled
+}
+
+// JobInfo — состояние задания в ответах API
+type JobInfo struct {
+	ID       string              `json:"id"`
+	Request  Request             `json:"request"`
+	Status   JobStatus           `json:"status"`
+	Error    string              `json:"error,omitempty"`
+	Title    string              `json:"title,omitempty"` // название тайтла, известно после получения ссылок
+	Created  time.Time           `json:"created"`
+	Started  *time.Time          `json:"started,omitempty"`
+	Finished *time.Time          `json:"finished,omitempty"`
+	Progress JobProgress         `json:"progress"`
+	Result   *utils.HandleResult `json:"result,omitempty"` // только в ответе GET /api/jobs/{id}
+}
+
+// JobProgress — ход загрузки задания
+type JobProgress struct {
+	Episodes       int           `json:"episodes"` // серий к загрузке; 0 — ссылки еще не получены
+	Done           int           `json:"done"`
+	Failed         int           `json:"failed"`
+	Bytes          int64         `json:"bytes"`
+	EstimatedBytes int64         `json:"estimatedBytes"`  // оценка по сериям, размер которых уже известен
+	Items          []EpisodeInfo `json:"items,omitempty"` // только в ответе GET /api/jobs/{id}
+}
+
+// EpisodeInfo — ход загрузки одной серии
+type EpisodeInfo struct {
+	Episode        string         `json:"episode"`
+	Bytes          int64          `json:"bytes"`
+	EstimatedBytes int64          `json:"estimatedBytes"` // 0 — размер пока неизвестен
+	Fragments      int            `json:"fragments,omitempty"`
+	TotalFragments int            `json:"totalFragments,omitempty"`
+	Speed          utils.ByteRate `json:"speed"` // средняя скорость в байтах в секунду
+	Done           bool           `json:"done"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// job — задание загрузки. Поля, кроме неизменяемых id, request и created,
+// защищены Server.mu
+type job struct {
+	id      string
+	request Request
+	created time.Time
+
+	status   JobStatus
+	started  time.Time
+	finished time.Time
+	err      error
+	result   *utils.HandleResult
+	episodes int
+	progress *utils.DownloadProgress
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newJobID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// enqueue ставит задание в очередь
+func (s *Server) enqueue(req Request) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errors.New("сервер останавливается")
+	}
+
+	s.prune(time.Now())
+
+	j := &job{
+		id:       newJobID(),
+		request:  req,
+		created:  time.Now(),
+		status:   JobQueued,
+		progress: utils.NewDownloadProgress(),
+	}
+	s.jobs[j.id] = j
+	s.order = append(s.order, j)
+	s.cond.Signal()
+
+	s.Log.Printf("API: job %s queued: %s", j.id, req.URL)
+	return j, nil
+}
+
+func (s *Server) job(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.jobs[id]
+}
+
+// work выполняет задания по очереди, пока сервер не закрыт
+func (s *Server) work() {
+	defer s.workers.Done()
+
+	for {
+		j := s.next()
+		if j == nil {
+			return
+		}
+		s.run(j)
+	}
+}
+
+// next ждет первое задание в очереди и отмечает его начатым; nil — сервер закрыт
+func (s *Server) next() *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed {
+		for _, j := range s.order {
+			if j.status != JobQueued {
+				continue
+			}
+
+			j.status = JobResolving
+			j.started = time.Now()
+			j.ctx, j.cancel = context.WithCancel(s.ctx)
+			return j
+		}
+		s.cond.Wait()
+	}
+
+	return nil
+}
+
+func (s *Server) run(j *job) {
+	defer j.cancel()
+
+	s.Log.Printf("API: job %s started", j.id)
+
+	config := s.config
+	config.Progress = j.progress
+
+	result, err := s.resolve(j.ctx, j.request, &config)
+	if err == nil {
+		// Загрузчик меняет Results на месте, поэтому заданию достается копия
+		resolved := result
+		resolved.Results = slices.Clone(result.Results)
+
+		s.mu.Lock()
+		j.status = JobDownloading
+		j.result = &resolved
+		j.episodes = len(resolved.Succeeded())
+		s.mu.Unlock()
+
+		downloadOpts := s.downloadOpts
+		downloadOpts.Log = s.Log
+		result, err = video_utils.Download(j.ctx, result, &config, downloadOpts)
+		if err == nil {
+			err = result.Err()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.result = &result
+	j.finished = time.Now()
+	j.err = err
+
+	switch {
+	case j.ctx.Err() != nil:
+		j.status = JobCancelled
+	case err != nil:
+		j.status = JobFailed
+	default:
+		j.status = JobDone
+	}
+
+	s.Log.Printf("API: job %s is %s: %v", j.id, j.status, err)
+	s.prune(j.finished)
+}
+
+// prune удаляет завершенные задания старше Server.JobTTL и самые старые завершенные сверх
+// Server.MaxFinishedJobs, чтобы долго работающий сервер не накапливал их. Вызывается под s.mu
+func (s *Server) prune(now time.Time) {
+	ttl := time.Duration(s.config.Server.JobTTL * float64(time.Second))
+
+	finished := 0
+	for _, j := range s.order {
+		if j.status.Finished() {
+			finished++
+		}
+	}
+
+	kept := s.order[:0]
+	for _, j := range s.order {
+		expired := ttl > 0 && now.Sub(j.finished) > ttl
+		excess := s.config.Server.MaxFinishedJobs > 0 && finished > s.config.Server.MaxFinishedJobs
+
+		// s.order упорядочен по постановке, поэтому сверх лимита удаляются самые старые
+		if j.status.Finished() && (expired || excess) {
+			finished--
+			delete(s.jobs, j.id)
+			continue
+		}
+		kept = append(kept, j)
+	}
+
+	clear(s.order[len(kept):])
+	s.order = kept
+}
+
+// cancelJob отменяет задание: из очереди оно снимается сразу, а выполняемое прерывается,
+// и незавершенные загрузки сохраняют прогресс. false — задание уже завершено
+func (s *Server) cancelJob(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case j.status == JobQueued:
+		j.status = JobCancelled
+		j.finished = time.Now()
+		j.err = context.Canceled
+	case j.status.Finished():
+		return false
+	default:
+		j.cancel()
+	}
+
+	s.Log.Printf("API: job %s is cancelled", j.id)
+	return true
+}
+
+// info собирает состояние задания; full добавляет результат и ход загрузки каждой серии
+func (s *Server) info(j *job, full bool) JobInfo {
+	s.mu.Lock()
+	info := JobInfo{
+		ID:       j.id,
+		Request:  j.request,
+		Status:   j.status,
+		Created:  j.created,
+		Started:  timeOrNil(j.started),
+		Finished: timeOrNil(j.finished),
+		Progress: JobProgress{Episodes: j.episodes},
+	}
+	if j.err != nil {
+		info.Error = j.err.Error()
+	}
+	if j.result != nil {
+		info.Title = j.result.TitleName
+		if full {
+			info.Result = j.result
+		}
+	}
+	s.mu.Unlock()
+
+	now := time.Now()
+	for _, stats := range j.progress.Snapshot() {
+		switch {
+		case stats.Done() && stats.Err != nil:
+			info.Progress.Failed++
+		case stats.Done():
+			info.Progress.Done++
+		}
+
+		info.Progress.Bytes += stats.Bytes
+		info.Progress.EstimatedBytes += stats.EstimatedTotal()
+
+		if full {
+			episode := EpisodeInfo{
+				Episode:        stats.Seria.Label(),
+				Bytes:          stats.Bytes,
+				EstimatedBytes: stats.EstimatedTotal(),
+				Fragments:      stats.Fragments,
+				TotalFragments: stats.TotalFragments,
+				Speed:          stats.AverageSpeed(now),
+				Done:           stats.Done(),
+			}
+			if stats.Err != nil {
+				episode.Error = stats.Err.Error()
+			}
+			info.Progress.Items = append(info.Progress.Items, episode)
+		}
+	}
+
+	return info
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,421 @@
+// Package server предоставляет HTTP API для получения ссылок и загрузки видео.
+//
+// Все запросы требуют заголовок "Authorization: Bearer <токен>" с токеном из
+// utils.ServerConfig. Ответы и тела запросов — JSON:
+//
+//	POST   /api/resolve     получить ссылки и вернуть utils.HandleResult
+//	POST   /api/jobs        поставить загрузку в очередь, вернуть JobInfo
+//	GET    /api/jobs        список заданий без результатов
+//	GET    /api/jobs/{id}   задание с ходом загрузки и результатом
+//	DELETE /api/jobs/{id}   отменить задание
+//	GET    /api/limits      текущие лимиты скорости загрузки
+//	PUT    /api/limits      изменить лимиты скорости загрузки, вернуть Limits
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kodik_parser/kodik"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRequestBody ограничивает размер тела запроса
+	maxRequestBody = 1 << 20
+
+	// shutdownTimeout — сколько ждать завершения запросов при остановке сервера
+	shutdownTimeout = 30 * time.Second
+)
+
+// Request описывает, что получить или загрузить. Пустые поля берутся из конфига
+type Request struct {
+	URL         string               `json:"url"`
+	Episodes    string               `json:"episodes,omitempty"`    // как флаг -episodes; пусто — все серии
+	Translation string               `json:"translation,omitempty"` // id или название озвучки
+	Quality     *utils.QualityPolicy `json:"quality,omitempty"`
+}
+
+// Limits — лимиты скорости загрузки процесса (video_utils.DefaultBandwidth); 0 — без ограничения.
+// Значения — число байт в секунду или строка вида "2M", как в конфиге. В PUT /api/limits
+// отсутствующее поле оставляет лимит прежним, ответы всегда содержат оба поля
+type Limits struct {
+	MaxBandwidth     *utils.ByteRate `json:"maxBandwidth,omitempty"`
+	EpisodeBandwidth *utils.ByteRate `json:"episodeBandwidth,omitempty"`
+}
+
+// Server обрабатывает запросы API и выполняет задания загрузки.
+// Настройки не меняются после создания, кроме лимитов скорости video_utils.DefaultBandwidth
+type Server struct {
+	config       utils.Config
+	client       *kodik.Client
+	mux          *http.ServeMux
+	validURL     func(string) bool
+	downloadOpts video_utils.Options // в тестах направляет загрузку на поддельный сервер
+
+	// Log получает журнал запросов, заданий и загрузок; nil — журнал не ведется.
+	// Задается до первого запроса
+	Log utils.Logf
+
+	ctx    context.Context // отменяется в Close и прерывает выполняемые задания
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	cond    *sync.Cond // сигналит о новых заданиях и о закрытии
+	closed  bool
+	jobs    map[string]*job
+	order   []*job // в порядке постановки в очередь
+	workers sync.WaitGroup
+}
+
+// New создает сервер и запускает config.Server.MaxJobs исполнителей заданий.
+// Если doer равен nil, запросы к Kodik выполняются через kodik.NewHTTPClient()
+func New(config utils.Config, doer utils.HTTPDoer) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		config:   config,
+		client:   kodik.NewClient(doer),
+		mux:      http.NewServeMux(),
+		validURL: utils.ValidateURL,
+		ctx:      ctx,
+		cancel:   cancel,
+		jobs:     make(map[string]*job),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	s.mux.HandleFunc("POST /api/resolve", s.handleResolve)
+	s.mux.HandleFunc("POST /api/jobs", s.handleEnqueue)
+	s.mux.HandleFunc("GET /api/jobs", s.handleJobs)
+	s.mux.HandleFunc("GET /api/jobs/{id}", s.handleJob)
+	s.mux.HandleFunc("DELETE /api/jobs/{id}", s.handleCancel)
+	s.mux.HandleFunc("GET /api/limits", s.handleLimits)
+	s.mux.HandleFunc("PUT /api/limits", s.handleSetLimits)
+
+	for range max(1, config.Server.MaxJobs) {
+		s.workers.Add(1)
+		go s.work()
+	}
+
+	return s
+}
+
+// ServeHTTP проверяет токен и передает запрос обработчику
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kodik_parser"`)
+		s.writeError(w, http.StatusUnauthorized, errors.New("неверный или отсутствующий токен"))
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized сравнивает токен за постоянное время. Пустой токен в конфиге запрещает все запросы
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.config.Server.Token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Server.Token)) == 1
+}
+
+// ListenAndServe принимает запросы на addr до отмены ctx. После отмены новые запросы
+// не принимаются, выполняемые запросы и задания прерываются, а незавершенные загрузки
+// сохраняют прогресс так же, как при прерывании CLI
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.Close()
+		return err
+	}
+
+	s.Log.Printf("API server is listening on %s", listener.Addr())
+	return s.Serve(ctx, listener)
+}
+
+// Serve принимает запросы из listener до отмены ctx, см. ListenAndServe
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		// Отмена ctx прерывает и запросы /api/resolve, иначе остановка ждала бы их
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		s.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	s.Log.Printf("API server is shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := httpServer.Shutdown(shutdownCtx)
+	s.Close()
+	if err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+
+	s.Log.Printf("API server is stopped")
+	return nil
+}
+
+// Close прерывает выполняемые задания и ждет их завершения. Новые задания не принимаются
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.cancel()
+	s.workers.Wait()
+}
+
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := readRequest(w, r, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	config := s.config
+	result, err := s.resolve(r.Context(), req, &config)
+	if err != nil {
+		s.writeError(w, errorStatus(err), err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, result)
+}
+
+// resolve получает ссылки по запросу без вопросов пользователю: озвучка и качество
+// берутся из запроса или конфига, а без диапазона выбираются все серии.
+// В config записывается ReResolve для загрузчика
+func (s *Server) resolve(ctx context.Context, req Request, config *utils.Config) (utils.HandleResult, error) {
+	if !s.validURL(req.URL) {
+		return utils.HandleResult{}, &requestError{fmt.Errorf("некорректный URL: %q", req.URL)}
+	}
+	url := utils.NormalizeURL(req.URL)
+
+	opts := kodik.Options{
+		Quality: config.Quality,
+		Retries: config.ResolveRetries,
+		Retry:   config.Retry.Resolve,
+	}
+	if req.Quality != nil {
+		opts.Quality = *req.Quality
+	}
+
+	translation := config.Translation
+	if req.Translation != "" {
+		translation = req.Translation
+	}
+	if translation != "" {
+		opts.SelectTranslation = func(title *kodik.Title) (utils.KodikTranslation, error) {
+			return kodik.FindTranslation(title.Translations, translation)
+		}
+	}
+
+	if req.Episodes != "" {
+		opts.SelectEpisodes = func(title *kodik.Title) ([]utils.KodikSeriaInfo, error) {
+			return utils.SelectSeries(title.Series, req.Episodes, title.Season)
+		}
+	}
+
+	s.Log.Printf("API: resolving %s", url)
+	client := s.client.WithLog(s.Log)
+	result, err := client.Resolve(ctx, url, opts)
+	if err != nil {
+		return result, err
+	}
+
+	config.ReResolve = func(ctx context.Context, res utils.Result) (utils.Result, error) {
+		return client.ResolveEpisode(ctx, url, res.Seria, kodik.Options{
+			Quality: opts.Quality,
+			Retries: config.ResolveRetries,
+			Retry:   config.Retry.Resolve,
+		})
+	}
+
+	return result, nil
+}
+
+func (s *Server) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := readRequest(w, r, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !s.validURL(req.URL) {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("некорректный URL: %q", req.URL))
+		return
+	}
+
+	j, err := s.enqueue(req)
+	if err != nil {
+		s.writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+j.id)
+	s.writeJSON(w, http.StatusAccepted, s.info(j, false))
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := append([]*job(nil), s.order...)
+	s.mu.Unlock()
+
+	infos := make([]JobInfo, 0, len(jobs))
+	for _, j := range jobs {
+		infos = append(infos, s.info(j, false))
+	}
+
+	s.writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	j := s.job(r.PathValue("id"))
+	if j == nil {
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("задание %s не найдено", r.PathValue("id")))
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, s.info(j, true))
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	j := s.job(r.PathValue("id"))
+	if j == nil {
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("задание %s не найдено", r.PathValue("id")))
+		return
+	}
+
+	if !s.cancelJob(j) {
+		s.writeError(w, http.StatusConflict, fmt.Errorf("задание %s уже завершено", j.id))
+		return
+	}
+
+	s.writeJSON(w, http.StatusAccepted, s.info(j, false))
+}
+
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, currentLimits())
+}
+
+// handleSetLimits меняет лимиты скорости так же, как SIGHUP в CLI: новые значения сразу
+// действуют на идущие загрузки всего процесса, в том числе не относящиеся к API
+func (s *Server) handleSetLimits(w http.ResponseWriter, r *http.Request) {
+	var req Limits
+	if err := readRequest(w, r, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, limit := range []*utils.ByteRate{req.MaxBandwidth, req.EpisodeBandwidth} {
+		if limit != nil && *limit < 0 {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("отрицательный лимит скорости: %d", *limit))
+			return
+		}
+	}
+
+	// Два одновременных запроса с разными полями не должны затереть друг друга
+	s.mu.Lock()
+	total, perEpisode := video_utils.DefaultBandwidth.Limits()
+	if req.MaxBandwidth != nil {
+		total = *req.MaxBandwidth
+	}
+	if req.EpisodeBandwidth != nil {
+		perEpisode = *req.EpisodeBandwidth
+	}
+	video_utils.SetBandwidthLimit(total, perEpisode)
+	s.mu.Unlock()
+
+	s.Log.Printf("API: bandwidth limits set: total %s, per episode %s", total, perEpisode)
+	s.writeJSON(w, http.StatusOK, currentLimits())
+}
+
+// currentLimits возвращает лимиты video_utils.DefaultBandwidth
+func currentLimits() Limits {
+	total, perEpisode := video_utils.DefaultBandwidth.Limits()
+	return Limits{MaxBandwidth: &total, EpisodeBandwidth: &perEpisode}
+}
+
+// requestError — ошибка в параметрах запроса, а не на стороне Kodik
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// errorStatus выбирает статус ответа: ошибки выбора озвучки и серий — ошибки запроса,
+// остальные — ошибки Kodik
+func errorStatus(err error) int {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return http.StatusBadRequest
+	}
+
+	var stageErr *kodik.StageError
+	if errors.As(err, &stageErr) && (stageErr.Stage == kodik.StageSelect || stageErr.Stage == kodik.StageTranslation) {
+		return http.StatusBadRequest
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadGateway
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("неверное тело запроса: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.Log.Printf("API: failed to write response: %v", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	s.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
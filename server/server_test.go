@@ -0,0 +1,426 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"kodik_parser/kodiktest"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+)
+
+const testToken = "secret"
+
+// gate задерживает запросы к хранилищу, пока не закрыт release, чтобы задание
+// оставалось выполняемым
+type gate struct {
+	transport http.RoundTripper
+	release   chan struct{}
+}
+
+func (g *gate) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-g.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return g.transport.RoundTrip(req)
+}
+
+func newTestServer(t *testing.T, kodik *kodiktest.Server, transport http.RoundTripper) *Server {
+	t.Helper()
+
+	config := utils.NewDefaultConfig()
+	config.OutputDirectory = t.TempDir()
+	config.Server.Token = testToken
+
+	s := New(config, kodik.Client())
+	s.validURL = func(url string) bool { return url != "" }
+	s.downloadOpts = video_utils.Options{Transport: transport}
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// call выполняет запрос к API и разбирает ответ в out, если он не nil
+func call(t *testing.T, s *Server, method, path string, body any, out any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, w.Body)
+		}
+	}
+	return w
+}
+
+// waitJob ждет, пока задание не перейдет в один из статусов
+func waitJob(t *testing.T, s *Server, id string, statuses ...JobStatus) JobInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var info JobInfo
+		call(t, s, "GET", "/api/jobs/"+id, nil, &info)
+		for _, status := range statuses {
+			if info.Status == status {
+				return info
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want one of %v", id, info.Status, statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	kodik := kodiktest.NewServer(kodiktest.Config{})
+	defer kodik.Close()
+
+	s := newTestServer(t, kodik, kodik.Client().Transport)
+
+	for _, header := range []string{"", "Bearer", "Bearer wrong", "Basic " + testToken, testToken} {
+		req := httptest.NewRequest("GET", "/api/jobs", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", header, w.Code)
+		}
+	}
+
+	if w := call(t, s, "GET", "/api/jobs", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("valid token: status %d", w.Code)
+	}
+
+	// Без токена в конфиге API закрыто
+	s.config.Server.Token = ""
+	if w := call(t, s, "GET", "/api/jobs", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("empty configured token: status %d, want 401", w.Code)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	kodik := kodiktest.NewServer(kodiktest.Config{Episodes: 3})
+	defer kodik.Close()
+
+	s := newTestServer(t, kodik, kodik.Client().Transport)
+
+	var result struct {
+		TitleName string
+		Results   []struct {
+			Seria   utils.KodikSeriaInfo
+			Video   string
+			Quality int
+			Status  utils.ResultStatus
+			Err     string
+		}
+	}
+	w := call(t, s, "POST", "/api/resolve", Request{URL: kodik.TitleURL(), Episodes: "2-3", Quality: &utils.QualityPolicy{Preferred: 480}}, &result)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	if len(result.Results) != 2 {
+		t.Fatalf("%d results, want 2", len(result.Results))
+	}
+	for i, res := range result.Results {
+		if want := kodik.VideoURL(0, 1, i+2, 480); res.Video != want || res.Err != "" {
+			t.Errorf("%s: Video = %q, Err = %q; want %q", res.Seria.Label(), res.Video, res.Err, want)
+		}
+	}
+
+	tests := []struct {
+		name string
+		body any
+		want int
+	}{
+		{"bad episodes", Request{URL: kodik.TitleURL(), Episodes: "10-12"}, http.StatusBadRequest},
+		{"no url", Request{}, http.StatusBadRequest},
+		{"unknown field", map[string]string{"link": kodik.TitleURL()}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var body map[string]string
+		if w := call(t, s, "POST", "/api/resolve", tt.body, &body); w.Code != tt.want || body["error"] == "" {
+			t.Errorf("%s: status %d, body %v; want %d with error", tt.name, w.Code, body, tt.want)
+		}
+	}
+
+	// Настоящая проверка URL пропускает только адреса Kodik
+	s.validURL = utils.ValidateURL
+	if w := call(t, s, "POST", "/api/resolve", Request{URL: "https://example.com/serial/1/abc"}, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("foreign URL: status %d, want 400", w.Code)
+	}
+}
+
+func TestJob(t *testing.T) {
+	kodik := kodiktest.NewServer(kodiktest.Config{Episodes: 2, Segments: 3})
+	defer kodik.Close()
+
+	s := newTestServer(t, kodik, kodik.Client().Transport)
+
+	var info JobInfo
+	w := call(t, s, "POST", "/api/jobs", Request{URL: kodik.TitleURL()}, &info)
+	if w.Code != http.StatusAccepted || w.Header().Get("Location") != "/api/jobs/"+info.ID {
+		t.Fatalf("status %d, Location %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+
+	info = waitJob(t, s, info.ID, JobDone, JobFailed)
+	if info.Status != JobDone || info.Error != "" {
+		t.Fatalf("Status = %q, Error = %q", info.Status, info.Error)
+	}
+
+	if info.Title != "Test Title" || info.Progress.Episodes != 2 || info.Progress.Done != 2 || len(info.Progress.Items) != 2 {
+		t.Errorf("Title = %q, Progress = %+v", info.Title, info.Progress)
+	}
+	for _, item := range info.Progress.Items {
+		if !item.Done || item.Bytes != int64(3*1024) || item.Fragments != 3 {
+			t.Errorf("episode %s: %+v", item.Episode, item)
+		}
+	}
+
+	for _, res := range info.Result.Results {
+		data, err := os.ReadFile(res.Path)
+		if err != nil || !bytes.Equal(data, kodik.HLSData(res.Seria.Id, res.Quality)) {
+			t.Errorf("%s: %d bytes in %q, %v", res.Seria.Label(), len(data), res.Path, err)
+		}
+	}
+
+	var jobs []JobInfo
+	call(t, s, "GET", "/api/jobs", nil, &jobs)
+	if len(jobs) != 1 || jobs[0].ID != info.ID || jobs[0].Result != nil || jobs[0].Progress.Items != nil {
+		t.Errorf("jobs = %+v, want one job without result", jobs)
+	}
+
+	if w := call(t, s, "DELETE", "/api/jobs/"+info.ID, nil, nil); w.Code != http.StatusConflict {
+		t.Errorf("cancel finished job: status %d, want 409", w.Code)
+	}
+	if w := call(t, s, "GET", "/api/jobs/unknown", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d, want 404", w.Code)
+	}
+}
+
+func TestJobEpisodeLocked(t *testing.T) {
+	kodik := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer kodik.Close()
+
+	s := newTestServer(t, kodik, kodik.Client().Transport)
+
+	// Первую серию записывает исполнитель очереди: он держит блокировку файла серии
+	dir := filepath.Join(s.config.OutputDirectory, "Test Title")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := os.Create(filepath.Join(dir, "1_серия.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if err := utils.LockFile(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	var info JobInfo
+	call(t, s, "POST", "/api/jobs", Request{URL: kodik.TitleURL()}, &info)
+	info = waitJob(t, s, info.ID, JobDone, JobFailed)
+	if info.Status != JobFailed || !strings.Contains(info.Error, "не удалось загрузить серии: 1") {
+		t.Fatalf("Status = %q, Error = %q", info.Status, info.Error)
+	}
+
+	locked, free := info.Result.Results[0], info.Result.Results[1]
+	if locked.Status != utils.StatusDownloadFailed || locked.Err == nil || !strings.Contains(locked.Err.Error(), video_utils.ErrEpisodeLocked.Error()) {
+		t.Errorf("locked episode: Status = %q, Err = %v", locked.Status, locked.Err)
+	}
+	if free.Status != utils.StatusDownloaded {
+		t.Errorf("free episode: Status = %q, Err = %v", free.Status, free.Err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	kodik := kodiktest.NewServer(kodiktest.Config{Episodes: 1})
+	defer kodik.Close()
+
+	storage := &gate{transport: kodik.Client().Transport, release: make(chan struct{})}
+	s := newTestServer(t, kodik, storage)
+
+	// Исполнитель один: первое задание ждет хранилище, второе стоит в очереди
+	var running, queued JobInfo
+	call(t, s, "POST", "/api/jobs", Request{URL: kodik.TitleURL()}, &running)
+	call(t, s, "POST", "/api/jobs", Request{URL: kodik.TitleURL()}, &queued)
+	waitJob(t, s, running.ID, JobDownloading)
+
+	var info JobInfo
+	if w := call(t, s, "DELETE", "/api/jobs/"+queued.ID, nil, &info); w.Code != http.StatusAccepted || info.Status != JobCancelled {
+		t.Errorf("cancel queued job: status %d, job %s", w.Code, info.Status)
+	}
+
+	if w := call(t, s, "DELETE", "/api/jobs/"+running.ID, nil, nil); w.Code != http.StatusAccepted {
+		t.Errorf("cancel running job: status %d", w.Code)
+	}
+	info = waitJob(t, s, running.ID, JobCancelled, JobFailed, JobDone)
+	if info.Status != JobCancelled || info.Error == "" {
+		t.Errorf("running job: Status = %q, Error = %q", info.Status, info.Error)
+	}
+
+	// Снятое с очереди задание не запускается
+	close(storage.release)
+	time.Sleep(50 * time.Millisecond)
+	if info := waitJob(t, s, queued.ID, JobCancelled); info.Started != nil {
+		t.Errorf("cancelled job was started at %v", info.Started)
+	}
+}
+
+func TestPruneJobs(t *testing.T) {
+	now := time.Now()
+
+	config := utils.NewDefaultConfig()
+	config.Server.JobTTL = 60
+	config.Server.MaxFinishedJobs = 2
+	s := &Server{config: config, jobs: make(map[string]*job)}
+
+	add := func(id string, status JobStatus, finished time.Duration) {
+		j := &job{id: id, status: status}
+		if status.Finished() {
+			j.finished = now.Add(-finished)
+		}
+		s.jobs[id] = j
+		s.order = append(s.order, j)
+	}
+	add("expired", JobDone, 2*time.Minute)
+	add("oldest", JobFailed, 30*time.Second)
+	add("running", JobDownloading, 0)
+	add("older", JobCancelled, 20*time.Second)
+	add("newest", JobDone, 10*time.Second)
+	add("queued", JobQueued, 0)
+
+	s.prune(now)
+
+	var ids []string
+	for _, j := range s.order {
+		ids = append(ids, j.id)
+		if s.jobs[j.id] != j {
+			t.Errorf("job %s is in order but not in jobs", j.id)
+		}
+	}
+	if want := []string{"running", "older", "newest", "queued"}; !slices.Equal(ids, want) || len(s.jobs) != len(want) {
+		t.Errorf("kept %v (%d in map), want %v", ids, len(s.jobs), want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	kodik := kodiktest.NewServer(kodiktest.Config{})
+	defer kodik.Close()
+
+	// Лимиты общие для процесса: возвращаем прежние, чтобы не замедлить другие тесты
+	total, perEpisode := video_utils.DefaultBandwidth.Limits()
+	t.Cleanup(func() { video_utils.SetBandwidthLimit(total, perEpisode) })
+	video_utils.SetBandwidthLimit(0, 512*1024)
+
+	s := newTestServer(t, kodik, nil)
+
+	var limits Limits
+	if w := call(t, s, "PUT", "/api/limits", map[string]any{"maxBandwidth": "2M"}, &limits); w.Code != http.StatusOK {
+		t.Fatalf("PUT /api/limits: %d %s", w.Code, w.Body)
+	}
+	if *limits.MaxBandwidth != 2*1024*1024 || *limits.EpisodeBandwidth != 512*1024 {
+		t.Errorf("limits = %d, %d; want the episode limit kept", *limits.MaxBandwidth, *limits.EpisodeBandwidth)
+	}
+	if total, perEpisode := video_utils.DefaultBandwidth.Limits(); total != 2*1024*1024 || perEpisode != 512*1024 {
+		t.Errorf("DefaultBandwidth = %d, %d", total, perEpisode)
+	}
+
+	limits = Limits{}
+	call(t, s, "GET", "/api/limits", nil, &limits)
+	if limits.MaxBandwidth == nil || *limits.MaxBandwidth != 2*1024*1024 {
+		t.Errorf("GET /api/limits = %+v", limits)
+	}
+
+	if w := call(t, s, "PUT", "/api/limits", map[string]any{"episodeBandwidth": -1}, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("negative limit: status %d, want 400", w.Code)
+	}
+
+	// Без токена лимиты не меняются
+	req := httptest.NewRequest("PUT", "/api/limits", strings.NewReader(`{"maxBandwidth": 0}`))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("PUT without token: status %d, want 401", w.Code)
+	}
+	if total, _ := video_utils.DefaultBandwidth.Limits(); total != 2*1024*1024 {
+		t.Errorf("limit changed without token: %d", total)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	kodik := kodiktest.NewServer(kodiktest.Config{Episodes: 1})
+	defer kodik.Close()
+
+	storage := &gate{transport: kodik.Client().Transport, release: make(chan struct{})}
+	s := newTestServer(t, kodik, storage)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, listener)
+	}()
+
+	var info JobInfo
+	call(t, s, "POST", "/api/jobs", Request{URL: kodik.TitleURL()}, &info)
+	waitJob(t, s, info.ID, JobDownloading)
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve did not return after cancel")
+	}
+
+	if info := s.info(s.job(info.ID), false); info.Status != JobCancelled {
+		t.Errorf("running job is %s after shutdown, want cancelled", info.Status)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/api/jobs"); err == nil {
+		t.Error("server still accepts connections")
+	}
+
+	// После остановки задания не принимаются
+	if w := call(t, s, "POST", "/api/jobs", Request{URL: kodik.TitleURL()}, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("enqueue after shutdown: status %d, want 503", w.Code)
+	}
+}
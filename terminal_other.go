@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// enableTerminalSequences — терминалы остальных систем понимают ANSI последовательности без настройки
+func enableTerminalSequences() bool {
+	return true
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteRate — скорость в байтах в секунду; 0 — без ограничения.
+// В конфиге задается числом байт или строкой с суффиксом: "500K", "2M", "1.5MB/s"
+type ByteRate int64
+
+// ParseByteRate разбирает скорость: число с необязательным суффиксом K, M или G
+// (кратные 1024, можно с B, iB и /s). Пустая строка и "0" — без ограничения
+func ParseByteRate(s string) (ByteRate, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	if value == "" {
+		return 0, nil
+	}
+
+	value = strings.TrimSuffix(value, "/S")
+	value = strings.TrimSuffix(value, "IB")
+	value = strings.TrimSuffix(value, "B")
+
+	multiplier := 1.0
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 || number*multiplier > 1<<62 {
+		return 0, fmt.Errorf("неверная скорость %q, ожидается например 500K, 2M или 1.5MB", s)
+	}
+
+	return ByteRate(number * multiplier), nil
+}
+
+// UnmarshalJSON принимает число байт в секунду или строку для ParseByteRate
+func (r *ByteRate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		rate, err := ParseByteRate(s)
+		if err != nil {
+			return err
+		}
+		*r = rate
+		return nil
+	}
+
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil || n < 0 {
+		return fmt.Errorf("неверная скорость %s, ожидается число байт в секунду или строка вида \"2M\"", data)
+	}
+	*r = ByteRate(n)
+	return nil
+}
+
+func (r ByteRate) String() string {
+	if r <= 0 {
+		return "unlimited"
+	}
+
+	units := []string{"B/s", "KB/s", "MB/s", "GB/s"}
+	value := float64(r)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B/s", int64(r))
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ByteRate
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1000", 1000},
+		{"500K", 500 << 10},
+		{"2m", 2 << 20},
+		{"1.5MB", 3 << 19},
+		{"2MiB/s", 2 << 20},
+		{"1G", 1 << 30},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseByteRate(tt.input)
+		if err != nil {
+			t.Errorf("ParseByteRate(%q): %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteRate(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"fast", "-1M", "2T", "M"} {
+		if _, err := ParseByteRate(input); err == nil {
+			t.Errorf("ParseByteRate(%q) succeeded", input)
+		}
+	}
+}
+
+func TestByteRateJSON(t *testing.T) {
+	var config struct {
+		Number ByteRate `json:"number"`
+		Text   ByteRate `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(`{"number": 1048576, "text": "512K"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Number != 1<<20 || config.Text != 512<<10 {
+		t.Errorf("got %d and %d", config.Number, config.Text)
+	}
+
+	if err := json.Unmarshal([]byte(`{"number": -5}`), &config); err == nil {
+		t.Error("negative rate accepted")
+	}
+
+	if s := ByteRate(3 << 19).String(); s != "1.5 MB/s" {
+		t.Errorf("String() = %q", s)
+	}
+}
@@ -25,11 +25,11 @@ func OpenInMpvNet(result HandleResult, config *Config) error {
 	commands = append(commands, "append")
 
 	if config.DownloadResults {
-		for _, res := range result.Results {
+		for _, res := range result.Succeeded() {
 			commands = append(commands, res.Path)
 		}
 	} else {
-		for _, res := range result.Results {
+		for _, res := range result.Succeeded() {
 			commands = append(commands, res.Video)
 		}
 	}
@@ -37,15 +37,25 @@ func OpenInMpvNet(result HandleResult, config *Config) error {
 	cmd := exec.Command(config.MpvNetExecutable, commands...)
 	err := cmd.Start()
 	if err != nil {
-		log.Fatalf("Error while opening with MVP.NET!")
-		return err
+		log.Printf("Error while opening with MPV.NET: %v", err)
+		return fmt.Errorf("ошибка запуска mpv.net: %w", err)
 	}
 
 	return nil
 }
 
-func PrintResults(result HandleResult) {
-	for _, res := range result.Results {
-		fmt.Printf("Серия %s: %s\n", res.Seria.Num, res.Video)
+// IsInteractive сообщает, подключен ли stdin к терминалу.
+// Интерактивные запросы используются только в этом случае
+func IsInteractive() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
 	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// PrintResults выводит ссылки на успешно обработанные серии
+func PrintResults(result HandleResult) {
+	Export(os.Stdout, result, ExportText)
 }
@@ -0,0 +1,6 @@
+//go:build !unix && !windows
+
+package utils
+
+// errConnReset — на остальных системах сброс соединения не распознается и не повторяется
+var errConnReset error
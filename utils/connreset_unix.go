@@ -0,0 +1,8 @@
+//go:build unix
+
+package utils
+
+import "golang.org/x/sys/unix"
+
+// errConnReset — ошибка сокета, когда сервер сбросил соединение
+var errConnReset error = unix.ECONNRESET
@@ -0,0 +1,6 @@
+package utils
+
+import "golang.org/x/sys/windows"
+
+// errConnReset — ошибка сокета, когда сервер сбросил соединение
+var errConnReset error = windows.WSAECONNRESET
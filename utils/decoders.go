@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Decoder — один способ расшифровки строк Kodik. Decode возвращает все варианты расшифровки,
+// которые способ смог получить; оценку вариантам выставляет реестр
+type Decoder interface {
+	Name() string
+	Decode(input string) []Candidate
+}
+
+// Candidate — вариант расшифровки строки
+type Candidate struct {
+	Decoder string // имя декодера, получившего вариант
+	Decoded string
+	Score   int
+}
+
+// Transform — одно преобразование строки в цепочке ChainDecoder
+type Transform func(s string) (string, error)
+
+// ChainDecoder применяет преобразования по очереди и возвращает единственный вариант,
+// если все они выполнились без ошибок
+type ChainDecoder struct {
+	DecoderName string
+	Steps       []Transform
+}
+
+func (d ChainDecoder) Name() string {
+	return d.DecoderName
+}
+
+func (d ChainDecoder) Decode(input string) []Candidate {
+	decoded := input
+	for _, step := range d.Steps {
+		var err error
+		if decoded, err = step(decoded); err != nil {
+			return nil
+		}
+	}
+	return []Candidate{{Decoder: d.DecoderName, Decoded: decoded}}
+}
+
+// Chain создает декодер из цепочки преобразований
+func Chain(name string, steps ...Transform) Decoder {
+	return ChainDecoder{DecoderName: name, Steps: steps}
+}
+
+// ROTDecoder перебирает сдвиги ROT и после каждого применяет Then (обычно Base64).
+// Нулевой сдвиг не перебирается: он совпадает с обычным декодером Then
+type ROTDecoder struct {
+	Then Transform
+}
+
+func (d ROTDecoder) Name() string {
+	return "rot+base64"
+}
+
+func (d ROTDecoder) Decode(input string) []Candidate {
+	var candidates []Candidate
+	for shift := 1; shift < 26; shift++ {
+		decoded, err := ROT(shift)(input)
+		if err == nil && d.Then != nil {
+			decoded, err = d.Then(decoded)
+		}
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, Candidate{Decoder: fmt.Sprintf("rot%d+base64", shift), Decoded: decoded})
+	}
+	return candidates
+}
+
+var (
+	base64Regex    = regexp.MustCompile(`^[A-Za-z0-9+/]+={0,2}$`)
+	base64URLRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+={0,2}$`)
+)
+
+// Base64 декодирует стандартный Base64
+func Base64(s string) (string, error) {
+	if !base64Regex.MatchString(s) {
+		return "", errors.New("not a base64 string")
+	}
+	return decodeBase64(base64.StdEncoding, s)
+}
+
+// Base64URL декодирует URL-safe Base64 (символы - и _ вместо + и /)
+func Base64URL(s string) (string, error) {
+	if !base64URLRegex.MatchString(s) {
+		return "", errors.New("not a base64url string")
+	}
+	return decodeBase64(base64.URLEncoding, s)
+}
+
+// decodeBase64 принимает строки как с дополнением =, так и без него
+func decodeBase64(encoding *base64.Encoding, s string) (string, error) {
+	if !strings.HasSuffix(s, "=") && len(s)%4 != 0 {
+		encoding = encoding.WithPadding(base64.NoPadding)
+	}
+
+	decoded, err := encoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// Reverse переворачивает строку
+func Reverse(s string) (string, error) {
+	return ReverseString(s), nil
+}
+
+// ROT сдвигает латинские буквы назад на shift позиций
+func ROT(shift int) Transform {
+	return func(s string) (string, error) {
+		return decodeROT(s, shift), nil
+	}
+}
+
+// XOR применяет к байтам строки XOR с ключом
+func XOR(key string) Transform {
+	return func(s string) (string, error) {
+		if key == "" {
+			return "", errors.New("empty xor key")
+		}
+
+		out := []byte(s)
+		for i := range out {
+			out[i] ^= key[i%len(key)]
+		}
+		return string(out), nil
+	}
+}
+
+// decodeROT применяет обратную ротацию для букв латинского алфавита с указанным сдвигом.
+func decodeROT(s string, shift int) string {
+	shift = shift % 26
+	var result strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			newRune := r - rune(shift)
+			if newRune < 'A' {
+				newRune += 26
+			}
+			result.WriteRune(newRune)
+		case r >= 'a' && r <= 'z':
+			newRune := r - rune(shift)
+			if newRune < 'a' {
+				newRune += 26
+			}
+			result.WriteRune(newRune)
+		default:
+			result.WriteRune(r)
+		}
+	}
+	return result.String()
+}
+
+// ScriptDecoding — параметры расшифровки ссылок, извлеченные из скрипта плеера.
+// В отличие от AutoDecode, расшифровка по ним не использует эвристику
+type ScriptDecoding struct {
+	RotOffset int // сдвиг, который скрипт прибавляет к кодам букв
+}
+
+// ParseScriptDecoding извлекает параметры расшифровки из скрипта плеера
+func ParseScriptDecoding(script string) (*ScriptDecoding, error) {
+	offset, err := GetRot13Offset(script)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScriptDecoding{RotOffset: offset}, nil
+}
+
+// Decode повторяет расшифровку скрипта: сдвиг букв вперед на RotOffset, затем Base64
+func (d *ScriptDecoding) Decode(input string) (string, error) {
+	// decodeROT сдвигает назад, поэтому сдвиг вперед на N — это сдвиг назад на 26-N
+	decoded, err := Base64(decodeROT(input, 26-d.RotOffset%26))
+	if err != nil {
+		return "", err
+	}
+
+	if !isCleanString(decoded) {
+		return "", errors.New("decoded string contains invalid characters")
+	}
+
+	return decoded, nil
+}
+
+// DecodeLink расшифровывает src ссылки параметрами из скрипта, а если их нет
+// или расшифровка по ним не удалась — эвристикой AutoDecode
+func DecodeLink(src string, decoding *ScriptDecoding, log Logf) (string, error) {
+	if decoding == nil {
+		return AutoDecode(src)
+	}
+
+	decoded, err := decoding.Decode(src)
+	if err != nil {
+		log.Printf(" Failed to decode link with script ROT offset %d: %v, falling back to heuristic", decoding.RotOffset, err)
+		return AutoDecode(src)
+	}
+
+	return decoded, nil
+}
+
+// DefaultTrustedHosts — домены CDN Kodik, повышающие оценку варианта расшифровки
+var DefaultTrustedHosts = []string{"kodik-storage.com"}
+
+// DecoderRegistry хранит декодеры и выбирает лучший вариант расшифровки по оценке
+type DecoderRegistry struct {
+	mu           sync.RWMutex
+	decoders     []Decoder
+	trustedHosts []string
+}
+
+// NewDecoderRegistry создает реестр с указанными декодерами и DefaultTrustedHosts
+func NewDecoderRegistry(decoders ...Decoder) *DecoderRegistry {
+	return &DecoderRegistry{
+		decoders:     decoders,
+		trustedHosts: DefaultTrustedHosts,
+	}
+}
+
+// DefaultDecoders — реестр, который использует AutoDecode. Содержит известные схемы кодирования ссылок Kodik
+var DefaultDecoders = NewDecoderRegistry(
+	Chain("base64", Base64),
+	Chain("reversed+base64", Reverse, Base64),
+	Chain("base64url", Base64URL),
+	ROTDecoder{Then: Base64},
+)
+
+// Register добавляет декодер в конец реестра. При равной оценке побеждает декодер,
+// добавленный раньше
+func (r *DecoderRegistry) Register(decoder Decoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.decoders = append(r.decoders, decoder)
+}
+
+// Decoders возвращает зарегистрированные декодеры
+func (r *DecoderRegistry) Decoders() []Decoder {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Decoder(nil), r.decoders...)
+}
+
+// SetTrustedHosts задает домены CDN, повышающие оценку варианта. Пустой список
+// возвращает DefaultTrustedHosts
+func (r *DecoderRegistry) SetTrustedHosts(hosts []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(hosts) == 0 {
+		hosts = DefaultTrustedHosts
+	}
+	r.trustedHosts = append([]string(nil), hosts...)
+}
+
+// Candidates возвращает все варианты расшифровки с оценками, от лучшего к худшему
+func (r *DecoderRegistry) Candidates(input string) []Candidate {
+	r.mu.RLock()
+	decoders := r.decoders
+	hosts := r.trustedHosts
+	r.mu.RUnlock()
+
+	var candidates []Candidate
+	for _, decoder := range decoders {
+		for _, candidate := range decoder.Decode(input) {
+			if candidate.Decoder == "" {
+				candidate.Decoder = decoder.Name()
+			}
+			candidate.Score = scoreCandidate(candidate.Decoded, hosts)
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	// Стабильная сортировка сохраняет порядок декодеров при равной оценке
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	return candidates
+}
+
+// Decode возвращает вариант с наибольшей оценкой
+func (r *DecoderRegistry) Decode(input string) (string, error) {
+	candidates := r.Candidates(input)
+	if len(candidates) == 0 || candidates[0].Score <= 1 {
+		return "", errors.New("decoding failure")
+	}
+
+	return candidates[0].Decoded, nil
+}
+
+// RegisterDecoder добавляет декодер в DefaultDecoders
+func RegisterDecoder(decoder Decoder) {
+	DefaultDecoders.Register(decoder)
+}
+
+// SetTrustedHosts задает домены CDN для DefaultDecoders
+func SetTrustedHosts(hosts []string) {
+	DefaultDecoders.SetTrustedHosts(hosts)
+}
+
+// AutoDecode пытается расшифровать строку всеми декодерами DefaultDecoders
+func AutoDecode(input string) (string, error) {
+	return DefaultDecoders.Decode(input)
+}
+
+// Вычисляет «оценку» расшифрованной строки.
+// Оценка методом эвристики. Может меняться по необходимости
+func scoreCandidate(decoded string, trustedHosts []string) int {
+	score := 0
+
+	// строка без запретных символов - самый ценный параметр
+	if isCleanString(decoded) {
+		score += 50
+	}
+	// нужный нам домен
+	for _, host := range trustedHosts {
+		if host != "" && strings.Contains(decoded, host) {
+			score += 20
+			break
+		}
+	}
+	if strings.Contains(decoded, "://") {
+		score += 20
+	}
+	if strings.HasPrefix(decoded, "//") {
+		score += 10
+	}
+	if strings.Contains(decoded, ".mp4") {
+		score += 5
+	}
+	if strings.Contains(decoded, ".m3u8") {
+		score += 5
+	}
+	return score
+}
+
+// проверяет, что строка не содержит запрещенных в URL символов
+func isCleanString(s string) bool {
+	allowedSymbols := ":/.?&=%-_#[]"
+	for _, r := range s {
+		if !unicode.IsPrint(r) && !strings.ContainsRune(allowedSymbols, r) {
+			return false
+		}
+		if r == '\ufffd' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// rotEncode сдвигает латинские буквы вперед, обратно decodeROT
+func rotEncode(s string, shift int) string {
+	return decodeROT(s, 26-shift%26)
+}
+
+func TestAutoDecode(t *testing.T) {
+	link := "//cloud.kodik-storage.com/useruploads/abc/720.mp4:hls:manifest.m3u8"
+	encoded := base64.StdEncoding.EncodeToString([]byte(link))
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"base64", encoded},
+		{"reversed", ReverseString(encoded)},
+		{"rot13", rotEncode(encoded, 13)},
+		{"rot5", rotEncode(encoded, 5)},
+		{"base64url without padding", base64.RawURLEncoding.EncodeToString([]byte(link + "?a=1&b=~"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := AutoDecode(tt.input)
+			if err != nil {
+				t.Fatalf("AutoDecode: %v", err)
+			}
+			if decoded != link && decoded != link+"?a=1&b=~" {
+				t.Errorf("decoded %q", decoded)
+			}
+		})
+	}
+
+	if _, err := AutoDecode("!!!"); err == nil {
+		t.Error("AutoDecode of garbage succeeded")
+	}
+}
+
+func TestRegistryCustomDecoder(t *testing.T) {
+	link := "//cdn.example.org/video/720.mp4"
+	encoded := base64.StdEncoding.EncodeToString([]byte(xorString(link, "key")))
+
+	registry := NewDecoderRegistry(Chain("base64", Base64))
+	registry.Register(Chain("base64+xor", Base64, XOR("key")))
+
+	candidates := registry.Candidates(encoded)
+	if len(candidates) != 2 {
+		t.Fatalf("got %d candidates, want 2", len(candidates))
+	}
+	if candidates[0].Decoder != "base64+xor" || candidates[0].Decoded != link {
+		t.Errorf("best candidate = %+v", candidates[0])
+	}
+}
+
+func TestRegistryTrustedHosts(t *testing.T) {
+	registry := NewDecoderRegistry(Chain("base64", Base64))
+	input := base64.StdEncoding.EncodeToString([]byte("https://cdn.example.org/1.mp4"))
+
+	before := registry.Candidates(input)[0].Score
+
+	registry.SetTrustedHosts([]string{"cdn.example.org"})
+	after := registry.Candidates(input)[0].Score
+
+	if after <= before {
+		t.Errorf("trusted host score %d, want more than %d", after, before)
+	}
+}
+
+func xorString(s, key string) string {
+	out, _ := XOR(key)(s)
+	return out
+}
+
+func TestScriptDecoding(t *testing.T) {
+	script := `function d(e){return e.replace(/[a-zA-Z]/g,function(e){return String.fromCharCode((e<="Z"?90:122)>=(e=e.charCodeAt(0)+19)?e:e-26)})}`
+
+	decoding, err := ParseScriptDecoding(script)
+	if err != nil {
+		t.Fatalf("ParseScriptDecoding: %v", err)
+	}
+	if decoding.RotOffset != 19 {
+		t.Fatalf("RotOffset = %d, want 19", decoding.RotOffset)
+	}
+
+	// Скрипт сдвигает вперед на 19, значит ссылка закодирована сдвигом вперед на 7
+	link := "//cdn.example.org/720.mp4:hls:manifest.m3u8"
+	src := rotEncode(base64.StdEncoding.EncodeToString([]byte(link)), 7)
+
+	decoded, err := DecodeLink(src, decoding, nil)
+	if err != nil || decoded != link {
+		t.Errorf("DecodeLink = %q, %v", decoded, err)
+	}
+
+	if _, err := ParseScriptDecoding("var a = 1;"); err == nil {
+		t.Error("ParseScriptDecoding of script without offset succeeded")
+	}
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ExportFormat — формат, в котором выводятся результаты
+type ExportFormat string
+
+const (
+	ExportText ExportFormat = "text" // строки "Серия N: ссылка", как PrintResults
+	ExportM3U  ExportFormat = "m3u"  // расширенный M3U с названиями серий и заголовками для VLC
+	ExportXSPF ExportFormat = "xspf" // XSPF плейлист
+	ExportJSON ExportFormat = "json" // весь HandleResult в документе с версией формата
+	ExportCSV  ExportFormat = "csv"  // таблица со всеми сериями, в том числе с ошибками
+)
+
+// ExportFormats перечисляет поддерживаемые форматы
+var ExportFormats = []ExportFormat{ExportText, ExportM3U, ExportXSPF, ExportJSON, ExportCSV}
+
+// ExportVersion — версия JSON документа. Увеличивается при несовместимых изменениях полей
+const ExportVersion = 1
+
+// ExportDocument — JSON документ с результатами обработки
+type ExportDocument struct {
+	Version int          `json:"version"`
+	Result  HandleResult `json:"result"`
+}
+
+// ParseExportFormat возвращает формат по имени без учета регистра
+func ParseExportFormat(name string) (ExportFormat, error) {
+	format := ExportFormat(strings.ToLower(strings.TrimSpace(name)))
+	for _, known := range ExportFormats {
+		if format == known {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("неизвестный формат: %q (поддерживаются text, m3u, xspf, json, csv)", name)
+}
+
+// ExportFormatFromPath определяет формат по расширению файла: .m3u, .m3u8, .xspf, .json, .csv.
+// Для других расширений возвращает ExportText
+func ExportFormatFromPath(path string) ExportFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8":
+		return ExportM3U
+	case ".xspf":
+		return ExportXSPF
+	case ".json":
+		return ExportJSON
+	case ".csv":
+		return ExportCSV
+	}
+	return ExportText
+}
+
+// Export записывает результаты в w в формате format. Плейлисты содержат только успешные серии:
+// загруженные — путем к файлу, остальные — ссылкой на видео. JSON и CSV содержат все серии
+func Export(w io.Writer, result HandleResult, format ExportFormat) error {
+	switch format {
+	case ExportText:
+		for _, res := range result.Succeeded() {
+			if _, err := fmt.Fprintf(w, "Серия %s: %s\n", res.Seria.Label(), res.Video); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ExportM3U:
+		return exportM3U(w, result)
+	case ExportXSPF:
+		return exportXSPF(w, result)
+	case ExportJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(ExportDocument{Version: ExportVersion, Result: result})
+	case ExportCSV:
+		return exportCSV(w, result)
+	}
+	return fmt.Errorf("неизвестный формат: %q", format)
+}
+
+// trackTitle возвращает название серии в плейлисте: "Тайтл — Серия 5. Название серии".
+// Название вида "5 серия", которое Kodik ставит по умолчанию, не повторяется
+func trackTitle(result HandleResult, res Result) string {
+	name := "Серия " + res.Seria.Label()
+	if res.Seria.Title != "" && res.Seria.Title != res.Seria.Num+" серия" {
+		name += ". " + res.Seria.Title
+	}
+	if result.TitleName != "" {
+		name = result.TitleName + " — " + name
+	}
+	return name
+}
+
+// location возвращает путь к загруженному файлу или ссылку на видео. remote сообщает,
+// что это ссылка, для которой плееру нужны Referer и User-Agent
+func location(res Result) (loc string, remote bool) {
+	if res.Path != "" {
+		return res.Path, false
+	}
+	return res.Video, true
+}
+
+func exportM3U(w io.Writer, result HandleResult) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+
+	for _, res := range result.Succeeded() {
+		loc, remote := location(res)
+
+		// Перевод строки в названии сломал бы плейлист
+		title := strings.NewReplacer("\r", " ", "\n", " ").Replace(trackTitle(result, res))
+		fmt.Fprintf(&b, "#EXTINF:-1,%s\n", title)
+
+		// Без Referer и User-Agent браузера CDN Kodik может отказать в доступе
+		if remote {
+			if result.Referer != "" {
+				fmt.Fprintf(&b, "#EXTVLCOPT:http-referrer=%s\n", result.Referer)
+			}
+			fmt.Fprintf(&b, "#EXTVLCOPT:http-user-agent=%s\n", UserAgent)
+		}
+
+		b.WriteString(loc + "\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	Album    string `xml:"album,omitempty"`
+	TrackNum int    `xml:"trackNum,omitempty"`
+}
+
+func exportXSPF(w io.Writer, result HandleResult) error {
+	playlist := xspfPlaylist{Version: 1, Title: result.TitleName, Tracks: []xspfTrack{}}
+
+	for _, res := range result.Succeeded() {
+		loc, remote := location(res)
+		if !remote {
+			// В XSPF location — URI, поэтому локальный путь записывается как file://
+			if abs, err := filepath.Abs(loc); err == nil {
+				loc = abs
+			}
+			path := filepath.ToSlash(loc)
+			if !strings.HasPrefix(path, "/") {
+				// Путь Windows вида C:/...
+				path = "/" + path
+			}
+			loc = (&url.URL{Scheme: "file", Path: path}).String()
+		}
+
+		num, _ := strconv.Atoi(res.Seria.Num)
+		playlist.Tracks = append(playlist.Tracks, xspfTrack{
+			Location: loc,
+			Title:    trackTitle(result, res),
+			Album:    result.TitleName,
+			TrackNum: num,
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(playlist); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func exportCSV(w io.Writer, result HandleResult) error {
+	writer := csv.NewWriter(w)
+
+	writer.Write([]string{"title", "translation", "season", "episode", "episode_title", "quality", "status", "url", "path", "error"})
+	for _, res := range result.Results {
+		var errText string
+		if res.Err != nil {
+			errText = res.Err.Error()
+		}
+
+		var quality string
+		if res.Quality > 0 {
+			quality = strconv.Itoa(res.Quality)
+		}
+
+		writer.Write([]string{
+			result.TitleName,
+			result.Translation.Title,
+			strconv.Itoa(res.Seria.Season),
+			res.Seria.Num,
+			res.Seria.Title,
+			quality,
+			string(res.Status),
+			res.Video,
+			res.Path,
+			errText,
+		})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
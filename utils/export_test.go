@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func exportResult() HandleResult {
+	return HandleResult{
+		TitleName:   "Test Title",
+		Translation: KodikTranslation{ID: "610", Title: "AniLibria.TV"},
+		Referer:     "https://kodik.info/",
+		Results: []Result{
+			{
+				Seria:   KodikSeriaInfo{Num: "1", Title: "1 серия"},
+				Video:   "https://cloud.kodik-storage.com/1/720.mp4:hls:manifest.m3u8",
+				Quality: 720,
+				Status:  StatusResolved,
+			},
+			{
+				Seria:   KodikSeriaInfo{Num: "2", Title: "Начало"},
+				Video:   "https://cloud.kodik-storage.com/2/720.mp4:hls:manifest.m3u8",
+				Quality: 720,
+				Path:    "/videos/Test Title/2.ts",
+				Status:  StatusDownloaded,
+			},
+			{
+				Seria:  KodikSeriaInfo{Num: "3"},
+				Status: StatusResolveFailed,
+				Err:    errors.New("unexpected status code: 500"),
+			},
+		},
+	}
+}
+
+func export(t *testing.T, format ExportFormat) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := Export(&b, exportResult(), format); err != nil {
+		t.Fatalf("Export(%s): %v", format, err)
+	}
+	return b.String()
+}
+
+func TestExportM3U(t *testing.T) {
+	want := "#EXTM3U\n" +
+		"#EXTINF:-1,Test Title — Серия 1\n" +
+		"#EXTVLCOPT:http-referrer=https://kodik.info/\n" +
+		"#EXTVLCOPT:http-user-agent=" + UserAgent + "\n" +
+		"https://cloud.kodik-storage.com/1/720.mp4:hls:manifest.m3u8\n" +
+		"#EXTINF:-1,Test Title — Серия 2. Начало\n" +
+		"/videos/Test Title/2.ts\n"
+
+	if got := export(t, ExportM3U); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportXSPF(t *testing.T) {
+	var playlist xspfPlaylist
+	if err := xml.Unmarshal([]byte(export(t, ExportXSPF)), &playlist); err != nil {
+		t.Fatal(err)
+	}
+
+	if playlist.Title != "Test Title" || len(playlist.Tracks) != 2 {
+		t.Fatalf("playlist = %+v", playlist)
+	}
+	if track := playlist.Tracks[0]; track.Location != "https://cloud.kodik-storage.com/1/720.mp4:hls:manifest.m3u8" || track.TrackNum != 1 {
+		t.Errorf("track 1 = %+v", track)
+	}
+	if track := playlist.Tracks[1]; !strings.HasPrefix(track.Location, "file:///") || !strings.HasSuffix(track.Location, "/Test%20Title/2.ts") {
+		t.Errorf("track 2 location = %q", track.Location)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	var doc ExportDocument
+	if err := json.Unmarshal([]byte(export(t, ExportJSON)), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Version != ExportVersion || doc.Result.TitleName != "Test Title" || doc.Result.Referer != "https://kodik.info/" || len(doc.Result.Results) != 3 {
+		t.Fatalf("document = %+v", doc)
+	}
+	if res := doc.Result.Results[2]; res.Status != StatusResolveFailed || res.Err == nil || res.Err.Error() != "unexpected status code: 500" {
+		t.Errorf("failed episode = %+v", res)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	records, err := csv.NewReader(strings.NewReader(export(t, ExportCSV))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want header and 3 episodes", len(records))
+	}
+	if got := records[3]; got[3] != "3" || got[5] != "" || got[6] != string(StatusResolveFailed) || got[9] != "unexpected status code: 500" {
+		t.Errorf("failed episode = %q", got)
+	}
+	if got := records[2]; got[4] != "Начало" || got[5] != "720" || got[8] != "/videos/Test Title/2.ts" {
+		t.Errorf("downloaded episode = %q", got)
+	}
+}
+
+func TestParseExportFormat(t *testing.T) {
+	for _, name := range []string{"m3u", "XSPF", " json "} {
+		if _, err := ParseExportFormat(name); err != nil {
+			t.Errorf("ParseExportFormat(%q): %v", name, err)
+		}
+	}
+	if _, err := ParseExportFormat("pls"); err == nil {
+		t.Error("ParseExportFormat(pls) succeeded")
+	}
+
+	for path, want := range map[string]ExportFormat{"a.m3u8": ExportM3U, "a.XSPF": ExportXSPF, "a.csv": ExportCSV, "a.txt": ExportText} {
+		if got := ExportFormatFromPath(path); got != want {
+			t.Errorf("ExportFormatFromPath(%q) = %s, want %s", path, got, want)
+		}
+	}
+}
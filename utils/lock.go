@@ -0,0 +1,6 @@
+package utils
+
+import "errors"
+
+// ErrLocked — файл уже заблокирован другим процессом или другим открытием в этом процессе
+var ErrLocked = errors.New("file is locked by another process")
@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package utils
+
+import "os"
+
+// LockFile — на остальных системах блокировки файлов нет, и файл защищен
+// только блокировками самого процесса
+func LockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,12 @@
+package utils
+
+// Logf выводит сообщение журнала в формате fmt.Printf. Нулевое значение ничего не выводит:
+// пакеты библиотеки молчат, пока вызывающий код не передаст, например, log.Printf
+type Logf func(format string, args ...any)
+
+// Printf выводит сообщение, если функция журнала задана
+func (l Logf) Printf(format string, args ...any) {
+	if l != nil {
+		l(format, args...)
+	}
+}
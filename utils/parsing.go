@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -37,11 +38,38 @@ type KodikSerialDetails struct {
 	TranslationTitle string
 }
 
+// KodikTranslation описывает одну озвучку (или субтитры) из списка на странице плеера
+type KodikTranslation struct {
+	ID           string
+	Title        string
+	Type         string // voice или subtitles
+	MediaID      string
+	MediaHash    string
+	EpisodeCount int // 0, если количество серий не указано на странице
+	Selected     bool
+}
+
+// KodikSeason описывает сезон из списка сезонов на странице плеера
+type KodikSeason struct {
+	Number   int
+	Title    string
+	Selected bool
+}
+
 type KodikSeriaInfo struct {
-	Num   string
-	Id    string
-	Hash  string
-	Title string
+	Num    string
+	Id     string
+	Hash   string
+	Title  string
+	Season int // номер сезона; 0, если у сериала один сезон
+}
+
+// Label возвращает номер серии для вывода: "5" или "S2E5" для многосезонных сериалов
+func (s KodikSeriaInfo) Label() string {
+	if s.Season == 0 {
+		return s.Num
+	}
+	return fmt.Sprintf("S%dE%s", s.Season, s.Num)
 }
 
 type kodikLinkTypes struct {
@@ -50,23 +78,194 @@ type kodikLinkTypes struct {
 }
 
 type Config struct {
-	OpenInMpvNet       bool
-	MpvNetExecutable   string
-	DownloadResults    bool
-	MaxVideosDownloads int
-	MaxVideoWorkers    int
-	DownloaderVersion  int
+	OpenInMpvNet       bool          `json:"openInMpvNet"`
+	MpvNetExecutable   string        `json:"mpvNetExecutable"`
+	DownloadResults    bool          `json:"downloadResults"`
+	MaxVideosDownloads int           `json:"maxVideosDownloads"`
+	MaxVideoWorkers    int           `json:"maxVideoWorkers"`
+	DownloaderVersion  int           `json:"downloaderVersion"`
+	OutputDirectory    string        `json:"outputDirectory"`
+	FileTemplate       string        `json:"fileTemplate"`     // путь файла серии внутри OutputDirectory, см. DefaultFileTemplate
+	Remux              bool          `json:"remux"`            // перепаковать загруженные HLS .ts в MP4
+	MaxBandwidth       ByteRate      `json:"maxBandwidth"`     // общая скорость загрузки всех серий; 0 — без ограничения
+	EpisodeBandwidth   ByteRate      `json:"episodeBandwidth"` // скорость загрузки одной серии; 0 — без ограничения
+	ResolveRetries     int           `json:"resolveRetries"`
+	Retry              RetryConfig   `json:"retry"` // повторы запросов при временных ошибках
+	Translation        string        `json:"translation"`
+	Quality            QualityPolicy `json:"quality"`
+	HLSVariant         VariantPolicy `json:"hlsVariant"`   // выбор варианта, если хранилище отдало мастер плейлист
+	TrustedHosts       []string      `json:"trustedHosts"` // домены CDN, повышающие оценку при расшифровке ссылок
+	Server             ServerConfig  `json:"server"`       // HTTP API команды serve
+	Queue              QueueConfig   `json:"queue"`        // очередь загрузок команд enqueue и worker
+	Watch              WatchConfig   `json:"watch"`        // сериалы, новые серии которых загружает команда watch
+
+	// ReResolve заново получает ссылку на серию, если загрузчик обнаружил, что она истекла.
+	// nil — не получать ссылку заново
+	ReResolve func(ctx context.Context, result Result) (Result, error) `json:"-"`
+
+	// Progress получает ход загрузки серий; nil — ход загрузки никуда не передается
+	Progress *DownloadProgress `json:"-"`
 }
 
+// ServerConfig настраивает HTTP API команды serve
+type ServerConfig struct {
+	Listen  string `json:"listen"`  // адрес, например "127.0.0.1:8080"
+	Token   string `json:"token"`   // токен доступа; без него API отклоняет все запросы
+	MaxJobs int    `json:"maxJobs"` // сколько заданий загрузки выполняется одновременно
+
+	// Завершенные задания хранятся в памяти JobTTL секунд, но не больше MaxFinishedJobs последних
+	JobTTL          float64 `json:"jobTTL"`
+	MaxFinishedJobs int     `json:"maxFinishedJobs"`
+}
+
+// QueueConfig настраивает очередь загрузок, которая хранится на диске и переживает перезапуск
+type QueueConfig struct {
+	Directory  string  `json:"directory"`  // каталог с файлами заданий
+	Workers    int     `json:"workers"`    // сколько заданий выполняется одновременно
+	Attempts   int     `json:"attempts"`   // попыток на задание, после чего оно считается неудачным
+	RetryDelay float64 `json:"retryDelay"` // пауза перед повтором задания в секундах, удваивается с каждой попыткой
+}
+
+// WatchConfig настраивает команду watch, которая периодически проверяет сериалы и загружает новые серии
+type WatchConfig struct {
+	Interval  float64         `json:"interval"`  // пауза между проверками в секундах
+	Jitter    float64         `json:"jitter"`    // случайное отклонение паузы в обе стороны в секундах
+	StateFile string          `json:"stateFile"` // файл с уже виденными сериями
+	Serials   []WatchedSerial `json:"serials"`
+}
+
+// WatchedSerial — сериал, за которым следит watch. Пустые поля берутся из общего конфига
+type WatchedSerial struct {
+	URL         string         `json:"url"`
+	Translation string         `json:"translation,omitempty"` // id или название озвучки
+	Quality     *QualityPolicy `json:"quality,omitempty"`
+	Existing    bool           `json:"existing,omitempty"` // при первой проверке загрузить и уже вышедшие серии
+}
+
+// ResultStatus описывает, на каком этапе находится обработка серии
+type ResultStatus string
+
+const (
+	StatusPending        ResultStatus = ""
+	StatusResolved       ResultStatus = "resolved"
+	StatusResolveFailed  ResultStatus = "resolve_failed"
+	StatusDownloaded     ResultStatus = "downloaded"
+	StatusDownloadFailed ResultStatus = "download_failed"
+)
+
 type Result struct {
-	Seria KodikSeriaInfo
-	Video string
-	Path  string
+	Seria     KodikSeriaInfo
+	Video     string
+	Quality   int       // выбранное качество
+	Qualities []Quality // все доступные качества и их ссылки
+	Path      string
+	Status    ResultStatus
+	Err       error // причина ошибки для статусов *_failed
+	Attempts  int   // сколько раз запрашивалась ссылка
+
+	Variant *HLSVariant // вариант мастер плейлиста, выбранный при загрузке; nil, если плейлист не мастер
 }
 
 type HandleResult struct {
-	Results   []Result
-	TitleName string
+	Results     []Result
+	TitleName   string
+	Translation KodikTranslation
+	Referer     string // адрес плеера, с которого CDN ожидает запросы к видео; нужен внешним плеерам
+}
+
+// MarshalJSON записывает Err текстом ошибки: сам интерфейс error в JSON не сохраняется
+func (r Result) MarshalJSON() ([]byte, error) {
+	type result Result
+
+	var errText string
+	if r.Err != nil {
+		errText = r.Err.Error()
+	}
+
+	return json.Marshal(struct {
+		result
+		Err string `json:",omitempty"`
+	}{result(r), errText})
+}
+
+// UnmarshalJSON восстанавливает Err из текста ошибки, записанного MarshalJSON
+func (r *Result) UnmarshalJSON(data []byte) error {
+	type result Result
+
+	var decoded struct {
+		result
+		Err string
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*r = Result(decoded.result)
+	if decoded.Err != "" {
+		r.Err = errors.New(decoded.Err)
+	}
+	return nil
+}
+
+// Failed сообщает, завершилась ли обработка серии ошибкой
+func (r Result) Failed() bool {
+	return r.Err != nil
+}
+
+// Succeeded возвращает серии, обработанные без ошибок
+func (h HandleResult) Succeeded() []Result {
+	var results []Result
+	for _, res := range h.Results {
+		if !res.Failed() {
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// Failed возвращает серии, обработка которых завершилась ошибкой
+func (h HandleResult) Failed() []Result {
+	var results []Result
+	for _, res := range h.Results {
+		if res.Failed() {
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// ResultError перечисляет серии, которые не удалось обработать, по этапам
+type ResultError struct {
+	ResolveFailed  []string // серии без ссылок, см. KodikSeriaInfo.Label
+	DownloadFailed []string // серии, которые не удалось загрузить
+}
+
+func (e *ResultError) Error() string {
+	var parts []string
+	if len(e.DownloadFailed) > 0 {
+		parts = append(parts, "не удалось загрузить серии: "+strings.Join(e.DownloadFailed, ", "))
+	}
+	if len(e.ResolveFailed) > 0 {
+		parts = append(parts, "не удалось получить ссылки на серии: "+strings.Join(e.ResolveFailed, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Err возвращает *ResultError, если обработка каких-либо серий завершилась ошибкой, иначе nil
+func (h HandleResult) Err() error {
+	var err ResultError
+	for _, res := range h.Failed() {
+		if res.Status == StatusDownloadFailed {
+			err.DownloadFailed = append(err.DownloadFailed, res.Seria.Label())
+		} else {
+			err.ResolveFailed = append(err.ResolveFailed, res.Seria.Label())
+		}
+	}
+
+	if len(err.ResolveFailed) == 0 && len(err.DownloadFailed) == 0 {
+		return nil
+	}
+	return &err
 }
 
 func NewKodikLinkTypes() kodikLinkTypes {
@@ -101,6 +300,93 @@ func ParseSeasonSeries(body string) ([]KodikSeriaInfo, error) {
 	return seasonInfo, nil
 }
 
+// ParseSeasons извлекает список сезонов из тела страницы плеера
+func ParseSeasons(body string) ([]KodikSeason, error) {
+	var seasons []KodikSeason
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return seasons, err
+	}
+
+	doc.Find(".serial-seasons-box select option").Each(
+		func(i int, s *goquery.Selection) {
+			season := KodikSeason{}
+
+			season.Number, _ = strconv.Atoi(s.AttrOr("value", ""))
+			season.Title = strings.TrimSpace(s.Text())
+			_, season.Selected = s.Attr("selected")
+
+			seasons = append(seasons, season)
+		})
+
+	return seasons, nil
+}
+
+// ParseAllSeasonsSeries извлекает серии всех сезонов из скрытого блока .series-options,
+// в котором плеер хранит списки серий по сезонам (div.season-N)
+func ParseAllSeasonsSeries(body string) ([]KodikSeriaInfo, error) {
+	var seasonInfo []KodikSeriaInfo
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return seasonInfo, err
+	}
+
+	doc.Find(".series-options > div").Each(
+		func(i int, box *goquery.Selection) {
+			var season int
+			for _, class := range strings.Fields(box.AttrOr("class", "")) {
+				if n, err := strconv.Atoi(strings.TrimPrefix(class, "season-")); err == nil && strings.HasPrefix(class, "season-") {
+					season = n
+				}
+			}
+			if season == 0 {
+				return
+			}
+
+			box.Find("option").Each(func(i int, s *goquery.Selection) {
+				seriaInfo := KodikSeriaInfo{Season: season}
+
+				seriaInfo.Num, _ = s.Attr("value")
+				seriaInfo.Id, _ = s.Attr("data-id")
+				seriaInfo.Hash, _ = s.Attr("data-hash")
+				seriaInfo.Title, _ = s.Attr("data-title")
+
+				seasonInfo = append(seasonInfo, seriaInfo)
+			})
+		})
+
+	return seasonInfo, nil
+}
+
+// ParseTranslations извлекает список озвучек из тела страницы плеера
+func ParseTranslations(body string) ([]KodikTranslation, error) {
+	var translations []KodikTranslation
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return translations, err
+	}
+
+	doc.Find(".serial-translations-box select option, .movie-translations-box select option").Each(
+		func(i int, s *goquery.Selection) {
+			translation := KodikTranslation{}
+
+			translation.ID, _ = s.Attr("value")
+			translation.Title = s.AttrOr("data-title", strings.TrimSpace(s.Text()))
+			translation.Type, _ = s.Attr("data-translation-type")
+			translation.MediaID, _ = s.Attr("data-media-id")
+			translation.MediaHash, _ = s.Attr("data-media-hash")
+			translation.EpisodeCount, _ = strconv.Atoi(s.AttrOr("data-episode-count", ""))
+			_, translation.Selected = s.Attr("selected")
+
+			translations = append(translations, translation)
+		})
+
+	return translations, nil
+}
+
 // ParseURLParameters парсит параметры из строки body в структуру KodikParams
 func ParseURLParameters(body string, params *KodikParams) error {
 	r := regexp.MustCompile(`\{[^{}]*\}`)
@@ -231,6 +517,8 @@ func GetSecretMethod(body string) (string, error) {
 	return encoded, nil
 }
 
+// GetRot13Offset извлекает из скрипта плеера сдвиг, который он прибавляет к кодам букв
+// при расшифровке ссылок: charCodeAt(0)+N
 func GetRot13Offset(body string) (int, error) {
 	offsetStr, err := extractRegex(body, `\([a-zA-Z]+=[a-zA-Z]+\.charCodeAt\(0\)\+([0-9]+)\)`, "RotOffset")
 	if err != nil {
@@ -258,45 +546,19 @@ func parseJSONToMap(jsonStr string) (map[string]interface{}, error) {
 	return result, nil
 }
 
+// GetBestQualityURL возвращает первую ссылку наибольшего доступного качества
 func GetBestQualityURL(body string) (string, error) {
-	var (
-		bestQuality       string
-		currentQualityInt int
-		bestQualityInt    int
-	)
-
-	secretMap, _ := parseJSONToMap(body)
-
-	links, ok := secretMap["links"].(map[string]any)
-	if !ok {
-		return "", errors.New("failed to assert links to map[string]interface{}")
-	}
-
-	for currentQuality := range links {
-		currentQualityInt, _ = strconv.Atoi(currentQuality)
-		bestQualityInt, _ = strconv.Atoi(bestQuality)
-
-		if bestQuality == "" || currentQualityInt > bestQualityInt {
-			bestQuality = currentQuality
-		}
-	}
-
-	resolutions, ok := links[bestQuality].([]any)
-	if !ok {
-		return "", errors.New("failed to assert resolutions to []interface{}")
-	}
-
-	resolution, ok := resolutions[0].(map[string]any)
-	if !ok {
-		return "", errors.New("failed to assert resolution to map[string]interface{}")
+	qualities, err := ParseLinks(body, nil, nil)
+	if err != nil {
+		return "", err
 	}
 
-	decodedURL, err := AutoDecode(resolution["src"].(string))
+	best, err := QualityPolicy{}.Select(qualities)
 	if err != nil {
 		return "", err
 	}
 
-	return NormalizeURL(decodedURL), nil
+	return best.Sources[0].Src, nil
 }
 
 func GetLinkType(url string) int {
@@ -307,6 +569,28 @@ func GetLinkType(url string) int {
 	}
 }
 
+// DefaultFileTemplate — шаблон имени файла по умолчанию: папка тайтла и файл "5_серия.ts",
+// для многосезонных сериалов "2_сезон_5_серия.ts"
+const DefaultFileTemplate = "{title}/[{season}_сезон_]{episode}_серия.{ext}"
+
+// NewDefaultConfig возвращает конфигурацию со значениями по умолчанию,
+// которые используются для ключей, отсутствующих в config.json
+func NewDefaultConfig() Config {
+	return Config{
+		MaxVideosDownloads: 4,
+		MaxVideoWorkers:    4,
+		DownloaderVersion:  2,
+		OutputDirectory:    "videos",
+		FileTemplate:       DefaultFileTemplate,
+		ResolveRetries:     2,
+		Retry:              DefaultRetryConfig,
+		TrustedHosts:       DefaultTrustedHosts,
+		Server:             ServerConfig{Listen: "127.0.0.1:8080", MaxJobs: 1, JobTTL: 24 * 60 * 60, MaxFinishedJobs: 100},
+		Queue:              QueueConfig{Directory: "queue", Workers: 2, Attempts: 5, RetryDelay: 60},
+		Watch:              WatchConfig{Interval: 6 * 60 * 60, Jitter: 30 * 60, StateFile: "watch.json"},
+	}
+}
+
 func GetConfigFile(filename string) (Config, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -316,24 +600,18 @@ func GetConfigFile(filename string) (Config, error) {
 
 	data, err := io.ReadAll(file)
 	if err != nil {
-		fmt.Println("Error reading file:", err)
-		return Config{}, err
+		return Config{}, fmt.Errorf("ошибка чтения файла: %w", err)
 	}
 
-	result, _ := parseJSONToMap(string(data))
-
-	config := Config{
-		OpenInMpvNet:       result["openInMpvNet"].(bool),
-		MpvNetExecutable:   result["mpvNetExecutable"].(string),
-		DownloadResults:    result["downloadResults"].(bool),
-		MaxVideosDownloads: int(result["maxVideosDownloads"].(float64)),
-		MaxVideoWorkers:    int(result["maxVideoWorkers"].(float64)),
-		DownloaderVersion:  int(result["downloaderVersion"].(float64)),
+	config := NewDefaultConfig()
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("ошибка при разборе конфига: %w", err)
 	}
 
 	return config, nil
 }
 
+// SortResults сортирует результаты по сезону, затем по номеру серии
 func SortResults(results []Result) []Result {
 	var (
 		sortedResults []Result
@@ -346,7 +624,8 @@ func SortResults(results []Result) []Result {
 			sNumFirst, _ = strconv.Atoi(results[i].Seria.Num)
 			sNumSecond, _ = strconv.Atoi(results[j].Seria.Num)
 
-			if sNumFirst > sNumSecond {
+			if results[i].Seria.Season > results[j].Seria.Season ||
+				(results[i].Seria.Season == results[j].Seria.Season && sNumFirst > sNumSecond) {
 				results[i], results[j] = results[j], results[i]
 			}
 		}
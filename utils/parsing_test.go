@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResultJSON(t *testing.T) {
+	result := Result{
+		Seria:   KodikSeriaInfo{Num: "5", Id: "11005", Season: 2},
+		Video:   "https://cloud.kodik-storage.com/720.mp4:hls:manifest.m3u8",
+		Quality: 720,
+		Status:  StatusDownloadFailed,
+		Err:     errors.New("unexpected status code: 404"),
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Err":"unexpected status code: 404"`) {
+		t.Errorf("Err is not written as text: %s", data)
+	}
+
+	var decoded Result
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Seria != result.Seria || decoded.Video != result.Video || decoded.Status != result.Status ||
+		decoded.Err == nil || decoded.Err.Error() != result.Err.Error() {
+		t.Errorf("decoded %+v, want %+v", decoded, result)
+	}
+
+	// Успешная серия записывается без Err и читается с nil
+	data, _ = json.Marshal(Result{Status: StatusResolved})
+	decoded = Result{}
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Err != nil || strings.Contains(string(data), "Err") {
+		t.Errorf("%s decoded with Err = %v, %v", data, decoded.Err, err)
+	}
+}
+
+func TestHandleResultErr(t *testing.T) {
+	result := HandleResult{Results: []Result{
+		{Seria: KodikSeriaInfo{Num: "1"}, Status: StatusDownloaded},
+		{Seria: KodikSeriaInfo{Num: "2"}, Status: StatusResolveFailed, Err: errors.New("no links")},
+		{Seria: KodikSeriaInfo{Num: "3", Season: 2}, Status: StatusDownloadFailed, Err: errors.New("404")},
+	}}
+
+	var resultErr *ResultError
+	if err := result.Err(); !errors.As(err, &resultErr) {
+		t.Fatalf("Err() = %v, want *ResultError", err)
+	}
+	if len(resultErr.ResolveFailed) != 1 || resultErr.ResolveFailed[0] != "2" ||
+		len(resultErr.DownloadFailed) != 1 || resultErr.DownloadFailed[0] != "S2E3" {
+		t.Errorf("ResultError = %+v", resultErr)
+	}
+	if want := "не удалось загрузить серии: S2E3; не удалось получить ссылки на серии: 2"; resultErr.Error() != want {
+		t.Errorf("Error() = %q, want %q", resultErr.Error(), want)
+	}
+
+	if err := (HandleResult{Results: result.Results[:1]}).Err(); err != nil {
+		t.Errorf("Err() of successful result = %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// DownloadProgress собирает ход загрузки серий. Загрузчики обновляют его из своих горутин,
+// а интерфейс периодически читает снимок через Snapshot
+type DownloadProgress struct {
+	mu       sync.Mutex
+	episodes []*EpisodeProgress // в порядке начала загрузки
+}
+
+func NewDownloadProgress() *DownloadProgress {
+	return &DownloadProgress{}
+}
+
+// Episode начинает учет загрузки серии
+func (p *DownloadProgress) Episode(seria KodikSeriaInfo) *EpisodeProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	episode := &EpisodeProgress{stats: EpisodeStats{Seria: seria, Started: time.Now()}}
+	p.episodes = append(p.episodes, episode)
+
+	return episode
+}
+
+// Snapshot возвращает состояние всех начатых серий
+func (p *DownloadProgress) Snapshot() []EpisodeStats {
+	p.mu.Lock()
+	episodes := append([]*EpisodeProgress(nil), p.episodes...)
+	p.mu.Unlock()
+
+	stats := make([]EpisodeStats, len(episodes))
+	for i, episode := range episodes {
+		stats[i] = episode.Stats()
+	}
+	return stats
+}
+
+// EpisodeStats — состояние загрузки одной серии
+type EpisodeStats struct {
+	Seria KodikSeriaInfo
+
+	Bytes        int64 // загружено байт, включая уже лежавшие на диске
+	ResumedBytes int64 // байт, загруженных при прошлом запуске
+	TotalBytes   int64 // размер из Content-Length; 0 — неизвестен
+
+	Fragments      int     // записано фрагментов HLS
+	TotalFragments int     // фрагментов в плейлисте; 0 — загрузка не по HLS
+	Duration       float64 // длительность записанных фрагментов в секундах
+	TotalDuration  float64 // длительность плейлиста в секундах
+
+	Started  time.Time
+	Finished time.Time // нулевое значение — загрузка идет
+	Err      error
+}
+
+// Done сообщает, завершена ли загрузка серии, успешно или с ошибкой
+func (s EpisodeStats) Done() bool {
+	return !s.Finished.IsZero()
+}
+
+// EstimatedTotal возвращает ожидаемый размер серии: из Content-Length, а для HLS —
+// пропорционально длительности или числу записанных фрагментов. 0 — оценить пока нельзя
+func (s EpisodeStats) EstimatedTotal() int64 {
+	switch {
+	case s.TotalBytes > 0:
+		return s.TotalBytes
+	case s.Done() && s.Err == nil:
+		return s.Bytes
+	case s.TotalDuration > 0 && s.Duration > 0:
+		return int64(float64(s.Bytes) * s.TotalDuration / s.Duration)
+	case s.TotalFragments > 0 && s.Fragments > 0:
+		return s.Bytes * int64(s.TotalFragments) / int64(s.Fragments)
+	}
+	return 0
+}
+
+// Elapsed возвращает время загрузки: до завершения или до now, если загрузка идет
+func (s EpisodeStats) Elapsed(now time.Time) time.Duration {
+	if s.Done() {
+		return s.Finished.Sub(s.Started)
+	}
+	return now.Sub(s.Started)
+}
+
+// AverageSpeed возвращает среднюю скорость в байтах в секунду без учета продолжения с диска
+func (s EpisodeStats) AverageSpeed(now time.Time) ByteRate {
+	elapsed := s.Elapsed(now).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return ByteRate(float64(s.Bytes-s.ResumedBytes) / elapsed)
+}
+
+// EpisodeProgress — ход загрузки одной серии. Методы безопасны для вызова из разных горутин
+type EpisodeProgress struct {
+	mu    sync.Mutex
+	stats EpisodeStats
+}
+
+// SetTotalBytes задает размер серии из Content-Length
+func (e *EpisodeProgress) SetTotalBytes(total int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.TotalBytes = total
+}
+
+// SetFragments задает число фрагментов и длительность плейлиста
+func (e *EpisodeProgress) SetFragments(total int, duration float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.TotalFragments = total
+	e.stats.TotalDuration = duration
+}
+
+// Resume учитывает данные, загруженные при прошлом запуске
+func (e *EpisodeProgress) Resume(bytes int64, fragments int, duration float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.Bytes += bytes
+	e.stats.ResumedBytes += bytes
+	e.stats.Fragments += fragments
+	e.stats.Duration += duration
+}
+
+// Add учитывает принятые байты. Отрицательное n отменяет байты неудачной попытки
+func (e *EpisodeProgress) Add(n int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.Bytes += n
+}
+
+// Write учитывает байты, проходящие через io.TeeReader
+func (e *EpisodeProgress) Write(p []byte) (int, error) {
+	e.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// FragmentDone учитывает записанный в файл фрагмент HLS
+func (e *EpisodeProgress) FragmentDone(duration float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.Fragments++
+	e.stats.Duration += duration
+}
+
+// Finish завершает учет серии; err — причина неудачи или nil
+func (e *EpisodeProgress) Finish(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.Finished = time.Now()
+	e.stats.Err = err
+}
+
+// Stats возвращает текущее состояние серии
+func (e *EpisodeProgress) Stats() EpisodeStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.stats
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEpisodeStatsEstimatedTotal(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats EpisodeStats
+		want  int64
+	}{
+		{"content length", EpisodeStats{Bytes: 10, TotalBytes: 100}, 100},
+		{"by duration", EpisodeStats{Bytes: 300, Duration: 12, TotalDuration: 48}, 1200},
+		{"by fragments", EpisodeStats{Bytes: 300, Fragments: 3, TotalFragments: 12}, 1200},
+		{"nothing yet", EpisodeStats{TotalFragments: 12, TotalDuration: 48}, 0},
+		{"finished", EpisodeStats{Bytes: 500, Duration: 12, TotalDuration: 48, Finished: time.Now()}, 500},
+		{"failed", EpisodeStats{Bytes: 300, Duration: 12, TotalDuration: 48, Finished: time.Now(), Err: errors.New("x")}, 1200},
+	}
+
+	for _, tt := range tests {
+		if got := tt.stats.EstimatedTotal(); got != tt.want {
+			t.Errorf("%s: EstimatedTotal() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadProgress(t *testing.T) {
+	progress := NewDownloadProgress()
+
+	episode := progress.Episode(KodikSeriaInfo{Num: "1"})
+	episode.SetFragments(4, 24)
+	episode.Resume(1000, 1, 6)
+	episode.Write(make([]byte, 700))
+	episode.Add(-200)
+	episode.FragmentDone(6)
+
+	progress.Episode(KodikSeriaInfo{Num: "2"}).Finish(errors.New("failed"))
+
+	stats := progress.Snapshot()
+	if len(stats) != 2 {
+		t.Fatalf("got %d episodes, want 2", len(stats))
+	}
+
+	s := stats[0]
+	if s.Bytes != 1500 || s.ResumedBytes != 1000 || s.Fragments != 2 || s.Duration != 12 || s.Done() {
+		t.Errorf("stats = %+v", s)
+	}
+	if s.EstimatedTotal() != 3000 {
+		t.Errorf("EstimatedTotal() = %d, want 3000", s.EstimatedTotal())
+	}
+
+	if !stats[1].Done() || stats[1].Err == nil {
+		t.Errorf("second episode = %+v, want failed", stats[1])
+	}
+}
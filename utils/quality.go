@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VideoSource — одна расшифрованная ссылка на видео определенного качества
+type VideoSource struct {
+	Src  string
+	Type string
+}
+
+// Quality — качество видео (высота кадра) и все ссылки на него
+type Quality struct {
+	Height  int
+	Sources []VideoSource
+}
+
+// QualityPolicy определяет, какое качество выбирать из доступных.
+// Нулевое значение выбирает наибольшее качество
+type QualityPolicy struct {
+	Preferred int   `json:"preferred"` // предпочтительное качество, например 720
+	Max       int   `json:"max"`       // максимальное допустимое качество; 0 — без ограничения
+	Fallback  []int `json:"fallback"`  // качества, которые перебираются по порядку, если нет предпочтительного
+	Closest   int   `json:"closest"`   // выбрать качество, ближайшее к указанному; перекрывает остальные правила
+}
+
+// Select выбирает качество согласно политике. Качества сверх Max не рассматриваются;
+// если подходящих правил нет, выбирается наибольшее из оставшихся
+func (p QualityPolicy) Select(qualities []Quality) (Quality, error) {
+	var candidates []Quality
+	for _, quality := range qualities {
+		if len(quality.Sources) == 0 {
+			continue
+		}
+		if p.Max > 0 && quality.Height > p.Max {
+			continue
+		}
+		candidates = append(candidates, quality)
+	}
+
+	if len(candidates) == 0 {
+		if p.Max > 0 {
+			return Quality{}, fmt.Errorf("no quality up to %dp among %s", p.Max, QualityList(qualities))
+		}
+		return Quality{}, errors.New("no qualities available")
+	}
+
+	// Сортируем по убыванию качества
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Height > candidates[j].Height
+	})
+
+	if p.Closest > 0 {
+		best := candidates[0]
+		for _, quality := range candidates[1:] {
+			// При равном расстоянии выбирается меньшее качество
+			if abs(quality.Height-p.Closest) <= abs(best.Height-p.Closest) {
+				best = quality
+			}
+		}
+		return best, nil
+	}
+
+	for _, height := range append([]int{p.Preferred}, p.Fallback...) {
+		if height <= 0 {
+			continue
+		}
+		for _, quality := range candidates {
+			if quality.Height == height {
+				return quality, nil
+			}
+		}
+	}
+
+	return candidates[0], nil
+}
+
+// HLSVariant — вариант потока из мастер плейлиста HLS (EXT-X-STREAM-INF)
+type HLSVariant struct {
+	URL        string
+	Bandwidth  int
+	Width      int
+	Height     int
+	Codecs     string
+	Audio      string // GROUP-ID группы аудиодорожек
+	AudioNames []string
+}
+
+// String возвращает вариант в виде "1280x720, 2500 kbit/s"
+func (v HLSVariant) String() string {
+	resolution := "unknown resolution"
+	if v.Height > 0 {
+		resolution = fmt.Sprintf("%dx%d", v.Width, v.Height)
+	}
+	return fmt.Sprintf("%s, %d kbit/s", resolution, v.Bandwidth/1000)
+}
+
+// VariantPolicy определяет, какой вариант выбирать из мастер плейлиста.
+// Нулевое значение выбирает наибольшее разрешение
+type VariantPolicy struct {
+	Preferred int `json:"preferred"` // предпочтительная высота кадра, например 720
+	Max       int `json:"max"`       // максимальная высота кадра; 0 — без ограничения
+}
+
+// Select выбирает вариант: с предпочтительной высотой, иначе с наибольшей высотой не выше Max.
+// При равной высоте выбирается больший битрейт. Если все варианты выше Max, выбирается наименьший
+func (p VariantPolicy) Select(variants []HLSVariant) (HLSVariant, error) {
+	if len(variants) == 0 {
+		return HLSVariant{}, errors.New("no variants in master playlist")
+	}
+
+	sorted := make([]HLSVariant, len(variants))
+	copy(sorted, variants)
+
+	// По убыванию высоты, затем битрейта
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Height != sorted[j].Height {
+			return sorted[i].Height > sorted[j].Height
+		}
+		return sorted[i].Bandwidth > sorted[j].Bandwidth
+	})
+
+	var candidates []HLSVariant
+	for _, variant := range sorted {
+		if p.Max > 0 && variant.Height > p.Max {
+			continue
+		}
+		candidates = append(candidates, variant)
+	}
+
+	if len(candidates) == 0 {
+		return sorted[len(sorted)-1], nil
+	}
+
+	if p.Preferred > 0 {
+		for _, variant := range candidates {
+			if variant.Height == p.Preferred {
+				return variant, nil
+			}
+		}
+	}
+
+	return candidates[0], nil
+}
+
+// ParseQualityList разбирает список качеств вида "720,480,360"
+func ParseQualityList(s string) ([]int, error) {
+	var list []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSuffix(strings.TrimSpace(part), "p")
+		if part == "" {
+			continue
+		}
+
+		height, err := strconv.Atoi(part)
+		if err != nil || height <= 0 {
+			return nil, fmt.Errorf("неверное качество: %q", part)
+		}
+		list = append(list, height)
+	}
+	return list, nil
+}
+
+// QualityList возвращает доступные качества строкой вида "720p, 480p"
+func QualityList(qualities []Quality) string {
+	var names []string
+	for _, quality := range qualities {
+		names = append(names, fmt.Sprintf("%dp", quality.Height))
+	}
+	return strings.Join(names, ", ")
+}
+
+// ParseLinks извлекает из ответа секретного метода все качества и расшифровывает их ссылки
+// параметрами из скрипта плеера (см. DecodeLink); nil decoding означает эвристику AutoDecode.
+// Качества отсортированы по убыванию, переход на эвристику записывается в журнал log
+func ParseLinks(body string, decoding *ScriptDecoding, log Logf) ([]Quality, error) {
+	secretMap, err := parseJSONToMap(body)
+	if err != nil {
+		return nil, err
+	}
+
+	links, ok := secretMap["links"].(map[string]any)
+	if !ok {
+		return nil, errors.New("failed to assert links to map[string]interface{}")
+	}
+
+	var qualities []Quality
+	for key, value := range links {
+		height, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+
+		resolutions, ok := value.([]any)
+		if !ok {
+			return nil, errors.New("failed to assert resolutions to []interface{}")
+		}
+
+		quality := Quality{Height: height}
+		for _, raw := range resolutions {
+			resolution, ok := raw.(map[string]any)
+			if !ok {
+				return nil, errors.New("failed to assert resolution to map[string]interface{}")
+			}
+
+			src, ok := resolution["src"].(string)
+			if !ok {
+				continue
+			}
+
+			decodedURL, err := DecodeLink(src, decoding, log)
+			if err != nil {
+				return nil, fmt.Errorf("quality %dp: %w", height, err)
+			}
+
+			sourceType, _ := resolution["type"].(string)
+			quality.Sources = append(quality.Sources, VideoSource{
+				Src:  NormalizeURL(decodedURL),
+				Type: sourceType,
+			})
+		}
+
+		qualities = append(qualities, quality)
+	}
+
+	if len(qualities) == 0 {
+		return nil, errors.New("no links in response")
+	}
+
+	sort.Slice(qualities, func(i, j int) bool {
+		return qualities[i].Height > qualities[j].Height
+	})
+
+	return qualities, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
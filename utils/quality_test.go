@@ -0,0 +1,64 @@
+package utils
+
+import "testing"
+
+func TestVariantPolicySelect(t *testing.T) {
+	variants := []HLSVariant{
+		{URL: "360", Height: 360, Bandwidth: 800},
+		{URL: "720-low", Height: 720, Bandwidth: 2000},
+		{URL: "720-high", Height: 720, Bandwidth: 3000},
+		{URL: "1080", Height: 1080, Bandwidth: 5000},
+	}
+
+	tests := []struct {
+		policy VariantPolicy
+		want   string
+	}{
+		{VariantPolicy{}, "1080"},
+		{VariantPolicy{Max: 720}, "720-high"},
+		{VariantPolicy{Preferred: 360}, "360"},
+		{VariantPolicy{Preferred: 480, Max: 1000}, "720-high"},
+		{VariantPolicy{Max: 240}, "360"},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.policy.Select(variants)
+		if err != nil {
+			t.Errorf("%+v: %v", tt.policy, err)
+			continue
+		}
+		if got.URL != tt.want {
+			t.Errorf("%+v: selected %s, want %s", tt.policy, got.URL, tt.want)
+		}
+	}
+
+	if _, err := (VariantPolicy{}).Select(nil); err == nil {
+		t.Error("Select of no variants succeeded")
+	}
+}
+
+func TestQualityPolicySelect(t *testing.T) {
+	qualities := []Quality{
+		{Height: 360, Sources: []VideoSource{{Src: "360"}}},
+		{Height: 480, Sources: []VideoSource{{Src: "480"}}},
+		{Height: 720, Sources: []VideoSource{{Src: "720"}}},
+	}
+
+	tests := []struct {
+		policy QualityPolicy
+		want   int
+	}{
+		{QualityPolicy{}, 720},
+		{QualityPolicy{Preferred: 480}, 480},
+		{QualityPolicy{Preferred: 1080, Fallback: []int{360}}, 360},
+		{QualityPolicy{Max: 600}, 480},
+		{QualityPolicy{Closest: 600}, 480},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.policy.Select(qualities)
+		if err != nil || got.Height != tt.want {
+			t.Errorf("%+v: selected %d, %v; want %d", tt.policy, got.Height, err, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -20,6 +21,12 @@ type kodikPageType struct {
 	SECRET_METHOD     int
 }
 
+// HTTPDoer выполняет HTTP запросы. Ему удовлетворяет *http.Client,
+// а в тестах и сторонних сервисах можно подставить свою реализацию
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
 type KodikRequestParams struct {
 	url          string
 	referer      string
@@ -59,52 +66,59 @@ func GetKodikRequestParams(url string, referer string, origin string, content_ty
 		NormalizeURL(url), NormalizeURL(referer), NormalizeURL(origin), content_type, NormalizeURL(host), page_type, seria_info)
 }
 
-func GetPage(client *http.Client, kodikParams *KodikParams, requestParams KodikRequestParams) (string, error) {
-	req, err := http.NewRequest("GET", requestParams.url, nil)
-	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
-	}
+// GetPage выполняет GET запрос к Kodik и возвращает тело ответа.
+// Временные ошибки повторяются по политике retry; nil — без повторов
+func GetPage(ctx context.Context, client HTTPDoer, retry *Retrier, kodikParams *KodikParams, requestParams KodikRequestParams) (string, error) {
+	var body string
+	err := retry.Do(ctx, "GET "+requestParams.url, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", requestParams.url, nil)
+		if err != nil {
+			return fmt.Errorf("error creating request: %w", err)
+		}
 
-	// Установка заголовков
-	SetHeaders(req, requestParams.page_type, kodikParams, requestParams)
+		// Установка заголовков
+		SetHeaders(req, requestParams.page_type, kodikParams, requestParams)
 
-	// Выполняем запрос
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("error making request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Обработка ответа
-	body, err := processResponseBody(resp)
-	if err != nil {
-		return "", err
-	}
+		body, err = sendRequest(client, req)
+		return err
+	})
 
-	return body, nil
+	return body, err
 }
 
-func PostPage(client *http.Client, kodikParams *KodikParams, requestParams KodikRequestParams, seriaType int) (string, error) {
-	var (
-		req *http.Request
-		err error
-	)
+// PostPage выполняет POST запрос к Kodik и возвращает тело ответа. Для секретного метода
+// тело запроса собирается заново на каждую попытку
+func PostPage(ctx context.Context, client HTTPDoer, retry *Retrier, kodikParams *KodikParams, requestParams KodikRequestParams, seriaType int) (string, error) {
+	var body string
+	err := retry.Do(ctx, "POST "+requestParams.url, func() error {
+		var (
+			req *http.Request
+			err error
+		)
+
+		switch requestParams.page_type {
+		case KodikPage.SECRET_METHOD:
+			req, err = http.NewRequestWithContext(ctx, "POST", requestParams.url, GetSecretMethodPayload(kodikParams, requestParams.seria, seriaType))
+		default:
+			req, err = http.NewRequestWithContext(ctx, "POST", requestParams.url, nil)
+		}
 
-	switch requestParams.page_type {
-	case KodikPage.SECRET_METHOD:
-		req, err = http.NewRequest("POST", requestParams.url, GetSecretMethodPayload(kodikParams, requestParams.seria, seriaType))
-	default:
-		req, err = http.NewRequest("POST", requestParams.url, nil)
-	}
+		if err != nil {
+			return fmt.Errorf("error creating request: %w", err)
+		}
 
-	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
-	}
+		// Установка заголовков
+		SetHeaders(req, requestParams.page_type, kodikParams, requestParams)
 
-	// Установка заголовков
-	SetHeaders(req, requestParams.page_type, kodikParams, requestParams)
+		body, err = sendRequest(client, req)
+		return err
+	})
 
-	// Выполняем запрос
+	return body, err
+}
+
+// sendRequest выполняет запрос и читает тело ответа
+func sendRequest(client HTTPDoer, req *http.Request) (string, error) {
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("error making request: %w", err)
@@ -112,18 +126,17 @@ func PostPage(client *http.Client, kodikParams *KodikParams, requestParams Kodik
 	defer resp.Body.Close()
 
 	// Обработка ответа
-	body, err := processResponseBody(resp)
-	if err != nil {
-		return "", err
-	}
-
-	return body, nil
+	return processResponseBody(resp)
 }
 
 func processResponseBody(resp *http.Response) (string, error) {
 	var reader io.ReadCloser
 	var err error
 
+	if resp.StatusCode != http.StatusOK {
+		return "", NewHTTPStatusError(resp)
+	}
+
 	// Обрабатываем сжато или не сжато содержимое
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPStatusError — ответ сервера с неожиданным статусом
+type HTTPStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration // из заголовка Retry-After; 0 — не задан
+}
+
+// NewHTTPStatusError создает ошибку по ответу сервера, разбирая Retry-After
+// в секундах или в виде даты HTTP
+func NewHTTPStatusError(resp *http.Response) *HTTPStatusError {
+	err := &HTTPStatusError{StatusCode: resp.StatusCode}
+
+	value := resp.Header.Get("Retry-After")
+	if seconds, parseErr := strconv.Atoi(value); parseErr == nil && seconds > 0 {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	} else if date, parseErr := http.ParseTime(value); parseErr == nil {
+		err.RetryAfter = max(0, time.Until(date))
+	}
+
+	return err
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// Retryable сообщает, стоит ли повторять запрос с таким статусом: 408, 429 и 5xx, кроме 501 и 505
+func (e *HTTPStatusError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return e.StatusCode >= 500 && e.StatusCode <= 599
+}
+
+// IsRetryable сообщает, временная ли ошибка: таймауты, сброс и обрыв соединения и повторяемые статусы HTTP.
+// Отмена контекста, ошибки сертификатов, разбора и статусы вроде 403 и 404 повторять бесполезно
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Retryable()
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	// Таймауты запроса и рукопожатия TLS, в том числе context.DeadlineExceeded от Timeout клиента
+	var timeoutErr interface{ Timeout() bool }
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+		return true
+	}
+
+	// Из остальных ошибок сокета повторяется только сброс соединения: отказ в соединении
+	// или недоступная сеть при повторе через секунду скорее всего останутся такими же
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return errConnReset != nil && errors.Is(err, errConnReset)
+	}
+
+	// Сервер закрыл соединение, не дослав ответ
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// RetryPolicy определяет, сколько раз и с какими паузами повторять временные ошибки.
+// Нулевое значение не повторяет запросы
+type RetryPolicy struct {
+	Attempts  int     `json:"attempts"`  // всего попыток одного запроса, включая первую
+	BaseDelay float64 `json:"baseDelay"` // пауза перед первым повтором в секундах, дальше удваивается
+	MaxDelay  float64 `json:"maxDelay"`  // наибольшая пауза в секундах; Retry-After длиннее нее не ждем
+	Budget    int     `json:"budget"`    // повторов на весь этап (получение ссылок, загрузка серии); 0 — без ограничения
+}
+
+// RetryConfig — политики повторов для этапов
+type RetryConfig struct {
+	Resolve  RetryPolicy `json:"resolve"`  // запросы страниц и секретного метода Kodik
+	Download RetryPolicy `json:"download"` // плейлисты, ключи, фрагменты и части одной серии
+}
+
+// DefaultRetryConfig — политики повторов по умолчанию
+var DefaultRetryConfig = RetryConfig{
+	Resolve:  RetryPolicy{Attempts: 3, BaseDelay: 1, MaxDelay: 30, Budget: 20},
+	Download: RetryPolicy{Attempts: 5, BaseDelay: 1, MaxDelay: 60, Budget: 100},
+}
+
+// delay возвращает паузу перед повтором номер retry (с 1): экспоненциальный рост
+// со случайной половиной, чтобы параллельные запросы не повторялись одновременно.
+// Retry-After сервера увеличивает паузу; false — сервер просит ждать дольше MaxDelay,
+// тогда возвращается запрошенная им пауза
+func (p RetryPolicy) delay(retry int, err error) (time.Duration, bool) {
+	maxDelay := time.Duration(p.MaxDelay * float64(time.Second))
+
+	d := time.Duration(p.BaseDelay * float64(time.Second))
+	for i := 1; i < retry && (maxDelay <= 0 || d < maxDelay); i++ {
+		d *= 2
+	}
+	if maxDelay > 0 {
+		d = min(d, maxDelay)
+	}
+	if d > 0 {
+		d = d/2 + rand.N(d/2+1)
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if maxDelay > 0 && statusErr.RetryAfter > maxDelay {
+			return statusErr.RetryAfter, false
+		}
+		d = max(d, statusErr.RetryAfter)
+	}
+
+	return d, true
+}
+
+// Retrier повторяет операции одного этапа по политике, расходуя общий для этапа бюджет повторов.
+// nil *Retrier выполняет операцию один раз
+type Retrier struct {
+	policy RetryPolicy
+	stage  string
+	log    Logf
+
+	mu     sync.Mutex
+	budget int // оставшиеся повторы; -1 — без ограничения
+}
+
+// NewRetrier создает повторитель этапа stage; имя этапа попадает в журнал log и ошибки
+func (p RetryPolicy) NewRetrier(stage string, log Logf) *Retrier {
+	budget := p.Budget
+	if budget <= 0 {
+		budget = -1
+	}
+	return &Retrier{policy: p, stage: stage, log: log, budget: budget}
+}
+
+// take забирает один повтор из бюджета этапа
+func (r *Retrier) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case r.budget < 0:
+		return true
+	case r.budget == 0:
+		return false
+	}
+	r.budget--
+	return true
+}
+
+// Do выполняет fn и повторяет ее при временных ошибках, пока не кончатся попытки или бюджет этапа.
+// what описывает операцию в логе, например "fragment 3"
+func (r *Retrier) Do(ctx context.Context, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || r == nil || ctx.Err() != nil || !IsRetryable(err) {
+			return err
+		}
+
+		if attempt >= r.policy.Attempts {
+			if attempt > 1 {
+				return fmt.Errorf("%w (gave up after %d attempts)", err, attempt)
+			}
+			return err
+		}
+
+		delay, ok := r.policy.delay(attempt, err)
+		if !ok {
+			r.log.Printf("%s: %s failed (attempt %d of %d), not retrying: server asks to wait %v, longer than maxDelay %gs: %v", r.stage, what, attempt, r.policy.Attempts, delay.Round(time.Millisecond), r.policy.MaxDelay, err)
+			return fmt.Errorf("%w (server asks to retry later than %gs)", err, r.policy.MaxDelay)
+		}
+
+		if !r.take() {
+			return fmt.Errorf("%w (retry budget of %s is exhausted)", err, r.stage)
+		}
+
+		r.log.Printf("%s: %s failed (attempt %d of %d), retrying in %v: %v", r.stage, what, attempt, r.policy.Attempts, delay.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
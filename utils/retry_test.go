@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HTTPStatusError{StatusCode: 500}, true},
+		{&HTTPStatusError{StatusCode: 503}, true},
+		{&HTTPStatusError{StatusCode: 429}, true},
+		{&HTTPStatusError{StatusCode: 408}, true},
+		{&HTTPStatusError{StatusCode: 501}, false},
+		{&HTTPStatusError{StatusCode: 404}, false},
+		{&HTTPStatusError{StatusCode: 403}, false},
+		{fmt.Errorf("fragment 3: %w", &HTTPStatusError{StatusCode: 502}), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false},
+		{&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: errConnReset}}, errConnReset != nil},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), true},
+		{errors.New("unsupported encryption method"), false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNewHTTPStatusError(t *testing.T) {
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		header   string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{date, 58 * time.Second, time.Minute},
+		{"soon", 0, 0},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: 429, Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+
+		err := NewHTTPStatusError(resp)
+		if err.RetryAfter < tt.min || err.RetryAfter > tt.max {
+			t.Errorf("Retry-After %q: RetryAfter = %v, want %v..%v", tt.header, err.RetryAfter, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, BaseDelay: 1, MaxDelay: 5}
+
+	for retry, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 8: 5 * time.Second} {
+		d, ok := policy.delay(retry, errors.New("reset"))
+		if !ok || d < want/2 || d > want {
+			t.Errorf("delay(%d) = %v, %v; want %v..%v", retry, d, ok, want/2, want)
+		}
+	}
+
+	if d, ok := policy.delay(1, &HTTPStatusError{StatusCode: 429, RetryAfter: 3 * time.Second}); !ok || d != 3*time.Second {
+		t.Errorf("delay with Retry-After 3s = %v, %v", d, ok)
+	}
+	if _, ok := policy.delay(1, &HTTPStatusError{StatusCode: 429, RetryAfter: time.Minute}); ok {
+		t.Error("delay with Retry-After above MaxDelay succeeded")
+	}
+}
+
+func TestRetrierDo(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, BaseDelay: 0.001, MaxDelay: 0.01}
+	transient := &HTTPStatusError{StatusCode: 503}
+
+	t.Run("recovers", func(t *testing.T) {
+		calls := 0
+		err := policy.NewRetrier("test", nil).Do(context.Background(), "request", func() error {
+			if calls++; calls < 3 {
+				return transient
+			}
+			return nil
+		})
+		if err != nil || calls != 3 {
+			t.Errorf("err = %v, calls = %d; want success on 3rd call", err, calls)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		calls := 0
+		err := policy.NewRetrier("test", nil).Do(context.Background(), "request", func() error {
+			calls++
+			return transient
+		})
+		if !errors.Is(err, transient) || !strings.Contains(err.Error(), "gave up after 3 attempts") || calls != 3 {
+			t.Errorf("err = %v, calls = %d", err, calls)
+		}
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		calls := 0
+		err := policy.NewRetrier("test", nil).Do(context.Background(), "request", func() error {
+			calls++
+			return &HTTPStatusError{StatusCode: 404}
+		})
+		if err == nil || calls != 1 {
+			t.Errorf("err = %v, calls = %d; want one call", err, calls)
+		}
+	})
+
+	t.Run("retry after too long", func(t *testing.T) {
+		var logged []string
+		log := Logf(func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) })
+
+		calls := 0
+		err := policy.NewRetrier("test", log).Do(context.Background(), "request", func() error {
+			calls++
+			return &HTTPStatusError{StatusCode: 429, RetryAfter: time.Minute}
+		})
+		if err == nil || calls != 1 {
+			t.Errorf("err = %v, calls = %d; want one call", err, calls)
+		}
+		if len(logged) != 1 || !strings.Contains(logged[0], "server asks to wait 1m0s") {
+			t.Errorf("logged %q; want the reason of giving up", logged)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		budgeted := policy
+		budgeted.Budget = 3
+		retrier := budgeted.NewRetrier("seria 1", nil)
+
+		calls := 0
+		for range 3 {
+			retrier.Do(context.Background(), "request", func() error {
+				calls++
+				return transient
+			})
+		}
+		// Первая операция тратит два повтора, вторая — последний, третья не повторяется
+		if calls != 6 {
+			t.Errorf("calls = %d, want 6", calls)
+		}
+
+		err := retrier.Do(context.Background(), "request", func() error { return transient })
+		if !strings.Contains(err.Error(), "retry budget of seria 1 is exhausted") {
+			t.Errorf("err = %v, want exhausted budget", err)
+		}
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		calls := 0
+		var retrier *Retrier
+		retrier.Do(context.Background(), "request", func() error {
+			calls++
+			return transient
+		})
+		if calls != 1 {
+			t.Errorf("calls = %d, want 1", calls)
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// seasonEpisodeRegex разбирает ссылку на серию вида S1E5 или на целый сезон вида S2
+	seasonEpisodeRegex = regexp.MustCompile(`^[sS](\d+)(?:[eE](\d+))?$`)
+	// lastRegex разбирает last и last:N
+	lastRegex = regexp.MustCompile(`^last(?::(\d+))?$`)
+)
+
+// SelectSeries выбирает серии по строке выбора. Строка состоит из элементов через запятую:
+//
+//	5, 1-12, 9-     серии текущего сезона (currentSeason) по номеру; 9- — с 9-й до последней
+//	last, last:3    последняя серия или последние N серий текущего сезона
+//	S2              весь сезон
+//	S1E5            одна серия сезона
+//	S1E1-S2E5       диапазон серий через границу сезонов
+//	all             все серии всех сезонов (также all seasons)
+//	title:текст     серии, в названии которых есть текст (без учета регистра)
+//	!элемент        исключение, например 1-12,!7
+//
+// Если указаны только исключения, они применяются ко всем сериям текущего сезона.
+// Серии возвращаются в порядке списка series
+func SelectSeries(series []KodikSeriaInfo, spec string, currentSeason int) ([]KodikSeriaInfo, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, fmt.Errorf("пустой выбор серий")
+	}
+
+	sel := seriesSelector{series: series, season: currentSeason}
+
+	included := make(map[int]bool)
+	excluded := make(map[int]bool)
+	hasIncludes, hasTerms := false, false
+
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		hasTerms = true
+
+		target := included
+		if strings.HasPrefix(term, "!") {
+			target = excluded
+			term = strings.TrimSpace(term[1:])
+		} else {
+			hasIncludes = true
+		}
+
+		indexes, err := sel.resolve(term)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range indexes {
+			target[i] = true
+		}
+	}
+
+	if !hasTerms {
+		return nil, fmt.Errorf("пустой выбор серий")
+	}
+
+	if !hasIncludes {
+		for _, i := range sel.seasonIndexes() {
+			included[i] = true
+		}
+	}
+
+	var selected []KodikSeriaInfo
+	for i, seria := range series {
+		if included[i] && !excluded[i] {
+			selected = append(selected, seria)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("выбор %q не содержит ни одной серии", spec)
+	}
+
+	return selected, nil
+}
+
+// seriesSelector сопоставляет элементы выбора с индексами в списке серий
+type seriesSelector struct {
+	series []KodikSeriaInfo
+	season int
+}
+
+// resolve возвращает индексы серий, соответствующих одному элементу выбора
+func (s seriesSelector) resolve(term string) ([]int, error) {
+	lower := strings.ToLower(term)
+
+	switch {
+	case lower == "all" || lower == "all seasons":
+		return s.indexes(func(KodikSeriaInfo) bool { return true }), nil
+
+	case strings.HasPrefix(lower, "title:"):
+		return s.byTitle(strings.TrimSpace(term[len("title:"):]))
+
+	case lastRegex.MatchString(lower):
+		count := 1
+		if match := lastRegex.FindStringSubmatch(lower); match[1] != "" {
+			count, _ = strconv.Atoi(match[1])
+		}
+		if count < 1 {
+			return nil, fmt.Errorf("неверное количество серий в %q", term)
+		}
+
+		indexes := s.seasonIndexes()
+		if len(indexes) == 0 {
+			return nil, s.emptySeasonError()
+		}
+		if count > len(indexes) {
+			count = len(indexes)
+		}
+		return indexes[len(indexes)-count:], nil
+	}
+
+	parts := strings.Split(term, "-")
+	first := strings.TrimSpace(parts[0])
+	_, numErr := strconv.Atoi(first)
+	isSeason := seasonEpisodeRegex.MatchString(first)
+	isNumber := numErr == nil || (first == "" && len(parts) > 1)
+
+	if (isSeason || isNumber) && len(parts) > 2 {
+		return nil, fmt.Errorf("неверный диапазон: %q", term)
+	}
+
+	// Диапазон или серия с указанием сезона
+	if isSeason {
+		return s.bySeasonRange(term, parts)
+	}
+
+	// Номера серий текущего сезона
+	if isNumber {
+		return s.byNumberRange(term, parts)
+	}
+
+	// Всё остальное считается поиском по названию серии
+	return s.byTitle(term)
+}
+
+func (s seriesSelector) indexes(match func(KodikSeriaInfo) bool) []int {
+	var indexes []int
+	for i, seria := range s.series {
+		if match(seria) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// seasonIndexes возвращает индексы серий текущего сезона
+func (s seriesSelector) seasonIndexes() []int {
+	return s.indexes(func(seria KodikSeriaInfo) bool { return seria.Season == s.season })
+}
+
+func (s seriesSelector) emptySeasonError() error {
+	return fmt.Errorf("в сезоне %d нет серий", s.season)
+}
+
+// byNumberRange выбирает серии текущего сезона по номерам: 5, 1-12, 9- или -3
+func (s seriesSelector) byNumberRange(term string, parts []string) ([]int, error) {
+	indexes := s.seasonIndexes()
+	if len(indexes) == 0 {
+		return nil, s.emptySeasonError()
+	}
+
+	minNum, maxNum := -1, -1
+	for _, i := range indexes {
+		num, err := strconv.Atoi(s.series[i].Num)
+		if err != nil {
+			continue
+		}
+		if minNum == -1 || num < minNum {
+			minNum = num
+		}
+		if num > maxNum {
+			maxNum = num
+		}
+	}
+
+	parseBound := func(value string, open int) (int, error) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return open, nil
+		}
+		num, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("неверный номер серии %q в %q", value, term)
+		}
+		return num, nil
+	}
+
+	first, err := parseBound(parts[0], minNum)
+	if err != nil {
+		return nil, err
+	}
+
+	last := first
+	if len(parts) == 2 {
+		last, err = parseBound(parts[1], maxNum)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if first > last {
+		first, last = last, first
+	}
+
+	if first < minNum || last > maxNum {
+		if s.season == 0 {
+			return nil, fmt.Errorf("неверный диапазон %q: доступны серии от %d до %d", term, minNum, maxNum)
+		}
+		return nil, fmt.Errorf("неверный диапазон %q: в сезоне %d доступны серии от %d до %d", term, s.season, minNum, maxNum)
+	}
+
+	var selected []int
+	for _, i := range indexes {
+		num, err := strconv.Atoi(s.series[i].Num)
+		if err == nil && num >= first && num <= last {
+			selected = append(selected, i)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("серии %q не найдены", term)
+	}
+
+	return selected, nil
+}
+
+// bySeasonRange выбирает серии по ссылкам с сезоном: S2, S1E5, S1E1-S2E5 или S2E3-
+func (s seriesSelector) bySeasonRange(term string, parts []string) ([]int, error) {
+	start, end, err := s.findSeasonEpisode(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 2 {
+		if strings.TrimSpace(parts[1]) == "" {
+			end = len(s.series) - 1
+		} else {
+			var otherStart int
+			otherStart, end, err = s.findSeasonEpisode(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, err
+			}
+
+			if otherStart < start {
+				return nil, fmt.Errorf("неверный диапазон %q: %s идет раньше %s", term, parts[1], parts[0])
+			}
+		}
+	}
+
+	var indexes []int
+	for i := start; i <= end; i++ {
+		indexes = append(indexes, i)
+	}
+
+	return indexes, nil
+}
+
+// findSeasonEpisode возвращает индексы первой и последней серии, соответствующих ссылке S2 или S2E5
+func (s seriesSelector) findSeasonEpisode(ref string) (int, int, error) {
+	match := seasonEpisodeRegex.FindStringSubmatch(ref)
+	if match == nil {
+		return 0, 0, fmt.Errorf("неверная серия: %q, ожидается формат S1E5", ref)
+	}
+
+	season, _ := strconv.Atoi(match[1])
+	episode := match[2]
+
+	start, end := -1, -1
+	for i, seria := range s.series {
+		if seria.Season != season {
+			continue
+		}
+
+		if episode != "" {
+			num, _ := strconv.Atoi(seria.Num)
+			want, _ := strconv.Atoi(episode)
+			if num != want {
+				continue
+			}
+		}
+
+		if start == -1 {
+			start = i
+		}
+		end = i
+	}
+
+	if start == -1 {
+		if episode == "" {
+			return 0, 0, fmt.Errorf("сезон %d не найден", season)
+		}
+		return 0, 0, fmt.Errorf("серия %s не найдена", ref)
+	}
+
+	return start, end, nil
+}
+
+// byTitle выбирает серии, в названии которых есть текст
+func (s seriesSelector) byTitle(text string) ([]int, error) {
+	if text == "" {
+		return nil, fmt.Errorf("пустой поиск по названию серии")
+	}
+
+	lower := strings.ToLower(text)
+	indexes := s.indexes(func(seria KodikSeriaInfo) bool {
+		return strings.Contains(strings.ToLower(seria.Title), lower)
+	})
+
+	if len(indexes) == 0 {
+		return nil, fmt.Errorf("нет серий с названием, содержащим %q", text)
+	}
+
+	return indexes, nil
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testSeries возвращает серии 1..n без сезонов с названиями "N серия"
+func testSeries(n int) []KodikSeriaInfo {
+	var series []KodikSeriaInfo
+	for i := 1; i <= n; i++ {
+		series = append(series, KodikSeriaInfo{Num: fmt.Sprint(i), Title: fmt.Sprintf("%d серия", i)})
+	}
+	return series
+}
+
+// testSeasons возвращает два сезона по 6 серий
+func testSeasons() []KodikSeriaInfo {
+	var series []KodikSeriaInfo
+	for season := 1; season <= 2; season++ {
+		for i := 1; i <= 6; i++ {
+			series = append(series, KodikSeriaInfo{Num: fmt.Sprint(i), Season: season, Title: fmt.Sprintf("%d серия", i)})
+		}
+	}
+	return series
+}
+
+func labels(series []KodikSeriaInfo) string {
+	var labels []string
+	for _, seria := range series {
+		labels = append(labels, seria.Label())
+	}
+	return strings.Join(labels, ",")
+}
+
+func TestSelectSeries(t *testing.T) {
+	plain := testSeries(12)
+	plain[3].Title = "Финал арки"
+	plain[10].Title = "Финал"
+
+	tests := []struct {
+		series []KodikSeriaInfo
+		season int
+		spec   string
+		want   string
+	}{
+		{plain, 0, "1-3,5,9-", "1,2,3,5,9,10,11,12"},
+		{plain, 0, "last", "12"},
+		{plain, 0, "last:3", "10,11,12"},
+		{plain, 0, "last:20", "1,2,3,4,5,6,7,8,9,10,11,12"},
+		{plain, 0, "all", "1,2,3,4,5,6,7,8,9,10,11,12"},
+		{plain, 0, "1-12,!7", "1,2,3,4,5,6,8,9,10,11,12"},
+		{plain, 0, "!1-10", "11,12"},
+		{plain, 0, "-2", "1,2"},
+		{plain, 0, "3-1", "1,2,3"},
+		{plain, 0, "title:финал", "4,11"},
+		{plain, 0, " 2 , 2 ", "2"},
+
+		{testSeasons(), 2, "1-2", "S2E1,S2E2"},
+		{testSeasons(), 1, "last:2", "S1E5,S1E6"},
+		{testSeasons(), 1, "S2", "S2E1,S2E2,S2E3,S2E4,S2E5,S2E6"},
+		{testSeasons(), 1, "S1E5-S2E2", "S1E5,S1E6,S2E1,S2E2"},
+		{testSeasons(), 1, "S2E5-", "S2E5,S2E6"},
+		{testSeasons(), 1, "all,!S1", "S2E1,S2E2,S2E3,S2E4,S2E5,S2E6"},
+	}
+
+	for _, tt := range tests {
+		got, err := SelectSeries(tt.series, tt.spec, tt.season)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if labels(got) != tt.want {
+			t.Errorf("%q: selected %s, want %s", tt.spec, labels(got), tt.want)
+		}
+	}
+}
+
+func TestSelectSeriesErrors(t *testing.T) {
+	tests := []struct {
+		series []KodikSeriaInfo
+		season int
+		spec   string
+		want   string
+	}{
+		{testSeries(12), 0, "", "пустой выбор серий"},
+		{testSeries(12), 0, " , ", "пустой выбор серий"},
+		{testSeries(12), 0, "1-12,!1-12", "не содержит ни одной серии"},
+		{testSeries(12), 0, "10-15", `неверный диапазон "10-15": доступны серии от 1 до 12`},
+		{testSeries(12), 0, "0", "доступны серии от 1 до 12"},
+		{testSeries(12), 0, "1-2-3", `неверный диапазон: "1-2-3"`},
+		{testSeries(12), 0, "1-x", `неверный номер серии "x" в "1-x"`},
+		{testSeries(12), 0, "last:0", `неверное количество серий в "last:0"`},
+		{testSeries(12), 0, "title:", "пустой поиск по названию серии"},
+		{testSeries(12), 0, "опенинг", `нет серий с названием, содержащим "опенинг"`},
+
+		// У тайтла без сезонов нет серий с указанием сезона
+		{testSeries(12), 0, "S1E1", `серия S1E1 не найдена`},
+		{testSeries(12), 0, "S1", "сезон 1 не найден"},
+		{testSeries(12), 0, "S1E1-S1E3", `серия S1E1 не найдена`},
+
+		{testSeasons(), 1, "7", `в сезоне 1 доступны серии от 1 до 6`},
+		{testSeasons(), 3, "1", "в сезоне 3 нет серий"},
+		{testSeasons(), 1, "S2E2-S1E1", `неверный диапазон "S2E2-S1E1": S1E1 идет раньше S2E2`},
+		{testSeasons(), 1, "S1E9", "серия S1E9 не найдена"},
+		{testSeasons(), 1, "S1E1-x", `неверная серия: "x", ожидается формат S1E5`},
+	}
+
+	for _, tt := range tests {
+		_, err := SelectSeries(tt.series, tt.spec, tt.season)
+		if err == nil {
+			t.Errorf("%q: selection succeeded, want error %q", tt.spec, tt.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error %q, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
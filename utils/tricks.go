@@ -2,18 +2,15 @@ package utils
 
 import (
 	"bytes"
-	"encoding/base64"
-	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
-	"sync"
-	"unicode"
 )
 
+// UserAgent — User-Agent браузера, с которым выполняются запросы к Kodik
+const UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.111 Safari/537.36"
+
 // SetHeaders устанавливает необходимые заголовки в зависимости от типа страницы.
 func SetHeaders(req *http.Request, kodikPageType int, params *KodikParams, requestParams KodikRequestParams) error {
 	switch kodikPageType {
@@ -32,7 +29,7 @@ func SetHeaders(req *http.Request, kodikPageType int, params *KodikParams, reque
 		req.Header.Set("Origin", "https://"+params.PlayerDomain.Domain)
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.111 Safari/537.36")
+	req.Header.Set("User-Agent", UserAgent)
 
 	if requestParams.host != "" {
 		req.Header.Set("Host", requestParams.host)
@@ -83,7 +80,8 @@ func ReverseString(s string) string {
 	return string(runes)
 }
 
-// Костыльная функция, использует normalizeURL для нормализации URL, но возвращает пустую строку, если входная строка пустая
+// Костыльная функция, использует normalizeURL для нормализации URL, но возвращает пустую строку, если входная строка пустая.
+// Если URL не удалось нормализовать, возвращается исходная строка, а ошибку вернет уже сам запрос
 func NormalizeURL(input string) string {
 	if input == "" {
 		return ""
@@ -91,8 +89,7 @@ func NormalizeURL(input string) string {
 
 	res, err := normalizeURL(input)
 	if err != nil {
-		log.Fatal(err)
-		return ""
+		return input
 	}
 
 	return res
@@ -100,8 +97,6 @@ func NormalizeURL(input string) string {
 
 // нормализует URL, добавляя схему и завершающий слеш
 func normalizeURL(input string) (string, error) {
-	log.Printf(" Normalizing URL: %s", input)
-
 	input, err := url.QueryUnescape(input)
 	if err != nil {
 		return "", fmt.Errorf("ошибка декодирования URL: %w", err)
@@ -132,199 +127,3 @@ func normalizeURL(input string) (string, error) {
 	// Возвращаем нормализованный URL
 	return parsedURL.String(), nil
 }
-
-// Проверка, что строка состоит только из допустимых Base64-символов.
-func isValidBase64Format(s string) bool {
-	// Base64 допускает A-Za-z0-9+/, а также может заканчиваться на = или ==
-	base64Regex := regexp.MustCompile(`^[A-Za-z0-9+/]+={0,2}$`)
-	return base64Regex.MatchString(s)
-}
-
-// decodeROT применяет обратную ротацию для букв латинского алфавита с указанным сдвигом.
-func decodeROT(s string, shift int) string {
-	shift = shift % 26
-	var result strings.Builder
-	for _, r := range s {
-		switch {
-		case r >= 'A' && r <= 'Z':
-			newRune := r - rune(shift)
-			if newRune < 'A' {
-				newRune += 26
-			}
-			result.WriteRune(newRune)
-		case r >= 'a' && r <= 'z':
-			newRune := r - rune(shift)
-			if newRune < 'a' {
-				newRune += 26
-			}
-			result.WriteRune(newRune)
-		default:
-			result.WriteRune(r)
-		}
-	}
-	return result.String()
-}
-
-// base64Decode пытается декодировать строку как Base64.
-func base64Decode(s string) (string, error) {
-	decodedBytes, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return "", err
-	}
-	return string(decodedBytes), nil
-}
-
-// Вычисляет «оценку» расшифрованной строки.
-// Оценка методом эвристики. Может меняться по необходимости
-func scoreCandidate(decoded string) int {
-	score := 0
-
-	// строка без запретных символов - самый ценный параметр
-	if isCleanString(decoded) {
-		score += 50
-	}
-	// нужный нам домен
-	if strings.Contains(decoded, "kodik-storage.com") {
-		score += 20
-	}
-	if strings.Contains(decoded, "://") {
-		score += 20
-	}
-	if strings.HasPrefix(decoded, "//") {
-		score += 10
-	}
-	if strings.Contains(decoded, ".mp4") {
-		score += 5
-	}
-	if strings.Contains(decoded, ".m3u8") {
-		score += 5
-	}
-	return score
-}
-
-// проверяет, что строка не содержит запрещенных в URL символов
-func isCleanString(s string) bool {
-	allowedSymbols := ":/.?&=%-_#[]"
-	for _, r := range s {
-		if !unicode.IsPrint(r) && !strings.ContainsRune(allowedSymbols, r) {
-			return false
-		}
-		if r == '\ufffd' {
-			return false
-		}
-	}
-	return true
-}
-
-// Реверс строки
-func reverseString(s string) string {
-	runes := []rune(s)
-	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-		runes[i], runes[j] = runes[j], runes[i]
-	}
-	return string(runes)
-}
-
-// пытается расшифровать строку путем перебора всех вариантов, что я видел у Kodik
-func AutoDecode(input string) (string, error) {
-	log.Printf("Decoding string: %s", input)
-	type decodingResult struct {
-		decoded string
-		score   int
-	}
-
-	var channel = make(chan decodingResult, 3)
-	var wg sync.WaitGroup
-	wg.Add(3)
-
-	// Пробуем вариант base64
-	go func() {
-		if isValidBase64Format(input) {
-			candidate, err := base64Decode(input)
-			score := scoreCandidate(candidate)
-			if err == nil && score > 1 {
-				channel <- decodingResult{
-					decoded: candidate,
-					score:   score,
-				}
-			}
-		}
-		wg.Done()
-	}()
-
-	// Пробуем вариант reversed base64
-	go func() {
-		reversed := reverseString(input)
-		if isValidBase64Format(reversed) {
-			candidate, err := base64Decode(reversed)
-			score := scoreCandidate(candidate)
-			if err == nil && score > 1 {
-				channel <- decodingResult{
-					decoded: candidate,
-					score:   score,
-				}
-			}
-		}
-		wg.Done()
-	}()
-
-	// Пробуем вариант ROT + base64
-	go func() {
-		bestScore := -1
-		var bestDecoded string
-
-		for shift := range 26 {
-			candidate := decodeROT(input, shift)
-			if !isValidBase64Format(candidate) {
-				continue
-			}
-
-			decoded, err := base64Decode(candidate)
-			if err != nil {
-				continue
-			}
-
-			score := scoreCandidate(decoded)
-			if score > bestScore {
-				bestScore = score
-				bestDecoded = decoded
-			}
-		}
-
-		if bestScore > 1 {
-			channel <- decodingResult{
-				decoded: bestDecoded,
-				score:   bestScore,
-			}
-		}
-
-		wg.Done()
-	}()
-
-	go func() {
-		wg.Wait()
-		close(channel)
-	}()
-
-	var decodingResults []decodingResult
-	for result := range channel {
-		decodingResults = append(decodingResults, result)
-	}
-
-	if len(decodingResults) > 0 {
-		var bestDecodedString string
-		bestScore := -1
-
-		for i := range decodingResults {
-			if bestScore < decodingResults[i].score {
-				bestDecodedString = decodingResults[i].decoded
-				bestScore = decodingResults[i].score
-			}
-		}
-
-		log.Printf("Decoding result: %s", bestDecodedString)
-		return bestDecodedString, nil
-	}
-
-	return "", errors.New("decoding failure")
-}
@@ -0,0 +1,63 @@
+package video_utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// aacFrameSamples — количество сэмплов в кадре AAC-LC
+const aacFrameSamples = 1024
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsHeader — заголовок кадра ADTS (ISO/IEC 13818-7, 6.2)
+type adtsHeader struct {
+	ObjectType   int // тип объекта MPEG-4 Audio: профиль ADTS + 1
+	SampleRate   int
+	RateIndex    int
+	Channels     int
+	HeaderLength int
+	FrameLength  int // длина кадра вместе с заголовком
+}
+
+// parseADTS разбирает заголовок ADTS в начале data
+func parseADTS(data []byte) (adtsHeader, error) {
+	if len(data) < 7 {
+		return adtsHeader{}, errors.New("short ADTS header")
+	}
+	if data[0] != 0xFF || data[1]&0xF6 != 0xF0 {
+		return adtsHeader{}, errors.New("invalid ADTS sync word")
+	}
+
+	h := adtsHeader{
+		ObjectType:   int(data[2]>>6) + 1,
+		RateIndex:    int(data[2]>>2) & 0x0F,
+		Channels:     int(data[2]&1)<<2 | int(data[3]>>6),
+		HeaderLength: 7,
+		FrameLength:  int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5])>>5,
+	}
+
+	// Без protection_absent после заголовка идет CRC
+	if data[1]&1 == 0 {
+		h.HeaderLength = 9
+	}
+
+	if h.RateIndex >= len(adtsSampleRates) {
+		return adtsHeader{}, fmt.Errorf("invalid ADTS sampling frequency index %d", h.RateIndex)
+	}
+	h.SampleRate = adtsSampleRates[h.RateIndex]
+
+	if h.FrameLength < h.HeaderLength {
+		return adtsHeader{}, fmt.Errorf("invalid ADTS frame length %d", h.FrameLength)
+	}
+
+	return h, nil
+}
+
+// audioSpecificConfig возвращает AudioSpecificConfig для esds (ISO/IEC 14496-3, 1.6.2.1)
+func (h adtsHeader) audioSpecificConfig() []byte {
+	return []byte{
+		byte(h.ObjectType<<3 | h.RateIndex>>1),
+		byte(h.RateIndex<<7 | h.Channels<<3),
+	}
+}
@@ -0,0 +1,200 @@
+package video_utils
+
+import (
+	"context"
+	"io"
+	"kodik_parser/utils"
+	"sync"
+	"time"
+)
+
+// bandwidthReadSize — наибольший объем одного чтения через ограничитель, чтобы скорость
+// выравнивалась небольшими порциями, а не целыми буферами io.Copy
+const bandwidthReadSize = 32 * 1024
+
+// BandwidthLimiter ограничивает скорость загрузки: общую для всех серий и отдельно для
+// каждой серии. Лимиты можно менять во время загрузки, новые значения сразу действуют
+// и на уже идущие загрузки
+type BandwidthLimiter struct {
+	total *rateLimiter
+
+	mu         sync.Mutex
+	perEpisode utils.ByteRate
+	episodes   map[*rateLimiter]struct{} // ограничители серий, которые сейчас загружаются
+}
+
+// NewBandwidthLimiter создает ограничитель с указанными лимитами; 0 — без ограничения
+func NewBandwidthLimiter(total, perEpisode utils.ByteRate) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		total:      newRateLimiter(total),
+		perEpisode: perEpisode,
+		episodes:   make(map[*rateLimiter]struct{}),
+	}
+}
+
+// DefaultBandwidth — ограничитель процесса, через который читают оба загрузчика
+var DefaultBandwidth = NewBandwidthLimiter(0, 0)
+
+// SetLimits задает общий лимит и лимит одной серии
+func (b *BandwidthLimiter) SetLimits(total, perEpisode utils.ByteRate) {
+	b.total.setRate(total)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.perEpisode = perEpisode
+	for episode := range b.episodes {
+		episode.setRate(perEpisode)
+	}
+}
+
+// Limits возвращает общий лимит и лимит одной серии
+func (b *BandwidthLimiter) Limits() (total, perEpisode utils.ByteRate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.total.rate(), b.perEpisode
+}
+
+// episode создает ограничитель одной серии. После загрузки его нужно освободить через release
+func (b *BandwidthLimiter) episode() *episodeBandwidth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	limiter := newRateLimiter(b.perEpisode)
+	b.episodes[limiter] = struct{}{}
+
+	return &episodeBandwidth{parent: b, limiter: limiter}
+}
+
+// SetBandwidthLimit задает лимиты DefaultBandwidth
+func SetBandwidthLimit(total, perEpisode utils.ByteRate) {
+	DefaultBandwidth.SetLimits(total, perEpisode)
+}
+
+// episodeBandwidth — ограничитель загрузки одной серии, все ее части и фрагменты читают через него
+type episodeBandwidth struct {
+	parent  *BandwidthLimiter
+	limiter *rateLimiter
+}
+
+func (e *episodeBandwidth) release() {
+	e.parent.mu.Lock()
+	defer e.parent.mu.Unlock()
+
+	delete(e.parent.episodes, e.limiter)
+}
+
+// reader возвращает r, чтение из которого ждет лимитов серии и процесса
+func (e *episodeBandwidth) reader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiters: []*rateLimiter{e.limiter, e.parent.total}}
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+// Read сначала читает, а потом ждет: сколько байт придет, заранее неизвестно
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthReadSize {
+		p = p[:bandwidthReadSize]
+	}
+
+	n, err := l.r.Read(p)
+	for _, limiter := range l.limiters {
+		if waitErr := limiter.wait(l.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// rateLimiter — корзина токенов, в которую каждую секунду добавляется rate байт.
+// Вместимость корзины — секунда загрузки
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   utils.ByteRate
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // закрывается при смене лимита, чтобы ждущие пересчитали время
+}
+
+func newRateLimiter(rate utils.ByteRate) *rateLimiter {
+	return &rateLimiter{
+		limit:   rate,
+		tokens:  float64(rate),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *rateLimiter) rate() utils.ByteRate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit
+}
+
+func (l *rateLimiter) setRate(rate utils.ByteRate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.limit = rate
+	l.tokens = min(l.tokens, float64(rate))
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// refill добавляет токены за время с прошлого пополнения
+func (l *rateLimiter) refill(now time.Time) {
+	if l.limit > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		l.tokens = min(l.tokens, float64(l.limit))
+	}
+	l.last = now
+}
+
+// wait ждет, пока в корзине наберется n байт, и забирает их. Если n больше вместимости,
+// ждет полную корзину и уходит в долг, который оплатят следующие чтения
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	for {
+		if l.limit <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+
+		l.refill(time.Now())
+		need := min(float64(n), float64(l.limit))
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+
+		delay := time.Duration((need - l.tokens) / float64(l.limit) * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		l.mu.Lock()
+	}
+}
@@ -0,0 +1,71 @@
+package video_utils
+
+import (
+	"context"
+	"kodik_parser/utils"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := newRateLimiter(100 * 1024)
+
+	// Полная корзина отдает секунду загрузки сразу, следующие полсекунды приходится ждать
+	start := time.Now()
+	if err := limiter.wait(context.Background(), 100*1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("full bucket waited %v", elapsed)
+	}
+
+	if err := limiter.wait(context.Background(), 50*1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("50 KB at 100 KB/s took %v, want about 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx, 100*1024); err == nil {
+		t.Error("wait ignored cancelled context")
+	}
+}
+
+func TestBandwidthLimiterSetLimits(t *testing.T) {
+	bandwidth := NewBandwidthLimiter(0, 1024)
+	episode := bandwidth.episode()
+	defer episode.release()
+
+	if err := episode.limiter.wait(context.Background(), 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ждущее чтение без лимита серии продолжается сразу, а не через секунду
+	done := make(chan error)
+	go func() { done <- episode.limiter.wait(context.Background(), 1024) }()
+
+	time.Sleep(50 * time.Millisecond)
+	bandwidth.SetLimits(2048, 0)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("waiting read isn't released after the episode limit was removed")
+	}
+
+	total, perEpisode := bandwidth.Limits()
+	if total != 2048 || perEpisode != 0 || episode.limiter.rate() != 0 {
+		t.Errorf("Limits() = %d, %d; episode rate %d", total, perEpisode, episode.limiter.rate())
+	}
+
+	// Новые серии получают новый лимит
+	bandwidth.SetLimits(0, utils.ByteRate(4096))
+	if next := bandwidth.episode(); next.limiter.rate() != 4096 {
+		t.Errorf("new episode rate = %d, want 4096", next.limiter.rate())
+	}
+}
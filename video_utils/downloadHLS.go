@@ -2,54 +2,67 @@ package video_utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"kodik_parser/utils"
-	"log"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/schollz/progressbar/v3"
 )
 
+// errLinkExpired означает, что хранилище отказало в доступе по ссылке: обычно у подписанной ссылки истек срок
+var errLinkExpired = errors.New("link has expired")
+
 type downloadedHlsFragment struct {
 	Number int
 	Data   []byte
 }
 
-type HlsFragment struct {
-	Number   int
-	Duration int
-	Url      string
-}
-
-func DownloadVideosHLS(result utils.HandleResult, config *utils.Config) utils.HandleResult {
+// DownloadVideosHLS загружает видео по HLS плейлистам. После отмены ctx новые серии не начинаются,
+// а недописанные .ts файлы остаются вместе с файлом состояния, чтобы следующий запуск их дописал
+func DownloadVideosHLS(ctx context.Context, result utils.HandleResult, config *utils.Config, opts Options) utils.HandleResult {
 	var wg sync.WaitGroup
 
 	// открываем семафор для ограничения количества одновременно загружаемых файлов
 	semaphore := make(chan struct{}, config.MaxVideosDownloads)
-	defer close(semaphore)
 
-	bar := progressbar.DefaultBytes(
-		-1,
-		"Загрузка видео...",
-	)
+	progress := downloadProgress(config)
+
+	for i := range result.Results {
+		if result.Results[i].Failed() {
+			continue
+		}
+
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			result.Results[i].Status = utils.StatusDownloadFailed
+			result.Results[i].Err = fmt.Errorf("download is not started: %w", ctx.Err())
+			opts.Log.Printf("Download cancelled, HLS seria %s is not started", result.Results[i].Seria.Label())
+			continue
+		}
 
-	for _, res := range result.Results {
-		semaphore <- struct{}{}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			defer func() { <-semaphore }()
 
-			if path, err := downloadVideoHls(res, bar, config, result.TitleName); err != nil {
-				log.Printf("Failed to download HLS seria %s: %v", res.Seria.Num, err)
+			res := &result.Results[i]
+			episode := progress.Episode(res.Seria)
+			path, err := downloadVideoHls(ctx, res, episode, config, opts, result.TitleName, result.Translation)
+			episode.Finish(err)
+			if err != nil {
+				opts.Log.Printf("Failed to download HLS seria %s: %v", res.Seria.Label(), err)
+				res.Status = utils.StatusDownloadFailed
+				res.Err = err
 			} else {
 				res.Path = path
+				res.Status = utils.StatusDownloaded
 			}
 		}()
 	}
@@ -59,225 +72,418 @@ func DownloadVideosHLS(result utils.HandleResult, config *utils.Config) utils.Ha
 	return result
 }
 
-func getPlaylist(url string) (string, error) {
-	resp, err := http.Get(url)
+func getPlaylist(ctx context.Context, client *http.Client, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return "", fmt.Errorf("error getting playlist: %v", err)
-	} else if resp.Body == nil {
-		return "", fmt.Errorf("empty playlist")
-	} else if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("status code: %d", resp.StatusCode)
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error getting playlist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return "", fmt.Errorf("%w: status code: %d", errLinkExpired, resp.StatusCode)
+	default:
+		return "", utils.NewHTTPStatusError(resp)
 	}
 
 	buf := new(strings.Builder)
 	_, err = io.Copy(buf, resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("error converting response body: %v", err)
+		return "", fmt.Errorf("error converting response body: %w", err)
 	}
 	body := buf.String()
 
 	return body, nil
 }
 
-func parseHlsFragments(body, baseUrl string) ([]HlsFragment, error) {
-	var fragments []HlsFragment
+// downloadHlsFragment загружает и расшифровывает фрагмент, читая его через ограничитель скорости серии.
+// Принятые байты учитываются в progress, байты неудачной попытки вычитаются
+func downloadHlsFragment(ctx context.Context, client *http.Client, bandwidth *episodeBandwidth, progress *utils.EpisodeProgress, keys *hlsKeys, hlsFragment HlsFragment) (downloadedHlsFragment, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", hlsFragment.Url, nil)
+	if err != nil {
+		return downloadedHlsFragment{}, fmt.Errorf("failed to create request: %w", err)
+	}
 
-	r := regexp.MustCompile(`#EXTINF:(\d+\.\d+),\n(\S+)`)
+	if hlsFragment.ByteRange != nil {
+		req.Header.Set("Range", hlsFragment.ByteRange.header())
+	}
 
-	fragments_raw := r.FindAllStringSubmatch(body, -1)
+	resp, err := client.Do(req)
+	if err != nil {
+		return downloadedHlsFragment{}, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
 
-	if len(fragments_raw) < 1 {
-		return nil, fmt.Errorf("can't find any fragment in playlist")
+	switch {
+	case hlsFragment.ByteRange != nil && resp.StatusCode == http.StatusPartialContent:
+	case hlsFragment.ByteRange == nil && resp.StatusCode == http.StatusOK:
+	default:
+		return downloadedHlsFragment{}, utils.NewHTTPStatusError(resp)
 	}
 
-	for i, fragment := range fragments_raw {
-		duration := fragment[1]
-		url := fragment[2]
+	body, err := io.ReadAll(io.TeeReader(bandwidth.reader(ctx, resp.Body), progress))
+	if err != nil {
+		progress.Add(-int64(len(body)))
+		return downloadedHlsFragment{}, fmt.Errorf("error reading resp.Body: %w", err)
+	}
 
-		fragments = append(fragments, HlsFragment{
-			Number:   i,
-			Duration: int(duration[0] - '0'),
-			Url:      baseUrl + url[2:],
-		})
+	body, err = keys.decrypt(ctx, hlsFragment, body)
+	if err != nil {
+		return downloadedHlsFragment{}, fmt.Errorf("failed to decrypt fragment: %w", err)
 	}
 
-	return fragments, nil
+	return downloadedHlsFragment{
+		Number: hlsFragment.Number,
+		Data:   body,
+	}, nil
 }
 
-func downloadHlsFragment(client *http.Client, hlsFragment HlsFragment) (downloadedHlsFragment, error) {
-	req, err := http.NewRequest("GET", hlsFragment.Url, nil)
+// getPlaylistWithRetry загружает плейлист, повторяя временные ошибки
+func getPlaylistWithRetry(ctx context.Context, client *http.Client, retry *utils.Retrier, url string) (string, error) {
+	var body string
+	err := retry.Do(ctx, "playlist", func() error {
+		var err error
+		body, err = getPlaylist(ctx, client, url)
+		return err
+	})
+	return body, err
+}
+
+// loadMediaPlaylist загружает плейлист по ссылке. Если это мастер плейлист, выбирает вариант
+// по config.HLSVariant, загружает его медиа плейлист и возвращает выбранный вариант
+func loadMediaPlaylist(ctx context.Context, client *http.Client, retry *utils.Retrier, playlistURL string, config *utils.Config, log utils.Logf) (*MediaPlaylist, *utils.HLSVariant, error) {
+	body, err := getPlaylistWithRetry(ctx, client, retry, playlistURL)
 	if err != nil {
-		return downloadedHlsFragment{}, fmt.Errorf("failed to create request: %v", err)
+		return nil, nil, fmt.Errorf("error downloading hls video: %w", err)
 	}
 
-	resp, err := client.Do(req)
+	if !IsMasterPlaylist(body) {
+		playlist, err := ParseMediaPlaylist(body, playlistURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing hls playlist: %w", err)
+		}
+		return playlist, nil, nil
+	}
+
+	master, err := ParseMasterPlaylist(body, playlistURL)
 	if err != nil {
-		return downloadedHlsFragment{}, fmt.Errorf("failed to send request: %v", err)
+		return nil, nil, fmt.Errorf("error parsing master playlist: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return downloadedHlsFragment{}, fmt.Errorf("unexpected status code: %v", err)
+	variant, err := config.HLSVariant.Select(master.Variants)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	log.Printf("master playlist has %d variants, selected %s", len(master.Variants), variant)
+
+	for _, rendition := range master.Audio {
+		if rendition.GroupID == variant.Audio && rendition.Url != "" {
+			log.Printf("audio rendition %q is a separate stream and won't be downloaded", rendition.Name)
+		}
+	}
+
+	body, err = getPlaylistWithRetry(ctx, client, retry, variant.URL)
 	if err != nil {
-		return downloadedHlsFragment{}, fmt.Errorf("error reading resp.Body: %v", err)
+		return nil, nil, fmt.Errorf("error downloading variant playlist: %w", err)
 	}
 
-	return downloadedHlsFragment{
-		Number: hlsFragment.Number,
-		Data:   body,
-	}, nil
+	playlist, err := ParseMediaPlaylist(body, variant.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing variant playlist: %w", err)
+	}
+
+	return playlist, &variant, nil
 }
 
-func getBaseUrl(url string) string {
-	lastSlash := strings.LastIndex(url, "/")
-	if lastSlash == -1 {
-		log.Fatal("Invalid url")
+// downloadVideoHls загружает одну серию в .ts файл, а если сегменты — фрагментированный MP4, в .mp4.
+// Выбранный вариант мастер плейлиста записывается в result.Variant. Прогресс сохраняется в файл
+// состояния рядом с файлом серии, поэтому прерванная загрузка продолжается с последнего записанного фрагмента
+func downloadVideoHls(ctx context.Context, result *utils.Result, progress *utils.EpisodeProgress, config *utils.Config, opts Options, title string, translation utils.KodikTranslation) (string, error) {
+	client := newHTTPClient(opts, 120*time.Second)
+	defer client.CloseIdleConnections()
+
+	// Бюджет повторов общий для плейлистов, ключей и фрагментов серии
+	retry := config.Retry.Download.NewRetrier("seria "+result.Seria.Label(), opts.Log)
+
+	playlist, variant, err := loadMediaPlaylist(ctx, client, retry, result.Video, config, opts.Log)
+	if errors.Is(err, errLinkExpired) && config.ReResolve != nil {
+		// Подписанная ссылка истекла, например с прошлого запуска: получаем новую
+		opts.Log.Printf("playlist of seria %s has expired, resolving it again", result.Seria.Label())
+
+		refreshed, resolveErr := config.ReResolve(ctx, *result)
+		if resolveErr != nil {
+			return "", fmt.Errorf("%w; failed to resolve again: %v", err, resolveErr)
+		}
+		result.Video = refreshed.Video
+		result.Quality = refreshed.Quality
+		result.Qualities = refreshed.Qualities
+
+		playlist, variant, err = loadMediaPlaylist(ctx, client, retry, result.Video, config, opts.Log)
 	}
+	if err != nil {
+		return "", err
+	}
+	result.Variant = variant
 
-	return url[:lastSlash+1]
-}
+	// Зашифрованный неподдерживаемым методом поток дал бы неиграбельный файл, поэтому не начинаем загрузку
+	if err := playlist.checkEncryption(); err != nil {
+		return "", err
+	}
+	if playlist.Encrypted() {
+		opts.Log.Printf("playlist of seria %s is encrypted with AES-128, fragments will be decrypted", result.Seria.Label())
+	}
+	keys := newHlsKeys(client)
 
-func downloadVideoHls(result utils.Result, bar *progressbar.ProgressBar, config *utils.Config, titleName string) (string, error) {
-	videoHlsPlaylistBody, err := getPlaylist(result.Video)
+	bandwidth := DefaultBandwidth.episode()
+	defer bandwidth.release()
+
+	if !playlist.EndList {
+		opts.Log.Printf("playlist of seria %s has no EXT-X-ENDLIST, downloading %d segments available now", result.Seria.Label(), len(playlist.Segments))
+	}
+
+	hlsPlaylistFragments := playlist.downloadOrder()
+
+	// Фрагменты с EXT-X-MAP склеиваются в готовый MP4, и перепаковывать его не нужно
+	ext := "ts"
+	if playlist.Fragmented() {
+		ext = "mp4"
+	}
+
+	path, err := episodePath(config, newPathFields(title, translation, *result, ext))
 	if err != nil {
-		return "", fmt.Errorf("error downloading hls video: %v", err)
+		return "", err
 	}
 
-	hlsPlaylistFragments, err := parseHlsFragments(videoHlsPlaylistBody, getBaseUrl(result.Video))
+	// Блокировка держится и во время перепаковки в .mp4
+	unlock, err := lockEpisode(path)
 	if err != nil {
-		return "", fmt.Errorf("error downloading hls video: %v", err)
+		return "", err
 	}
+	defer unlock()
 
-	client := &http.Client{
-		Timeout: 120 * time.Second,
-		Transport: &http.Transport{
-			TLSHandshakeTimeout: 10 * time.Second,
-		},
+	file, state, err := openHlsFile(path, result.Video, newHlsStream(result.Quality, variant), len(hlsPlaylistFragments), opts.Log)
+	if err != nil {
+		return "", err
+	}
+
+	progress.SetFragments(len(hlsPlaylistFragments), playlist.Duration())
+	if state.Written > 0 {
+		opts.Log.Printf("resuming seria %s from fragment %d of %d (%d bytes)", result.Seria.Label(), state.Written, state.Fragments, state.Bytes)
+
+		var duration float64
+		for _, fragment := range hlsPlaylistFragments[:state.Written] {
+			duration += fragment.Duration
+		}
+		progress.Resume(state.Bytes, state.Written, duration)
 	}
-	defer client.CloseIdleConnections()
 
 	// Канал для получения результатов из горутин
 	downloadedFrags := make(chan downloadedHlsFragment, 20)
-	// Контекст для прерывания выполнения горутин
-	ctx, cancel := context.WithCancel(context.Background())
+	// Контекст для прерывания выполнения горутин. Отменяется как извне, так и при ошибке загрузки
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
 	// Открываем семафор для ограничения одновременного количества загружаемых фрагментов
 	semaphore := make(chan struct{}, config.MaxVideoWorkers)
 
 	var wgDownloader sync.WaitGroup
 
-	// Загружающая горутина
+	// Загружающая горутина. Уже записанные при прошлом запуске фрагменты пропускаются
 	go func() {
 		defer close(downloadedFrags)
 		defer wgDownloader.Wait()
 
-		for _, playlistFragment := range hlsPlaylistFragments {
-			wgDownloader.Add(1)
-			semaphore <- struct{}{}
-
+		for _, playlistFragment := range hlsPlaylistFragments[state.Written:] {
 			select {
+			case semaphore <- struct{}{}:
 			case <-ctx.Done():
-				log.Print("context cancel signal recieved")
+			}
+			if ctx.Err() != nil {
+				opts.Log.Printf("context cancel signal recieved")
 				return
-			default:
 			}
 
+			wgDownloader.Add(1)
 			go func() {
 				defer wgDownloader.Done()
 				defer func() { <-semaphore }()
 
 				var downloadedFragment downloadedHlsFragment
-
-				attempts := 3
-				for attempts > 0 {
-					downloadedFragment, err = downloadHlsFragment(client, playlistFragment)
-					if err != nil {
-						log.Printf("failed to download fragment %d with error: %v", playlistFragment.Number, err)
-
-						if strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "504") {
-							log.Printf("condition fullfilled, retrying to download fragment %d", playlistFragment.Number)
-							attempts--
-							continue
-						} else {
-							// В случае непредвиденной ошибки отменяем контекст загрузчика конкретно этого видео
-							cancel()
-							return
-						}
+				err := retry.Do(ctx, fmt.Sprintf("fragment %d", playlistFragment.Number), func() error {
+					var err error
+					downloadedFragment, err = downloadHlsFragment(ctx, client, bandwidth, progress, keys, playlistFragment)
+					return err
+				})
+				if err != nil {
+					if ctx.Err() != nil {
+						return
 					}
 
-					downloadedFrags <- downloadedFragment
-					break
+					// Фрагмент не загружен: отменяем загрузчик конкретно этого видео
+					opts.Log.Printf("failed to download fragment %d with error: %v", playlistFragment.Number, err)
+					cancel(fmt.Errorf("fragment %d: %w", playlistFragment.Number, err))
+					return
+				}
+
+				select {
+				case downloadedFrags <- downloadedFragment:
+				case <-ctx.Done():
 				}
 			}()
 		}
 	}()
 
-	path := fmt.Sprintf("%s\\%s_серия.ts", getPath(titleName), result.Seria.Num)
-	file, err := os.Create(path)
-	if err != nil {
-		cancel()
-		return "", fmt.Errorf("failed to create file: %v", err)
-	}
-	defer file.Close()
-
-	var wgWriter sync.WaitGroup
-	wgWriter.Add(1)
-
-	// Записывающая горутина
+	// Записывающая горутина. Фрагменты пишутся целиком, а состояние обновляется после
+	// каждого фрагмента. Уже загруженные фрагменты записываются и после отмены, чтобы
+	// следующий запуск продолжил с них
+	writerDone := make(chan int)
 	go func() {
-		defer wgWriter.Done()
-
 		// Буфер для хранения фрагментов, которые пришли не по порядку
 		buffer := make(map[int]downloadedHlsFragment)
-		expectedFragmentNumber := 0
+		expectedFragmentNumber := state.Written
+		failed := false
 
-		for {
-			select {
-			case <-ctx.Done():
-				log.Print("context cancel signal recieved")
-				os.Remove(path)
-				return
+		for downloadedFragment := range downloadedFrags {
+			if failed {
+				continue
+			}
+			buffer[downloadedFragment.Number] = downloadedFragment
 
-			case downloadedFragment, ok := <-downloadedFrags:
-				if ok {
-					buffer[downloadedFragment.Number] = downloadedFragment
+			for {
+				fragment, exists := buffer[expectedFragmentNumber]
+				if !exists {
+					break
 				}
 
-				for {
-					if fragment, exists := buffer[expectedFragmentNumber]; exists {
-						// Записываем фрагмент в файл
-						_, err := file.Write(fragment.Data)
-						if err != nil {
-							log.Printf("failed to write fragment %d: %v", fragment.Number, err)
-							cancel()
-							return
-						}
-
-						bar.Add(len(fragment.Data))
-
-						// Удаляем записанный фрагмент из буфера
-						delete(buffer, expectedFragmentNumber)
-
-						expectedFragmentNumber++
-					} else if !ok && expectedFragmentNumber < len(hlsPlaylistFragments) {
-						expectedFragmentNumber++
-					} else {
-						// Если фрагмент не ожидаемый, выходим из цикла
-						break
-					}
+				// Записываем фрагмент в файл
+				if _, err := file.Write(fragment.Data); err != nil {
+					cancel(fmt.Errorf("failed to write fragment %d: %w", fragment.Number, err))
+					failed = true
+					break
 				}
 
-				if !ok {
-					return
+				progress.FragmentDone(hlsPlaylistFragments[fragment.Number].Duration)
+
+				// Удаляем записанный фрагмент из буфера
+				delete(buffer, expectedFragmentNumber)
+
+				expectedFragmentNumber++
+
+				state.Written = expectedFragmentNumber
+				state.Bytes += int64(len(fragment.Data))
+				if err := state.save(path); err != nil {
+					cancel(err)
+					failed = true
+					break
 				}
 			}
 		}
+
+		writerDone <- expectedFragmentNumber
 	}()
 
-	wgWriter.Wait()
+	written := <-writerDone
+	file.Close()
+
+	// Все фрагменты могли успеть записаться и после отмены: такой файл полный
+	switch {
+	case written == len(hlsPlaylistFragments):
+	case ctx.Err() != nil:
+		err = context.Cause(ctx)
+	default:
+		err = fmt.Errorf("fragment %d is missing", written)
+	}
+
+	if err != nil {
+		if written == 0 {
+			opts.Log.Printf("download of seria %s has not started, removing %s", result.Seria.Label(), path)
+			os.Remove(path)
+			removeHlsState(path, opts.Log)
+		} else {
+			opts.Log.Printf("download of seria %s is not complete, %d of %d fragments are kept for resume", result.Seria.Label(), written, len(hlsPlaylistFragments))
+		}
+		return "", err
+	}
+
+	removeHlsState(path, opts.Log)
+
+	if !config.Remux {
+		return path, nil
+	}
+	if playlist.Fragmented() {
+		opts.Log.Printf("seria %s is fragmented MP4, saved as %s without remux", result.Seria.Label(), path)
+		return path, nil
+	}
+
+	// Ошибка перепаковки не делает загрузку неудачной: остается исходный .ts
+	mp4Path, err := episodePath(config, newPathFields(title, translation, *result, "mp4"))
+	if err == nil {
+		mp4Path, err = remuxDownloaded(path, mp4Path, playlist.Duration(), opts.Log)
+	}
+	if err != nil {
+		opts.Log.Printf("failed to remux seria %s into MP4, keeping %s: %v", result.Seria.Label(), path, err)
+		return path, nil
+	}
+
+	return mp4Path, nil
+}
+
+// openHlsFile открывает файл серии для записи. Если рядом лежит подходящее состояние прошлой загрузки
+// того же потока, файл обрезается до последнего записанного фрагмента и дописывается, иначе создается заново
+func openHlsFile(path, playlistURL string, stream hlsStream, fragments int, log utils.Logf) (*os.File, *hlsState, error) {
+	state, err := loadHlsState(path)
+	if err != nil {
+		log.Printf("%v, starting download from scratch", err)
+		state = nil
+	}
+
+	// Ссылка могла быть получена заново с другим качеством: номера фрагментов совпадут, а содержимое нет
+	if state != nil && state.Stream != stream {
+		log.Printf("download state of %s was written for %s, now downloading %s, starting from scratch", path, state.Stream, stream)
+		state = nil
+	}
+
+	if state != nil && !state.resumable(path, fragments) {
+		log.Printf("download state of %s doesn't match the playlist, starting from scratch", path)
+		state = nil
+	}
+
+	if state == nil {
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create file: %v", err)
+		}
+
+		state = &hlsState{PlaylistURL: playlistURL, Stream: stream, Fragments: fragments}
+		return file, state, nil
+	}
+
+	if state.PlaylistURL != playlistURL {
+		log.Printf("playlist URL of %s changed since the last run, resuming %s by fragment number", path, stream)
+		state.PlaylistURL = playlistURL
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	if err := file.Truncate(state.Bytes); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to truncate file: %v", err)
+	}
+
+	if _, err := file.Seek(state.Bytes, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to seek file: %v", err)
+	}
 
-	return path, nil
+	return file, state, nil
 }
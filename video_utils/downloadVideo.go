@@ -1,45 +1,84 @@
 package video_utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"kodik_parser/utils"
-	"log"
 	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
-	"unicode"
-
-	"github.com/schollz/progressbar/v3"
 )
 
 const chunkSize = 5 * 1024 * 1024 // Размер части - 5MB
 
-func DownloadVideos(result utils.HandleResult, config *utils.Config) utils.HandleResult {
+// Options задает параметры загрузки, которые не относятся к настройкам пользователя
+type Options struct {
+	// Transport выполняет запросы к хранилищу видео; nil — стандартный транспорт.
+	// Позволяет направить загрузку, например, на тестовый сервер
+	Transport http.RoundTripper
+
+	// Log получает ход загрузки: повторы, продолжение прерванных загрузок, ошибки серий.
+	// nil — журнал не ведется
+	Log utils.Logf
+}
+
+// Download загружает видео загрузчиком, выбранным в config.DownloaderVersion
+func Download(ctx context.Context, result utils.HandleResult, config *utils.Config, opts Options) (utils.HandleResult, error) {
+	switch config.DownloaderVersion {
+	case 1:
+		return DownloadVideos(ctx, result, config, opts), nil
+	case 2:
+		return DownloadVideosHLS(ctx, result, config, opts), nil
+	default:
+		return result, fmt.Errorf("unknown downloader version: %d", config.DownloaderVersion)
+	}
+}
+
+// DownloadVideos загружает видео частями. После отмены ctx новые серии не начинаются;
+// загруженные части остаются на диске, и повторный запуск загружает только недостающие
+func DownloadVideos(ctx context.Context, result utils.HandleResult, config *utils.Config, opts Options) utils.HandleResult {
 	var wg sync.WaitGroup
 
 	semaphore := make(chan struct{}, config.MaxVideosDownloads)
-	defer close(semaphore)
 
-	bar := progressbar.DefaultBytes(
-		-1,
-		"Загрузка видео...",
-	)
+	progress := downloadProgress(config)
+
+	for i := range result.Results {
+		if result.Results[i].Failed() {
+			continue
+		}
+
+		// Захват семафора
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			result.Results[i].Status = utils.StatusDownloadFailed
+			result.Results[i].Err = fmt.Errorf("download is not started: %w", ctx.Err())
+			opts.Log.Printf("Download cancelled, seria %s is not started", result.Results[i].Seria.Label())
+			continue
+		}
 
-	for _, res := range result.Results {
-		semaphore <- struct{}{} // Захват семафора
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			defer func() { <-semaphore }()
-			if path, err := downloadVideo(res, bar, config, result.TitleName); err != nil {
-				log.Printf("Failed to download video %s: %v", res.Seria.Num, err)
+			res := &result.Results[i]
+			episode := progress.Episode(res.Seria)
+			path, err := downloadVideo(ctx, *res, episode, config, opts, result.TitleName, result.Translation)
+			episode.Finish(err)
+			if err != nil {
+				opts.Log.Printf("Failed to download video %s: %v", res.Seria.Label(), err)
+				res.Status = utils.StatusDownloadFailed
+				res.Err = err
 			} else {
 				res.Path = path
+				res.Status = utils.StatusDownloaded
 			}
 		}()
 	}
@@ -49,76 +88,98 @@ func DownloadVideos(result utils.HandleResult, config *utils.Config) utils.Handl
 	return result
 }
 
-func downloadVideo(result utils.Result, bar *progressbar.ProgressBar, config *utils.Config, titleName string) (string, error) {
+func downloadVideo(ctx context.Context, result utils.Result, progress *utils.EpisodeProgress, config *utils.Config, opts Options, title string, translation utils.KodikTranslation) (string, error) {
 	url := strings.Replace(result.Video, ":hls:manifest.m3u8", "", -1)
 
-	headResp, err := http.Head(url)
-	if err != nil {
-		return "", fmt.Errorf("failed to send HEAD request: %w", err)
-	}
-	defer headResp.Body.Close()
+	client := newHTTPClient(opts, 0)
+	defer client.CloseIdleConnections()
 
-	if headResp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch video: status code %d", headResp.StatusCode)
-	}
+	bandwidth := DefaultBandwidth.episode()
+	defer bandwidth.release()
 
-	totalSize := headResp.ContentLength
+	// Бюджет повторов общий для всех запросов серии
+	retry := config.Retry.Download.NewRetrier("seria "+result.Seria.Label(), opts.Log)
+
+	var totalSize int64
+	err := retry.Do(ctx, "HEAD request", func() error {
+		var err error
+		totalSize, err = videoSize(ctx, client, url)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	progress.SetTotalBytes(totalSize)
 	numChunks := int(totalSize / chunkSize)
 	if totalSize%chunkSize != 0 {
 		numChunks++
 	}
 
+	outputFile, err := episodePath(config, newPathFields(title, translation, result, "mp4"))
+	if err != nil {
+		return "", err
+	}
+
+	unlock, err := lockEpisode(outputFile)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Части лежат рядом с итоговым файлом. Имена включают качество, чтобы части другого
+	// файла той же серии не попали в склейку
 	tempFiles := make([]string, numChunks)
-	var chunkWG sync.WaitGroup
+	for i := range tempFiles {
+		tempFiles[i] = fmt.Sprintf("%s.%dp_chunk_%d.tmp", outputFile, result.Quality, i)
+	}
 
-	path := getPath(titleName)
+	var chunkWG sync.WaitGroup
 
 	semaphore := make(chan struct{}, config.MaxVideoWorkers)
 
-	client := &http.Client{
-		Timeout: 0,
-		Transport: &http.Transport{
-			TLSHandshakeTimeout: 10 * time.Second,
-		},
-	}
-	defer client.CloseIdleConnections()
-
 	for i := 0; i < numChunks; i++ {
-		semaphore <- struct{}{}
+		start, end := chunkRange(i, totalSize)
+
+		// Часть, целиком загруженная при прошлом запуске, не загружается повторно
+		if size, ok := chunkSizeOnDisk(tempFiles[i]); ok && size == end-start+1 {
+			progress.Resume(size, 0, 0)
+			continue
+		}
+
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
 		chunkWG.Add(1)
 		go func(i int) {
 			defer chunkWG.Done()
 			defer func() { <-semaphore }()
 
-			start := int64(i) * chunkSize
-			end := start + chunkSize - 1
-			if end >= totalSize {
-				end = totalSize - 1
-			}
-
-			tempFile := fmt.Sprintf("%s\\%s_chunk_%d.tmp", path, result.Seria.Num, i)
-			attempts := 3
-
-			for attempts > 0 {
-				if err := downloadChunk(client, url, start, end, tempFile, bar); err != nil {
-					if strings.Contains(err.Error(), "TLS handshake timeout") || strings.Contains(err.Error(), "status code: 504") {
-						log.Printf("Retrying chunk %d due to error: %v", i, err)
-						time.Sleep(5 * time.Second)
-						attempts--
-						continue
-					}
-					log.Printf("Failed to download chunk %d: %v", i, err)
-					return
-				}
-				tempFiles[i] = tempFile
-				break
+			// Неудачная часть остается незагруженной, и склейка не начнется
+			err := retry.Do(ctx, fmt.Sprintf("chunk %d", i), func() error {
+				return downloadChunk(ctx, client, bandwidth, url, start, end, tempFiles[i], progress)
+			})
+			if err != nil && ctx.Err() == nil {
+				opts.Log.Printf("Failed to download chunk %d: %v", i, err)
 			}
 		}(i)
 	}
 
 	chunkWG.Wait()
 
-	outputFile := fmt.Sprintf("%s\\%s_серия.mp4", path, result.Seria.Num)
+	// Загруженные части остаются на диске: повторный запуск загрузит только недостающие
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("download cancelled: %w", ctx.Err())
+	}
+
+	if missing := missingChunks(tempFiles, totalSize); len(missing) > 0 {
+		return "", fmt.Errorf("missing %d of %d chunks, absent byte ranges: %s", len(missing), numChunks, strings.Join(missing, ", "))
+	}
+
 	if err := mergeChunks(tempFiles, outputFile); err != nil {
 		return "", fmt.Errorf("failed to merge chunks: %w", err)
 	}
@@ -126,8 +187,68 @@ func downloadVideo(result utils.Result, bar *progressbar.ProgressBar, config *ut
 	return outputFile, nil
 }
 
-func downloadChunk(client *http.Client, url string, start, end int64, tempFile string, bar *progressbar.ProgressBar) error {
-	req, err := http.NewRequest("GET", url, nil)
+// videoSize запрашивает размер mp4 файла HEAD запросом
+func videoSize(ctx context.Context, client *http.Client, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create HEAD request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send HEAD request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to fetch video: %w", utils.NewHTTPStatusError(resp))
+	}
+
+	// Без размера нельзя разбить файл на части и проверить, что все они загружены
+	if resp.ContentLength <= 0 {
+		return 0, errors.New("server did not report video size")
+	}
+
+	return resp.ContentLength, nil
+}
+
+// chunkRange возвращает первый и последний байт части i
+func chunkRange(i int, totalSize int64) (start, end int64) {
+	start = int64(i) * chunkSize
+	end = start + chunkSize - 1
+	if end >= totalSize {
+		end = totalSize - 1
+	}
+	return start, end
+}
+
+// chunkSizeOnDisk возвращает размер файла части; false, если файла нет
+func chunkSizeOnDisk(tempFile string) (int64, bool) {
+	info, err := os.Stat(tempFile)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// missingChunks возвращает диапазоны байт частей, которых нет на диске или размер которых
+// не совпадает с ожидаемым
+func missingChunks(tempFiles []string, totalSize int64) []string {
+	var missing []string
+	for i, tempFile := range tempFiles {
+		start, end := chunkRange(i, totalSize)
+		if size, ok := chunkSizeOnDisk(tempFile); !ok || size != end-start+1 {
+			missing = append(missing, fmt.Sprintf("%d-%d", start, end))
+		}
+	}
+	return missing
+}
+
+// downloadChunk загружает диапазон байт во временный файл.
+// Если загрузка прервана или размер не совпал с диапазоном, недописанный файл удаляется.
+// Тело ответа читается через ограничитель скорости серии, байты неудачной попытки вычитаются из прогресса
+func downloadChunk(ctx context.Context, client *http.Client, bandwidth *episodeBandwidth, url string, start, end int64, tempFile string, progress *utils.EpisodeProgress) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -142,98 +263,100 @@ func downloadChunk(client *http.Client, url string, start, end int64, tempFile s
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return utils.NewHTTPStatusError(resp)
 	}
 
 	file, err := os.Create(tempFile)
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
-	defer file.Close()
 
-	progressReader := io.TeeReader(resp.Body, bar)
+	progressReader := io.TeeReader(bandwidth.reader(ctx, resp.Body), progress)
 
-	_, err = io.Copy(file, progressReader)
+	written, err := io.Copy(file, progressReader)
+	file.Close()
 	if err != nil {
+		progress.Add(-written)
+		os.Remove(tempFile)
 		return fmt.Errorf("failed to write chunk to file: %w", err)
 	}
 
+	// Сервер может оборвать ответ или проигнорировать Range: такая часть испортила бы склейку.
+	// Оборванный ответ стоит повторить, а лишние байты повторный запрос не исправит
+	if written != end-start+1 {
+		progress.Add(-written)
+		os.Remove(tempFile)
+		err := fmt.Errorf("chunk size mismatch: got %d bytes, expected %d", written, end-start+1)
+		if written < end-start+1 {
+			err = fmt.Errorf("%w: %w", err, io.ErrUnexpectedEOF)
+		}
+		return err
+	}
+
 	return nil
 }
 
+// newHTTPClient создает клиент для загрузки видео. Если в opts задан Transport, используется он
+func newHTTPClient(opts Options, timeout time.Duration) *http.Client {
+	transport := opts.Transport
+	if transport == nil {
+		transport = &http.Transport{
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// downloadProgress возвращает config.Progress, а если он не задан — прогресс, который никто не читает
+func downloadProgress(config *utils.Config) *utils.DownloadProgress {
+	if config.Progress != nil {
+		return config.Progress
+	}
+	return utils.NewDownloadProgress()
+}
+
+// removeFiles удаляет временные файлы, пропуская пустые пути
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+}
+
 func mergeChunks(tempFiles []string, outputFile string) error {
 	out, err := os.Create(outputFile)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
-	defer out.Close()
 
 	for _, tempFile := range tempFiles {
 		file, err := os.Open(tempFile)
 		if err != nil {
+			out.Close()
+			os.Remove(outputFile)
 			return fmt.Errorf("failed to open temp file: %w", err)
 		}
 		_, err = io.Copy(out, file)
 		file.Close()
 		if err != nil {
+			out.Close()
+			os.Remove(outputFile)
 			return fmt.Errorf("failed to append chunk: %w", err)
 		}
-		os.Remove(tempFile)
 	}
 
-	return nil
-}
-
-func getPath(titleName string) string {
-	filePath := fmt.Sprintf("videos\\%s", normalizeDirName(titleName))
-	absPath, err := filepath.Abs(filePath)
-	if err != nil {
-		log.Fatalf("Ошибка при получении пути: %v", err)
+	if err := out.Close(); err != nil {
+		os.Remove(outputFile)
+		return fmt.Errorf("failed to close output file: %w", err)
 	}
 
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		err = os.MkdirAll(absPath, os.ModePerm)
-		if err != nil {
-			log.Fatalf("Failed to create directory: %v", err)
-		}
-	}
+	// Временные файлы удаляются только после успешной склейки
+	removeFiles(tempFiles)
 
-	return absPath
-}
-
-func normalizeDirName(dirName string) string {
-	// Список зарезервированных имен файлов/папок в Windows
-	reservedNames := map[string]struct{}{
-		"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
-		"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {},
-		"COM8": {}, "COM9": {}, "LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {},
-		"LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
-	}
-
-	// Удаляем или заменяем символы, не разрешенные в Windows
-	re := regexp.MustCompile(`[<>:"/\|?*\ ]`)
-	dirName = re.ReplaceAllString(dirName, "_")
-
-	// Заменяем зарезервированные имена на "_"
-	if _, exists := reservedNames[strings.ToUpper(dirName)]; exists {
-		dirName = "_" + dirName
-	}
-
-	// Обрезаем имя, если оно слишком длинное (Windows ограничивает длину пути 255 символами)
-	if len(dirName) > 255 {
-		dirName = dirName[:255]
-	}
-
-	// Удаляем пробелы в начале и в конце строки
-	dirName = strings.TrimSpace(dirName)
-
-	// Убираем все неалфавитные символы в начале и в конце
-	dirName = strings.Map(func(r rune) rune {
-		if unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_' {
-			return r
-		}
-		return -1
-	}, dirName)
-
-	return dirName
+	return nil
 }
@@ -0,0 +1,573 @@
+package video_utils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"kodik_parser/kodik"
+	"kodik_parser/kodiktest"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resolve получает ссылки на все серии поддельного тайтла
+func resolve(t *testing.T, server *kodiktest.Server) utils.HandleResult {
+	t.Helper()
+
+	result, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	return result
+}
+
+func testConfig(t *testing.T) *utils.Config {
+	config := utils.NewDefaultConfig()
+	config.OutputDirectory = t.TempDir()
+	// Короткие паузы между повторами, чтобы тесты не ждали секундами
+	config.Retry.Download.BaseDelay = 0.01
+	config.Retry.Download.MaxDelay = 0.1
+	return &config
+}
+
+// testOptions направляет загрузку на поддельный сервер
+func testOptions(server *kodiktest.Server) video_utils.Options {
+	return video_utils.Options{Transport: server.Client().Transport}
+}
+
+func checkDownloaded(t *testing.T, result utils.HandleResult, want func(res utils.Result) []byte) {
+	t.Helper()
+
+	for _, res := range result.Results {
+		if res.Status != utils.StatusDownloaded || res.Err != nil {
+			t.Errorf("%s: Status = %q, Err = %v", res.Seria.Label(), res.Status, res.Err)
+			continue
+		}
+
+		data, err := os.ReadFile(res.Path)
+		if err != nil {
+			t.Errorf("%s: %v", res.Seria.Label(), err)
+			continue
+		}
+		if !bytes.Equal(data, want(res)) {
+			t.Errorf("%s: downloaded %d bytes, content mismatch", res.Seria.Label(), len(data))
+		}
+	}
+}
+
+// findFiles возвращает файлы в dir и его подкаталогах, имя которых оканчивается на suffix
+func findFiles(t *testing.T, dir, suffix string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(path, suffix) {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDownloadVideosHLS(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2, Segments: 5, SegmentSize: 4096})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Progress = utils.NewDownloadProgress()
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+
+	for _, s := range config.Progress.Snapshot() {
+		if !s.Done() || s.Bytes != 5*4096 || s.Fragments != 5 || s.TotalFragments != 5 || s.Duration != s.TotalDuration {
+			t.Errorf("%s: progress = %+v", s.Seria.Label(), s)
+		}
+	}
+
+	want := filepath.Join(config.OutputDirectory, "Test Title", "1_серия.ts")
+	if result.Results[0].Path != want {
+		t.Errorf("Path = %q, want %q", result.Results[0].Path, want)
+	}
+}
+
+func TestDownloadVideosHLSBandwidth(t *testing.T) {
+	// 96 КБ при общем лимите 64 КБ/с: секунда из полной корзины сразу, остальное за полсекунды
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2, Segments: 4, SegmentSize: 12 * 1024})
+	defer server.Close()
+
+	video_utils.SetBandwidthLimit(64*1024, 0)
+	defer video_utils.SetBandwidthLimit(0, 0)
+
+	config := testConfig(t)
+	result := resolve(t, server)
+
+	start := time.Now()
+	result = video_utils.DownloadVideosHLS(context.Background(), result, config, testOptions(server))
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("96 KB at 64 KB/s downloaded in %v", elapsed)
+	}
+
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+}
+
+func TestDownloadFileTemplate(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Title: "../Test/Title", Seasons: 2, Episodes: 1})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.FileTemplate = "{translation}/{title}/S{season:02}E{episode:02}_{quality}p.{ext}"
+
+	result, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{
+		SelectEpisodes: func(title *kodik.Title) ([]utils.KodikSeriaInfo, error) {
+			return utils.SelectSeries(title.Series, "all seasons", title.Season)
+		},
+	})
+	if err != nil || len(result.Results) != 2 {
+		t.Fatalf("Resolve: %d results, %v", len(result.Results), err)
+	}
+
+	result = video_utils.DownloadVideos(context.Background(), result, config, testOptions(server))
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.MP4Data(res.Seria.Id, res.Quality)
+	})
+
+	for _, res := range result.Results {
+		want := filepath.Join(config.OutputDirectory, "AniLibria.TV", ".._Test_Title",
+			fmt.Sprintf("S%02dE01_%dp.mp4", res.Seria.Season, res.Quality))
+		if res.Path != want {
+			t.Errorf("Path = %q, want %q", res.Path, want)
+		}
+	}
+}
+
+func TestDownloadVideos(t *testing.T) {
+	// Чуть больше одной части, чтобы файл собирался из нескольких запросов с Range
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2, VideoSize: 5*1024*1024 + 4096})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Progress = utils.NewDownloadProgress()
+	result := video_utils.DownloadVideos(context.Background(), resolve(t, server), config, testOptions(server))
+
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.MP4Data(res.Seria.Id, res.Quality)
+	})
+
+	stats := config.Progress.Snapshot()
+	if len(stats) != 2 {
+		t.Fatalf("progress has %d episodes, want 2", len(stats))
+	}
+	for _, s := range stats {
+		if !s.Done() || s.Err != nil || s.Bytes != 5*1024*1024+4096 || s.TotalBytes != s.Bytes {
+			t.Errorf("%s: progress = %+v", s.Seria.Label(), s)
+		}
+	}
+}
+
+func TestDownloadVideosUnknownSize(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, HideVideoSize: true})
+	defer server.Close()
+
+	config := testConfig(t)
+	result := video_utils.DownloadVideos(context.Background(), resolve(t, server), config, testOptions(server))
+
+	res := result.Results[0]
+	if res.Status != utils.StatusDownloadFailed || res.Err == nil || !strings.Contains(res.Err.Error(), "did not report video size") {
+		t.Errorf("Status = %q, Err = %v; want unknown size error", res.Status, res.Err)
+	}
+	if files := findFiles(t, config.OutputDirectory, ".mp4"); len(files) != 0 {
+		t.Errorf("files written: %v", files)
+	}
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer server.Close()
+
+	result := resolve(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	config := testConfig(t)
+	result = video_utils.DownloadVideosHLS(ctx, result, config, testOptions(server))
+
+	for _, res := range result.Results {
+		if res.Status != utils.StatusDownloadFailed || res.Err == nil {
+			t.Errorf("%s: Status = %q, Err = %v", res.Seria.Label(), res.Status, res.Err)
+		}
+	}
+
+	entries, _ := os.ReadDir(config.OutputDirectory)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			t.Errorf("file %s left after cancel", entry.Name())
+		}
+	}
+}
+
+func TestDownloadEpisodeLocked(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1})
+	defer server.Close()
+
+	config := testConfig(t)
+
+	// Серию записывает другой процесс: он держит блокировку файла серии
+	dir := filepath.Join(config.OutputDirectory, "Test Title")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := os.Create(filepath.Join(dir, "1_серия.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.LockFile(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, download := range []func(context.Context, utils.HandleResult, *utils.Config, video_utils.Options) utils.HandleResult{
+		video_utils.DownloadVideosHLS,
+		video_utils.DownloadVideos,
+	} {
+		result := download(context.Background(), resolve(t, server), config, testOptions(server))
+		if res := result.Results[0]; res.Status != utils.StatusDownloadFailed || !errors.Is(res.Err, video_utils.ErrEpisodeLocked) {
+			t.Errorf("Status = %q, Err = %v, want %v", res.Status, res.Err, video_utils.ErrEpisodeLocked)
+		}
+	}
+	if files := findFiles(t, dir, "серия.ts"); len(files) != 0 {
+		t.Errorf("locked episode was written: %v", files)
+	}
+
+	// После снятия блокировки серия загружается, а файл блокировки удаляется
+	lock.Close()
+
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+	if files := findFiles(t, config.OutputDirectory, ".lock"); len(files) != 0 {
+		t.Errorf("lock files left: %v", files)
+	}
+}
+
+func TestDownloadVideosHLSByteRanges(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Segments: 4, SegmentSize: 1000, ByteRanges: true})
+	defer server.Close()
+
+	config := testConfig(t)
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+}
+
+func TestDownloadVideosHLSMasterPlaylist(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Variants: []int{360, 720, 1080}})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.HLSVariant.Max = 720
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+
+	res := result.Results[0]
+	if res.Variant == nil || res.Variant.Height != 720 || res.Variant.Width != 1280 {
+		t.Fatalf("Variant = %+v, want 720p", res.Variant)
+	}
+
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Variant.Height)
+	})
+}
+
+func TestDownloadVideosHLSEncrypted(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Segments: 5, SegmentSize: 1000, KeyRotation: 2})
+	defer server.Close()
+
+	config := testConfig(t)
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+
+	// Ключи кешируются: каждый загружается один раз
+	id := result.Results[0].Seria.Id
+	for key := 0; key < 3; key++ {
+		path := fmt.Sprintf("/storage/%s/key-%d.bin", id, key)
+		if n := server.Requests(path); n != 1 {
+			t.Errorf("%s requested %d times, want 1", path, n)
+		}
+	}
+}
+
+func TestDownloadVideosHLSSampleAES(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, KeyRotation: 2, KeyMethod: "SAMPLE-AES"})
+	defer server.Close()
+
+	config := testConfig(t)
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+
+	res := result.Results[0]
+	if res.Status != utils.StatusDownloadFailed || res.Err == nil || !strings.Contains(res.Err.Error(), "SAMPLE-AES") {
+		t.Errorf("Status = %q, Err = %v; want SAMPLE-AES error", res.Status, res.Err)
+	}
+	if res.Path != "" {
+		t.Errorf("Path = %q, want no file", res.Path)
+	}
+}
+
+func TestDownloadVideosHLSResume(t *testing.T) {
+	// Третий фрагмент первый раз отвечает ошибкой: без повторов загрузка прерывается после двух фрагментов
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Segments: 5, SegmentSize: 1000, FailSegments: map[int]int{3: 1}})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.MaxVideoWorkers = 1
+	config.Retry.Download.Attempts = 1
+
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+	res := result.Results[0]
+	if res.Status != utils.StatusDownloadFailed {
+		t.Fatalf("first run: Status = %q, want %q", res.Status, utils.StatusDownloadFailed)
+	}
+
+	states := findFiles(t, config.OutputDirectory, ".state.json")
+	if len(states) != 1 {
+		t.Fatalf("first run left %d state files, want 1", len(states))
+	}
+
+	result = video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+
+	// Записанные при первом запуске фрагменты повторно не запрашиваются
+	res = result.Results[0]
+	for n, want := range map[int]int{1: 1, 2: 1, 3: 2, 4: 1, 5: 1} {
+		path := fmt.Sprintf("/storage/%s/%d.mp4:hls:seg-%d-v1-a1.ts", res.Seria.Id, res.Quality, n)
+		if got := server.Requests(path); got != want {
+			t.Errorf("fragment %d requested %d times, want %d", n, got, want)
+		}
+	}
+
+	if _, err := os.Stat(states[0]); !os.IsNotExist(err) {
+		t.Errorf("state file is left after complete download: %v", err)
+	}
+}
+
+func TestDownloadVideosHLSResumeOtherQuality(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Segments: 5, SegmentSize: 1000, FailSegments: map[int]int{3: 1}})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.MaxVideoWorkers = 1
+	config.Retry.Download.Attempts = 1
+
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+	if res := result.Results[0]; res.Status != utils.StatusDownloadFailed || res.Quality != 720 {
+		t.Fatalf("first run: Status = %q, Quality = %d", res.Status, res.Quality)
+	}
+
+	// Второй запуск получает ссылку на другое качество с тем же числом фрагментов:
+	// записанные фрагменты 720p не должны оказаться в одном файле с 480p
+	result, err := kodik.NewClient(server.Client()).Resolve(context.Background(), server.TitleURL(), kodik.Options{
+		Quality: utils.QualityPolicy{Preferred: 480},
+	})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	result = video_utils.DownloadVideosHLS(context.Background(), result, config, testOptions(server))
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, 480)
+	})
+
+	res := result.Results[0]
+	path := fmt.Sprintf("/storage/%s/480.mp4:hls:seg-1-v1-a1.ts", res.Seria.Id)
+	if n := server.Requests(path); n != 1 {
+		t.Errorf("first 480p fragment requested %d times, want 1", n)
+	}
+}
+
+func TestDownloadVideosHLSReResolve(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer server.Close()
+
+	result := resolve(t, server)
+	server.ExpireLinks()
+
+	config := testConfig(t)
+	config.ReResolve = func(ctx context.Context, res utils.Result) (utils.Result, error) {
+		return kodik.NewClient(server.Client()).ResolveEpisode(ctx, server.TitleURL(), res.Seria, kodik.Options{})
+	}
+
+	secretRequests := server.SecretRequests()
+	result = video_utils.DownloadVideosHLS(context.Background(), result, config, testOptions(server))
+
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+
+	if n := server.SecretRequests() - secretRequests; n != 2 {
+		t.Errorf("links requested again %d times, want 2", n)
+	}
+}
+
+func TestDownloadVideosHLSExpired(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1})
+	defer server.Close()
+
+	result := resolve(t, server)
+	server.ExpireLinks()
+
+	config := testConfig(t)
+	result = video_utils.DownloadVideosHLS(context.Background(), result, config, testOptions(server))
+
+	res := result.Results[0]
+	if res.Status != utils.StatusDownloadFailed || res.Err == nil || !strings.Contains(res.Err.Error(), "410") {
+		t.Errorf("Status = %q, Err = %v; want 410 error", res.Status, res.Err)
+	}
+}
+
+func TestDownloadVideosResume(t *testing.T) {
+	const chunk = 5 * 1024 * 1024
+
+	// Три части; вторая при первом запуске отвечает ошибкой, повторы отключены
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, VideoSize: 2*chunk + 4096, FailRanges: map[int64]int{chunk: 1}})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Retry.Download.Attempts = 1
+
+	result := video_utils.DownloadVideos(context.Background(), resolve(t, server), config, testOptions(server))
+	res := result.Results[0]
+	wantRange := fmt.Sprintf("%d-%d", chunk, 2*chunk-1)
+	if res.Status != utils.StatusDownloadFailed || res.Err == nil || !strings.Contains(res.Err.Error(), wantRange) {
+		t.Fatalf("first run: Status = %q, Err = %v; want missing range %s", res.Status, res.Err, wantRange)
+	}
+	if mp4 := findFiles(t, config.OutputDirectory, ".mp4"); len(mp4) != 0 {
+		t.Fatalf("first run merged %v despite a missing chunk", mp4)
+	}
+
+	chunks := findFiles(t, config.OutputDirectory, "_chunk_0.tmp")
+	if len(chunks) != 1 {
+		t.Fatalf("first run left %d files of chunk 0, want 1", len(chunks))
+	}
+
+	// Недописанная часть загружается заново
+	if err := os.Truncate(chunks[0], 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	video := strings.TrimSuffix(kodiktest.LinkPath(res.Video), ":hls:manifest.m3u8")
+	requests := server.Requests(video)
+
+	result = video_utils.DownloadVideos(context.Background(), resolve(t, server), config, testOptions(server))
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.MP4Data(res.Seria.Id, res.Quality)
+	})
+
+	// HEAD и две части: первая недописанная и вторая отсутствующая
+	if n := server.Requests(video) - requests; n != 3 {
+		t.Errorf("second run sent %d requests, want 3", n)
+	}
+
+	if tmp := findFiles(t, config.OutputDirectory, ".tmp"); len(tmp) != 0 {
+		t.Errorf("chunks left after merge: %v", tmp)
+	}
+}
+
+func TestDownloadVideosHLSRetry(t *testing.T) {
+	// Третий фрагмент дважды отвечает ошибкой 500 и загружается с третьей попытки
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Segments: 5, SegmentSize: 1000, FailSegments: map[int]int{3: 2}})
+	defer server.Close()
+
+	config := testConfig(t)
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+
+	res := result.Results[0]
+	path := fmt.Sprintf("/storage/%s/%d.mp4:hls:seg-3-v1-a1.ts", res.Seria.Id, res.Quality)
+	if n := server.Requests(path); n != 3 {
+		t.Errorf("fragment 3 requested %d times, want 3", n)
+	}
+}
+
+func TestDownloadVideosRetryAfter(t *testing.T) {
+	const chunk = 5 * 1024 * 1024
+
+	server := kodiktest.NewServer(kodiktest.Config{
+		Episodes: 1, VideoSize: chunk + 4096, FailRanges: map[int64]int{chunk: 1},
+		FailStatus: 429, RetryAfter: "1",
+	})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Retry.Download.MaxDelay = 2
+
+	start := time.Now()
+	result := video_utils.DownloadVideos(context.Background(), resolve(t, server), config, testOptions(server))
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.MP4Data(res.Seria.Id, res.Quality)
+	})
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("download took %v, want at least Retry-After of 1s", elapsed)
+	}
+}
+
+func TestDownloadVideosNotRetried(t *testing.T) {
+	tests := []struct {
+		name   string
+		config kodiktest.Config
+	}{
+		// 404 повторять бесполезно
+		{"not found", kodiktest.Config{FailStatus: 404}},
+		// Сервер просит подождать дольше MaxDelay
+		{"retry after", kodiktest.Config{FailStatus: 503, RetryAfter: "3600"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const chunk = 5 * 1024 * 1024
+
+			tt.config.Episodes = 1
+			tt.config.VideoSize = chunk + 4096
+			tt.config.FailRanges = map[int64]int{chunk: 1}
+			server := kodiktest.NewServer(tt.config)
+			defer server.Close()
+
+			config := testConfig(t)
+			result := video_utils.DownloadVideos(context.Background(), resolve(t, server), config, testOptions(server))
+
+			res := result.Results[0]
+			if res.Status != utils.StatusDownloadFailed {
+				t.Fatalf("Status = %q, want %q", res.Status, utils.StatusDownloadFailed)
+			}
+
+			video := strings.TrimSuffix(kodiktest.LinkPath(res.Video), ":hls:manifest.m3u8")
+			// HEAD и по одному запросу каждой части
+			if n := server.Requests(video); n != 3 {
+				t.Errorf("sent %d requests, want 3", n)
+			}
+		})
+	}
+}
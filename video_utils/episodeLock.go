@@ -0,0 +1,95 @@
+package video_utils
+
+import (
+	"errors"
+	"fmt"
+	"kodik_parser/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrEpisodeLocked — файл серии сейчас записывает другая загрузка этого или другого процесса,
+// например другая озвучка той же серии, если шаблон имени файла не содержит {translation}
+var ErrEpisodeLocked = errors.New("episode file is being written by another download")
+
+var (
+	lockedMu    sync.Mutex
+	lockedPaths = make(map[string]bool) // блокировки этого процесса
+)
+
+// lockEpisode захватывает блокировку файла серии без ожидания. Блокируется путь без расширения,
+// поэтому .ts, .mp4 после перепаковки и части mp4 одной серии защищены одной блокировкой.
+// Файл блокировки <путь>.lock удаляется вызовом unlock, а при падении процесса блокировку снимает система
+func lockEpisode(path string) (unlock func(), err error) {
+	lockPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".lock"
+
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+
+	if lockedPaths[lockPath] {
+		return nil, fmt.Errorf("%s: %w", path, ErrEpisodeLocked)
+	}
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open episode lock: %w", err)
+		}
+		if err := utils.LockFile(f); err != nil {
+			f.Close()
+			if errors.Is(err, utils.ErrLocked) {
+				return nil, fmt.Errorf("%s: %w", path, ErrEpisodeLocked)
+			}
+			return nil, fmt.Errorf("failed to lock episode: %w", err)
+		}
+
+		// Пока файл открывался, прежний владелец мог снять блокировку и удалить его.
+		// Тогда заблокирован файл, которого другие уже не видят, и нужно открыть новый
+		same, err := sameFile(f, lockPath)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to check episode lock: %w", err)
+		}
+		if !same {
+			f.Close()
+			continue
+		}
+
+		lockedPaths[lockPath] = true
+		return func() {
+			lockedMu.Lock()
+			defer lockedMu.Unlock()
+
+			delete(lockedPaths, lockPath)
+
+			// Файл удаляется под блокировкой. Windows не удаляет открытый файл, поэтому там
+			// он удаляется после закрытия, если его к этому времени не открыла другая загрузка
+			if os.Remove(lockPath) != nil {
+				f.Close()
+				os.Remove(lockPath)
+				return
+			}
+			f.Close()
+		}, nil
+	}
+}
+
+// sameFile сообщает, что открытый файл f все еще лежит по пути path
+func sameFile(f *os.File, path string) (bool, error) {
+	opened, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(opened, current), nil
+}
@@ -0,0 +1,212 @@
+package video_utils
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Типы NAL единиц H.264, которые важны при перепаковке
+const (
+	nalSliceIDR = 5
+	nalSPS      = 7
+	nalPPS      = 8
+	nalAUD      = 9
+)
+
+// splitAnnexB делит поток H.264 в формате Annex B на NAL единицы без стартовых кодов
+func splitAnnexB(data []byte) [][]byte {
+	var (
+		nalus [][]byte
+		start = -1
+	)
+
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				// Нулевой байт четырехбайтного стартового кода относится к нему, а не к NAL
+				nalus = append(nalus, bytes.TrimRight(data[start:i], "\x00"))
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+
+	return nalus
+}
+
+// spsInfo — параметры SPS, нужные для заголовков MP4
+type spsInfo struct {
+	Width  int
+	Height int
+}
+
+// parseSPS извлекает размер кадра из SPS (ITU-T H.264, 7.3.2.1.1)
+func parseSPS(nal []byte) (spsInfo, error) {
+	if len(nal) < 4 || nal[0]&0x1f != nalSPS {
+		return spsInfo{}, errors.New("not an SPS NAL unit")
+	}
+
+	r := &bitReader{data: removeEmulationPrevention(nal[1:])}
+
+	profile := r.bits(8)
+	r.bits(16) // constraint_set флаги и level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := 1
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				skipScalingList(r, size)
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bits(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+
+	if r.err != nil {
+		return spsInfo{}, r.err
+	}
+
+	// Единицы обрезки зависят от субдискретизации цветности (таблица 6-1)
+	cropX, cropY := 1, 2-frameMbsOnly
+	switch chromaFormat {
+	case 1:
+		cropX, cropY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropX = 2
+	}
+
+	info := spsInfo{
+		Width:  widthMbs*16 - (cropLeft+cropRight)*cropX,
+		Height: (2-frameMbsOnly)*heightMapUnits*16 - (cropTop+cropBottom)*cropY,
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return spsInfo{}, errors.New("invalid frame size in SPS")
+	}
+
+	return info, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// removeEmulationPrevention убирает байты 0x03, вставленные после двух нулей
+func removeEmulationPrevention(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader читает биты и коды Exp-Golomb. Первая ошибка запоминается, дальнейшие чтения возвращают 0
+type bitReader struct {
+	data []byte
+	pos  int // позиция в битах
+	err  error
+}
+
+func (r *bitReader) bits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errors.New("unexpected end of SPS")
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | int(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errors.New("invalid Exp-Golomb code in SPS")
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 0 {
+		return -v / 2
+	}
+	return (v + 1) / 2
+}
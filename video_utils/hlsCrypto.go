@@ -0,0 +1,140 @@
+package video_utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"kodik_parser/utils"
+	"net/http"
+	"sync"
+)
+
+// hlsKeys загружает ключи AES-128 и кеширует их по URI. Фрагменты, одновременно запросившие
+// один ключ, ждут одной загрузки; ошибка не кешируется, чтобы повторная попытка загрузила ключ заново
+type hlsKeys struct {
+	client *http.Client
+
+	mu   sync.Mutex
+	keys map[string]*hlsKey
+}
+
+type hlsKey struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+func newHlsKeys(client *http.Client) *hlsKeys {
+	return &hlsKeys{client: client, keys: make(map[string]*hlsKey)}
+}
+
+// get возвращает ключ по URI, загружая его при первом обращении
+func (k *hlsKeys) get(ctx context.Context, uri string) ([]byte, error) {
+	k.mu.Lock()
+	entry, ok := k.keys[uri]
+	if !ok {
+		entry = &hlsKey{}
+		k.keys[uri] = entry
+	}
+	k.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.key == nil {
+		key, err := k.fetch(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		entry.key = key
+	}
+
+	return entry.key, nil
+}
+
+func (k *hlsKeys) fetch(ctx context.Context, uri string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key request: %w", err)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch key: %w", utils.NewHTTPStatusError(resp))
+	}
+
+	// Ключ AES-128 — ровно 16 байт; читаем на байт больше, чтобы заметить лишние данные
+	key, err := io.ReadAll(io.LimitReader(resp.Body, aes.BlockSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key length %d, expected %d", len(key), aes.BlockSize)
+	}
+
+	return key, nil
+}
+
+// decrypt расшифровывает фрагмент ключом из его EXT-X-KEY
+func (k *hlsKeys) decrypt(ctx context.Context, fragment HlsFragment, data []byte) ([]byte, error) {
+	if fragment.Key == nil {
+		return data, nil
+	}
+	if fragment.Key.Method != KeyMethodAES128 {
+		return nil, fmt.Errorf("encryption method %s is not supported", fragment.Key.Method)
+	}
+
+	iv := fragment.Key.IV
+	if iv == nil {
+		// Без атрибута IV вектор — номер сегмента в big-endian (RFC 8216, 5.2)
+		if fragment.Sequence < 0 {
+			return nil, errors.New("encrypted init section without IV")
+		}
+		iv = sequenceIV(fragment.Sequence)
+	}
+
+	key, err := k.get(ctx, fragment.Key.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptAES128(data, key, iv)
+}
+
+// sequenceIV возвращает IV из номера сегмента
+func sequenceIV(sequence int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	return iv
+}
+
+// decryptAES128 расшифровывает AES-128-CBC и снимает дополнение PKCS#7
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted data length %d is not a multiple of the block size", len(data))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("invalid PKCS#7 padding, wrong key or IV")
+	}
+
+	return plain[:len(plain)-padding], nil
+}
@@ -0,0 +1,109 @@
+package video_utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"kodik_parser/utils"
+	"os"
+)
+
+// hlsState — состояние незавершенной HLS загрузки. Хранится рядом с .ts файлом,
+// чтобы повторный запуск продолжил загрузку с последнего записанного фрагмента
+type hlsState struct {
+	PlaylistURL string    `json:"playlistUrl"`
+	Stream      hlsStream `json:"stream"`
+	Fragments   int       `json:"fragments"` // всего частей в плейлисте, включая секции инициализации
+	Written     int       `json:"written"`   // сколько частей подряд с начала записано в файл
+	Bytes       int64     `json:"bytes"`     // размер файла после последней записанной части
+}
+
+// hlsStream — качество и вариант мастер плейлиста, фрагменты которых записаны в файл.
+// Фрагменты разных потоков нельзя склеивать, даже если их количество совпадает
+type hlsStream struct {
+	Quality   int `json:"quality"`
+	Height    int `json:"height,omitempty"`
+	Bandwidth int `json:"bandwidth,omitempty"`
+}
+
+// newHlsStream описывает поток качества quality; variant равен nil, если мастер плейлиста не было
+func newHlsStream(quality int, variant *utils.HLSVariant) hlsStream {
+	stream := hlsStream{Quality: quality}
+	if variant != nil {
+		stream.Height = variant.Height
+		stream.Bandwidth = variant.Bandwidth
+	}
+	return stream
+}
+
+// String возвращает поток в виде "720p" или "720p (variant 720p, 2500 kbit/s)"
+func (s hlsStream) String() string {
+	if s.Height == 0 && s.Bandwidth == 0 {
+		return fmt.Sprintf("%dp", s.Quality)
+	}
+	return fmt.Sprintf("%dp (variant %dp, %d kbit/s)", s.Quality, s.Height, s.Bandwidth/1000)
+}
+
+// statePath возвращает путь файла состояния для загружаемого файла
+func statePath(path string) string {
+	return path + ".state.json"
+}
+
+// loadHlsState читает состояние загрузки. Отсутствие файла не является ошибкой: возвращается nil
+func loadHlsState(path string) (*hlsState, error) {
+	data, err := os.ReadFile(statePath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read download state: %w", err)
+	}
+
+	var state hlsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse download state: %w", err)
+	}
+
+	return &state, nil
+}
+
+// save записывает состояние через временный файл, чтобы падение процесса не оставило его недописанным
+func (s *hlsState) save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := statePath(path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+
+	if err := os.Rename(tmp, statePath(path)); err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+
+	return nil
+}
+
+// resumable сообщает, можно ли продолжить загрузку в файл path по этому состоянию
+func (s *hlsState) resumable(path string, fragments int) bool {
+	if s.Fragments != fragments || s.Written <= 0 || s.Written > fragments {
+		return false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	// Файл может оказаться длиннее, если процесс упал между записью фрагмента и состояния
+	return info.Size() >= s.Bytes
+}
+
+func removeHlsState(path string, log utils.Logf) {
+	if err := os.Remove(statePath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("failed to remove download state: %v", err)
+	}
+}
@@ -0,0 +1,499 @@
+package video_utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"kodik_parser/utils"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ByteRange — часть ресурса, заданная EXT-X-BYTERANGE или атрибутом BYTERANGE
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+// header возвращает значение заголовка Range
+func (r ByteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1)
+}
+
+// MediaInit — секция инициализации из EXT-X-MAP
+type MediaInit struct {
+	Url       string
+	ByteRange *ByteRange
+	Key       *SegmentKey // ключ, действующий на момент EXT-X-MAP
+}
+
+// Методы шифрования EXT-X-KEY
+const (
+	KeyMethodNone      = "NONE"
+	KeyMethodAES128    = "AES-128"
+	KeyMethodSampleAES = "SAMPLE-AES"
+)
+
+// SegmentKey — ключ шифрования из EXT-X-KEY
+type SegmentKey struct {
+	Method string
+	Url    string
+	IV     []byte // nil, если IV не указан и выводится из номера сегмента
+}
+
+// HlsFragment — сегмент медиа плейлиста
+type HlsFragment struct {
+	Number        int // порядковый номер при загрузке, с 0
+	Sequence      int // номер сегмента с учетом EXT-X-MEDIA-SEQUENCE
+	Duration      float64
+	Title         string
+	Url           string
+	ByteRange     *ByteRange
+	Discontinuity bool        // перед сегментом стоит EXT-X-DISCONTINUITY
+	Map           *MediaInit  // секция инициализации, действующая для сегмента
+	Key           *SegmentKey // ключ шифрования сегмента; nil, если сегмент не зашифрован
+}
+
+// MediaPlaylist — разобранный медиа плейлист HLS (RFC 8216)
+type MediaPlaylist struct {
+	TargetDuration int
+	MediaSequence  int
+	EndList        bool
+	Segments       []HlsFragment
+}
+
+// AudioRendition — аудиодорожка из EXT-X-MEDIA с TYPE=AUDIO
+type AudioRendition struct {
+	GroupID  string
+	Name     string
+	Language string
+	Default  bool
+	Url      string // пусто, если дорожка уже есть в потоке варианта
+}
+
+// MasterPlaylist — разобранный мастер плейлист HLS
+type MasterPlaylist struct {
+	Variants []utils.HLSVariant
+	Audio    []AudioRendition
+}
+
+// errMasterPlaylist возвращается, если вместо медиа плейлиста передан мастер плейлист
+var errMasterPlaylist = errors.New("playlist is a master playlist")
+
+// IsMasterPlaylist сообщает, содержит ли плейлист варианты потока
+func IsMasterPlaylist(body string) bool {
+	return strings.Contains(body, "#EXT-X-STREAM-INF:")
+}
+
+// ParseMasterPlaylist разбирает мастер плейлист: варианты (BANDWIDTH, RESOLUTION, CODECS, AUDIO)
+// и группы аудиодорожек. Ссылки разрешаются относительно playlistURL
+func ParseMasterPlaylist(body, playlistURL string) (*MasterPlaylist, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid playlist URL: %w", err)
+	}
+
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	if strings.TrimSpace(lines[0]) != "#EXTM3U" {
+		return nil, errors.New("playlist does not start with #EXTM3U")
+	}
+
+	playlist := &MasterPlaylist{}
+
+	var (
+		variant    utils.HLSVariant
+		hasVariant bool
+	)
+
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		lineNum := i + 2
+
+		switch {
+		case line == "":
+			continue
+
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+
+			variant = utils.HLSVariant{
+				Codecs: attrs["CODECS"],
+				Audio:  attrs["AUDIO"],
+			}
+
+			variant.Bandwidth, err = strconv.Atoi(attrs["BANDWIDTH"])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid BANDWIDTH %q", lineNum, attrs["BANDWIDTH"])
+			}
+
+			if resolution, ok := attrs["RESOLUTION"]; ok {
+				if _, err := fmt.Sscanf(resolution, "%dx%d", &variant.Width, &variant.Height); err != nil {
+					return nil, fmt.Errorf("line %d: invalid RESOLUTION %q", lineNum, resolution)
+				}
+			}
+			hasVariant = true
+
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			if attrs["TYPE"] != "AUDIO" {
+				continue
+			}
+
+			rendition := AudioRendition{
+				GroupID:  attrs["GROUP-ID"],
+				Name:     attrs["NAME"],
+				Language: attrs["LANGUAGE"],
+				Default:  attrs["DEFAULT"] == "YES",
+			}
+			if uri, ok := attrs["URI"]; ok {
+				if rendition.Url, err = resolveURI(base, uri); err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNum, err)
+				}
+			}
+			playlist.Audio = append(playlist.Audio, rendition)
+
+		case strings.HasPrefix(line, "#"):
+			continue
+
+		default:
+			if !hasVariant {
+				return nil, fmt.Errorf("line %d: URI %q without EXT-X-STREAM-INF", lineNum, line)
+			}
+
+			if variant.URL, err = resolveURI(base, line); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			playlist.Variants = append(playlist.Variants, variant)
+			hasVariant = false
+		}
+	}
+
+	if len(playlist.Variants) == 0 {
+		return nil, errors.New("can't find any variant in master playlist")
+	}
+
+	// Названия аудиодорожек группы сохраняются в варианте
+	for i := range playlist.Variants {
+		for _, rendition := range playlist.Audio {
+			if rendition.GroupID == playlist.Variants[i].Audio {
+				playlist.Variants[i].AudioNames = append(playlist.Variants[i].AudioNames, rendition.Name)
+			}
+		}
+	}
+
+	return playlist, nil
+}
+
+// ParseMediaPlaylist разбирает медиа плейлист. Ссылки на сегменты и секции инициализации
+// разрешаются относительно playlistURL по RFC 3986
+func ParseMediaPlaylist(body, playlistURL string) (*MediaPlaylist, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid playlist URL: %w", err)
+	}
+
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "#EXTM3U" {
+		return nil, errors.New("playlist does not start with #EXTM3U")
+	}
+
+	playlist := &MediaPlaylist{}
+
+	var (
+		segment       HlsFragment
+		hasInf        bool
+		currentMap    *MediaInit
+		currentKey    *SegmentKey
+		discontinuity bool
+		// Конец предыдущего поддиапазона для EXT-X-BYTERANGE без смещения
+		lastRangeURL string
+		lastRangeEnd int64
+	)
+
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		lineNum := i + 2
+
+		switch {
+		case line == "":
+			continue
+
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			return nil, errMasterPlaylist
+
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			duration, title, _ := strings.Cut(value, ",")
+
+			segment.Duration, err = strconv.ParseFloat(strings.TrimSpace(duration), 64)
+			if err != nil || segment.Duration < 0 {
+				return nil, fmt.Errorf("line %d: invalid EXTINF duration %q", lineNum, duration)
+			}
+			segment.Title = strings.TrimSpace(title)
+			hasInf = true
+
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			playlist.TargetDuration, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid EXT-X-TARGETDURATION", lineNum)
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			playlist.MediaSequence, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid EXT-X-MEDIA-SEQUENCE", lineNum)
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			byteRange, hasOffset, err := parseByteRange(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			if !hasOffset {
+				// Смещение берется из конца предыдущего поддиапазона; проверяется, когда станет известен URI
+				byteRange.Offset = -1
+			}
+			segment.ByteRange = &byteRange
+
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+
+			uri, ok := attrs["URI"]
+			if !ok {
+				return nil, fmt.Errorf("line %d: EXT-X-MAP without URI", lineNum)
+			}
+
+			currentMap = &MediaInit{Key: currentKey}
+			if currentMap.Url, err = resolveURI(base, uri); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+
+			if value, ok := attrs["BYTERANGE"]; ok {
+				byteRange, hasOffset, err := parseByteRange(value)
+				if err != nil || !hasOffset {
+					return nil, fmt.Errorf("line %d: invalid EXT-X-MAP BYTERANGE %q", lineNum, value)
+				}
+				currentMap.ByteRange = &byteRange
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			currentKey, err = parseKey(base, strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+
+		case line == "#EXT-X-ENDLIST":
+			playlist.EndList = true
+
+		case strings.HasPrefix(line, "#"):
+			// Прочие теги и комментарии не влияют на загрузку
+			continue
+
+		default:
+			if !hasInf {
+				return nil, fmt.Errorf("line %d: segment %q without EXTINF", lineNum, line)
+			}
+
+			if segment.Url, err = resolveURI(base, line); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+
+			if segment.ByteRange != nil {
+				if segment.ByteRange.Offset == -1 {
+					if lastRangeURL != segment.Url {
+						return nil, fmt.Errorf("line %d: EXT-X-BYTERANGE without offset does not follow a subrange of the same resource", lineNum)
+					}
+					segment.ByteRange.Offset = lastRangeEnd
+				}
+				lastRangeURL = segment.Url
+				lastRangeEnd = segment.ByteRange.Offset + segment.ByteRange.Length
+			} else {
+				lastRangeURL = ""
+			}
+
+			segment.Number = len(playlist.Segments)
+			segment.Sequence = playlist.MediaSequence + segment.Number
+			segment.Discontinuity = discontinuity
+			segment.Map = currentMap
+			segment.Key = currentKey
+			playlist.Segments = append(playlist.Segments, segment)
+
+			segment = HlsFragment{}
+			hasInf = false
+			discontinuity = false
+		}
+	}
+
+	if len(playlist.Segments) == 0 {
+		return nil, errors.New("can't find any fragment in playlist")
+	}
+
+	return playlist, nil
+}
+
+// Duration возвращает суммарную длительность сегментов в секундах
+func (p *MediaPlaylist) Duration() float64 {
+	var total float64
+	for _, segment := range p.Segments {
+		total += segment.Duration
+	}
+	return total
+}
+
+// Fragmented сообщает, что сегменты — фрагментированный MP4 с секцией инициализации EXT-X-MAP,
+// а не MPEG-TS
+func (p *MediaPlaylist) Fragmented() bool {
+	for _, segment := range p.Segments {
+		if segment.Map != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadOrder возвращает части в порядке записи в файл: перед первым сегментом
+// с новой секцией инициализации вставляется сама секция
+func (p *MediaPlaylist) downloadOrder() []HlsFragment {
+	var (
+		parts   []HlsFragment
+		lastMap *MediaInit
+	)
+
+	for _, segment := range p.Segments {
+		if segment.Map != nil && segment.Map != lastMap {
+			parts = append(parts, HlsFragment{
+				Sequence:  -1,
+				Url:       segment.Map.Url,
+				ByteRange: segment.Map.ByteRange,
+				Key:       segment.Map.Key,
+			})
+			lastMap = segment.Map
+		}
+		parts = append(parts, segment)
+	}
+
+	for i := range parts {
+		parts[i].Number = i
+	}
+
+	return parts
+}
+
+// parseKey разбирает атрибуты EXT-X-KEY. METHOD=NONE отменяет шифрование и возвращает nil
+func parseKey(base *url.URL, value string) (*SegmentKey, error) {
+	attrs := parseAttributes(value)
+
+	key := &SegmentKey{Method: attrs["METHOD"]}
+	switch key.Method {
+	case KeyMethodNone:
+		return nil, nil
+	case "":
+		return nil, errors.New("EXT-X-KEY without METHOD")
+	}
+
+	uri, ok := attrs["URI"]
+	if !ok {
+		return nil, fmt.Errorf("EXT-X-KEY with METHOD=%s without URI", key.Method)
+	}
+
+	var err error
+	if key.Url, err = resolveURI(base, uri); err != nil {
+		return nil, err
+	}
+
+	if iv, ok := attrs["IV"]; ok {
+		hexIV := strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+		key.IV, err = hex.DecodeString(hexIV)
+		if err != nil || len(key.IV) != 16 {
+			return nil, fmt.Errorf("invalid IV %q", iv)
+		}
+	}
+
+	return key, nil
+}
+
+// Encrypted сообщает, зашифрован ли хотя бы один сегмент плейлиста
+func (p *MediaPlaylist) Encrypted() bool {
+	for _, segment := range p.Segments {
+		if segment.Key != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEncryption возвращает ошибку, если плейлист зашифрован неподдерживаемым методом
+func (p *MediaPlaylist) checkEncryption() error {
+	for _, segment := range p.Segments {
+		if segment.Key != nil && segment.Key.Method != KeyMethodAES128 {
+			return fmt.Errorf("segment %d is encrypted with %s, which is not supported (only AES-128)", segment.Sequence, segment.Key.Method)
+		}
+	}
+	return nil
+}
+
+// resolveURI разрешает ссылку из плейлиста относительно его URL
+func resolveURI(base *url.URL, ref string) (string, error) {
+	parsed, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %q: %w", ref, err)
+	}
+	return base.ResolveReference(parsed).String(), nil
+}
+
+// parseByteRange разбирает значение вида <n>[@<o>]
+func parseByteRange(value string) (ByteRange, bool, error) {
+	lengthStr, offsetStr, hasOffset := strings.Cut(strings.TrimSpace(value), "@")
+
+	var byteRange ByteRange
+	var err error
+
+	byteRange.Length, err = strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil || byteRange.Length <= 0 {
+		return byteRange, false, fmt.Errorf("invalid byte range %q", value)
+	}
+
+	if hasOffset {
+		byteRange.Offset, err = strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || byteRange.Offset < 0 {
+			return byteRange, false, fmt.Errorf("invalid byte range %q", value)
+		}
+	}
+
+	return byteRange, hasOffset, nil
+}
+
+// parseAttributes разбирает список атрибутов тега: KEY=VALUE,KEY="VALUE, с запятыми"
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		name = strings.TrimSpace(name)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		attrs[name] = strings.TrimSpace(value)
+		s = rest
+	}
+
+	return attrs
+}
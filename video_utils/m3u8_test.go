@@ -0,0 +1,162 @@
+package video_utils_test
+
+import (
+	"kodik_parser/video_utils"
+	"testing"
+)
+
+func TestParseMediaPlaylist(t *testing.T) {
+	body := "#EXTM3U\r\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-TARGETDURATION:10\n" +
+		"#EXT-X-MEDIA-SEQUENCE:5\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"600@0\"\n" +
+		"#EXTINF:10,Первый\n" +
+		"seg-1.m4s\n" +
+		"#EXTINF:9.5,\n" +
+		"#EXT-X-BYTERANGE:1000@200\n" +
+		"../media/all.ts?token=abc\n" +
+		"#EXTINF:4.25,\n" +
+		"#EXT-X-BYTERANGE:500\n" +
+		"../media/all.ts?token=abc\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXTINF:3,\n" +
+		"https://other.example.org/x.ts\n" +
+		"#EXT-X-ENDLIST\n"
+
+	playlist, err := video_utils.ParseMediaPlaylist(body, "https://cdn.example.org/video/720/index.m3u8?sig=1")
+	if err != nil {
+		t.Fatalf("ParseMediaPlaylist: %v", err)
+	}
+
+	if playlist.TargetDuration != 10 || playlist.MediaSequence != 5 || !playlist.EndList {
+		t.Errorf("playlist = %+v", playlist)
+	}
+	if len(playlist.Segments) != 4 {
+		t.Fatalf("got %d segments, want 4", len(playlist.Segments))
+	}
+	if playlist.Duration() != 26.75 {
+		t.Errorf("Duration = %v, want 26.75", playlist.Duration())
+	}
+
+	first := playlist.Segments[0]
+	if first.Url != "https://cdn.example.org/video/720/seg-1.m4s" || first.Title != "Первый" || first.Sequence != 5 {
+		t.Errorf("first segment = %+v", first)
+	}
+	if first.Map == nil || first.Map.Url != "https://cdn.example.org/video/720/init.mp4" || *first.Map.ByteRange != (video_utils.ByteRange{Length: 600}) {
+		t.Errorf("first segment map = %+v", first.Map)
+	}
+
+	second, third := playlist.Segments[1], playlist.Segments[2]
+	if second.Url != "https://cdn.example.org/video/media/all.ts?token=abc" {
+		t.Errorf("second segment URL = %s", second.Url)
+	}
+	if *second.ByteRange != (video_utils.ByteRange{Length: 1000, Offset: 200}) {
+		t.Errorf("second byte range = %+v", *second.ByteRange)
+	}
+	if *third.ByteRange != (video_utils.ByteRange{Length: 500, Offset: 1200}) {
+		t.Errorf("third byte range = %+v", *third.ByteRange)
+	}
+
+	last := playlist.Segments[3]
+	if last.Url != "https://other.example.org/x.ts" || !last.Discontinuity || last.Duration != 3 || last.Sequence != 8 {
+		t.Errorf("last segment = %+v", last)
+	}
+}
+
+func TestParseMediaPlaylistErrors(t *testing.T) {
+	tests := map[string]string{
+		"no header":       "#EXTINF:1,\na.ts\n",
+		"master":          "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nlow.m3u8\n",
+		"no extinf":       "#EXTM3U\na.ts\n",
+		"bad duration":    "#EXTM3U\n#EXTINF:abc,\na.ts\n",
+		"no segments":     "#EXTM3U\n#EXT-X-ENDLIST\n",
+		"orphan subrange": "#EXTM3U\n#EXTINF:1,\n#EXT-X-BYTERANGE:10\na.ts\n",
+	}
+
+	for name, body := range tests {
+		if _, err := video_utils.ParseMediaPlaylist(body, "https://cdn.example.org/a.m3u8"); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestParseMasterPlaylist(t *testing.T) {
+	body := "#EXTM3U\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"Русский\",LANGUAGE=\"ru\",DEFAULT=YES\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"English\",LANGUAGE=\"en\",URI=\"audio/en.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.4d401e,mp4a.40.2\",AUDIO=\"aud\"\n" +
+		"360/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720\n" +
+		"https://other.example.org/720.m3u8?t=1\n"
+
+	if !video_utils.IsMasterPlaylist(body) {
+		t.Fatal("IsMasterPlaylist = false")
+	}
+
+	playlist, err := video_utils.ParseMasterPlaylist(body, "https://cdn.example.org/v/master.m3u8")
+	if err != nil {
+		t.Fatalf("ParseMasterPlaylist: %v", err)
+	}
+
+	if len(playlist.Variants) != 2 || len(playlist.Audio) != 2 {
+		t.Fatalf("got %d variants, %d audio renditions", len(playlist.Variants), len(playlist.Audio))
+	}
+
+	low := playlist.Variants[0]
+	if low.URL != "https://cdn.example.org/v/360/index.m3u8" || low.Bandwidth != 800000 || low.Height != 360 ||
+		low.Codecs != "avc1.4d401e,mp4a.40.2" || low.Audio != "aud" || len(low.AudioNames) != 2 {
+		t.Errorf("first variant = %+v", low)
+	}
+
+	if playlist.Audio[1].Url != "https://cdn.example.org/v/audio/en.m3u8" || !playlist.Audio[0].Default {
+		t.Errorf("audio = %+v", playlist.Audio)
+	}
+
+	if _, err := video_utils.ParseMediaPlaylist(body, "https://cdn.example.org/v/master.m3u8"); err == nil {
+		t.Error("ParseMediaPlaylist accepted a master playlist")
+	}
+}
+
+func TestParseMediaPlaylistKeys(t *testing.T) {
+	body := "#EXTM3U\n" +
+		"#EXT-X-MEDIA-SEQUENCE:10\n" +
+		"#EXTINF:4,\n" +
+		"clear.ts\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"keys/1.bin\",IV=0x000102030405060708090a0b0c0d0e0f\n" +
+		"#EXTINF:4,\n" +
+		"a.ts\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.example.org/2\"\n" +
+		"#EXTINF:4,\n" +
+		"b.ts\n" +
+		"#EXT-X-KEY:METHOD=NONE\n" +
+		"#EXTINF:4,\n" +
+		"c.ts\n"
+
+	playlist, err := video_utils.ParseMediaPlaylist(body, "https://cdn.example.org/v/index.m3u8")
+	if err != nil {
+		t.Fatalf("ParseMediaPlaylist: %v", err)
+	}
+	if !playlist.Encrypted() {
+		t.Error("Encrypted = false")
+	}
+
+	segments := playlist.Segments
+	if segments[0].Key != nil || segments[3].Key != nil {
+		t.Errorf("clear segments have keys: %+v, %+v", segments[0].Key, segments[3].Key)
+	}
+
+	first := segments[1].Key
+	if first == nil || first.Method != video_utils.KeyMethodAES128 || first.Url != "https://cdn.example.org/v/keys/1.bin" || len(first.IV) != 16 || first.IV[15] != 0x0f {
+		t.Errorf("first key = %+v", first)
+	}
+
+	second := segments[2].Key
+	if second == nil || second.Url != "https://keys.example.org/2" || second.IV != nil || segments[2].Sequence != 12 {
+		t.Errorf("second key = %+v, sequence %d", second, segments[2].Sequence)
+	}
+
+	if _, err := video_utils.ParseMediaPlaylist("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0x01\n#EXTINF:1,\na.ts\n", "https://cdn.example.org/"); err == nil {
+		t.Error("short IV accepted")
+	}
+}
@@ -0,0 +1,333 @@
+package video_utils
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// movieTimescale — единица времени mvhd, tkhd и elst: миллисекунды
+const movieTimescale = 1000
+
+// mp4Sample — сэмпл дорожки: положение в mdat, длительность и сдвиг отображения (PTS - DTS)
+type mp4Sample struct {
+	offset   uint64
+	size     uint32
+	duration uint32
+	cto      uint32
+	key      bool
+}
+
+// mp4Track — дорожка MP4, которую собирает RemuxTS
+type mp4Track struct {
+	id          uint32
+	handler     string // vide или soun
+	timescale   uint32
+	start       uint64 // задержка начала дорожки относительно начала фильма в единицах timescale
+	sampleEntry []byte // avc1 или mp4a
+	width       int
+	height      int
+	samples     []mp4Sample
+}
+
+// duration возвращает длительность дорожки в единицах timescale без задержки начала
+func (t *mp4Track) duration() uint64 {
+	var d uint64
+	for _, s := range t.samples {
+		d += uint64(s.duration)
+	}
+	return d
+}
+
+// seconds возвращает время окончания дорожки в секундах с учетом задержки начала
+func (t *mp4Track) seconds() float64 {
+	return float64(t.start+t.duration()) / float64(t.timescale)
+}
+
+func toMovieTime(v uint64, timescale uint32) uint64 {
+	return v * movieTimescale / uint64(timescale)
+}
+
+// mp4Box собирает бокс ISO BMFF из типа и содержимого
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// mp4FullBox собирает бокс с версией и флагами
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// unityMatrix — матрица преобразования без поворота и масштабирования
+var unityMatrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+func mp4Ftyp() []byte {
+	return mp4Box("ftyp", []byte("isom"), be32(0x200), []byte("isomiso2avc1mp41"))
+}
+
+// mp4Moov собирает moov для дорожек, сэмплы которых уже записаны в mdat
+func mp4Moov(tracks []*mp4Track) []byte {
+	var duration uint64
+	for _, t := range tracks {
+		duration = max(duration, toMovieTime(t.start+t.duration(), t.timescale))
+	}
+
+	var mvhd []byte
+	mvhd = append(mvhd, make([]byte, 8)...) // creation_time, modification_time
+	mvhd = binary.BigEndian.AppendUint32(mvhd, movieTimescale)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, clamp32(duration))
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0x00010000) // rate 1.0
+	mvhd = binary.BigEndian.AppendUint16(mvhd, 0x0100)     // volume 1.0
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, unityMatrix...)
+	mvhd = append(mvhd, make([]byte, 24)...) // pre_defined
+	mvhd = binary.BigEndian.AppendUint32(mvhd, uint32(len(tracks)+1))
+
+	boxes := [][]byte{mp4FullBox("mvhd", 0, 0, mvhd)}
+	for _, t := range tracks {
+		boxes = append(boxes, t.trak())
+	}
+
+	return mp4Box("moov", boxes...)
+}
+
+func (t *mp4Track) trak() []byte {
+	duration := t.duration()
+
+	var tkhd []byte
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, t.id)
+	tkhd = append(tkhd, make([]byte, 4)...)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, clamp32(toMovieTime(t.start+duration, t.timescale)))
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = append(tkhd, 0, 0, 0, 0) // layer, alternate_group
+	if t.handler == "soun" {
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0x0100)
+	} else {
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0)
+	}
+	tkhd = append(tkhd, 0, 0)
+	tkhd = append(tkhd, unityMatrix...)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, uint32(t.width)<<16)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, uint32(t.height)<<16)
+
+	boxes := [][]byte{mp4FullBox("tkhd", 0, 3, tkhd)}
+
+	// Задержка начала записывается пустым интервалом списка правок, чтобы не сбить синхронизацию
+	if t.start > 0 {
+		var elst []byte
+		elst = binary.BigEndian.AppendUint32(elst, 2)
+		elst = binary.BigEndian.AppendUint32(elst, clamp32(toMovieTime(t.start, t.timescale)))
+		elst = binary.BigEndian.AppendUint32(elst, math.MaxUint32) // media_time -1
+		elst = binary.BigEndian.AppendUint32(elst, 0x00010000)
+		elst = binary.BigEndian.AppendUint32(elst, clamp32(toMovieTime(duration, t.timescale)))
+		elst = binary.BigEndian.AppendUint32(elst, 0)
+		elst = binary.BigEndian.AppendUint32(elst, 0x00010000)
+		boxes = append(boxes, mp4Box("edts", mp4FullBox("elst", 0, 0, elst)))
+	}
+
+	var mdhd []byte
+	mdhd = append(mdhd, make([]byte, 8)...)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, t.timescale)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, clamp32(duration))
+	mdhd = binary.BigEndian.AppendUint16(mdhd, 0x55C4) // язык und
+	mdhd = append(mdhd, 0, 0)
+
+	name := "VideoHandler"
+	header := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	if t.handler == "soun" {
+		name = "SoundHandler"
+		header = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	var hdlr []byte
+	hdlr = append(hdlr, 0, 0, 0, 0)
+	hdlr = append(hdlr, t.handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, name...)
+	hdlr = append(hdlr, 0)
+
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+
+	mdia := mp4Box("mdia",
+		mp4FullBox("mdhd", 0, 0, mdhd),
+		mp4FullBox("hdlr", 0, 0, hdlr),
+		mp4Box("minf", header, dinf, t.stbl()),
+	)
+
+	return mp4Box("trak", append(boxes, mdia)...)
+}
+
+func (t *mp4Track) stbl() []byte {
+	boxes := [][]byte{mp4FullBox("stsd", 0, 0, be32(1), t.sampleEntry)}
+
+	// Длительности сэмплов сжимаются в серии одинаковых значений
+	var (
+		stts    []byte
+		entries uint32
+	)
+	for i := 0; i < len(t.samples); {
+		j := i
+		for j < len(t.samples) && t.samples[j].duration == t.samples[i].duration {
+			j++
+		}
+		stts = binary.BigEndian.AppendUint32(stts, uint32(j-i))
+		stts = binary.BigEndian.AppendUint32(stts, t.samples[i].duration)
+		entries++
+		i = j
+	}
+	boxes = append(boxes, mp4FullBox("stts", 0, 0, be32(entries), stts))
+
+	var (
+		ctts     []byte
+		shifted  bool
+		cttsRuns uint32
+	)
+	for i := 0; i < len(t.samples); {
+		j := i
+		for j < len(t.samples) && t.samples[j].cto == t.samples[i].cto {
+			j++
+		}
+		shifted = shifted || t.samples[i].cto != 0
+		ctts = binary.BigEndian.AppendUint32(ctts, uint32(j-i))
+		ctts = binary.BigEndian.AppendUint32(ctts, t.samples[i].cto)
+		cttsRuns++
+		i = j
+	}
+	if shifted {
+		boxes = append(boxes, mp4FullBox("ctts", 0, 0, be32(cttsRuns), ctts))
+	}
+
+	// Без stss все сэмплы считаются ключевыми, поэтому он нужен только видео с P и B кадрами
+	var (
+		stss []byte
+		keys uint32
+	)
+	for i, s := range t.samples {
+		if s.key {
+			stss = binary.BigEndian.AppendUint32(stss, uint32(i+1))
+			keys++
+		}
+	}
+	if int(keys) < len(t.samples) {
+		boxes = append(boxes, mp4FullBox("stss", 0, 0, be32(keys), stss))
+	}
+
+	// Каждый сэмпл — отдельный чанк: дорожки перемежаются в mdat в порядке прихода PES
+	var stsc []byte
+	stsc = binary.BigEndian.AppendUint32(stsc, 1)
+	stsc = binary.BigEndian.AppendUint32(stsc, 1)
+	stsc = binary.BigEndian.AppendUint32(stsc, 1)
+	stsc = binary.BigEndian.AppendUint32(stsc, 1)
+	boxes = append(boxes, mp4FullBox("stsc", 0, 0, stsc))
+
+	stsz := make([]byte, 0, 8+4*len(t.samples))
+	stsz = binary.BigEndian.AppendUint32(stsz, 0)
+	stsz = binary.BigEndian.AppendUint32(stsz, uint32(len(t.samples)))
+	for _, s := range t.samples {
+		stsz = binary.BigEndian.AppendUint32(stsz, s.size)
+	}
+	boxes = append(boxes, mp4FullBox("stsz", 0, 0, stsz))
+
+	large := len(t.samples) > 0 && t.samples[len(t.samples)-1].offset > math.MaxUint32
+	co := be32(uint32(len(t.samples)))
+	for _, s := range t.samples {
+		if large {
+			co = binary.BigEndian.AppendUint64(co, s.offset)
+		} else {
+			co = binary.BigEndian.AppendUint32(co, uint32(s.offset))
+		}
+	}
+	if large {
+		boxes = append(boxes, mp4FullBox("co64", 0, 0, co))
+	} else {
+		boxes = append(boxes, mp4FullBox("stco", 0, 0, co))
+	}
+
+	return mp4Box("stbl", boxes...)
+}
+
+// avc1Entry собирает описание видео H.264 с avcC из SPS и PPS
+func avc1Entry(width, height int, sps, pps []byte) []byte {
+	var avcC []byte
+	avcC = append(avcC, 1, sps[1], sps[2], sps[3])
+	avcC = append(avcC, 0xFF) // длина NAL единиц — 4 байта
+	avcC = append(avcC, 0xE1) // один SPS
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(sps)))
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 1)
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(pps)))
+	avcC = append(avcC, pps...)
+
+	var entry []byte
+	entry = append(entry, make([]byte, 6)...)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // data_reference_index
+	entry = append(entry, make([]byte, 16)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(width))
+	entry = binary.BigEndian.AppendUint16(entry, uint16(height))
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000) // 72 dpi
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000)
+	entry = append(entry, 0, 0, 0, 0)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // frame_count
+	entry = append(entry, make([]byte, 32)...)      // compressorname
+	entry = binary.BigEndian.AppendUint16(entry, 0x0018)
+	entry = binary.BigEndian.AppendUint16(entry, 0xFFFF)
+
+	return mp4Box("avc1", entry, mp4Box("avcC", avcC))
+}
+
+// mp4aEntry собирает описание аудио AAC с esds
+func mp4aEntry(trackID uint32, header adtsHeader) []byte {
+	asc := header.audioSpecificConfig()
+
+	decoderSpecific := append([]byte{0x05, byte(len(asc))}, asc...)
+
+	decoderConfig := []byte{0x40, 0x15}            // MPEG-4 Audio, аудиопоток
+	decoderConfig = append(decoderConfig, 0, 0, 0) // bufferSizeDB
+	decoderConfig = append(decoderConfig, make([]byte, 8)...)
+	decoderConfig = append(decoderConfig, decoderSpecific...)
+
+	es := be16(uint16(trackID))
+	es = append(es, 0)
+	es = append(es, 0x04, byte(len(decoderConfig)))
+	es = append(es, decoderConfig...)
+	es = append(es, 0x06, 0x01, 0x02) // SLConfigDescriptor
+
+	esds := append([]byte{0x03, byte(len(es))}, es...)
+
+	var entry []byte
+	entry = append(entry, make([]byte, 6)...)
+	entry = binary.BigEndian.AppendUint16(entry, 1)
+	entry = append(entry, make([]byte, 8)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(header.Channels))
+	entry = binary.BigEndian.AppendUint16(entry, 16) // samplesize
+	entry = append(entry, 0, 0, 0, 0)
+	entry = binary.BigEndian.AppendUint32(entry, uint32(header.SampleRate)<<16)
+
+	return mp4Box("mp4a", entry, mp4FullBox("esds", 0, 0, esds))
+}
+
+func clamp32(v uint64) uint32 {
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
@@ -0,0 +1,264 @@
+package video_utils
+
+import (
+	"errors"
+	"fmt"
+	"kodik_parser/utils"
+)
+
+const tsPacketSize = 188
+
+// Типы потоков в PMT, которые умеет перепаковывать RemuxTS
+const (
+	streamTypeAAC  = 0x0F // AAC в ADTS
+	streamTypeH264 = 0x1B
+)
+
+// pesPacket — собранный PES пакет одного потока. PTS и DTS в единицах 90 кГц, без учета переполнения
+type pesPacket struct {
+	StreamType byte
+	PTS        int64
+	DTS        int64
+	Payload    []byte
+}
+
+// tsDemuxer собирает PES пакеты из пакетов MPEG-TS (ISO/IEC 13818-1). Состав потоков
+// берется из PAT и PMT; потоки неподдерживаемых типов пропускаются
+type tsDemuxer struct {
+	pmtPID  int
+	streams map[int]byte   // PID -> stream_type
+	pes     map[int][]byte // незавершенные PES по PID
+	onPES   func(pes pesPacket) error
+	log     utils.Logf
+
+	ignored map[byte]bool // неподдерживаемые типы потоков, о которых уже сообщено
+}
+
+func newTSDemuxer(onPES func(pes pesPacket) error, log utils.Logf) *tsDemuxer {
+	return &tsDemuxer{
+		pmtPID:  -1,
+		streams: make(map[int]byte),
+		pes:     make(map[int][]byte),
+		onPES:   onPES,
+		log:     log,
+		ignored: make(map[byte]bool),
+	}
+}
+
+// packet обрабатывает один пакет MPEG-TS
+func (d *tsDemuxer) packet(p []byte) error {
+	if len(p) != tsPacketSize || p[0] != 0x47 {
+		return errors.New("lost MPEG-TS sync byte")
+	}
+
+	start := p[1]&0x40 != 0
+	pid := int(p[1]&0x1F)<<8 | int(p[2])
+	adaptation := p[3] >> 4 & 3
+
+	payload := p[4:]
+	if adaptation&2 != 0 {
+		length := int(p[4])
+		if 1+length > len(payload) {
+			return errors.New("invalid adaptation field length")
+		}
+		payload = payload[1+length:]
+	}
+	if adaptation&1 == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == 0:
+		if start {
+			return d.parsePAT(payload)
+		}
+	case pid == d.pmtPID:
+		if start {
+			return d.parsePMT(payload)
+		}
+	default:
+		if _, ok := d.streams[pid]; !ok {
+			return nil
+		}
+		if start {
+			if err := d.flushPID(pid); err != nil {
+				return err
+			}
+			d.pes[pid] = append([]byte(nil), payload...)
+		} else if d.pes[pid] != nil {
+			d.pes[pid] = append(d.pes[pid], payload...)
+		}
+	}
+
+	return nil
+}
+
+// flush отдает последние незавершенные PES пакеты всех потоков
+func (d *tsDemuxer) flush() error {
+	for pid := range d.pes {
+		if err := d.flushPID(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *tsDemuxer) flushPID(pid int) error {
+	data := d.pes[pid]
+	if len(data) == 0 {
+		return nil
+	}
+	d.pes[pid] = nil
+
+	pes, err := parsePES(data)
+	if err != nil {
+		return fmt.Errorf("PID %d: %w", pid, err)
+	}
+	pes.StreamType = d.streams[pid]
+
+	return d.onPES(pes)
+}
+
+// section возвращает тело PSI секции без заголовка и CRC
+func section(payload []byte) ([]byte, error) {
+	if len(payload) < 1 || 1+int(payload[0]) > len(payload) {
+		return nil, errors.New("invalid PSI pointer field")
+	}
+	payload = payload[1+int(payload[0]):]
+
+	if len(payload) < 3 {
+		return nil, errors.New("short PSI section")
+	}
+	length := int(payload[1]&0x0F)<<8 | int(payload[2])
+	// Секция должна помещаться в один пакет: так делают все известные нам упаковщики HLS
+	if length < 9 || 3+length > len(payload) {
+		return nil, errors.New("PSI section spans several packets or is truncated")
+	}
+
+	return payload[3 : 3+length-4], nil
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte) error {
+	body, err := section(payload)
+	if err != nil {
+		return fmt.Errorf("PAT: %w", err)
+	}
+
+	for entries := body[5:]; len(entries) >= 4; entries = entries[4:] {
+		program := int(entries[0])<<8 | int(entries[1])
+		if program != 0 {
+			d.pmtPID = int(entries[2]&0x1F)<<8 | int(entries[3])
+			return nil
+		}
+	}
+
+	return errors.New("PAT has no programs")
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte) error {
+	body, err := section(payload)
+	if err != nil {
+		return fmt.Errorf("PMT: %w", err)
+	}
+	if len(body) < 9 {
+		return errors.New("PMT: short section")
+	}
+
+	infoLength := int(body[7]&0x0F)<<8 | int(body[8])
+	if 9+infoLength > len(body) {
+		return errors.New("PMT: invalid program info length")
+	}
+
+	for entries := body[9+infoLength:]; len(entries) >= 5; {
+		streamType := entries[0]
+		pid := int(entries[1]&0x1F)<<8 | int(entries[2])
+		esInfoLength := int(entries[3]&0x0F)<<8 | int(entries[4])
+
+		switch streamType {
+		case streamTypeH264, streamTypeAAC:
+			d.streams[pid] = streamType
+		default:
+			if !d.ignored[streamType] {
+				d.ignored[streamType] = true
+				d.log.Printf("MPEG-TS stream type 0x%02x on PID %d is not supported and will be skipped", streamType, pid)
+			}
+		}
+
+		if 5+esInfoLength > len(entries) {
+			break
+		}
+		entries = entries[5+esInfoLength:]
+	}
+
+	return nil
+}
+
+// parsePES разбирает заголовок PES (ISO/IEC 13818-1, 2.4.3.6)
+func parsePES(data []byte) (pesPacket, error) {
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return pesPacket{}, errors.New("invalid PES start code")
+	}
+
+	flags := data[7] >> 6
+	headerLength := int(data[8])
+	if 9+headerLength > len(data) {
+		return pesPacket{}, errors.New("invalid PES header length")
+	}
+
+	var pes pesPacket
+	switch flags {
+	case 2:
+		if headerLength < 5 {
+			return pesPacket{}, errors.New("invalid PES header length")
+		}
+		pes.PTS = readTimestamp(data[9:])
+		pes.DTS = pes.PTS
+	case 3:
+		if headerLength < 10 {
+			return pesPacket{}, errors.New("invalid PES header length")
+		}
+		pes.PTS = readTimestamp(data[9:])
+		pes.DTS = readTimestamp(data[14:])
+	default:
+		return pesPacket{}, errors.New("PES packet without PTS")
+	}
+
+	pes.Payload = data[9+headerLength:]
+
+	// Длина указана у аудио; по ней отрезаются байты заполнения после пакета
+	if length := int(data[4])<<8 | int(data[5]); length > 0 && 6+length <= len(data) {
+		pes.Payload = data[9+headerLength : 6+length]
+	}
+
+	return pes, nil
+}
+
+// readTimestamp читает 33-битную метку времени PTS/DTS
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// tsClock раскрывает переполнение 33-битных меток времени MPEG-TS
+type tsClock struct {
+	last   int64
+	offset int64
+	set    bool
+}
+
+const tsTimestampWrap = 1 << 33
+
+func (c *tsClock) unwrap(ts int64) int64 {
+	v := ts + c.offset
+	if c.set {
+		switch {
+		case v < c.last-tsTimestampWrap/2:
+			c.offset += tsTimestampWrap
+			v += tsTimestampWrap
+		case v > c.last+tsTimestampWrap/2:
+			c.offset -= tsTimestampWrap
+			v -= tsTimestampWrap
+		}
+	}
+	c.last, c.set = v, true
+	return v
+}
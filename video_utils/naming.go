@@ -0,0 +1,309 @@
+package video_utils
+
+import (
+	"errors"
+	"fmt"
+	"kodik_parser/utils"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pathFields — значения подстановок шаблона имени файла
+type pathFields struct {
+	Title        string
+	Season       int // 0, если у сериала один сезон
+	Episode      string
+	EpisodeTitle string
+	Translation  string
+	Quality      int
+	Ext          string
+}
+
+// newPathFields собирает подстановки для серии
+func newPathFields(title string, translation utils.KodikTranslation, result utils.Result, ext string) pathFields {
+	quality := result.Quality
+	if result.Variant != nil && result.Variant.Height > 0 {
+		quality = result.Variant.Height
+	}
+
+	return pathFields{
+		Title:        title,
+		Season:       result.Seria.Season,
+		Episode:      result.Seria.Num,
+		EpisodeTitle: result.Seria.Title,
+		Translation:  translation.Title,
+		Quality:      quality,
+		Ext:          ext,
+	}
+}
+
+func (f pathFields) value(name string) (string, bool) {
+	switch name {
+	case "title":
+		return f.Title, true
+	case "season":
+		if f.Season == 0 {
+			return "", true
+		}
+		return strconv.Itoa(f.Season), true
+	case "episode":
+		return f.Episode, true
+	case "episode_title":
+		return f.EpisodeTitle, true
+	case "translation":
+		return f.Translation, true
+	case "quality":
+		if f.Quality == 0 {
+			return "", true
+		}
+		return strconv.Itoa(f.Quality), true
+	case "ext":
+		return f.Ext, true
+	}
+	return "", false
+}
+
+// ValidateFileTemplate проверяет шаблон имени файла: известные подстановки, парные скобки
+// и отсутствие абсолютных путей и переходов в родительскую папку. Пустой шаблон — DefaultFileTemplate
+func ValidateFileTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+
+	_, err := expandTemplate(template, pathFields{Title: "t", Season: 1, Episode: "1", Quality: 720, Ext: "mp4"}, runtime.GOOS)
+	return err
+}
+
+// episodePath возвращает путь файла серии внутри config.OutputDirectory по шаблону config.FileTemplate
+// и создает для него папки. Путь не может выйти за пределы OutputDirectory
+func episodePath(config *utils.Config, fields pathFields) (string, error) {
+	template := config.FileTemplate
+	if template == "" {
+		template = utils.DefaultFileTemplate
+	}
+
+	components, err := expandTemplate(template, fields, runtime.GOOS)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := filepath.Abs(config.OutputDirectory)
+	if err != nil {
+		return "", fmt.Errorf("ошибка при получении пути: %w", err)
+	}
+
+	path := filepath.Join(append([]string{root}, components...)...)
+	if rel, err := filepath.Rel(root, path); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside of output directory %q", path, root)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	return path, nil
+}
+
+// emptyComponent заменяет компонент пути, все подстановки которого оказались пустыми
+const emptyComponent = "untitled"
+
+// expandTemplate подставляет значения в шаблон и возвращает компоненты пути.
+//
+// Шаблон состоит из компонентов, разделенных "/". Подстановка {name} заменяется значением,
+// {name:02} дополняет числовое значение нулями до двух знаков. Часть в квадратных скобках
+// выводится, только если все подстановки в ней непустые: "[{season}_сезон_]" пропадает
+// у сериалов с одним сезоном. Значения очищаются от разделителей и запрещенных в goos символов,
+// поэтому название со страницы не может изменить структуру папок
+func expandTemplate(template string, fields pathFields, goos string) ([]string, error) {
+	var components []string
+
+	for _, part := range strings.Split(template, "/") {
+		if part == "" || part == "." || part == ".." {
+			return nil, fmt.Errorf("invalid file template %q: empty, \".\" or \"..\" path component", template)
+		}
+
+		expanded, err := expandComponent(part, fields, goos)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file template %q: %w", template, err)
+		}
+
+		component := sanitizeComponent(expanded, goos)
+		if component == "" {
+			// Пустым может оказаться значение со страницы, например название тайтла, — тогда
+			// подставляется emptyComponent. Пустой компонент из одного текста — ошибка шаблона
+			if !strings.Contains(part, "{") {
+				return nil, fmt.Errorf("file template %q gives an empty path component", template)
+			}
+			component = emptyComponent
+		}
+		components = append(components, component)
+	}
+
+	return components, nil
+}
+
+// expandComponent подставляет значения в один компонент пути
+func expandComponent(part string, fields pathFields, goos string) (string, error) {
+	var (
+		out      strings.Builder
+		optional strings.Builder
+		inOption bool
+		empty    bool // в необязательной части есть пустая подстановка
+	)
+
+	for i := 0; i < len(part); i++ {
+		c := part[i]
+		switch c {
+		case '[':
+			if inOption {
+				return "", errors.New("nested [")
+			}
+			inOption, empty = true, false
+			optional.Reset()
+		case ']':
+			if !inOption {
+				return "", errors.New("unmatched ]")
+			}
+			if !empty {
+				out.WriteString(optional.String())
+			}
+			inOption = false
+		case '{':
+			end := strings.IndexByte(part[i:], '}')
+			if end < 0 {
+				return "", errors.New("unclosed {")
+			}
+			value, err := placeholder(part[i+1:i+end], fields, goos)
+			if err != nil {
+				return "", err
+			}
+			if inOption {
+				empty = empty || value == ""
+				optional.WriteString(value)
+			} else {
+				out.WriteString(value)
+			}
+			i += end
+		case '}':
+			return "", errors.New("unmatched }")
+		default:
+			if inOption {
+				optional.WriteByte(c)
+			} else {
+				out.WriteByte(c)
+			}
+		}
+	}
+
+	if inOption {
+		return "", errors.New("unclosed [")
+	}
+
+	return out.String(), nil
+}
+
+// placeholder возвращает очищенное значение подстановки вида name или name:0N
+func placeholder(spec string, fields pathFields, goos string) (string, error) {
+	name, format, hasFormat := strings.Cut(spec, ":")
+
+	value, ok := fields.value(name)
+	if !ok {
+		return "", fmt.Errorf("unknown placeholder {%s}", name)
+	}
+
+	if hasFormat {
+		width, err := strconv.Atoi(format)
+		if err != nil || !strings.HasPrefix(format, "0") || width <= 0 {
+			return "", fmt.Errorf("invalid format {%s}, expected {%s:02}", spec, name)
+		}
+		// Дробные номера серий (например "6.5") дополняются по целой части
+		whole, _, _ := strings.Cut(value, ".")
+		if _, err := strconv.Atoi(whole); err == nil && len(whole) < width {
+			value = strings.Repeat("0", width-len(whole)) + value
+		}
+	}
+
+	return sanitizeValue(value, goos), nil
+}
+
+// sanitizeValue заменяет в значении разделители путей и запрещенные символы на "_"
+func sanitizeValue(value, goos string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) || (goos == "windows" && strings.ContainsRune(`<>:"|?*`, r)) {
+			return '_'
+		}
+		return r
+	}, value)
+
+	// Значение из одних точек стало бы ссылкой на текущую или родительскую папку
+	if strings.Trim(value, ".") == "" && value != "" {
+		return strings.Repeat("_", len(value))
+	}
+
+	return value
+}
+
+// windowsReservedNames — имена устройств, которые нельзя использовать в Windows даже с расширением
+var windowsReservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {},
+	"COM8": {}, "COM9": {}, "LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {},
+	"LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// maxComponentLength — ограничение длины имени файла в байтах в большинстве файловых систем
+const maxComponentLength = 255
+
+// sanitizeComponent приводит компонент пути к допустимому в goos виду
+func sanitizeComponent(component, goos string) string {
+	component = strings.TrimSpace(component)
+
+	if goos == "windows" {
+		// Символы, запрещенные в Windows, могут прийти и из самого шаблона
+		component = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`<>:"|?*\`, r) {
+				return '_'
+			}
+			return r
+		}, component)
+
+		// Windows отбрасывает точки и пробелы в конце имени
+		component = strings.TrimRight(component, ". ")
+
+		base, _, _ := strings.Cut(component, ".")
+		if _, reserved := windowsReservedNames[strings.ToUpper(base)]; reserved {
+			component = "_" + component
+		}
+	}
+
+	if component == "." || component == ".." {
+		return strings.Repeat("_", len(component))
+	}
+
+	return truncateComponent(component, maxComponentLength)
+}
+
+// truncateComponent обрезает имя до limit байт, сохраняя расширение и не разрывая символы UTF-8
+func truncateComponent(component string, limit int) string {
+	if len(component) <= limit {
+		return component
+	}
+
+	ext := filepath.Ext(component)
+	if len(ext) >= limit/2 {
+		ext = ""
+	}
+
+	name := component[:len(component)-len(ext)]
+	cut := limit - len(ext)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+
+	return name[:cut] + ext
+}
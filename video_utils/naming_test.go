@@ -0,0 +1,103 @@
+package video_utils
+
+import (
+	"kodik_parser/utils"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	fields := pathFields{
+		Title:        "Тайтл: часть 2",
+		Season:       2,
+		Episode:      "5",
+		EpisodeTitle: "Конец?",
+		Translation:  "AniLibria.TV",
+		Quality:      720,
+		Ext:          "ts",
+	}
+
+	tests := []struct {
+		template string
+		goos     string
+		fields   pathFields
+		want     []string
+	}{
+		{utils.DefaultFileTemplate, "linux", fields, []string{"Тайтл: часть 2", "2_сезон_5_серия.ts"}},
+		{utils.DefaultFileTemplate, "linux", pathFields{Title: "Фильм", Episode: "1", Ext: "mp4"}, []string{"Фильм", "1_серия.mp4"}},
+		{"{title}/S{season:02}E{episode:02} - {episode_title}.{ext}", "linux", fields, []string{"Тайтл: часть 2", "S02E05 - Конец?.ts"}},
+		{"{title}/S{season:02}E{episode:02} - {episode_title}.{ext}", "windows", fields, []string{"Тайтл_ часть 2", "S02E05 - Конец_.ts"}},
+		{"{translation}/{quality}p/{episode:03}.{ext}", "linux", pathFields{Translation: "AniLibria.TV", Quality: 1080, Episode: "6.5", Ext: "ts"}, []string{"AniLibria.TV", "1080p", "006.5.ts"}},
+		{"[{quality}p_]{episode}.{ext}", "linux", pathFields{Episode: "1", Ext: "ts"}, []string{"1.ts"}},
+
+		// Название со страницы не может добавить папки или выйти из outputDirectory
+		{"{title}/{episode}.{ext}", "linux", pathFields{Title: "../../etc", Episode: "1", Ext: "ts"}, []string{".._.._etc", "1.ts"}},
+		{"{title}/{episode}.{ext}", "linux", pathFields{Title: "..", Episode: "1", Ext: "ts"}, []string{"__", "1.ts"}},
+		{"{title}/{episode}.{ext}", "windows", pathFields{Title: `a\b/c`, Episode: "1", Ext: "ts"}, []string{"a_b_c", "1.ts"}},
+		{"{title}/{episode}.{ext}", "windows", pathFields{Title: "Con", Episode: "1", Ext: "ts"}, []string{"_Con", "1.ts"}},
+		{"{title}/{episode}.{ext}", "windows", pathFields{Title: "Тайтл... ", Episode: "1", Ext: "ts"}, []string{"Тайтл", "1.ts"}},
+
+		// Пустое название со страницы не делает путь недопустимым
+		{utils.DefaultFileTemplate, "linux", pathFields{Episode: "1", Ext: "ts"}, []string{"untitled", "1_серия.ts"}},
+		{"{title}/{episode}.{ext}", "windows", pathFields{Title: " ... ", Episode: "1", Ext: "ts"}, []string{"untitled", "1.ts"}},
+		{"{title}/{season}", "linux", pathFields{Title: "t"}, []string{"t", "untitled"}},
+	}
+
+	for _, tt := range tests {
+		got, err := expandTemplate(tt.template, tt.fields, tt.goos)
+		if err != nil {
+			t.Errorf("expandTemplate(%q, %s): %v", tt.template, tt.goos, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandTemplate(%q, %s) = %q, want %q", tt.template, tt.goos, got, tt.want)
+		}
+	}
+}
+
+func TestExpandTemplateErrors(t *testing.T) {
+	for _, template := range []string{
+		"",
+		"/{title}/{episode}.{ext}",
+		"../{title}/{episode}.{ext}",
+		"{title}//{episode}.{ext}",
+		"{title}/{unknown}.{ext}",
+		"{title}/{episode:2}.{ext}",
+		"{title}/{episode.{ext}",
+		"{title}/[{season}_{episode}.{ext}",
+		"{title}/ ",
+	} {
+		if _, err := expandTemplate(template, pathFields{Title: "t", Episode: "1", Ext: "ts"}, "linux"); err == nil {
+			t.Errorf("expandTemplate(%q) succeeded, want error", template)
+		}
+	}
+}
+
+func TestTruncateComponent(t *testing.T) {
+	name := strings.Repeat("я", 200) + ".ts"
+
+	got := truncateComponent(name, maxComponentLength)
+	if len(got) > maxComponentLength || !strings.HasSuffix(got, ".ts") || !strings.HasPrefix(got, "яя") {
+		t.Errorf("truncateComponent = %q (%d bytes)", got, len(got))
+	}
+	if strings.ContainsRune(got, '�') {
+		t.Errorf("truncateComponent split a UTF-8 character: %q", got)
+	}
+}
+
+func TestEpisodePath(t *testing.T) {
+	config := utils.NewDefaultConfig()
+	config.OutputDirectory = t.TempDir()
+
+	path, err := episodePath(&config, pathFields{Title: "../Тайтл", Season: 1, Episode: "3", Ext: "ts"})
+	if err != nil {
+		t.Fatalf("episodePath: %v", err)
+	}
+
+	want := filepath.Join(config.OutputDirectory, ".._Тайтл", "1_сезон_3_серия.ts")
+	if path != want {
+		t.Errorf("episodePath = %q, want %q", path, want)
+	}
+}
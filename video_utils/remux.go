@@ -0,0 +1,358 @@
+package video_utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"kodik_parser/utils"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RemuxInfo описывает MP4, полученный RemuxTS
+type RemuxInfo struct {
+	Duration     float64 // длительность самой длинной дорожки в секундах
+	Width        int
+	Height       int
+	VideoSamples int
+	AudioSamples int
+}
+
+// Длительности сэмплов, которые подставляются, если соседние метки времени не годятся
+const (
+	defaultVideoFrameDuration = 90000 / 25
+	// maxSampleGap — разрыв меток больше этого считается разрывом потока (EXT-X-DISCONTINUITY), а не паузой
+	maxSampleGap = 10 * 90000
+)
+
+// RemuxTS перепаковывает MPEG-TS с H.264 и AAC из src в обычный MP4 dst без перекодирования.
+// Метки времени раскрываются после переполнения, дорожки начинаются с нуля, а разрывы потока
+// склеиваются без пауз. Файл читается потоком, в памяти держатся только таблицы сэмплов.
+// Пропущенные потоки и кадры записываются в журнал log
+func RemuxTS(src, dst string, log utils.Logf) (RemuxInfo, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return RemuxInfo{}, fmt.Errorf("failed to open MPEG-TS: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return RemuxInfo{}, fmt.Errorf("failed to create MP4: %w", err)
+	}
+
+	info, err := remux(in, out, log)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return RemuxInfo{}, err
+	}
+
+	return info, nil
+}
+
+// remuxer записывает сэмплы в mdat по мере разбора PES и запоминает их для moov
+type remuxer struct {
+	out    *bufio.Writer
+	offset uint64 // смещение следующего байта в файле
+
+	clock tsClock
+
+	video    mp4Track
+	videoDTS []int64
+	videoPTS []int64
+	sps, pps []byte
+	skipped  int // кадры до первого ключевого, которые нельзя декодировать
+
+	audio        mp4Track
+	audioStart   int64
+	audioHeader  *adtsHeader
+	audioPending []byte // начало кадра ADTS, продолжение которого в следующем PES
+}
+
+func remux(in io.Reader, out *os.File, log utils.Logf) (RemuxInfo, error) {
+	r := &remuxer{
+		out:   bufio.NewWriterSize(out, 1<<20),
+		video: mp4Track{id: 1, handler: "vide", timescale: 90000},
+		audio: mp4Track{id: 2, handler: "soun"},
+	}
+
+	// mdat с 64-битным размером: размер станет известен только в конце
+	ftyp := mp4Ftyp()
+	r.write(ftyp)
+	mdatStart := r.offset
+	r.write([]byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 0, 0, 0})
+
+	demuxer := newTSDemuxer(r.pes, log)
+	reader := bufio.NewReaderSize(in, 1<<20)
+	packet := make([]byte, tsPacketSize)
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("MPEG-TS ends with a partial packet, %d packets read", n)
+				break
+			}
+			return RemuxInfo{}, fmt.Errorf("failed to read MPEG-TS: %w", err)
+		}
+		if err := demuxer.packet(packet); err != nil {
+			return RemuxInfo{}, fmt.Errorf("packet %d: %w", n, err)
+		}
+	}
+	if err := demuxer.flush(); err != nil {
+		return RemuxInfo{}, err
+	}
+
+	if r.skipped > 0 {
+		log.Printf("skipped %d video frames before the first keyframe", r.skipped)
+	}
+
+	tracks := r.tracks()
+	if len(tracks) == 0 {
+		return RemuxInfo{}, errors.New("no H.264 video or AAC audio found in MPEG-TS")
+	}
+
+	mdatSize := r.offset - mdatStart
+	r.write(mp4Moov(tracks))
+
+	if err := r.out.Flush(); err != nil {
+		return RemuxInfo{}, fmt.Errorf("failed to write MP4: %w", err)
+	}
+	if _, err := out.WriteAt(binary.BigEndian.AppendUint64(nil, mdatSize), int64(mdatStart)+8); err != nil {
+		return RemuxInfo{}, fmt.Errorf("failed to write MP4: %w", err)
+	}
+
+	info := RemuxInfo{
+		Width:        r.video.width,
+		Height:       r.video.height,
+		VideoSamples: len(r.video.samples),
+		AudioSamples: len(r.audio.samples),
+	}
+	for _, t := range tracks {
+		info.Duration = math.Max(info.Duration, t.seconds())
+	}
+
+	return info, nil
+}
+
+// write пишет данные в файл; ошибка записи возвращается при Flush
+func (r *remuxer) write(data []byte) uint64 {
+	offset := r.offset
+	r.out.Write(data)
+	r.offset += uint64(len(data))
+	return offset
+}
+
+func (r *remuxer) pes(pes pesPacket) error {
+	switch pes.StreamType {
+	case streamTypeH264:
+		return r.videoPES(pes)
+	case streamTypeAAC:
+		return r.audioPES(pes)
+	}
+	return nil
+}
+
+// videoPES переводит кадр из Annex B в формат MP4 с длинами NAL единиц. SPS и PPS
+// переносятся в avcC, разделители кадров отбрасываются
+func (r *remuxer) videoPES(pes pesPacket) error {
+	var (
+		sample []byte
+		key    bool
+	)
+
+	for _, nal := range splitAnnexB(pes.Payload) {
+		if len(nal) == 0 {
+			continue
+		}
+
+		switch nal[0] & 0x1F {
+		case nalAUD:
+			continue
+		case nalSPS:
+			if r.sps == nil {
+				info, err := parseSPS(nal)
+				if err != nil {
+					return err
+				}
+				r.sps = append([]byte(nil), nal...)
+				r.video.width, r.video.height = info.Width, info.Height
+			}
+			continue
+		case nalPPS:
+			if r.pps == nil {
+				r.pps = append([]byte(nil), nal...)
+			}
+			continue
+		case nalSliceIDR:
+			key = true
+		}
+
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nal)))
+		sample = append(sample, nal...)
+	}
+
+	if len(sample) == 0 {
+		return nil
+	}
+
+	if len(r.video.samples) == 0 && (!key || r.sps == nil || r.pps == nil) {
+		r.skipped++
+		return nil
+	}
+
+	r.video.samples = append(r.video.samples, mp4Sample{
+		offset: r.write(sample),
+		size:   uint32(len(sample)),
+		key:    key,
+	})
+	dts := r.clock.unwrap(pes.DTS)
+	r.videoDTS = append(r.videoDTS, dts)
+	r.videoPTS = append(r.videoPTS, dts+(pes.PTS-pes.DTS+tsTimestampWrap)%tsTimestampWrap)
+
+	return nil
+}
+
+// audioPES записывает каждый кадр ADTS отдельным сэмплом без заголовка ADTS
+func (r *remuxer) audioPES(pes pesPacket) error {
+	data := pes.Payload
+	if len(r.audioPending) > 0 {
+		data = append(r.audioPending, data...)
+		r.audioPending = nil
+	}
+
+	for len(data) > 0 {
+		header, err := parseADTS(data)
+		if err != nil {
+			if len(data) < 7 {
+				break
+			}
+			return err
+		}
+		if header.FrameLength > len(data) {
+			break
+		}
+
+		if r.audioHeader == nil {
+			r.audioHeader = &header
+			r.audioStart = r.clock.unwrap(pes.PTS)
+			r.audio.timescale = uint32(header.SampleRate)
+			r.audio.sampleEntry = mp4aEntry(r.audio.id, header)
+		} else if header.SampleRate != r.audioHeader.SampleRate || header.Channels != r.audioHeader.Channels {
+			return fmt.Errorf("AAC parameters changed mid-stream: %d Hz %d ch -> %d Hz %d ch",
+				r.audioHeader.SampleRate, r.audioHeader.Channels, header.SampleRate, header.Channels)
+		}
+
+		frame := data[header.HeaderLength:header.FrameLength]
+		r.audio.samples = append(r.audio.samples, mp4Sample{
+			offset:   r.write(frame),
+			size:     uint32(len(frame)),
+			duration: aacFrameSamples,
+			key:      true,
+		})
+
+		data = data[header.FrameLength:]
+	}
+
+	if len(data) > 0 {
+		r.audioPending = append([]byte(nil), data...)
+	}
+
+	return nil
+}
+
+// tracks заполняет длительности и задержки дорожек и возвращает непустые
+func (r *remuxer) tracks() []*mp4Track {
+	var tracks []*mp4Track
+
+	// Общее начало — самая ранняя метка; более поздняя дорожка получает задержку начала
+	start := int64(math.MaxInt64)
+	if len(r.video.samples) > 0 {
+		start = r.videoDTS[0]
+	}
+	if len(r.audio.samples) > 0 {
+		start = min(start, r.audioStart)
+	}
+
+	if len(r.video.samples) > 0 {
+		r.video.sampleEntry = avc1Entry(r.video.width, r.video.height, r.sps, r.pps)
+		r.video.start = uint64(r.videoDTS[0] - start)
+
+		durations := sampleDurations(r.videoDTS, defaultVideoFrameDuration)
+		for i := range r.video.samples {
+			r.video.samples[i].duration = durations[i]
+			r.video.samples[i].cto = uint32(max(0, min(r.videoPTS[i]-r.videoDTS[i], math.MaxUint32)))
+		}
+		tracks = append(tracks, &r.video)
+	}
+
+	if len(r.audio.samples) > 0 {
+		r.audio.start = uint64(r.audioStart-start) * uint64(r.audio.timescale) / 90000
+		tracks = append(tracks, &r.audio)
+	}
+
+	return tracks
+}
+
+// sampleDurations восстанавливает длительности сэмплов по DTS. На разрывах потока
+// и при повторяющихся метках используется длительность предыдущего сэмпла
+func sampleDurations(dts []int64, fallback uint32) []uint32 {
+	durations := make([]uint32, len(dts))
+	last := fallback
+
+	for i := 0; i+1 < len(dts); i++ {
+		if d := dts[i+1] - dts[i]; d > 0 && d <= maxSampleGap {
+			last = uint32(d)
+		}
+		durations[i] = last
+	}
+	if len(dts) > 0 {
+		durations[len(dts)-1] = last
+	}
+
+	return durations
+}
+
+// remuxDurationTolerance — допустимое расхождение длительности MP4 и суммы EXTINF
+func remuxDurationTolerance(expected float64) float64 {
+	return math.Max(1, expected*0.01)
+}
+
+// remuxDownloaded перепаковывает загруженный .ts в mp4Path и сверяет длительность с суммой EXTINF
+// плейлиста. При успехе .ts удаляется, при ошибке остается, а mp4 удаляется
+func remuxDownloaded(tsPath, mp4Path string, expected float64, log utils.Logf) (string, error) {
+	// Шаблон без {ext} дал бы одинаковые имена, и перепаковка перезаписала бы исходный файл
+	if mp4Path == tsPath {
+		mp4Path = strings.TrimSuffix(tsPath, filepath.Ext(tsPath)) + ".mp4"
+		if mp4Path == tsPath {
+			mp4Path = tsPath + ".mp4"
+		}
+	}
+
+	info, err := RemuxTS(tsPath, mp4Path, log)
+	if err != nil {
+		return "", err
+	}
+
+	if math.Abs(info.Duration-expected) > remuxDurationTolerance(expected) {
+		os.Remove(mp4Path)
+		return "", fmt.Errorf("MP4 duration %.2fs doesn't match playlist duration %.2fs", info.Duration, expected)
+	}
+
+	log.Printf("remuxed %s into MP4: %dx%d, %.2fs, %d video and %d audio samples",
+		tsPath, info.Width, info.Height, info.Duration, info.VideoSamples, info.AudioSamples)
+
+	if err := os.Remove(tsPath); err != nil {
+		log.Printf("failed to remove %s after remux: %v", tsPath, err)
+	}
+
+	return mp4Path, nil
+}
@@ -0,0 +1,175 @@
+package video_utils_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"kodik_parser/kodiktest"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mp4Boxes возвращает содержимое дочерних боксов указанного типа
+func mp4Boxes(t *testing.T, data []byte, typ string) [][]byte {
+	t.Helper()
+
+	var found [][]byte
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		if size == 1 {
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			t.Fatalf("invalid size %d of box %q", size, data[4:8])
+		}
+		if string(data[4:8]) == typ {
+			found = append(found, data[header:size])
+		}
+		data = data[size:]
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d trailing bytes after boxes", len(data))
+	}
+
+	return found
+}
+
+// mp4Box возвращает содержимое бокса по пути, например "moov", "trak", "mdia"
+func mp4Box(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+
+	for _, typ := range path {
+		boxes := mp4Boxes(t, data, typ)
+		if len(boxes) == 0 {
+			t.Fatalf("box %s not found", strings.Join(path, "/"))
+		}
+		data = boxes[0]
+	}
+	return data
+}
+
+func TestRemuxTS(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{MPEGTS: true, Segments: 3})
+	defer server.Close()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "1.ts")
+	dst := filepath.Join(dir, "1.mp4")
+	if err := os.WriteFile(src, server.HLSData("11001", 720), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := video_utils.RemuxTS(src, dst, nil)
+	if err != nil {
+		t.Fatalf("RemuxTS: %v", err)
+	}
+
+	// 3 фрагмента по 6 секунд: 450 кадров 25 к/с и 844 кадра AAC по 1024 сэмпла 48 кГц
+	if info.Width != 1280 || info.Height != 720 || info.VideoSamples != 450 || info.AudioSamples != 844 {
+		t.Errorf("info = %+v", info)
+	}
+	if math.Abs(info.Duration-18) > 0.05 {
+		t.Errorf("Duration = %v, want 18s", info.Duration)
+	}
+
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp4Box(t, data, "ftyp")
+	mdat := mp4Box(t, data, "mdat")
+	moov := mp4Box(t, data, "moov")
+
+	traks := mp4Boxes(t, moov, "trak")
+	if len(traks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(traks))
+	}
+
+	stbl := mp4Box(t, traks[0], "mdia", "minf", "stbl")
+
+	// Метки времени переполняются на третьей секунде, но все кадры длятся по 3600 единиц
+	stts := mp4Box(t, stbl, "stts")
+	if !bytes.Equal(stts, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 0xC2, 0, 0, 0x0E, 0x10}) {
+		t.Errorf("video stts = % x, want one entry of 450 x 3600", stts)
+	}
+
+	avcC := mp4Box(t, stbl, "stsd")[8+78:]
+	if !bytes.Contains(avcC, []byte{0x67, 0x42, 0x00, 0x1E, 0xDA, 0x01, 0x40, 0x16, 0xE4}) {
+		t.Errorf("avcC doesn't contain SPS: % x", avcC)
+	}
+
+	// Ключевой кадр раз в 25 кадров
+	if stss := mp4Box(t, stbl, "stss"); binary.BigEndian.Uint32(stss[4:]) != 18 {
+		t.Errorf("stss has %d keyframes, want 18", binary.BigEndian.Uint32(stss[4:]))
+	}
+
+	// Первый сэмпл — IDR срез с длиной вместо стартового кода, без AUD, SPS и PPS
+	stco := mp4Box(t, stbl, "stco")
+	offset := binary.BigEndian.Uint32(stco[8:])
+	mdatStart := uint32(len(data) - len(mdat) - len(moov) - 8)
+	sample := mdat[offset-mdatStart:]
+	if binary.BigEndian.Uint32(sample) != 41 || sample[4] != 0x65 {
+		t.Errorf("first video sample starts with % x", sample[:8])
+	}
+}
+
+func TestRemuxTSInvalid(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "1.ts")
+	dst := filepath.Join(dir, "1.mp4")
+	if err := os.WriteFile(src, bytes.Repeat([]byte("not a transport stream "), 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := video_utils.RemuxTS(src, dst, nil); err == nil {
+		t.Fatal("RemuxTS succeeded on invalid input")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("MP4 is left after failed remux: %v", err)
+	}
+}
+
+func TestDownloadVideosHLSRemux(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Segments: 2, MPEGTS: true})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Remux = true
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+
+	res := result.Results[0]
+	if res.Err != nil || !strings.HasSuffix(res.Path, "1_серия.mp4") {
+		t.Fatalf("Path = %q, Err = %v; want remuxed MP4", res.Path, res.Err)
+	}
+	if ts := findFiles(t, config.OutputDirectory, ".ts"); len(ts) != 0 {
+		t.Errorf(".ts is left after remux: %v", ts)
+	}
+}
+
+func TestDownloadVideosHLSFragmentedMP4(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, Segments: 3, FMP4: true})
+	defer server.Close()
+
+	config := testConfig(t)
+	config.Remux = true
+	result := video_utils.DownloadVideosHLS(context.Background(), resolve(t, server), config, testOptions(server))
+
+	// Сегменты с EXT-X-MAP пишутся сразу в .mp4 вместе с секцией инициализации и не перепаковываются
+	res := result.Results[0]
+	if res.Err != nil || !strings.HasSuffix(res.Path, "1_серия.mp4") {
+		t.Fatalf("Path = %q, Err = %v; want MP4", res.Path, res.Err)
+	}
+	checkDownloaded(t, result, func(res utils.Result) []byte {
+		return server.HLSData(res.Seria.Id, res.Quality)
+	})
+	if ts := findFiles(t, config.OutputDirectory, ".ts"); len(ts) != 0 {
+		t.Errorf(".ts files written: %v", ts)
+	}
+}
@@ -0,0 +1,70 @@
+package watch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// state — уже виденные серии всех сериалов. Хранится в WatchConfig.StateFile
+type state struct {
+	Serials map[string]*serialState `json:"serials"` // по ключу serialKey
+}
+
+// serialState — серии одного сериала в одной озвучке, которые уже загружены или были
+// на странице при первой проверке
+type serialState struct {
+	URL         string    `json:"url"`
+	Title       string    `json:"title"`
+	Translation string    `json:"translation"` // ID озвучки
+	Seen        []string  `json:"seen"`        // номера серий в виде KodikSeriaInfo.Label()
+	Checked     time.Time `json:"checked"`     // время последней успешной проверки
+}
+
+func serialKey(url, translationID string) string {
+	return url + "#" + translationID
+}
+
+// loadState читает состояние. Отсутствие файла не является ошибкой: возвращается пустое состояние
+func loadState(path string) (*state, error) {
+	s := &state{Serials: make(map[string]*serialState)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watch state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse watch state: %w", err)
+	}
+	if s.Serials == nil {
+		s.Serials = make(map[string]*serialState)
+	}
+
+	return s, nil
+}
+
+// save записывает состояние через временный файл, чтобы падение процесса не оставило его недописанным
+func (s *state) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write watch state: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write watch state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// Package watch периодически проверяет выходящие сериалы и загружает новые серии.
+//
+// При каждой проверке заново загружается список серий сериала (ParseSeasonSeries
+// на странице плеера) и сравнивается с сериями, виденными раньше. Ссылки получаются
+// и загружаются только для новых серий. Виденные серии хранятся в файле состояния,
+// поэтому перезапуск не приводит к повторной загрузке.
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kodik_parser/kodik"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// Options настраивает Run
+type Options struct {
+	// Once завершает Run после первой проверки
+	Once bool
+
+	// OnReport вызывается после проверки каждого сериала
+	OnReport func(report Report)
+
+	// OnSleep вызывается перед паузой до следующей проверки
+	OnSleep func(next time.Time)
+}
+
+// Report — итог проверки одного сериала
+type Report struct {
+	Serial utils.WatchedSerial
+	Title  string
+
+	// First — сериал проверялся впервые. Если загрузка уже вышедших серий не включена,
+	// они только запоминаются
+	First bool
+
+	New    []utils.KodikSeriaInfo // серии, которых не было при прошлой проверке
+	Result utils.HandleResult     // получение ссылок и загрузка новых серий
+	Err    error                  // ошибка проверки, получения ссылок или загрузки
+}
+
+// Downloaded возвращает загруженные новые серии
+func (r Report) Downloaded() []utils.Result {
+	var downloaded []utils.Result
+	for _, res := range r.Result.Results {
+		if res.Status == utils.StatusDownloaded {
+			downloaded = append(downloaded, res)
+		}
+	}
+	return downloaded
+}
+
+// Watcher проверяет сериалы из config.Watch.Serials
+type Watcher struct {
+	config utils.Config
+	client *kodik.Client
+
+	// validURL проверяет URL сериала; в тестах заменяется, чтобы принимать адрес поддельного сервера
+	validURL func(string) bool
+
+	// Log получает журнал проверок, получения ссылок и загрузок; nil — журнал не ведется
+	Log utils.Logf
+
+	// downloadOpts в тестах направляет загрузку на поддельный сервер
+	downloadOpts video_utils.Options
+}
+
+// New создает Watcher. Если doer равен nil, запросы к Kodik выполняются через kodik.NewHTTPClient()
+func New(config utils.Config, doer utils.HTTPDoer) *Watcher {
+	return &Watcher{config: config, client: kodik.NewClient(doer), validURL: utils.ValidateURL}
+}
+
+// Run проверяет сериалы сразу, а затем каждые Interval ± Jitter секунд до отмены ctx
+func (w *Watcher) Run(ctx context.Context, opts Options) error {
+	for {
+		if _, err := w.Check(ctx, opts.OnReport); err != nil {
+			return err
+		}
+
+		if opts.Once {
+			return nil
+		}
+
+		delay := w.delay()
+		if opts.OnSleep != nil {
+			opts.OnSleep(time.Now().Add(delay))
+		}
+		w.Log.Printf("Watch: next check in %v", delay.Round(time.Second))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// delay возвращает паузу до следующей проверки со случайным отклонением, чтобы несколько
+// экземпляров не обращались к Kodik одновременно
+func (w *Watcher) delay() time.Duration {
+	interval := w.config.Watch.Interval
+	if jitter := w.config.Watch.Jitter; jitter > 0 {
+		interval += (rand.Float64()*2 - 1) * jitter
+	}
+	return time.Duration(max(1, interval) * float64(time.Second))
+}
+
+// Check один раз проверяет все сериалы и загружает новые серии. Ошибка отдельного сериала
+// записывается в его Report и не мешает остальным; ошибка возвращается, только если
+// не удалось прочитать или записать файл состояния либо отменен ctx
+func (w *Watcher) Check(ctx context.Context, onReport func(Report)) ([]Report, error) {
+	st, err := loadState(w.config.Watch.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []Report
+	for _, serial := range w.config.Watch.Serials {
+		if ctx.Err() != nil {
+			return reports, ctx.Err()
+		}
+
+		report := w.check(ctx, serial, st)
+		if err := st.save(w.config.Watch.StateFile); err != nil {
+			return reports, err
+		}
+
+		if report.Err != nil {
+			w.Log.Printf("Watch: %s: %v", serial.URL, report.Err)
+		}
+
+		reports = append(reports, report)
+		if onReport != nil {
+			onReport(report)
+		}
+	}
+
+	return reports, nil
+}
+
+// check загружает список серий сериала, сравнивает его с виденными сериями и загружает новые.
+// Виденными становятся только загруженные серии, поэтому неудачные повторяются при следующей проверке
+func (w *Watcher) check(ctx context.Context, serial utils.WatchedSerial, st *state) Report {
+	report := Report{Serial: serial}
+
+	if !w.validURL(serial.URL) {
+		report.Err = fmt.Errorf("некорректный URL: %s", serial.URL)
+		return report
+	}
+	url := utils.NormalizeURL(serial.URL)
+
+	client := w.client.WithLog(w.Log)
+	title, err := client.Fetch(ctx, url)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	report.Title = title.Name
+
+	if title.Type != utils.KodikLinkTypes.Serial {
+		report.Err = errors.New("это фильм, а не сериал")
+		return report
+	}
+
+	translation := w.config.Translation
+	if serial.Translation != "" {
+		translation = serial.Translation
+	}
+	if translation != "" && len(title.Translations) > 1 {
+		selected, err := kodik.FindTranslation(title.Translations, translation)
+		if err != nil {
+			report.Err = err
+			return report
+		}
+		if err := client.SelectTranslation(ctx, title, selected); err != nil {
+			report.Err = err
+			return report
+		}
+	}
+
+	key := serialKey(url, title.Translation.ID)
+	seen, ok := st.Serials[key]
+	if !ok {
+		seen = &serialState{URL: url, Translation: title.Translation.ID}
+		st.Serials[key] = seen
+		report.First = true
+	}
+	seen.Title = title.Name
+	seen.Checked = time.Now()
+
+	for _, seria := range title.Series {
+		if !slices.Contains(seen.Seen, seria.Label()) {
+			report.New = append(report.New, seria)
+		}
+	}
+
+	if report.First && !serial.Existing {
+		// Уже вышедшие серии только запоминаются, загружаются следующие
+		for _, seria := range report.New {
+			seen.Seen = append(seen.Seen, seria.Label())
+		}
+		w.Log.Printf("Watch: %s: %d episodes remembered on first check", title.Name, len(report.New))
+		report.New = nil
+		return report
+	}
+
+	if len(report.New) == 0 {
+		return report
+	}
+
+	w.Log.Printf("Watch: %s: %d new episodes", title.Name, len(report.New))
+	report.Result, report.Err = w.download(ctx, url, title, serial, report.New)
+
+	for _, res := range report.Downloaded() {
+		seen.Seen = append(seen.Seen, res.Seria.Label())
+	}
+
+	return report
+}
+
+// download получает ссылки на новые серии и загружает их. Ошибки отдельных серий записаны в их Result
+func (w *Watcher) download(ctx context.Context, url string, title *kodik.Title, serial utils.WatchedSerial, series []utils.KodikSeriaInfo) (utils.HandleResult, error) {
+	opts := kodik.Options{
+		Quality: w.config.Quality,
+		Retries: w.config.ResolveRetries,
+		Retry:   w.config.Retry.Resolve,
+	}
+	if serial.Quality != nil {
+		opts.Quality = *serial.Quality
+	}
+
+	client := w.client.WithLog(w.Log)
+	result, err := client.ResolveSeries(ctx, title, series, opts)
+	if err != nil {
+		return result, err
+	}
+
+	config := w.config
+	config.ReResolve = func(ctx context.Context, res utils.Result) (utils.Result, error) {
+		return client.ResolveEpisode(ctx, url, res.Seria, opts)
+	}
+
+	downloadOpts := w.downloadOpts
+	downloadOpts.Log = w.Log
+	return video_utils.Download(ctx, result, &config, downloadOpts)
+}
@@ -0,0 +1,132 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"kodik_parser/kodiktest"
+	"kodik_parser/utils"
+	"kodik_parser/video_utils"
+)
+
+func testConfig(t *testing.T, serials ...utils.WatchedSerial) utils.Config {
+	config := utils.NewDefaultConfig()
+	config.OutputDirectory = t.TempDir()
+	config.Watch.StateFile = filepath.Join(t.TempDir(), "watch.json")
+	config.Watch.Serials = serials
+	config.Retry.Download.Attempts = 1
+	return config
+}
+
+func newTestWatcher(server *kodiktest.Server, config utils.Config) *Watcher {
+	w := New(config, server.Client())
+	w.validURL = func(url string) bool { return url != "" }
+	w.downloadOpts = video_utils.Options{Transport: server.Client().Transport}
+	return w
+}
+
+func check(t *testing.T, w *Watcher) Report {
+	t.Helper()
+
+	reports, err := w.Check(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(reports))
+	}
+	return reports[0]
+}
+
+func labels(results []utils.Result) []string {
+	var labels []string
+	for _, res := range results {
+		labels = append(labels, res.Seria.Label())
+	}
+	return labels
+}
+
+func TestWatchNewEpisodes(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer server.Close()
+
+	config := testConfig(t, utils.WatchedSerial{URL: server.TitleURL()})
+
+	// Первая проверка только запоминает вышедшие серии
+	report := check(t, newTestWatcher(server, config))
+	if report.Err != nil || !report.First || len(report.New) != 0 || server.SecretRequests() != 0 {
+		t.Fatalf("first check: Err = %v, First = %v, New = %d, secret requests = %d",
+			report.Err, report.First, len(report.New), server.SecretRequests())
+	}
+
+	// Без новых серий ничего не загружается
+	if report := check(t, newTestWatcher(server, config)); report.First || len(report.New) != 0 {
+		t.Errorf("second check: First = %v, New = %d", report.First, len(report.New))
+	}
+
+	// Новая серия загружается при следующей проверке, в том числе новым Watcher с тем же файлом состояния
+	server.ReleaseEpisodes(1)
+	report = check(t, newTestWatcher(server, config))
+	if report.Err != nil || len(report.New) != 1 {
+		t.Fatalf("after release: Err = %v, New = %d", report.Err, len(report.New))
+	}
+
+	downloaded := report.Downloaded()
+	if got := labels(downloaded); !slices.Equal(got, []string{"3"}) {
+		t.Fatalf("downloaded %v, want [3]", got)
+	}
+	data, err := os.ReadFile(downloaded[0].Path)
+	if err != nil || !bytes.Equal(data, server.HLSData(server.EpisodeID(0, 1, 3), 720)) {
+		t.Errorf("%d bytes in %q, %v", len(data), downloaded[0].Path, err)
+	}
+	if n := server.SecretRequests(); n != 1 {
+		t.Errorf("secret requests = %d, want 1", n)
+	}
+
+	if report := check(t, newTestWatcher(server, config)); len(report.New) != 0 {
+		t.Errorf("downloaded episode reported again: New = %d", len(report.New))
+	}
+}
+
+func TestWatchExisting(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 2})
+	defer server.Close()
+
+	config := testConfig(t, utils.WatchedSerial{URL: server.TitleURL(), Existing: true})
+
+	report := check(t, newTestWatcher(server, config))
+	if got := labels(report.Downloaded()); report.Err != nil || !report.First || !slices.Equal(got, []string{"1", "2"}) {
+		t.Errorf("Err = %v, First = %v, downloaded %v", report.Err, report.First, got)
+	}
+}
+
+func TestWatchFailed(t *testing.T) {
+	server := kodiktest.NewServer(kodiktest.Config{Episodes: 1, FailSegments: map[int]int{1: 1}})
+	defer server.Close()
+
+	config := testConfig(t, utils.WatchedSerial{URL: server.TitleURL(), Existing: true})
+
+	// Неудачная серия не запоминается и загружается при следующей проверке
+	if report := check(t, newTestWatcher(server, config)); len(report.Downloaded()) != 0 || len(report.New) != 1 {
+		t.Fatalf("first check: New = %d, downloaded %v", len(report.New), labels(report.Downloaded()))
+	}
+
+	report := check(t, newTestWatcher(server, config))
+	if got := labels(report.Downloaded()); report.First || !slices.Equal(got, []string{"1"}) {
+		t.Errorf("second check: First = %v, downloaded %v", report.First, got)
+	}
+}
+
+func TestWatchDelay(t *testing.T) {
+	w := New(utils.Config{Watch: utils.WatchConfig{Interval: 100, Jitter: 10}}, nil)
+
+	for range 100 {
+		if d := w.delay().Seconds(); d < 90 || d > 110 {
+			t.Fatalf("delay = %vs, want 100±10s", d)
+		}
+	}
+}